@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// adhoc is a request for a cycle of all the targets of the agent at once,
+// outside of their schedules, eg, during an incident, with SIGUSR1 or POST
+// /v1/cycle. Its results are recorded to the sinks as those of the
+// schedules, dumped on stdout, and sent to reply, if any, which is closed
+// without if the cycle is abandoned.
+type adhoc struct {
+	reply chan adhocResult
+}
+
+type adhocResult struct {
+	Totals []apiResult `json:"totals"`
+	Failed int         `json:"failed,omitempty"`
+}
+
+// handleSignals requests an ad hoc cycle on every SIGUSR1, those received
+// during a cycle making one more.
+func (a *agent) handleSignals() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			slog.Info("Measuring all targets", "signal", "SIGUSR1")
+			a.adhoc <- adhoc{}
+		}
+	}()
+}
+
+// serveCycle serves POST /v1/cycle: an ad hoc cycle, replying with its
+// totals once done, after the cycle in flight, if any.
+func (a *agent) serveCycle(w http.ResponseWriter, r *http.Request) {
+	req := adhoc{reply: make(chan adhocResult, 1)}
+	select {
+	case a.adhoc <- req:
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case res, ok := <-req.reply:
+		if !ok {
+			replyError(w, http.StatusServiceUnavailable, errors.New("Cycle abandoned, wss is stopping"))
+			return
+		}
+		reply(w, http.StatusOK, res)
+	case <-r.Context().Done():
+	}
+}
+
+// dump prints the totals of an ad hoc cycle on stdout, and replies to req.
+func (a *agent) dump(req adhoc, results [][]wss.Result, failed []int) {
+	out, _ := newPrinter("text", os.Stdout, printOptions{multi: true})
+	out.header()
+	res := adhocResult{Totals: []apiResult{}}
+	for i := range results {
+		for _, sum := range results[i] {
+			out.total(sum)
+			res.Totals = append(res.Totals, newAPIResult(sum))
+		}
+		res.Failed += failed[i]
+	}
+	if req.reply != nil {
+		req.reply <- res
+	}
+}
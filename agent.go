@@ -0,0 +1,623 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+func agentUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("USAGE: wss agent [options]")
+		fs.PrintDefaults()
+		fmt.Println("   eg,")
+		fmt.Println("\twss agent --listen :9400 --interval 300  # export the WSS of all pods every 5 minutes")
+		fmt.Println("\twss agent --config /etc/wss/agent.toml  # targets, discovery rules, limits and sinks from a file")
+		fmt.Println("\twss agent --statsd localhost:8125  # also send the WSS of all pods to DogStatsD")
+		fmt.Println("\twss agent --influx 'http://localhost:8086/api/v2/write?org=ops&bucket=wss'  # also write the WSS of all pods to InfluxDB")
+		fmt.Println("\twss agent --otlp http://otel-collector:4318  # also push the WSS of all pods to an OpenTelemetry collector")
+		fmt.Println("\twss agent --ndjson /var/log/wss.ndjson  # also append the WSS of all pods as JSON lines, eg, tailed by Vector")
+		fmt.Println("\tkill -USR1 $(pidof wss)  # measure all pods now, and print their WSS, eg, during an incident")
+		fmt.Println("\tcurl -X POST localhost:9400/v1/cycle  # same, and reply with their WSS as JSON")
+		fmt.Println("\twss agent --debug-listen localhost:6060  # profile wss itself, eg, go tool pprof localhost:6060/debug/pprof/heap")
+	}
+}
+
+// sink receives the results of every measurement cycle of the agent, and
+// the number of targets that could not be measured.
+type sink interface {
+	record(results []wss.Result, failed int)
+}
+
+// scheduleSink is a sink keeping the last results of every schedule, rather
+// than of the last cycle, eg, the exporter, as a cycle measures the targets
+// due only.
+type scheduleSink interface {
+	recordSchedules(results map[string][]wss.Result, failed int)
+}
+
+// csvSink appends the results of every cycle to a CSV file.
+type csvSink struct {
+	out printer
+}
+
+// newCSVSink returns a sink appending to the file path, or writing to stdout
+// for "-".
+func newCSVSink(path string) (*csvSink, error) {
+	w := os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Can't open CSV file %s", err)
+		}
+		w = f
+	}
+	out, err := newPrinter("csv", w, printOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// a header per file
+	if info, err := w.Stat(); err != nil || info.Size() == 0 || path == "-" {
+		out.header()
+	}
+	return &csvSink{out: out}, nil
+}
+
+func (c *csvSink) record(results []wss.Result, failed int) {
+	for _, res := range results {
+		c.out.total(res)
+	}
+}
+
+// agent measures the pods ready on the node, and the configured targets.
+type agent struct {
+	scanner  *wss.Scanner
+	endpoint string
+	pods     bool
+	targets  []*selector
+	// the rules discovering targets every cycle
+	rules []*rule
+	// the targets with their own schedule, rather than every interval
+	scheduled []*job
+	// the requests of ad hoc cycles
+	adhoc chan adhoc
+	// limits: the processes measured per cycle, 0 for no limit, and the
+	// duration of a cycle, 0 for no timeout
+	maxPids int
+	timeout time.Duration
+	sinks   []sink
+	health  *health
+	// the labels of the containers of the targets' processes
+	metadata *containerMetadata
+	queue    *cycleQueue
+}
+
+// groups returns the groups of the processes of job to measure in a cycle,
+// and the number of targets that could not be resolved.
+func (a *agent) groups(j *job) ([]group, int, error) {
+	var groups []group
+	failed := 0
+	if j.pods {
+		pods, err := wss.ListPods(a.endpoint)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, pod := range pods {
+			g, err := podGroups(pod, "")
+			if err != nil {
+				slog.Warn("Error resolving pod", "namespace", pod.Namespace, "pod", pod.Name, "err", err)
+				failed++
+				continue
+			}
+			groups = append(groups, g...)
+		}
+	}
+	for _, sel := range j.targets {
+		pids, err := sel.resolve()
+		if err != nil {
+			slog.Warn("Error resolving target", "target", sel.describe(), "err", err)
+			failed++
+			continue
+		}
+		groups = append(groups, sel.groups...)
+		// the processes outside of a group are reported each
+		for _, pid := range pids {
+			if sel.labels(pid) == nil {
+				labels := map[string]string{"pid": strconv.Itoa(pid), "comm": wss.Comm(pid)}
+				maps.Copy(labels, a.metadata.labels(pid))
+				groups = append(groups, group{labels: labels, pids: []int{pid}})
+			}
+		}
+	}
+	for _, r := range j.rules {
+		found, err := r.groups(a.endpoint)
+		if err != nil {
+			slog.Warn("Error discovering targets", "rule", r.describe(), "err", err)
+			failed++
+			continue
+		}
+		groups = append(groups, found...)
+	}
+	return groups, failed, nil
+}
+
+// cycle measures all the groups of jobs in one idle page cycle, until ctx
+// is done, and returns their totals, and the number of targets that could
+// not be resolved, per job. The results of the jobs whose pods couldn't be
+// listed are nil.
+func (a *agent) cycle(ctx context.Context, d time.Duration, jobs []*job) ([][]wss.Result, []int) {
+	a.health.begin()
+	defer a.health.end()
+	groups := make([][]group, len(jobs))
+	failed := make([]int, len(jobs))
+	var pids []int
+	for i, j := range jobs {
+		var err error
+		if groups[i], failed[i], err = a.groups(j); err != nil {
+			slog.Error("Error listing pods", "endpoint", a.endpoint, "err", err)
+			continue
+		}
+		for _, g := range groups[i] {
+			pids = append(pids, g.pids...)
+		}
+	}
+	slices.Sort(pids)
+	pids = slices.Compact(pids)
+	sums := make([][]wss.Result, len(jobs))
+	if len(pids) == 0 {
+		for i := range jobs {
+			if groups[i] != nil {
+				sums[i] = []wss.Result{}
+			}
+		}
+		return sums, failed
+	}
+	if a.maxPids > 0 && len(pids) > a.maxPids {
+		slog.Warn("Measuring only max-pids processes", "max_pids", a.maxPids, "pids", len(pids))
+		pids = pids[:a.maxPids]
+	}
+	// the wait in the queue isn't part of the timeout
+	release, err := a.queue.acquire(ctx)
+	if err != nil {
+		return sums, failed
+	}
+	defer release()
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	results, err := a.scanner.MeasureAllContext(ctx, pids, d)
+	if err != nil {
+		// processes exit all the time on a busy node, report the rest
+		slog.Warn("Error measuring", "err", err)
+	}
+	for i := range jobs {
+		if groups[i] != nil {
+			sums[i] = totals(groups[i], results)
+		}
+	}
+	return sums, failed
+}
+
+// record records the results of a cycle of jobs to the sinks, but those of
+// the jobs whose results are nil.
+func (a *agent) record(jobs []*job, results [][]wss.Result, failed []int) {
+	byKey := make(map[string][]wss.Result)
+	var all []wss.Result
+	var failures int
+	for i, j := range jobs {
+		if results[i] != nil {
+			byKey[j.key] = results[i]
+			all = append(all, results[i]...)
+			failures += failed[i]
+		}
+	}
+	if len(byKey) == 0 {
+		return
+	}
+	for _, s := range a.sinks {
+		if ss, ok := s.(scheduleSink); ok {
+			ss.recordSchedules(byKey, failures)
+		} else {
+			s.record(all, failures)
+		}
+	}
+}
+
+// run measures the jobs on their schedules, those due at the same time in
+// the same cycle, until stop is done, or the cycle in flight until ctx is.
+func (a *agent) run(stop, ctx context.Context, d time.Duration, jobs []*job) {
+	now := time.Now()
+	for _, j := range jobs {
+		if _, ok := j.schedule.(*cronSchedule); ok {
+			j.due = j.schedule.next(now, now)
+		} else {
+			j.due = now
+		}
+	}
+	for stop.Err() == nil {
+		start := time.Now()
+		var due []*job
+		next := start.Add(CRON_HORIZON)
+		for _, j := range jobs {
+			if !j.due.After(start) {
+				due = append(due, j)
+			} else if j.due.Before(next) {
+				next = j.due
+			}
+		}
+		if len(due) == 0 {
+			select {
+			case <-stop.Done():
+			case <-time.After(time.Until(next)):
+			case req := <-a.adhoc:
+				results, failed := a.cycle(ctx, d, jobs)
+				if ctx.Err() != nil {
+					if req.reply != nil {
+						close(req.reply)
+					}
+					return
+				}
+				a.record(jobs, results, failed)
+				a.dump(req, results, failed)
+			}
+			continue
+		}
+		results, failed := a.cycle(ctx, d, due)
+		if ctx.Err() != nil {
+			return
+		}
+		a.record(due, results, failed)
+		now := time.Now()
+		for _, j := range due {
+			j.due = j.schedule.next(start, now)
+		}
+	}
+}
+
+// agentMain runs the node agent, eg, as a Kubernetes DaemonSet: all pods on
+// the node are enumerated using the CRI runtime and measured on a schedule,
+// and the per-container and per-pod totals are served on /metrics. The
+// targets, discovery rules, limits and sinks can be set in a --config file.
+func agentMain(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	configPath := fs.String("config", "", "configuration `file`, in TOML: the options below by name, the [limits], and the [[targets]], [[discover]] and [[sinks]] tables")
+	listen := fs.String("listen", ":9400", "`address` to serve /metrics on")
+	duration := fs.Float64("duration", 1, "measurement duration in `secs`")
+	interval := fs.Float64("interval", 300, "`secs` between the start of measurements")
+	grace := fs.Float64("grace", GRACE, "on SIGTERM, `secs` given to the cycle in flight to finish before abandoning it")
+	window := fs.Float64("window", WINDOW, "summarize the WSS of every target over the measurements of the last `secs` on /metrics, its quantiles, 0 for none")
+	stall := fs.Float64("stall", STALL, "fail /healthz once a cycle lasts longer than `secs`, more than --duration and --timeout, for the liveness probe to restart a wedged agent")
+	endpoint := fs.String("cri-endpoint", "", "CRI runtime `socket`, default $CONTAINER_RUNTIME_ENDPOINT or the first one found")
+	maxPids := fs.Int("max-pids", 0, "measure at most `N` processes per cycle, 0 for no limit")
+	statsd := fs.String("statsd", "", "also send the results to the StatsD, or DogStatsD, server at the UDP `host:port`")
+	influx := fs.String("influx", "", "also write the results in line protocol to the InfluxDB, or Telegraf, write `url`, with the token of $INFLUX_TOKEN, - for stdout")
+	otlp := fs.String("otlp", "", "also push the results to the OpenTelemetry collector at the OTLP/HTTP `url`, eg, http://localhost:4318, with the headers of $OTEL_EXPORTER_OTLP_HEADERS")
+	graphite := fs.String("graphite", "", "also send the results to the Graphite carbon server at the TCP `host:port`, in the plaintext protocol")
+	graphitePrefix := fs.String("graphite-prefix", GRAPHITE_PREFIX, "`prefix` of the Graphite metric paths")
+	ndjson := fs.String("ndjson", "", "also append the results as a JSON object per line to `file`, eg, tailed by a log shipper, - for stdout")
+	store := fs.String("store", "", "also record the results in the SQLite history database `file` (builds with -tags sqlite)")
+	timeout := fs.Float64("timeout", 0, "end the cycles longer than `secs`, with partial results, 0 for no timeout")
+	maxCPU := fs.Float64("max-cpu-pct", 0, "cap the CPU time of wss while setting, loading and walking the page flags to `percent` of a CPU, with pauses, trading longer scans for less interference with latency-sensitive workloads, 0 for no cap")
+	ioUring := fs.Bool("io-uring", false, "read the page maps and the idle bitmap in batches with io_uring, a system call per batch, for processes with thousands of mappings, falling back to pread where unavailable")
+	parallelism := fs.Int("parallelism", 1, "walk the mappings of a process with `N` goroutines, bounding the concurrent walks of a cycle")
+	cooldown := fs.Float64("cooldown", 0, "start the cycles `secs` after the start of the last one of the host at the earliest, those of the other wss processes included")
+	cycleLock := fs.String("cycle-lock", CYCLE_LOCK_PATH, "lock `file` of the cycles of the wss processes of the host, which take turns, \"\" for none")
+	sparse := fs.Bool("sparse", false, "only load the chunks of the idle bitmap of the pages mapped by the measured processes, rather than the bitmap of the whole host, for less memory on large hosts")
+	idleChunk := bytesFlag(wss.IDLEMAP_BUF_SIZE)
+	fs.Var(&idleChunk, "idle-chunk", "`size` of the idle bitmap set per write, eg, 64K, in bytes without a unit, a multiple of 8 bytes, up to 1M")
+	idleDelay := fs.Float64("idle-delay", 0, "pause `secs` between the writes of the idle bitmap, eg, 0.0001, to spread the setting of the idle flags of large hosts over time")
+	pprof := fs.Bool("pprof", false, "also serve the profiles of wss itself on /debug/pprof/, and its Go runtime metrics on /debug/metrics, on --listen")
+	debugListen := fs.String("debug-listen", "", "serve /debug/pprof/ and /debug/metrics on `address` instead, eg, localhost:6060, out of reach of the scrapers")
+	logging := addLogFlags(fs)
+	fs.Usage = agentUsage(fs)
+	fs.Parse(args)
+
+	a := &agent{pods: true, adhoc: make(chan adhoc)}
+	exp := newExporter()
+	if *configPath != "" {
+		if err := a.configure(fs, *configPath, exp); err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+	} else {
+		a.sinks = []sink{exp}
+	}
+	// after the config, which may set the logging options
+	if err := logging.setup(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+	if *duration < 0.01 {
+		fmt.Println("Interval too short. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *maxPids < 0 || *timeout < 0 || *maxCPU < 0 || *cooldown < 0 {
+		fmt.Println("Limits must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *parallelism < 1 {
+		fmt.Println("Parallelism must be >= 1. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *grace < 0 || *window < 0 {
+		fmt.Println("Grace and window must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	exp.window = time.Duration(*window * float64(time.Second))
+	if *stall <= *duration || *timeout > 0 && *stall <= *timeout {
+		fmt.Println("Stall must be longer than the duration and the timeout. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	checkIdleFlags(idleChunk, *idleDelay)
+	if *statsd != "" {
+		s, err := newStatsdSink(*statsd)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		a.sinks = append(a.sinks, s)
+	}
+	if *influx != "" {
+		s, err := newInfluxSink(*influx)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		a.sinks = append(a.sinks, s)
+	}
+	if *graphite != "" {
+		s, err := newGraphiteSink(*graphite, *graphitePrefix)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		a.sinks = append(a.sinks, s)
+	}
+	if *ndjson != "" {
+		s, err := newNDJSONSink(*ndjson)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		a.sinks = append(a.sinks, s)
+	}
+	if *store != "" {
+		s, err := newStoreSink(*store, "agent")
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(exitStatus(err, 0))
+		}
+		a.sinks = append(a.sinks, s)
+	}
+	if *otlp != "" {
+		s, err := newOTLPSink(*otlp)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		a.sinks = append(a.sinks, s)
+	}
+	if *endpoint == "" {
+		*endpoint = wss.CRIEndpoint()
+	}
+	a.endpoint = *endpoint
+	a.metadata = newContainerMetadata(*endpoint)
+	a.maxPids = *maxPids
+	a.timeout = time.Duration(*timeout * float64(time.Second))
+
+	a.scanner = wss.NewScanner()
+	a.scanner.MaxCPU = *maxCPU
+	a.scanner.IdleChunk = int(idleChunk)
+	a.scanner.IdleDelay = time.Duration(*idleDelay * float64(time.Second))
+	a.scanner.Sparse = *sparse
+	a.scanner.Parallelism = *parallelism
+	a.queue = newCycleQueue(*cycleLock, time.Duration(*cooldown*float64(time.Second)))
+	a.scanner.IOUring = *ioUring
+	if err := a.scanner.Check(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
+	}
+	d := &daemon{listen: *listen, mux: http.NewServeMux(), debug: *debugListen, grace: time.Duration(*grace * float64(time.Second))}
+	jobs := a.scheduled
+	if a.pods || len(a.targets) > 0 || len(a.rules) > 0 {
+		every := everySchedule(time.Duration(*interval * float64(time.Second)))
+		jobs = append([]*job{{pods: a.pods, targets: a.targets, rules: a.rules, schedule: every}}, jobs...)
+	}
+	a.health = &health{scanner: a.scanner, stall: time.Duration(*stall * float64(time.Second))}
+	d.loop = func(stop, ctx context.Context) {
+		a.health.setRunning(true)
+		defer a.health.setRunning(false)
+		a.run(stop, ctx, time.Duration(*duration*float64(time.Second)), jobs)
+	}
+
+	d.mux.Handle("/metrics", exp)
+	d.mux.HandleFunc("POST /v1/cycle", a.serveCycle)
+	d.mux.HandleFunc("/healthz", a.health.serveHealth)
+	d.mux.HandleFunc("/readyz", a.health.serveReady)
+	if *pprof && *debugListen == "" {
+		debugHandlers(d.mux)
+	}
+	a.handleSignals()
+	slog.Info("Serving WSS metrics", "listen", *listen, "pods", a.pods, "targets", len(a.targets)+len(a.scheduled), "rules", len(a.rules))
+	d.run()
+}
+
+// configure sets the flags of fs, the targets and the sinks of a from the
+// configuration file path. The metrics are served by exp, which is a sink
+// unless other sinks are configured without a prometheus one.
+func (a *agent) configure(fs *flag.FlagSet, path string, exp *exporter) error {
+	cfg, err := parseConfig(path)
+	if err != nil {
+		return err
+	}
+	top := maps.Clone(cfg.top)
+	delete(top, "config")
+	if pods, ok := top["pods"]; ok {
+		if a.pods, ok = pods.(bool); !ok {
+			return fmt.Errorf("Bad config key pods: expected a boolean")
+		}
+		delete(top, "pods")
+	} else {
+		// by default, only the targets are measured, if any
+		a.pods = len(cfg.arrays["targets"]) == 0 && len(cfg.arrays["discover"]) == 0
+	}
+	if err := setFlags(fs, top, ""); err != nil {
+		return err
+	}
+	for name, t := range cfg.tables {
+		if name != "limits" {
+			return fmt.Errorf("Unknown config table %s", name)
+		}
+		for key := range t {
+			if key != "max-pids" && key != "timeout" && key != "max-cpu-pct" && key != "cooldown" {
+				return fmt.Errorf("Unknown config key limits.%s", key)
+			}
+		}
+		if err := setFlags(fs, t, "limits."); err != nil {
+			return err
+		}
+	}
+	for name, tables := range cfg.arrays {
+		switch name {
+		case "targets":
+			for i, t := range tables {
+				t, sched, err := tableSchedule(name, t)
+				if err != nil {
+					return err
+				}
+				sel, err := targetSelector(t)
+				if err != nil {
+					return err
+				}
+				if sched == nil {
+					a.targets = append(a.targets, sel)
+					continue
+				}
+				a.scheduled = append(a.scheduled, &job{key: fmt.Sprintf("targets.%d", i), targets: []*selector{sel}, schedule: sched})
+			}
+		case "discover":
+			for i, t := range tables {
+				t, sched, err := tableSchedule(name, t)
+				if err != nil {
+					return err
+				}
+				r, err := discoverRule(t)
+				if err != nil {
+					return err
+				}
+				if sched == nil {
+					a.rules = append(a.rules, r)
+					continue
+				}
+				a.scheduled = append(a.scheduled, &job{key: fmt.Sprintf("discover.%d", i), rules: []*rule{r}, schedule: sched})
+			}
+		case "sinks":
+			for _, t := range tables {
+				s, err := configSink(t, exp)
+				if err != nil {
+					return err
+				}
+				a.sinks = append(a.sinks, s)
+			}
+		default:
+			return fmt.Errorf("Unknown config table %s", name)
+		}
+	}
+	if len(a.sinks) == 0 {
+		a.sinks = []sink{exp}
+	}
+	return nil
+}
+
+// tableSchedule returns the schedule of t, a table of the array name, if
+// any, and t without it.
+func tableSchedule(name string, t table) (table, schedule, error) {
+	spec, ok := t["schedule"]
+	if !ok {
+		return t, nil, nil
+	}
+	t = maps.Clone(t)
+	delete(t, "schedule")
+	s, ok := spec.(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("Bad config key %s.schedule: expected a string", name)
+	}
+	sched, err := parseSchedule(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, sched, nil
+}
+
+// configSink returns the sink of a [[sinks]] table: type "prometheus", the
+// metrics served on --listen, "csv" or "ndjson", appended to the file path,
+// "statsd", sent to the StatsD server addr, "graphite", sent to the carbon
+// server addr under prefix, "influx", written to the InfluxDB write url,
+// "otlp", pushed to the OpenTelemetry collector url, or "sqlite", recorded in
+// the history database path.
+func configSink(t table, exp *exporter) (sink, error) {
+	typ, _ := t["type"].(string)
+	path, _ := t["path"].(string)
+	addr, _ := t["addr"].(string)
+	url, _ := t["url"].(string)
+	prefix, ok := t["prefix"].(string)
+	if !ok {
+		prefix = GRAPHITE_PREFIX
+	}
+	for key := range t {
+		if key != "type" && key != "path" && key != "addr" && key != "url" && key != "prefix" {
+			return nil, fmt.Errorf("Unknown config key sinks.%s", key)
+		}
+	}
+	switch typ {
+	case "prometheus":
+		return exp, nil
+	case "csv":
+		if path == "" {
+			return nil, fmt.Errorf("Bad config sinks: the csv sink needs a path, or - for stdout")
+		}
+		return newCSVSink(path)
+	case "ndjson":
+		if path == "" {
+			return nil, fmt.Errorf("Bad config sinks: the ndjson sink needs a path, or - for stdout")
+		}
+		return newNDJSONSink(path)
+	case "statsd":
+		if addr == "" {
+			return nil, fmt.Errorf("Bad config sinks: the statsd sink needs an addr, host:port")
+		}
+		return newStatsdSink(addr)
+	case "graphite":
+		if addr == "" {
+			return nil, fmt.Errorf("Bad config sinks: the graphite sink needs an addr, host:port")
+		}
+		return newGraphiteSink(addr, prefix)
+	case "influx":
+		if url == "" {
+			return nil, fmt.Errorf("Bad config sinks: the influx sink needs a url, or - for stdout")
+		}
+		return newInfluxSink(url)
+	case "otlp":
+		if url == "" {
+			return nil, fmt.Errorf("Bad config sinks: the otlp sink needs a url")
+		}
+		return newOTLPSink(url)
+	case "sqlite":
+		if path == "" {
+			return nil, fmt.Errorf("Bad config sinks: the sqlite sink needs a path")
+		}
+		return newStoreSink(path, "agent")
+	}
+	return nil, fmt.Errorf("Bad config sinks: unknown type %q, expected prometheus, csv, ndjson, statsd, graphite, influx, otlp or sqlite", typ)
+}
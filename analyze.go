@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+func analyzeUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("USAGE: wss analyze [options] file...")
+		fs.PrintDefaults()
+		fmt.Println("   eg,")
+		fmt.Println("\twss analyze db1-181.snap  # WSS of a snapshot, and per mapping kind")
+		fmt.Println("\twss analyze --per-map --map-filter 'libjvm.so|\\.jar$' db1-181.snap  # referenced memory of the JVM code and jars")
+		fmt.Println("\twss analyze -o csv *.snap > wss.csv  # a CSV row per snapshot")
+	}
+}
+
+// analyzeMain computes the WSS, and its breakdowns, of the snapshots saved
+// by wss snapshot, offline.
+func analyzeMain(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	output := fs.String("o", "text", "output `format`: text, csv or ndjson (a JSON object per line)")
+	var only kindList
+	fs.Var(&only, "only", "only count the mappings of these `kinds`: anon|file|heap|stack|shmem, comma-separated")
+	var mapFilter regexpFlag
+	fs.Var(&mapFilter, "map-filter", "only count the mappings whose path matches this `regexp`")
+	perMap := fs.Bool("per-map", false, "show the referenced memory of every mapping (text and ndjson output)")
+	top := fs.Int("top", 0, "with --per-map, only show the `N` mappings with the most referenced memory, 0 for all")
+	hugepages := fs.Bool("hugepages", false, "show the referenced memory per page size, of the snapshots captured with --page-flags (text output)")
+	ksm := fs.Bool("ksm", false, "show the referenced memory merged by KSM, of the snapshots captured with --page-flags (text output)")
+	locked := fs.Bool("locked", false, "show the referenced memory mlocked or unevictable, of the snapshots captured with --page-flags (text output)")
+	zero := fs.Bool("zero-pages", false, "show the memory mapped to the shared zero page, left out, of the snapshots captured with --page-flags (text output)")
+	extended := fs.Bool("x", false, "extended text output: add the Walked(MB), Swap(MB), Mapped(MB), Unmapped(MB) and Hot(%) columns")
+	cold := fs.Bool("cold", false, "add the Cold(MB) and Reclaim(MB) columns (text output)")
+	rollup := fs.Bool("rollup", false, "add the Rss(MB), Pss(MB) and Referenced(MB) columns, of the snapshots captured with --rollup (text output)")
+	fs.Usage = analyzeUsage(fs)
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	if (*hugepages || *ksm || *locked || *zero || *extended || *cold || *rollup) && *output != "text" {
+		fmt.Println("-x, --cold, --rollup, --hugepages, --ksm, --locked and --zero-pages need the text output. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *perMap && *output != "text" && *output != "ndjson" {
+		fmt.Println("--per-map needs the text or ndjson output. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *output == "influx" {
+		fmt.Println("Unknown output format \"influx\". Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *top < 0 {
+		fmt.Println("Top must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	snaps := make([]*wss.Snapshot, 0, fs.NArg())
+	for _, path := range fs.Args() {
+		snap, err := readSnapshot(path)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		if (*hugepages || *ksm || *locked || *zero) && len(snap.Maps) > 0 && snap.Maps[0].Flags == nil {
+			fmt.Printf("The snapshot %s has no page flags, capture it with --page-flags. Exiting.\n", path)
+			os.Exit(EXIT_USAGE)
+		}
+		snaps = append(snaps, snap)
+	}
+
+	out, err := newPrinter(*output, os.Stdout, printOptions{
+		multi:     len(snaps) > 1,
+		hugepages: *hugepages,
+		ksm:       *ksm,
+		locked:    *locked,
+		zero:      *zero,
+		extended:  *extended,
+		cold:      *cold,
+		rollup:    *rollup,
+	})
+	if err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+	defer out.flush()
+	for i, snap := range snaps {
+		res := snap.Result
+		out.banner("Snapshot %s of PID %d (%s) on %s at %s, %s backend, during %.2f seconds", fs.Arg(i), res.PID, snap.Comm, snap.Host,
+			res.Time.Format("2006-01-02 15:04:05"), snap.Backend, res.Duration.Seconds())
+	}
+	out.header()
+	for _, snap := range snaps {
+		res := snap.Analyze(only, mapFilter.re)
+		kinds := res.Maps
+		res.Maps = nil
+		if *perMap {
+			res.Maps = topMaps(kinds, *top)
+		}
+		if p, ok := out.(*ndjsonPrinter); ok {
+			// the host and process of the snapshot, rather than of this host
+			p.host, p.comm = snap.Host, snap.Comm
+		}
+		out.row(res)
+		if *output == "text" {
+			printKinds(kinds, res.PageSize)
+		}
+	}
+}
+
+// readSnapshot reads the snapshot file path.
+func readSnapshot(path string) (*wss.Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open snapshot %s", err)
+	}
+	defer f.Close()
+	snap, err := wss.ReadSnapshot(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", path, err)
+	}
+	return snap, nil
+}
+
+// topMaps returns the n mappings of maps with the most referenced pages, in
+// that order, or all of maps, in address order, for 0.
+func topMaps(maps []wss.Mapping, n int) []wss.Mapping {
+	if n == 0 || n >= len(maps) {
+		return maps
+	}
+	sorted := slices.Clone(maps)
+	slices.SortStableFunc(sorted, func(a, b wss.Mapping) int {
+		return b.ActivePages - a.ActivePages
+	})
+	return sorted[:n]
+}
+
+// printKinds prints the walked and referenced memory of maps per mapping
+// kind, the most specific one of every mapping.
+func printKinds(maps []wss.Mapping, pagesize int) {
+	walked := make(map[string]int)
+	active := make(map[string]int)
+	for _, m := range maps {
+		kind := mappingKind(m)
+		walked[kind] += m.WalkedPages
+		active[kind] += m.ActivePages
+	}
+	fmt.Printf("    %-7s %10s %10s\n", "KIND", "Walked(MB)", "Ref(MB)")
+	for _, kind := range []string{"heap", "stack", "anon", "shmem", "file"} {
+		if walked[kind] == 0 {
+			continue
+		}
+		fmt.Printf("    %-7s %10.2f %10.2f\n", kind, mb(walked[kind], pagesize), mb(active[kind], pagesize))
+	}
+}
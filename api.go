@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// API_QUEUE_SIZE is the number of measurements queued, beyond it the
+// requests are refused, 429.
+const API_QUEUE_SIZE = 64
+
+// API_WORKERS is the number of measurements run at once, those of the same
+// duration sharing an idle page cycle.
+const API_WORKERS = 8
+
+// API_JOBS_KEPT is the number of finished measurements kept for polling, the
+// oldest are forgotten.
+const API_JOBS_KEPT = 256
+
+// The states of a measurement of the API.
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_DONE      = "done"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+// apiTarget is the target of a measurement, in the requests and jobs.
+type apiTarget struct {
+	PID      int    `json:"pid,omitempty"`
+	Cgroup   string `json:"cgroup,omitempty"`
+	Children bool   `json:"children,omitempty"`
+}
+
+// apiRequest is the body of POST /v1/measurements.
+type apiRequest struct {
+	apiTarget
+	Duration float64 `json:"duration_seconds,omitempty"`
+}
+
+// apiResult is a result of a measurement, as in the Result message of
+// wss.proto.
+type apiResult struct {
+	PID              int               `json:"pid,omitempty"`
+	Comm             string            `json:"comm,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	ReferencedBytes  uint64            `json:"referenced_bytes"`
+	ResidentBytes    uint64            `json:"resident_bytes"`
+	WalkedPages      int               `json:"walked_pages"`
+	PageSize         int               `json:"page_size"`
+	Est              float64           `json:"estimated_duration_seconds"`
+	Time             time.Time         `json:"time"`
+	HotRatio         float64           `json:"hot_ratio"`
+	ColdBytes        uint64            `json:"cold_bytes"`
+	ReclaimableBytes uint64            `json:"reclaimable_bytes"`
+	PageSample       int               `json:"page_sample,omitempty"`
+	ReferencedLow    uint64            `json:"referenced_bytes_low,omitempty"`
+	ReferencedHigh   uint64            `json:"referenced_bytes_high,omitempty"`
+	LockedBytes      uint64            `json:"locked_bytes,omitempty"`
+	HugetlbfsBytes   uint64            `json:"hugetlbfs_bytes,omitempty"`
+	ZeroBytes        uint64            `json:"zero_bytes,omitempty"`
+	SpecialBytes     uint64            `json:"special_bytes,omitempty"`
+	Maps             []apiMapping      `json:"maps,omitempty"`
+	Overhead         *apiOverhead      `json:"overhead,omitempty"`
+}
+
+// apiOverhead is the cost of the measurement cycle of a result to wss, of
+// all its phases.
+type apiOverhead struct {
+	CPU        float64 `json:"cpu_seconds"`
+	ReadCalls  uint64  `json:"read_syscalls"`
+	ReadBytes  uint64  `json:"read_bytes"`
+	WriteCalls uint64  `json:"write_syscalls"`
+	WriteBytes uint64  `json:"write_bytes"`
+}
+
+// apiMapping is a mapping walked, of the results measured with --per-map.
+type apiMapping struct {
+	Start           uint64 `json:"start_address"`
+	End             uint64 `json:"end_address"`
+	Perms           string `json:"perms"`
+	Offset          uint64 `json:"file_offset"`
+	Path            string `json:"path"`
+	Kind            string `json:"kind"`
+	WalkedBytes     uint64 `json:"walked_bytes"`
+	ReferencedBytes uint64 `json:"referenced_bytes"`
+}
+
+func newAPIResult(res wss.Result) apiResult {
+	r := apiResult{
+		PID:              res.PID,
+		Labels:           res.Labels,
+		ReferencedBytes:  res.ReferencedBytes(),
+		ResidentBytes:    uint64(res.RssPages) * uint64(res.PageSize),
+		WalkedPages:      res.WalkedPages,
+		PageSize:         res.PageSize,
+		Est:              res.Est.Seconds(),
+		Time:             res.Time,
+		HotRatio:         res.HotPercent() / 100,
+		ColdBytes:        uint64(res.ColdPages()) * uint64(res.PageSize),
+		ReclaimableBytes: uint64(res.ReclaimablePages()) * uint64(res.PageSize),
+		PageSample:       res.PageSample,
+		LockedBytes:      uint64(res.LockedPages) * uint64(res.PageSize),
+		HugetlbfsBytes:   uint64(res.HugetlbfsPages) * uint64(res.PageSize),
+		ZeroBytes:        uint64(res.ZeroPages) * uint64(res.PageSize),
+		SpecialBytes:     uint64(res.SpecialPages) * uint64(res.PageSize),
+	}
+	if res.PID != 0 {
+		r.Comm = wss.Comm(res.PID)
+	}
+	if res.PageSample > 1 {
+		lo, hi := res.ActiveInterval()
+		r.ReferencedLow = uint64(lo) * uint64(res.PageSize)
+		r.ReferencedHigh = uint64(hi) * uint64(res.PageSize)
+	}
+	if c := res.Overhead.Total(); c != (wss.Cost{}) {
+		r.Overhead = &apiOverhead{
+			CPU:        c.CPUTime.Seconds(),
+			ReadCalls:  c.ReadCalls,
+			ReadBytes:  c.ReadBytes,
+			WriteCalls: c.WriteCalls,
+			WriteBytes: c.WriteBytes,
+		}
+	}
+	for _, m := range res.Maps {
+		r.Maps = append(r.Maps, apiMapping{
+			Start:           m.Start,
+			End:             m.End,
+			Perms:           m.Perms,
+			Offset:          m.Offset,
+			Path:            m.Path,
+			Kind:            mappingKind(m),
+			WalkedBytes:     uint64(m.WalkedPages) * uint64(res.PageSize),
+			ReferencedBytes: uint64(m.ActivePages) * uint64(res.PageSize),
+		})
+	}
+	return r
+}
+
+// apiJob is a measurement requested with the API, as returned by GET.
+type apiJob struct {
+	ID       string      `json:"id"`
+	Status   string      `json:"status"`
+	Target   apiTarget   `json:"target"`
+	Duration float64     `json:"duration_seconds"`
+	Created  time.Time   `json:"created"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Results  []apiResult `json:"results,omitempty"`
+	Totals   []apiResult `json:"totals,omitempty"`
+	Failed   int         `json:"failed,omitempty"`
+	Error    string      `json:"error,omitempty"`
+
+	req    measureRequest
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// api serves the measurement API: measurements are requested with POST, and
+// queued, then run by API_WORKERS, and polled with GET until done.
+//
+//	POST   /v1/measurements       queue a measurement, 202 and its job
+//	GET    /v1/measurements       the jobs, oldest first
+//	GET    /v1/measurements/{id}  a job, with the results once done
+//	DELETE /v1/measurements/{id}  cancel a queued or running job
+type api struct {
+	m     *measurer
+	queue chan *apiJob
+
+	mu     sync.Mutex
+	jobs   map[string]*apiJob
+	order  []string
+	nextID int
+}
+
+// newAPI returns the API measuring with m, and starts its workers.
+func newAPI(m *measurer) *api {
+	a := &api{m: m, queue: make(chan *apiJob, API_QUEUE_SIZE), jobs: make(map[string]*apiJob)}
+	for range API_WORKERS {
+		go a.work()
+	}
+	return a
+}
+
+// register adds the routes of the API to mux.
+func (a *api) register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /v1/measurements", a.create)
+	mux.HandleFunc("GET /v1/measurements", a.list)
+	mux.HandleFunc("GET /v1/measurements/{id}", a.get)
+	mux.HandleFunc("DELETE /v1/measurements/{id}", a.delete)
+}
+
+// reply writes v as JSON with the status code.
+func reply(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func replyError(w http.ResponseWriter, code int, err error) {
+	reply(w, code, map[string]string{"error": err.Error()})
+}
+
+func (a *api) create(w http.ResponseWriter, r *http.Request) {
+	var body apiRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("Bad request %s", err))
+		return
+	}
+	req := measureRequest{pid: body.PID, cgroup: body.Cgroup, children: body.Children, duration: body.Duration}
+	_, d, err := req.target()
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.mu.Lock()
+	a.nextID++
+	job := &apiJob{
+		ID:       strconv.Itoa(a.nextID),
+		Status:   JOB_QUEUED,
+		Target:   body.apiTarget,
+		Duration: d.Seconds(),
+		Created:  time.Now(),
+		req:      req,
+	}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	select {
+	case a.queue <- job:
+	default:
+		a.mu.Unlock()
+		job.cancel()
+		replyError(w, http.StatusTooManyRequests, fmt.Errorf("Too many measurements queued, %d", API_QUEUE_SIZE))
+		return
+	}
+	a.jobs[job.ID] = job
+	a.order = append(a.order, job.ID)
+	a.prune()
+	view := *job
+	a.mu.Unlock()
+	slog.Debug("Measurement queued", "id", job.ID, "pid", req.pid, "cgroup", req.cgroup)
+	w.Header().Set("Location", "/v1/measurements/"+job.ID)
+	reply(w, http.StatusAccepted, &view)
+}
+
+func (a *api) list(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	jobs := make([]apiJob, 0, len(a.order))
+	for _, id := range a.order {
+		jobs = append(jobs, *a.jobs[id])
+	}
+	a.mu.Unlock()
+	reply(w, http.StatusOK, jobs)
+}
+
+func (a *api) get(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	job, ok := a.jobs[r.PathValue("id")]
+	var view apiJob
+	if ok {
+		view = *job
+	}
+	a.mu.Unlock()
+	if !ok {
+		replyError(w, http.StatusNotFound, fmt.Errorf("No measurement %s", r.PathValue("id")))
+		return
+	}
+	reply(w, http.StatusOK, &view)
+}
+
+func (a *api) delete(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	job, ok := a.jobs[r.PathValue("id")]
+	if ok && (job.Status == JOB_QUEUED || job.Status == JOB_RUNNING) {
+		job.cancel()
+		if job.Status == JOB_QUEUED {
+			// the worker skips it
+			a.finish(job, JOB_CANCELLED, nil)
+		}
+	}
+	var view apiJob
+	if ok {
+		view = *job
+	}
+	a.mu.Unlock()
+	if !ok {
+		replyError(w, http.StatusNotFound, fmt.Errorf("No measurement %s", r.PathValue("id")))
+		return
+	}
+	reply(w, http.StatusOK, &view)
+}
+
+// finish ends job with status, and the error err. a.mu is held.
+func (a *api) finish(job *apiJob, status string, err error) {
+	now := time.Now()
+	job.Status = status
+	job.Finished = &now
+	if err != nil {
+		job.Error = err.Error()
+	}
+	job.cancel()
+}
+
+// prune forgets the oldest finished jobs beyond API_JOBS_KEPT. a.mu is held.
+func (a *api) prune() {
+	finished := 0
+	for _, id := range a.order {
+		if a.jobs[id].Finished != nil {
+			finished++
+		}
+	}
+	kept := a.order[:0]
+	for _, id := range a.order {
+		if finished > API_JOBS_KEPT && a.jobs[id].Finished != nil {
+			delete(a.jobs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	a.order = kept
+}
+
+// work runs the queued jobs, one at a time, alongside the other workers.
+func (a *api) work() {
+	for job := range a.queue {
+		a.mu.Lock()
+		if job.Status != JOB_QUEUED {
+			a.mu.Unlock()
+			continue
+		}
+		now := time.Now()
+		job.Status = JOB_RUNNING
+		job.Started = &now
+		a.mu.Unlock()
+
+		sel, d, _ := job.req.target()
+		results, sums, failed, err := a.m.measureTargets(job.ctx, sel, d)
+
+		a.mu.Lock()
+		switch {
+		case job.ctx.Err() != nil:
+			a.finish(job, JOB_CANCELLED, nil)
+		case err != nil:
+			a.finish(job, JOB_FAILED, err)
+		default:
+			for _, res := range results {
+				job.Results = append(job.Results, newAPIResult(res))
+			}
+			for _, total := range sums {
+				job.Totals = append(job.Totals, newAPIResult(total))
+			}
+			job.Failed = failed
+			a.finish(job, JOB_DONE, nil)
+		}
+		a.prune()
+		a.mu.Unlock()
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+func checkUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("USAGE: wss check [options]")
+		fs.PrintDefaults()
+		fmt.Println("   eg,")
+		fmt.Println("\twss check  # can idle page tracking measure on this host, or what is missing")
+	}
+}
+
+// checkMain tells whether the backend can measure on this host, and what is
+// missing otherwise, without measuring.
+func checkMain(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	backend := backendFlag(wss.BACKEND_IDLE)
+	fs.Var(&backend, "backend", "`method` of finding the referenced pages to check, see wss -h")
+	logging := addLogFlags(fs)
+	fs.Usage = checkUsage(fs)
+	fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Printf("Unexpected arguments %s. Exiting.\n", strings.Join(fs.Args(), " "))
+		os.Exit(EXIT_USAGE)
+	}
+	if backend != wss.BACKEND_IDLE {
+		fmt.Printf("The %s backend checks its requirements when measuring.\n", backend)
+		return
+	}
+	scanner := wss.NewScanner()
+	if err := scanner.Check(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
+	}
+	fmt.Println("Idle page tracking can measure on this host.")
+}
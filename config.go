@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The agent configuration file, in a subset of TOML: comments, key = value
+ * pairs, [tables] and [[arrays of tables]], with strings, integers, floats,
+ * booleans, and one-line arrays of those. eg,
+ *
+ *	listen = ":9400"
+ *	interval = 300
+ *	pods = false
+ *
+ *	[limits]
+ *	max-pids = 5000
+ *	timeout = 30
+ *	max-cpu-pct = 10
+ *
+ *	[[targets]]
+ *	cgroup = "system.slice/nginx.service"
+ *
+ *	[[targets]]
+ *	cmdline-regex = "java .*kafka"
+ *
+ *	[[sinks]]
+ *	type = "csv"
+ *	path = "/var/log/wss.csv"
+ */
+
+// table is a TOML table, the values are string, int64, float64, bool or
+// []any of those.
+type table map[string]any
+
+// config is a parsed configuration file: the top-level table, the [tables]
+// and the [[arrays of tables]].
+type config struct {
+	top    table
+	tables map[string]table
+	arrays map[string][]table
+}
+
+// parseConfig parses the configuration file path.
+func parseConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read config file %s", err)
+	}
+	defer f.Close()
+
+	cfg := &config{top: table{}, tables: map[string]table{}, arrays: map[string][]table{}}
+	current := cfg.top
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "[["):
+			name, ok := strings.CutSuffix(line[2:], "]]")
+			if !ok {
+				return nil, fmt.Errorf("Bad config %s line %d: %s", path, n, line)
+			}
+			name = strings.TrimSpace(name)
+			current = table{}
+			cfg.arrays[name] = append(cfg.arrays[name], current)
+			continue
+		case strings.HasPrefix(line, "["):
+			name, ok := strings.CutSuffix(line[1:], "]")
+			if !ok {
+				return nil, fmt.Errorf("Bad config %s line %d: %s", path, n, line)
+			}
+			name = strings.TrimSpace(name)
+			if _, dup := cfg.tables[name]; dup {
+				return nil, fmt.Errorf("Bad config %s line %d: duplicate table %s", path, n, name)
+			}
+			current = table{}
+			cfg.tables[name] = current
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("Bad config %s line %d: %s", path, n, line)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		v, err := parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("Bad config %s line %d: %s", path, n, err)
+		}
+		if _, dup := current[key]; dup {
+			return nil, fmt.Errorf("Bad config %s line %d: duplicate key %s", path, n, key)
+		}
+		current[key] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Can't read config file %s", err)
+	}
+	return cfg, nil
+}
+
+// stripComment removes a # comment from line, outside of strings.
+func stripComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseValue parses a TOML value.
+func parseValue(value string) (any, error) {
+	switch {
+	case value == "":
+		return nil, fmt.Errorf("missing value")
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		s, ok := strings.CutSuffix(value[1:], "'")
+		if !ok || strings.Contains(s, "'") {
+			return nil, fmt.Errorf("bad string %s", value)
+		}
+		return s, nil
+	case strings.HasPrefix(value, "["):
+		inner, ok := strings.CutSuffix(value[1:], "]")
+		if !ok {
+			return nil, fmt.Errorf("bad array %s, arrays must be on one line", value)
+		}
+		var values []any
+		for _, elem := range splitArray(inner) {
+			elem = strings.TrimSpace(elem)
+			if elem == "" {
+				// a trailing comma
+				continue
+			}
+			v, err := parseValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	case value == "true" || value == "false":
+		return value == "true", nil
+	}
+	digits := strings.ReplaceAll(value, "_", "")
+	if i, err := strconv.ParseInt(digits, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(digits, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("bad value %s", value)
+}
+
+// splitArray splits the elements of an array at the commas outside of
+// strings.
+func splitArray(inner string) []string {
+	var elems []string
+	var quote rune
+	escaped := false
+	start := 0
+	for i, c := range inner {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			elems = append(elems, inner[start:i])
+			start = i + 1
+		}
+	}
+	return append(elems, inner[start:])
+}
+
+// formatValue formats a scalar value as a flag value.
+func formatValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("expected a string, number or boolean, got %v", v)
+}
+
+// setFlags sets the flags of fs from the keys of t, by name, except those set
+// on the command line, which take precedence. prefix names the table in the
+// errors.
+func setFlags(fs *flag.FlagSet, t table, prefix string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for key, v := range t {
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("Unknown config key %s%s", prefix, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		value, err := formatValue(v)
+		if err != nil {
+			return fmt.Errorf("Bad config key %s%s: %s", prefix, key, err)
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("Bad config key %s%s: %s", prefix, key, err)
+		}
+	}
+	return nil
+}
+
+// targetSelector returns the selector of a [[targets]] table: pids, pidns,
+// name, cmdline-regex, cgroup, pgid, sid and children, as the options of wss.
+// Its schedule is left to agent.configure.
+func targetSelector(t table) (*selector, error) {
+	sel := &selector{}
+	for key, v := range t {
+		var err error
+		switch key {
+		case "pids":
+			values, ok := v.([]any)
+			if !ok {
+				values = []any{v}
+			}
+			for _, value := range values {
+				pid, ok := value.(int64)
+				if !ok || pid <= 0 {
+					return nil, fmt.Errorf("Bad config key targets.pids: bad PID %v", value)
+				}
+				sel.pids = append(sel.pids, int(pid))
+			}
+			continue
+		case "pidns", "name", "cmdline-regex", "cgroup":
+			value, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("Bad config key targets.%s: expected a string", key)
+			}
+			switch key {
+			case "pidns":
+				sel.pidns = value
+			case "name":
+				sel.name = value
+			case "cmdline-regex":
+				err = sel.cmdline.Set(value)
+			case "cgroup":
+				sel.cgroup = value
+			}
+		case "pgid", "sid":
+			value, ok := v.(int64)
+			if !ok || value <= 0 {
+				return nil, fmt.Errorf("Bad config key targets.%s: expected an ID > 0", key)
+			}
+			if key == "pgid" {
+				sel.pgid = int(value)
+			} else {
+				sel.sid = int(value)
+			}
+		case "children":
+			value, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("Bad config key targets.children: expected a boolean")
+			}
+			sel.children = value
+		default:
+			return nil, fmt.Errorf("Unknown config key targets.%s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad config key targets.%s: %s", key, err)
+		}
+	}
+	if sel.empty() {
+		return nil, fmt.Errorf("Bad config targets: one of pids, name, cmdline-regex, cgroup, pgid or sid is needed")
+	}
+	if sel.pidns != "" && len(sel.pids) == 0 {
+		return nil, fmt.Errorf("Bad config targets: pidns needs pids")
+	}
+	return sel, nil
+}
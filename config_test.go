@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes content to a config file of a temporary directory, and
+// returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.toml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{`listen = ":9400"`, `listen = ":9400"`},
+		{`listen = ":9400" # the port`, `listen = ":9400" `},
+		{`# a comment`, ``},
+		{`name = "a # b"`, `name = "a # b"`},
+		{`name = 'a # b' # c`, `name = 'a # b' `},
+		{`name = "a \" # b" # c`, `name = "a \" # b" `},
+		{`name = 'a \' # b`, `name = 'a \' `},
+		{`pids = [1, 2] # the PIDs`, `pids = [1, 2] `},
+	}
+	for _, tt := range tests {
+		if got := stripComment(tt.line); got != tt.want {
+			t.Errorf("stripComment(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSplitArray(t *testing.T) {
+	tests := []struct {
+		inner string
+		want  []string
+	}{
+		{``, []string{``}},
+		{`1`, []string{`1`}},
+		{`1, 2,3`, []string{`1`, ` 2`, `3`}},
+		{`"a,b", 'c,d'`, []string{`"a,b"`, ` 'c,d'`}},
+		{`"a\",b", c`, []string{`"a\",b"`, ` c`}},
+		{`1,`, []string{`1`, ``}},
+	}
+	for _, tt := range tests {
+		if got := splitArray(tt.inner); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArray(%q) = %q, want %q", tt.inner, got, tt.want)
+		}
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  any
+	}{
+		{`"nginx"`, "nginx"},
+		{`"a\tb \"c\""`, "a\tb \"c\""},
+		{`'C:\path'`, `C:\path`},
+		{`""`, ""},
+		{`true`, true},
+		{`false`, false},
+		{`300`, int64(300)},
+		{`-1`, int64(-1)},
+		{`1_000_000`, int64(1000000)},
+		{`0x10`, int64(16)},
+		{`0.5`, 0.5},
+		{`1e3`, 1000.0},
+		{`[1, 2, 3]`, []any{int64(1), int64(2), int64(3)}},
+		{`["a", 'b',]`, []any{"a", "b"}},
+		{`["a,b", "c"]`, []any{"a,b", "c"}},
+		{`[]`, []any(nil)},
+		{`[1, "a", true, 0.5]`, []any{int64(1), "a", true, 0.5}},
+	}
+	for _, tt := range tests {
+		got, err := parseValue(tt.value)
+		if err != nil {
+			t.Errorf("parseValue(%q) failed: %s", tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseValue(%q) = %#v, want %#v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseValueErrors(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{``, "missing value"},
+		{`'a'b'`, "bad string 'a'b'"},
+		{`'abc`, "bad string 'abc"},
+		{`[1, 2`, "bad array [1, 2, arrays must be on one line"},
+		{`[1, nope]`, "bad value nope"},
+		{`yes`, "bad value yes"},
+		{`"abc`, "invalid syntax"},
+	}
+	for _, tt := range tests {
+		_, err := parseValue(tt.value)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parseValue(%q) error = %v, want %q", tt.value, err, tt.want)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	path := writeConfig(t, `
+# the agent
+listen = ":9400" # the port
+interval = 300
+pods = false
+"quoted-key" = "a # b"
+
+[limits]
+max-pids = 5000
+max-cpu-pct = 10.5
+
+[[targets]]
+cgroup = "system.slice/nginx.service"
+
+[[targets]]
+cmdline-regex = 'java .*kafka'
+pids = [1, 2]
+
+[[ sinks ]]
+type = "csv"
+`)
+	cfg, err := parseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &config{
+		top: table{"listen": ":9400", "interval": int64(300), "pods": false, "quoted-key": "a # b"},
+		tables: map[string]table{
+			"limits": {"max-pids": int64(5000), "max-cpu-pct": 10.5},
+		},
+		arrays: map[string][]table{
+			"targets": {
+				{"cgroup": "system.slice/nginx.service"},
+				{"cmdline-regex": "java .*kafka", "pids": []any{int64(1), int64(2)}},
+			},
+			"sinks": {{"type": "csv"}},
+		},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("parseConfig = %#v, want %#v", cfg, want)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		content, want string
+	}{
+		{"[[targets]\n", "line 1: [[targets]"},
+		{"[limits\n", "line 1: [limits"},
+		{"[limits]\n[limits]\n", "line 2: duplicate table limits"},
+		{"listen\n", "line 1: listen"},
+		{"listen =\n", "line 1: missing value"},
+		{"a = 1\na = 2\n", "line 2: duplicate key a"},
+		{"\n\npids = [1,\n", "line 3: bad array [1,, arrays must be on one line"},
+		{"x = nope\n", "line 1: bad value nope"},
+	}
+	for _, tt := range tests {
+		path := writeConfig(t, tt.content)
+		_, err := parseConfig(path)
+		if err == nil {
+			t.Errorf("parseConfig(%q) succeeded, want error %q", tt.content, tt.want)
+			continue
+		}
+		if want := "Bad config " + path + " " + tt.want; err.Error() != want {
+			t.Errorf("parseConfig(%q) error = %q, want %q", tt.content, err, want)
+		}
+	}
+}
+
+func TestParseConfigMissing(t *testing.T) {
+	_, err := parseConfig(filepath.Join(t.TempDir(), "none.toml"))
+	if err == nil || !strings.HasPrefix(err.Error(), "Can't read config file ") {
+		t.Errorf("parseConfig of a missing file error = %v", err)
+	}
+}
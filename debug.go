@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"regexp"
+	runtimemetrics "runtime/metrics"
+	"strings"
+)
+
+// runtimeMetricChars are the characters of the names of the Go runtime
+// metrics not allowed in Prometheus metric names
+var runtimeMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// debugHandlers adds the endpoints profiling wss itself to mux, eg, when the
+// agent misbehaves on a big host: /debug/pprof/, the profiles of
+// net/http/pprof, and /debug/metrics, the Go runtime metrics.
+func debugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/metrics", serveRuntimeMetrics)
+}
+
+// serveRuntimeMetrics serves the Go runtime metrics of runtime/metrics, but
+// the histograms, in the Prometheus text exposition format, named after
+// them, eg, go_gc_heap_allocs_bytes for /gc/heap/allocs:bytes.
+func serveRuntimeMetrics(w http.ResponseWriter, r *http.Request) {
+	descs := runtimemetrics.All()
+	samples := make([]runtimemetrics.Sample, len(descs))
+	for i := range descs {
+		samples[i].Name = descs[i].Name
+	}
+	runtimemetrics.Read(samples)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	escaper := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	for i, s := range samples {
+		var value float64
+		switch s.Value.Kind() {
+		case runtimemetrics.KindUint64:
+			value = float64(s.Value.Uint64())
+		case runtimemetrics.KindFloat64:
+			value = s.Value.Float64()
+		default:
+			continue
+		}
+		name := "go" + runtimeMetricChars.ReplaceAllString(strings.Replace(s.Name, ":", "/", 1), "_")
+		typ := "gauge"
+		if descs[i].Cumulative {
+			typ = "counter"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, escaper.Replace(descs[i].Description), name, typ, name, value)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+func diffUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("USAGE: wss diff [options] before after")
+		fs.PrintDefaults()
+		fmt.Println("   eg,")
+		fmt.Println("\twss diff before.snap after.snap  # WSS changes of a process, and of its mappings, between two snapshots")
+		fmt.Println("\twss -o ndjson --per-map 181 10 > before.json  # measure PID 181 before a deploy, and again after it, then")
+		fmt.Println("\twss diff --top 20 before.json after.json")
+		fmt.Println("\twss diff --only heap before.snap after.snap  # changes of the heap only")
+	}
+}
+
+// diffTarget is a process, or a total, of a measurement compared by wss diff.
+type diffTarget struct {
+	key string
+	pid int
+	// the bytes referenced and walked
+	referenced, walked uint64
+	// maps are the mappings, by mappingKey, merged, nil without mappings
+	maps map[string]*diffMapping
+}
+
+// diffMapping is a mapping, or the anonymous mappings of the same
+// permissions, of a diffTarget.
+type diffMapping struct {
+	referenced, walked uint64
+}
+
+// mappingKey identifies a mapping across measurements, whose addresses may
+// change, eg, after a restart: the mappings of files by their path,
+// permissions and offset, and the others by their name, eg, [heap], and
+// permissions.
+func mappingKey(path, perms string, offset uint64) string {
+	if path == "" {
+		path = "[anon]"
+	}
+	if (wss.Mapping{Path: path}).Is("file") {
+		return fmt.Sprintf("%s %x %s", perms, offset, path)
+	}
+	return perms + " " + path
+}
+
+// add adds the mapping of the key to t, if it is of the only kinds, and its
+// path matches filter, if set.
+func (t *diffTarget) add(path, perms string, offset, referenced, walked uint64, only []string, filter *regexp.Regexp) {
+	m := wss.Mapping{Path: path}
+	if len(only) > 0 && !slices.ContainsFunc(only, m.Is) || filter != nil && !filter.MatchString(path) {
+		return
+	}
+	if t.maps == nil {
+		t.maps = make(map[string]*diffMapping)
+	}
+	key := mappingKey(path, perms, offset)
+	dm, ok := t.maps[key]
+	if !ok {
+		dm = &diffMapping{}
+		t.maps[key] = dm
+	}
+	dm.referenced += referenced
+	dm.walked += walked
+}
+
+// diffInput is a JSON measurement: a line of -o ndjson, or a job of the
+// API, with the results and totals.
+type diffInput struct {
+	ndjsonRecord
+	Results []apiResult `json:"results"`
+	Totals  []apiResult `json:"totals"`
+}
+
+// loadDiff reads the targets of the file path, a snapshot, or JSON
+// measurements, the last one of every process and total, counting only the
+// mappings of the only kinds, and whose path matches filter, if set.
+func loadDiff(path string, only []string, filter *regexp.Regexp) ([]*diffTarget, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open %s", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if magic, _ := r.Peek(len(wss.SNAPSHOT_MAGIC)); string(magic) == wss.SNAPSHOT_MAGIC {
+		snap, err := wss.ReadSnapshot(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s", path, err)
+		}
+		res := snap.Analyze(only, filter)
+		t := &diffTarget{
+			key:        snap.Comm,
+			pid:        res.PID,
+			referenced: res.ReferencedBytes(),
+			walked:     uint64(res.WalkedPages) * uint64(res.PageSize),
+			maps:       make(map[string]*diffMapping),
+		}
+		pagesize := uint64(res.PageSize)
+		for _, m := range res.Maps {
+			t.add(m.Path, m.Perms, m.Offset, uint64(m.ActivePages)*pagesize, uint64(m.WalkedPages)*pagesize, nil, nil)
+		}
+		return []*diffTarget{t}, nil
+	}
+
+	var targets []*diffTarget
+	byKey := make(map[string]int)
+	add := func(res apiResult, total bool) {
+		t := &diffTarget{pid: res.PID, referenced: res.ReferencedBytes, walked: uint64(res.WalkedPages) * uint64(res.PageSize)}
+		switch {
+		case total:
+			t.key = "total"
+			t.pid = 0
+		case res.Comm != "":
+			t.key = res.Comm
+		default:
+			t.key = fmt.Sprintf("PID %d", res.PID)
+		}
+		if len(res.Labels) > 0 {
+			t.key += " " + formatLabels(res.Labels)
+		}
+		if len(only) > 0 || filter != nil {
+			// the totals are those of the mappings counted
+			if res.Maps == nil {
+				return
+			}
+			t.referenced, t.walked = 0, 0
+		}
+		for _, m := range res.Maps {
+			t.add(m.Path, m.Perms, m.Offset, m.ReferencedBytes, m.WalkedBytes, only, filter)
+		}
+		if len(only) > 0 || filter != nil {
+			for _, dm := range t.maps {
+				t.referenced += dm.referenced
+				t.walked += dm.walked
+			}
+		}
+		if i, ok := byKey[t.key]; ok {
+			targets[i] = t
+			return
+		}
+		byKey[t.key] = len(targets)
+		targets = append(targets, t)
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var in diffInput
+		err := dec.Decode(&in)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Can't read %s, expected a snapshot or JSON results %s", path, err)
+		}
+		for _, res := range in.Results {
+			add(res, false)
+		}
+		for _, res := range in.Totals {
+			add(res, true)
+		}
+		if in.Results == nil && in.Totals == nil && in.PageSize != 0 {
+			add(in.apiResult, in.Total)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("No result in %s", path)
+	}
+	return targets, nil
+}
+
+// diffMain compares two measurements, or snapshots, of the same processes,
+// eg, before and after a deploy: the change of the WSS of every process and
+// total, and of their mappings.
+func diffMain(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	top := fs.Int("top", 10, "show the `N` mappings of every process with the largest changes, 0 for all")
+	var only kindList
+	fs.Var(&only, "only", "only compare the mappings of these `kinds`: anon|file|heap|stack|shmem, comma-separated")
+	var mapFilter regexpFlag
+	fs.Var(&mapFilter, "map-filter", "only compare the mappings whose path matches this `regexp`")
+	fs.Usage = diffUsage(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	if *top < 0 {
+		fmt.Println("Top must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	before, err := loadDiff(fs.Arg(0), only, mapFilter.re)
+	if err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_ERROR)
+	}
+	after, err := loadDiff(fs.Arg(1), only, mapFilter.re)
+	if err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_ERROR)
+	}
+	// a process, eg, restarted, is compared with itself
+	if len(before) == 1 && len(after) == 1 && before[0].pid != 0 && after[0].pid != 0 {
+		after[0].key = before[0].key
+	}
+
+	fmt.Printf("Comparing %s (A) with %s (B):\n", fs.Arg(0), fs.Arg(1))
+	fmt.Printf("%10s %10s %10s %9s %16s  %s\n", "A Ref(MB)", "B Ref(MB)", "Delta(MB)", "Delta(%)", "Walked Delta(MB)", "TARGET")
+	for _, pair := range pairTargets(before, after) {
+		a, b := pair[0], pair[1]
+		name := a.key + targetPIDs(a, b)
+		printDelta(a.referenced, b.referenced, a.walked, b.walked, name)
+		// the mappings, by decreasing change
+		var keys []string
+		for key := range a.maps {
+			keys = append(keys, key)
+		}
+		for key := range b.maps {
+			if _, ok := a.maps[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		get := func(t *diffTarget, key string) diffMapping {
+			if m, ok := t.maps[key]; ok {
+				return *m
+			}
+			return diffMapping{}
+		}
+		change := func(key string) (float64, float64) {
+			ma, mb := get(a, key), get(b, key)
+			return math.Abs(float64(mb.referenced) - float64(ma.referenced)), math.Abs(float64(mb.walked) - float64(ma.walked))
+		}
+		keys = slices.DeleteFunc(keys, func(key string) bool {
+			ma, mb := get(a, key), get(b, key)
+			return ma.referenced == mb.referenced && ma.walked == mb.walked
+		})
+		slices.SortFunc(keys, func(k1, k2 string) int {
+			ref1, walked1 := change(k1)
+			ref2, walked2 := change(k2)
+			return cmp.Or(cmp.Compare(ref2, ref1), cmp.Compare(walked2, walked1), strings.Compare(k1, k2))
+		})
+		if *top > 0 && len(keys) > *top {
+			keys = keys[:*top]
+		}
+		for _, key := range keys {
+			ma, mb := get(a, key), get(b, key)
+			printDelta(ma.referenced, mb.referenced, ma.walked, mb.walked, "  "+key)
+		}
+	}
+}
+
+// pairTargets pairs the targets of before and after by key, in order, with
+// an empty target for those measured only once.
+func pairTargets(before, after []*diffTarget) [][2]*diffTarget {
+	var pairs [][2]*diffTarget
+	matched := make(map[string]bool)
+	for _, a := range before {
+		b := &diffTarget{key: a.key}
+		if i := slices.IndexFunc(after, func(t *diffTarget) bool { return t.key == a.key }); i >= 0 {
+			b = after[i]
+			matched[a.key] = true
+		}
+		pairs = append(pairs, [2]*diffTarget{a, b})
+	}
+	for _, b := range after {
+		if !matched[b.key] {
+			pairs = append(pairs, [2]*diffTarget{{key: b.key}, b})
+		}
+	}
+	return pairs
+}
+
+// targetPIDs describes the PIDs of the process measured as a and b.
+func targetPIDs(a, b *diffTarget) string {
+	switch {
+	case a.pid == 0 && b.pid == 0:
+		return ""
+	case a.pid == 0:
+		return fmt.Sprintf(" (PID %d, new)", b.pid)
+	case b.pid == 0:
+		return fmt.Sprintf(" (PID %d, gone)", a.pid)
+	case a.pid != b.pid:
+		return fmt.Sprintf(" (PID %d -> %d)", a.pid, b.pid)
+	}
+	return fmt.Sprintf(" (PID %d)", a.pid)
+}
+
+// printDelta prints a row of wss diff, of the referenced and walked bytes
+// before and after.
+func printDelta(refA, refB, walkedA, walkedB uint64, name string) {
+	mbytes := func(b uint64) float64 {
+		return float64(b) / (1024 * 1024)
+	}
+	pct := "-"
+	if refA > 0 {
+		pct = fmt.Sprintf("%+.1f", 100*(float64(refB)-float64(refA))/float64(refA))
+	}
+	fmt.Printf("%10.2f %10.2f %+10.2f %9s %+16.2f  %s\n", mbytes(refA), mbytes(refB), mbytes(refB)-mbytes(refA), pct, mbytes(walkedB)-mbytes(walkedA), name)
+}
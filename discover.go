@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// rule discovers the targets of the agent again on every cycle, as processes
+// and pods come and go: a target per command name matching comm, per cgroup
+// under cgroupPrefix holding processes, or per container of the pods of the
+// node matching pods, with a total per pod.
+type rule struct {
+	comm         *regexp.Regexp
+	cgroupPrefix string
+	pods         labelSelector
+	spec         string
+	// the targets of the last cycle, by their labels
+	seen map[string]bool
+}
+
+// discoverRule returns the rule of a [[discover]] table: comm, cgroup-prefix
+// or pod-selector. Its schedule is left to agent.configure.
+func discoverRule(t table) (*rule, error) {
+	if len(t) != 1 {
+		return nil, fmt.Errorf("Bad config discover: one of comm, cgroup-prefix or pod-selector is needed")
+	}
+	r := &rule{}
+	for key, v := range t {
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Bad config key discover.%s: expected a string", key)
+		}
+		var err error
+		switch key {
+		case "comm":
+			r.comm, err = regexp.Compile(value)
+		case "cgroup-prefix":
+			r.cgroupPrefix = value
+		case "pod-selector":
+			r.pods, err = parseLabelSelector(value)
+		default:
+			return nil, fmt.Errorf("Unknown config key discover.%s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad config key discover.%s: %s", key, err)
+		}
+		r.spec = key + " " + value
+	}
+	return r, nil
+}
+
+func (r *rule) describe() string {
+	return r.spec
+}
+
+// groups returns the groups of the targets discovered, and logs those which
+// appeared or went away since the last cycle.
+func (r *rule) groups(endpoint string) ([]group, error) {
+	var groups []group
+	var err error
+	switch {
+	case r.comm != nil:
+		groups, err = r.commGroups()
+	case r.cgroupPrefix != "":
+		groups, err = r.cgroupGroups()
+	default:
+		groups, err = r.podGroups(endpoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		key := formatLabels(g.labels)
+		seen[key] = true
+		if !r.seen[key] {
+			slog.Info("Discovered target", "rule", r.spec, "target", key)
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(r.seen)) {
+		if !seen[key] {
+			slog.Info("Target gone", "rule", r.spec, "target", key)
+		}
+	}
+	r.seen = seen
+	return groups, nil
+}
+
+// commGroups returns a group per command name matching comm, of all its
+// processes.
+func (r *rule) commGroups() ([]group, error) {
+	pids, err := wss.Processes()
+	if err != nil {
+		return nil, err
+	}
+	byComm := make(map[string][]int)
+	for _, pid := range pids {
+		if comm := wss.Comm(pid); comm != "" && r.comm.MatchString(comm) {
+			byComm[comm] = append(byComm[comm], pid)
+		}
+	}
+	var groups []group
+	for _, comm := range slices.Sorted(maps.Keys(byComm)) {
+		groups = append(groups, group{labels: map[string]string{"comm": comm}, pids: byComm[comm]})
+	}
+	return groups, nil
+}
+
+// cgroupGroups returns a group per cgroup under cgroupPrefix, or
+// cgroupPrefix itself, holding processes, labeled with its path.
+func (r *rule) cgroupGroups() ([]group, error) {
+	prefix, err := wss.ResolveCgroup(r.cgroupPrefix)
+	if err != nil {
+		return nil, err
+	}
+	pids, err := wss.Processes()
+	if err != nil {
+		return nil, err
+	}
+	byCgroup := make(map[string][]int)
+	for _, pid := range pids {
+		path, err := wss.ProcessCgroup(pid)
+		if err != nil {
+			// exited
+			continue
+		}
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			byCgroup[path] = append(byCgroup[path], pid)
+		}
+	}
+	var groups []group
+	for _, path := range slices.Sorted(maps.Keys(byCgroup)) {
+		name := strings.TrimSuffix(r.cgroupPrefix, "/") + strings.TrimPrefix(path, prefix)
+		groups = append(groups, group{labels: map[string]string{"cgroup": name}, pids: byCgroup[path]})
+	}
+	return groups, nil
+}
+
+// podGroups returns the groups of the containers of the pods ready on the
+// node whose labels match pods, and of the pods.
+func (r *rule) podGroups(endpoint string) ([]group, error) {
+	pods, err := wss.ListPods(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var groups []group
+	for _, pod := range pods {
+		if !r.pods.matches(pod.Labels) {
+			continue
+		}
+		g, err := podGroups(pod, "")
+		if err != nil {
+			slog.Warn("Error resolving pod", "namespace", pod.Namespace, "pod", pod.Name, "err", err)
+			continue
+		}
+		groups = append(groups, g...)
+	}
+	return groups, nil
+}
+
+// labelSelector is a Kubernetes label selector, its requirements all met,
+// eg, "app=web,tier!=cache", "env in (prod,staging)", "canary" or "!canary".
+type labelSelector []labelRequirement
+
+type labelRequirement struct {
+	key string
+	// =, !=, in, notin, exists or !exists
+	op     string
+	values []string
+}
+
+// parseLabelSelector parses a label selector of equality-based and set-based
+// requirements, separated by commas.
+func parseLabelSelector(s string) (labelSelector, error) {
+	var sel labelSelector
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, s[start:])
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		var req labelRequirement
+		fields := strings.Fields(part)
+		switch {
+		case part == "":
+			return nil, fmt.Errorf("empty requirement in %s", s)
+		case len(fields) >= 3 && (fields[1] == "in" || fields[1] == "notin"):
+			set := strings.TrimSpace(strings.Join(fields[2:], " "))
+			if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+				return nil, fmt.Errorf("bad requirement %s, expected a (value,...) set", part)
+			}
+			req = labelRequirement{key: fields[0], op: fields[1]}
+			for _, v := range strings.Split(set[1:len(set)-1], ",") {
+				req.values = append(req.values, strings.TrimSpace(v))
+			}
+		case strings.Contains(part, "!="):
+			key, value, _ := strings.Cut(part, "!=")
+			req = labelRequirement{key: key, op: "!=", values: []string{value}}
+		case strings.Contains(part, "=="):
+			key, value, _ := strings.Cut(part, "==")
+			req = labelRequirement{key: key, op: "=", values: []string{value}}
+		case strings.Contains(part, "="):
+			key, value, _ := strings.Cut(part, "=")
+			req = labelRequirement{key: key, op: "=", values: []string{value}}
+		case strings.HasPrefix(part, "!"):
+			req = labelRequirement{key: part[1:], op: "!exists"}
+		default:
+			req = labelRequirement{key: part, op: "exists"}
+		}
+		req.key = strings.TrimSpace(req.key)
+		for i := range req.values {
+			req.values[i] = strings.TrimSpace(req.values[i])
+		}
+		if req.key == "" || strings.ContainsAny(req.key, " ()!=") {
+			return nil, fmt.Errorf("bad requirement %s", part)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// matches reports whether labels meet all the requirements of sel.
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, ok := labels[req.key]
+		var met bool
+		switch req.op {
+		case "=":
+			met = ok && value == req.values[0]
+		case "!=":
+			met = !ok || value != req.values[0]
+		case "in":
+			met = ok && slices.Contains(req.values, value)
+		case "notin":
+			met = !ok || !slices.Contains(req.values, value)
+		case "exists":
+			met = ok
+		case "!exists":
+			met = !ok
+		}
+		if !met {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// The exit statuses of wss, for scripts.
+const (
+	EXIT_OK = 0
+	// any other error
+	EXIT_ERROR = 1
+	// bad options or arguments
+	EXIT_USAGE = 2
+	// the kernel, or the CPU, can't measure with the backend
+	EXIT_UNSUPPORTED = 3
+	// wss needs more privileges, eg, root
+	EXIT_PERMISSION = 4
+	// the measured processes are gone, or were not found
+	EXIT_GONE = 5
+	// some of the processes were measured, or the measurement was
+	// interrupted, and what was measured was printed
+	EXIT_PARTIAL = 6
+)
+
+// onlyExited reports whether err is made of ExitedErrors only.
+func onlyExited(err error) bool {
+	if err == nil {
+		return false
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			if !onlyExited(err) {
+				return false
+			}
+		}
+		return true
+	}
+	var exited *wss.ExitedError
+	return errors.As(err, &exited)
+}
+
+// exitStatus returns the exit status of a measurement failing with err,
+// after printing results, if any.
+func exitStatus(err error, results int) int {
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return EXIT_PARTIAL
+	case errors.Is(err, os.ErrPermission):
+		return EXIT_PERMISSION
+	case errors.Is(err, errors.ErrUnsupported):
+		return EXIT_UNSUPPORTED
+	case onlyExited(err) || errors.Is(err, errNoProcess) || errors.Is(err, wss.ErrNotInNamespace):
+		return EXIT_GONE
+	case results > 0:
+		return EXIT_PARTIAL
+	}
+	return EXIT_ERROR
+}
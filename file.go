@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+func fileUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("USAGE: wss file [options] path...")
+		fs.PrintDefaults()
+		fmt.Println("   eg,")
+		fmt.Println("\twss file --duration 10 /var/lib/postgresql  # referenced page cache of the database files over 10 seconds")
+	}
+}
+
+// fileMain measures the page cache working set of files: how much of their
+// cached pages are referenced during the duration.
+func fileMain(args []string) {
+	fs := flag.NewFlagSet("file", flag.ExitOnError)
+	duration := fs.Float64("duration", 1, "measurement duration in `secs`")
+	logging := addLogFlags(fs)
+	fs.Usage = fileUsage(fs)
+	fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	if *duration < 0.01 {
+		fmt.Println("Interval too short. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	files, err := wss.Files(fs.Args())
+	if err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
+	}
+	if len(files) == 0 {
+		fmt.Println("No file to measure. Exiting.")
+		os.Exit(EXIT_GONE)
+	}
+
+	scanner := wss.NewScanner()
+	if err := scanner.Check(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
+	}
+	fmt.Printf("Watching %d files page cache references during %.2f seconds...\n", len(files), *duration)
+	results, err := scanner.MeasureFiles(files, time.Duration(*duration*float64(time.Second)))
+	if len(results) > 0 {
+		fmt.Printf("Est(s): %.3f\n", results[0].Est.Seconds())
+		fmt.Printf("%12s %10s %s\n", "Cached(MB)", "Ref(MB)", "FILE")
+		for _, res := range results {
+			fmt.Printf("%12.2f %10.2f %s\n", mb(res.WalkedPages, res.PageSize), res.ReferencedMB(), res.Labels["file"])
+		}
+		if len(results) > 1 {
+			total := wss.Sum(results)
+			fmt.Printf("%12.2f %10.2f %s\n", mb(total.WalkedPages, total.PageSize), total.ReferencedMB(), "total")
+		}
+	}
+	if err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, len(results)))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// GRAPHITE_PREFIX is the default first node of the Graphite metric paths.
+const GRAPHITE_PREFIX = "wss"
+
+// graphiteInvalid matches the characters replaced in the nodes of Graphite
+// metric paths, the dots would add nodes.
+var graphiteInvalid = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// graphiteNode returns s as a node of a Graphite metric path.
+func graphiteNode(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return graphiteInvalid.ReplaceAllString(s, "_")
+}
+
+// graphiteSink sends the results of every measurement to a Graphite carbon
+// server, in the plaintext protocol over TCP: the metrics of /metrics, as
+// PREFIX.HOST[.NAME.VALUE...].referenced_bytes and so on, with a NAME.VALUE
+// pair per label of the result, and its comm and pid, sorted by name.
+type graphiteSink struct {
+	addr   string
+	prefix string
+	host   string
+	conn   net.Conn
+}
+
+// newGraphiteSink returns a sink sending to the carbon server at addr, a TCP
+// host:port, with the metric paths under prefix, eg, "wss" or
+// "servers.wss".
+func newGraphiteSink(addr, prefix string) (*graphiteSink, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("Bad Graphite %s", err)
+	}
+	var nodes []string
+	for _, node := range strings.Split(prefix, ".") {
+		if node != "" {
+			nodes = append(nodes, graphiteNode(node))
+		}
+	}
+	return &graphiteSink{addr: addr, prefix: strings.Join(nodes, "."), host: graphiteNode(hostname())}, nil
+}
+
+// path returns the metric path of res, without the metric name.
+func (s *graphiteSink) path(res wss.Result) string {
+	nodes := []string{s.host}
+	if s.prefix != "" {
+		nodes = append([]string{s.prefix}, nodes...)
+	}
+	labels := make(map[string]string, len(res.Labels)+2)
+	if res.PID != 0 {
+		labels["pid"] = strconv.Itoa(res.PID)
+		labels["comm"] = wss.Comm(res.PID)
+	}
+	for name, value := range res.Labels {
+		labels[name] = value
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		nodes = append(nodes, graphiteNode(name), graphiteNode(labels[name]))
+	}
+	return strings.Join(nodes, ".")
+}
+
+func (s *graphiteSink) record(results []wss.Result, failed int) {
+	if len(results) == 0 {
+		return
+	}
+	var b bytes.Buffer
+	for _, res := range results {
+		path := s.path(res)
+		for _, m := range metrics {
+			if m.name == "wss_last_measurement_timestamp_seconds" {
+				// the timestamp of the line
+				continue
+			}
+			fmt.Fprintf(&b, "%s.%s %s %d\n", path, strings.TrimPrefix(m.name, "wss_"),
+				strconv.FormatFloat(m.value(res), 'f', -1, 64), res.Time.Unix())
+		}
+	}
+	// the connection is kept, and made again after errors, eg, carbon
+	// restarting
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+		if err != nil {
+			slog.Warn("Error sending to Graphite", "addr", s.addr, "err", err)
+			return
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		slog.Warn("Error sending to Graphite", "addr", s.addr, "err", err)
+		s.conn.Close()
+		s.conn = nil
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// The gRPC status codes, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md.
+const (
+	GRPC_OK                  = 0
+	GRPC_CANCELLED           = 1
+	GRPC_INVALID_ARGUMENT    = 3
+	GRPC_DEADLINE_EXCEEDED   = 4
+	GRPC_NOT_FOUND           = 5
+	GRPC_PERMISSION_DENIED   = 7
+	GRPC_FAILED_PRECONDITION = 9
+	GRPC_UNIMPLEMENTED       = 12
+	GRPC_INTERNAL            = 13
+)
+
+// GRPC_MAX_MESSAGE is the largest request message read.
+const GRPC_MAX_MESSAGE = 1 << 20
+
+// The protobuf wire types.
+const (
+	PROTO_VARINT = 0
+	PROTO_I64    = 1
+	PROTO_LEN    = 2
+	PROTO_I32    = 5
+)
+
+// protoEncoder appends the fields of a protobuf message to b.
+type protoEncoder struct {
+	b []byte
+}
+
+func (e *protoEncoder) tag(field, wire int) {
+	e.b = binary.AppendUvarint(e.b, uint64(field)<<3|uint64(wire))
+}
+
+// uint appends a varint field, omitted if 0 as in proto3.
+func (e *protoEncoder) uint(field int, v uint64) {
+	if v != 0 {
+		e.tag(field, PROTO_VARINT)
+		e.b = binary.AppendUvarint(e.b, v)
+	}
+}
+
+func (e *protoEncoder) double(field int, v float64) {
+	if v != 0 {
+		e.tag(field, PROTO_I64)
+		e.b = binary.LittleEndian.AppendUint64(e.b, math.Float64bits(v))
+	}
+}
+
+func (e *protoEncoder) bytes(field int, v []byte) {
+	e.tag(field, PROTO_LEN)
+	e.b = binary.AppendUvarint(e.b, uint64(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *protoEncoder) string(field int, v string) {
+	if v != "" {
+		e.bytes(field, []byte(v))
+	}
+}
+
+// protoDecode calls f with the number, wire type and value of every field of
+// the protobuf message b: v of the varint and fixed size fields, data of the
+// length-delimited ones.
+func protoDecode(b []byte, f func(field, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("Bad protobuf field key")
+		}
+		b = b[n:]
+		field, wire := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch wire {
+		case PROTO_VARINT:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("Bad protobuf varint of field %d", field)
+			}
+			b = b[n:]
+		case PROTO_I64:
+			if len(b) < 8 {
+				return fmt.Errorf("Short protobuf field %d", field)
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case PROTO_I32:
+			if len(b) < 4 {
+				return fmt.Errorf("Short protobuf field %d", field)
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case PROTO_LEN:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("Short protobuf field %d", field)
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("Unsupported protobuf wire type %d of field %d", wire, field)
+		}
+		if err := f(field, wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeMeasureRequest decodes the MeasureRequest message of wss.proto.
+func decodeMeasureRequest(b []byte) (measureRequest, error) {
+	var m measureRequest
+	err := protoDecode(b, func(field, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.pid = int(int32(v))
+		case 2:
+			m.cgroup = string(data)
+		case 3:
+			m.duration = math.Float64frombits(v)
+		case 4:
+			m.children = v != 0
+		}
+		return nil
+	})
+	return m, err
+}
+
+// watchRequest is the WatchRequest message of wss.proto.
+type watchRequest struct {
+	measure  measureRequest
+	interval float64
+	count    int
+}
+
+func decodeWatchRequest(b []byte) (watchRequest, error) {
+	var w watchRequest
+	err := protoDecode(b, func(field, wire int, v uint64, data []byte) error {
+		var err error
+		switch field {
+		case 1:
+			w.measure, err = decodeMeasureRequest(data)
+		case 2:
+			w.interval = math.Float64frombits(v)
+		case 3:
+			w.count = int(uint32(v))
+		}
+		return err
+	})
+	return w, err
+}
+
+// encodeResult returns the Result message of wss.proto of res.
+func encodeResult(res wss.Result) []byte {
+	var e protoEncoder
+	e.uint(1, uint64(res.PID))
+	if res.PID != 0 {
+		e.string(2, wss.Comm(res.PID))
+	}
+	names := make([]string, 0, len(res.Labels))
+	for name := range res.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// a map entry is a message of the key and value
+		var entry protoEncoder
+		entry.string(1, name)
+		entry.string(2, res.Labels[name])
+		e.bytes(3, entry.b)
+	}
+	e.uint(4, res.ReferencedBytes())
+	e.uint(5, uint64(res.RssPages)*uint64(res.PageSize))
+	e.uint(6, uint64(res.WalkedPages))
+	e.uint(7, uint64(res.PageSize))
+	e.double(8, res.Est.Seconds())
+	e.uint(9, uint64(res.Time.UnixNano()))
+	e.double(10, res.HotPercent()/100)
+	e.uint(11, uint64(res.ColdPages())*uint64(res.PageSize))
+	e.uint(12, uint64(res.ReclaimablePages())*uint64(res.PageSize))
+	return e.b
+}
+
+// encodeMeasureResponse returns the MeasureResponse message of wss.proto.
+func encodeMeasureResponse(results, totals []wss.Result, failed int) []byte {
+	var e protoEncoder
+	for _, res := range results {
+		e.bytes(1, encodeResult(res))
+	}
+	for _, total := range totals {
+		e.bytes(2, encodeResult(total))
+	}
+	e.uint(3, uint64(failed))
+	return e.b
+}
+
+// grpcError is an error with its gRPC status code.
+type grpcError struct {
+	code int
+	err  error
+}
+
+func (e *grpcError) Error() string {
+	return e.err.Error()
+}
+
+func grpcErrorf(code int, format string, a ...any) error {
+	return &grpcError{code: code, err: fmt.Errorf(format, a...)}
+}
+
+// grpcCode returns the gRPC status code of err, from its exit status.
+func grpcCode(err error) int {
+	var gerr *grpcError
+	switch {
+	case errors.As(err, &gerr):
+		return gerr.code
+	case errors.Is(err, context.Canceled):
+		return GRPC_CANCELLED
+	case errors.Is(err, context.DeadlineExceeded):
+		return GRPC_DEADLINE_EXCEEDED
+	}
+	switch exitStatus(err, 0) {
+	case EXIT_GONE:
+		return GRPC_NOT_FOUND
+	case EXIT_PERMISSION:
+		return GRPC_PERMISSION_DENIED
+	case EXIT_UNSUPPORTED:
+		return GRPC_FAILED_PRECONDITION
+	}
+	return GRPC_INTERNAL
+}
+
+// grpcMessage percent-encodes msg for the grpc-message trailer.
+func grpcMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcTimeout parses the grpc-timeout header, eg, 10S or 500m.
+func grpcTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[s[len(s)-1]]
+	return time.Duration(n) * unit, ok
+}
+
+// grpcServer is the WSS service of wss.proto, over HTTP/2, with the
+// protobuf messages encoded by hand.
+type grpcServer struct {
+	m *measurer
+}
+
+func newGRPCServer(m *measurer) *grpcServer {
+	return &grpcServer{m: m}
+}
+
+func (g *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	ctx := r.Context()
+	if timeout, ok := grpcTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var err error
+	switch r.URL.Path {
+	case "/wss.v1.WSS/Measure":
+		err = g.measure(ctx, w, r.Body)
+	case "/wss.v1.WSS/Watch":
+		err = g.watch(ctx, w, r.Body)
+	default:
+		err = grpcErrorf(GRPC_UNIMPLEMENTED, "Unknown method %s", r.URL.Path)
+	}
+	code := GRPC_OK
+	if err != nil {
+		code = grpcCode(err)
+		w.Header().Set("Grpc-Message", grpcMessage(err.Error()))
+		slog.Debug("gRPC call failed", "method", r.URL.Path, "code", code, "err", err)
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+}
+
+// read returns the request message of a call.
+func (g *grpcServer) read(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, grpcErrorf(GRPC_INVALID_ARGUMENT, "Can't read the request %s", err)
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(GRPC_UNIMPLEMENTED, "Compressed requests are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > GRPC_MAX_MESSAGE {
+		return nil, grpcErrorf(GRPC_INVALID_ARGUMENT, "Request of %d bytes too large", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, grpcErrorf(GRPC_INVALID_ARGUMENT, "Can't read the request %s", err)
+	}
+	return msg, nil
+}
+
+// write sends the response message msg, right away.
+func (g *grpcServer) write(w http.ResponseWriter, msg []byte) error {
+	var b bytes.Buffer
+	b.WriteByte(0)
+	binary.Write(&b, binary.BigEndian, uint32(len(msg)))
+	b.Write(msg)
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	http.NewResponseController(w).Flush()
+	return nil
+}
+
+// once measures the targets of req, and returns the MeasureResponse.
+func (g *grpcServer) once(ctx context.Context, req measureRequest) ([]byte, error) {
+	sel, d, err := req.target()
+	if err != nil {
+		return nil, &grpcError{code: GRPC_INVALID_ARGUMENT, err: err}
+	}
+	results, totals, failed, err := g.m.measureTargets(ctx, sel, d)
+	if err != nil {
+		return nil, err
+	}
+	return encodeMeasureResponse(results, totals, failed), nil
+}
+
+func (g *grpcServer) measure(ctx context.Context, w http.ResponseWriter, body io.Reader) error {
+	msg, err := g.read(body)
+	if err != nil {
+		return err
+	}
+	req, err := decodeMeasureRequest(msg)
+	if err != nil {
+		return &grpcError{code: GRPC_INVALID_ARGUMENT, err: err}
+	}
+	resp, err := g.once(ctx, req)
+	if err != nil {
+		return err
+	}
+	return g.write(w, resp)
+}
+
+func (g *grpcServer) watch(ctx context.Context, w http.ResponseWriter, body io.Reader) error {
+	msg, err := g.read(body)
+	if err != nil {
+		return err
+	}
+	req, err := decodeWatchRequest(msg)
+	if err != nil {
+		return &grpcError{code: GRPC_INVALID_ARGUMENT, err: err}
+	}
+	_, d, err := req.measure.target()
+	if err != nil {
+		return &grpcError{code: GRPC_INVALID_ARGUMENT, err: err}
+	}
+	interval := d
+	if req.interval != 0 {
+		interval = time.Duration(req.interval * float64(time.Second))
+	}
+	if interval < d {
+		return grpcErrorf(GRPC_INVALID_ARGUMENT, "Interval shorter than the duration")
+	}
+	for i := 0; req.count == 0 || i < req.count; i++ {
+		start := time.Now()
+		resp, err := g.once(ctx, req.measure)
+		if err != nil {
+			return err
+		}
+		if err := g.write(w, resp); err != nil {
+			return err
+		}
+		if req.count != 0 && i+1 == req.count {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(start.Add(interval))):
+		}
+	}
+	return nil
+}
+
+// serveGRPC serves the WSS service on addr, over TLS with the certificate
+// and key files if given, or else cleartext HTTP/2 (h2c).
+func serveGRPC(addr string, g *grpcServer, cert, key string) error {
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{Addr: addr, Handler: g, Protocols: &protocols}
+	slog.Info("Serving the gRPC WSS service", "listen", addr, "tls", cert != "")
+	if cert != "" {
+		return srv.ListenAndServeTLS(cert, key)
+	}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// result is the Result message of wss.proto, decoded.
+type result struct {
+	pid                  int
+	comm                 string
+	labels               map[string]string
+	referenced, resident uint64
+	walked, pageSize     uint64
+	est                  float64
+	time                 int64
+	hot                  float64
+	cold, reclaimable    uint64
+	wires                map[int]int
+}
+
+func decodeResult(t *testing.T, b []byte) result {
+	t.Helper()
+	r := result{wires: map[int]int{}}
+	err := protoDecode(b, func(field, wire int, v uint64, data []byte) error {
+		r.wires[field] = wire
+		switch field {
+		case 1:
+			r.pid = int(int32(v))
+		case 2:
+			r.comm = string(data)
+		case 3:
+			var key, value string
+			err := protoDecode(data, func(field, wire int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					key = string(data)
+				case 2:
+					value = string(data)
+				}
+				return nil
+			})
+			if r.labels == nil {
+				r.labels = map[string]string{}
+			}
+			r.labels[key] = value
+			return err
+		case 4:
+			r.referenced = v
+		case 5:
+			r.resident = v
+		case 6:
+			r.walked = v
+		case 7:
+			r.pageSize = v
+		case 8:
+			r.est = math.Float64frombits(v)
+		case 9:
+			r.time = int64(v)
+		case 10:
+			r.hot = math.Float64frombits(v)
+		case 11:
+			r.cold = v
+		case 12:
+			r.reclaimable = v
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decoding Result: %s", err)
+	}
+	return r
+}
+
+func TestEncodeResult(t *testing.T) {
+	res := wss.Result{
+		PID:         os.Getpid(),
+		Est:         1500 * time.Millisecond,
+		Time:        time.Unix(1700000000, 123456789),
+		ActivePages: 300,
+		WalkedPages: 1000,
+		RssPages:    1200,
+		PageSize:    4096,
+		Labels:      map[string]string{"cgroup": "system.slice/nginx.service", "container": "web"},
+	}
+	r := decodeResult(t, encodeResult(res))
+	want := result{
+		pid:         res.PID,
+		comm:        wss.Comm(res.PID),
+		labels:      res.Labels,
+		referenced:  res.ReferencedBytes(),
+		resident:    1200 * 4096,
+		walked:      1000,
+		pageSize:    4096,
+		est:         1.5,
+		time:        res.Time.UnixNano(),
+		hot:         res.HotPercent() / 100,
+		cold:        uint64(res.ColdPages()) * 4096,
+		reclaimable: uint64(res.ReclaimablePages()) * 4096,
+		wires: map[int]int{
+			1: PROTO_VARINT, 2: PROTO_LEN, 3: PROTO_LEN, 4: PROTO_VARINT, 5: PROTO_VARINT, 6: PROTO_VARINT,
+			7: PROTO_VARINT, 8: PROTO_I64, 9: PROTO_VARINT, 10: PROTO_I64, 11: PROTO_VARINT, 12: PROTO_VARINT,
+		},
+	}
+	if want.cold == 0 {
+		delete(want.wires, 11)
+	}
+	if want.reclaimable == 0 {
+		delete(want.wires, 12)
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Result = %+v, want %+v", r, want)
+	}
+}
+
+func TestEncodeResultTotal(t *testing.T) {
+	// the zero fields are left out, as in proto3, and a total has no comm
+	r := decodeResult(t, encodeResult(wss.Result{WalkedPages: 10, PageSize: 4096}))
+	want := result{walked: 10, pageSize: 4096, resident: 0, wires: map[int]int{6: PROTO_VARINT, 7: PROTO_VARINT, 9: PROTO_VARINT}}
+	// the zero time.Time is before 1970
+	want.time = time.Time{}.UnixNano()
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Result = %+v, want %+v", r, want)
+	}
+}
+
+func TestEncodeMeasureResponse(t *testing.T) {
+	results := []wss.Result{{PID: os.Getpid(), WalkedPages: 1}, {PID: os.Getpid(), WalkedPages: 2}}
+	totals := []wss.Result{{WalkedPages: 3}}
+	var walked []uint64
+	var fields []int
+	var failed uint64
+	err := protoDecode(encodeMeasureResponse(results, totals, 4), func(field, wire int, v uint64, data []byte) error {
+		fields = append(fields, field)
+		switch field {
+		case 1, 2:
+			walked = append(walked, decodeResult(t, data).walked)
+		case 3:
+			failed = v
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fields, []int{1, 1, 2, 3}) || !reflect.DeepEqual(walked, []uint64{1, 2, 3}) || failed != 4 {
+		t.Errorf("MeasureResponse fields %v, walked %v, failed %d", fields, walked, failed)
+	}
+}
+
+func TestDecodeRequests(t *testing.T) {
+	var m protoEncoder
+	m.uint(1, 181)
+	m.string(2, "system.slice/nginx.service")
+	m.double(3, 0.5)
+	m.uint(4, 1)
+	// unknown fields are skipped
+	m.uint(15, 7)
+	m.bytes(16, []byte("x"))
+	req, err := decodeMeasureRequest(m.b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := measureRequest{pid: 181, cgroup: "system.slice/nginx.service", duration: 0.5, children: true}
+	if req != want {
+		t.Errorf("MeasureRequest = %+v, want %+v", req, want)
+	}
+
+	var w protoEncoder
+	w.bytes(1, m.b)
+	w.double(2, 10)
+	w.uint(3, 6)
+	watch, err := decodeWatchRequest(w.b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (watch != watchRequest{measure: want, interval: 10, count: 6}) {
+		t.Errorf("WatchRequest = %+v", watch)
+	}
+}
+
+func TestProtoDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"truncated key", []byte{0x80}, "Bad protobuf field key"},
+		{"overlong key", bytes.Repeat([]byte{0xff}, 11), "Bad protobuf field key"},
+		{"missing varint", []byte{0x08}, "Bad protobuf varint of field 1"},
+		{"truncated varint", []byte{0x08, 0x96}, "Bad protobuf varint of field 1"},
+		{"overlong varint", append([]byte{0x08}, bytes.Repeat([]byte{0x80}, 10)...), "Bad protobuf varint of field 1"},
+		{"overflowing varint", append([]byte{0x08}, append(bytes.Repeat([]byte{0xff}, 9), 0x02)...), "Bad protobuf varint of field 1"},
+		{"short double", []byte{0x19, 0, 0, 0}, "Short protobuf field 3"},
+		{"short fixed32", []byte{0x25, 0}, "Short protobuf field 4"},
+		{"short string", []byte{0x12, 5, 'a', 'b'}, "Short protobuf field 2"},
+		{"missing length", []byte{0x12}, "Short protobuf field 2"},
+		{"huge length", []byte{0x12, 0xff, 0xff, 0xff, 0xff, 0x0f}, "Short protobuf field 2"},
+		{"group", []byte{0x0b}, "Unsupported protobuf wire type 3 of field 1"},
+		{"after a good field", []byte{0x08, 0x01, 0x10}, "Bad protobuf varint of field 2"},
+	}
+	for _, tt := range tests {
+		err := protoDecode(tt.b, func(field, wire int, v uint64, data []byte) error { return nil })
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: protoDecode(% x) error = %v, want %q", tt.name, tt.b, err, tt.want)
+		}
+	}
+	// and those of the nested messages
+	if _, err := decodeWatchRequest([]byte{0x0a, 0x01, 0x08}); err == nil {
+		t.Errorf("decodeWatchRequest of a truncated MeasureRequest succeeded")
+	}
+}
+
+func TestGRPCFraming(t *testing.T) {
+	var g grpcServer
+	msg := encodeResult(wss.Result{WalkedPages: 42, PageSize: 4096})
+	rec := httptest.NewRecorder()
+	if err := g.write(rec, msg); err != nil {
+		t.Fatal(err)
+	}
+	frame := rec.Body.Bytes()
+	if len(frame) != 5+len(msg) || frame[0] != 0 || int(frame[1])<<24|int(frame[2])<<16|int(frame[3])<<8|int(frame[4]) != len(msg) {
+		t.Fatalf("frame % x of a message of %d bytes", frame, len(msg))
+	}
+	got, err := g.read(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("read % x, want % x", got, msg)
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		code  int
+		want  string
+	}{
+		{"empty", nil, GRPC_INVALID_ARGUMENT, "Can't read the request EOF"},
+		{"short prefix", []byte{0, 0, 0}, GRPC_INVALID_ARGUMENT, "Can't read the request unexpected EOF"},
+		{"short message", []byte{0, 0, 0, 0, 3, 1}, GRPC_INVALID_ARGUMENT, "Can't read the request unexpected EOF"},
+		{"compressed", []byte{1, 0, 0, 0, 0}, GRPC_UNIMPLEMENTED, "Compressed requests are not supported"},
+		{"too large", []byte{0, 0, 0x10, 0, 1}, GRPC_INVALID_ARGUMENT, "Request of 1048577 bytes too large"},
+	}
+	for _, tt := range tests {
+		_, err := g.read(bytes.NewReader(tt.frame))
+		if err == nil || grpcCode(err) != tt.code || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: read error = %v (code %d), want %q (code %d)", tt.name, err, grpcCode(err), tt.want, tt.code)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// STALL is the default seconds a cycle of the agent may last before it is
+// reported wedged on /healthz
+const STALL = 600
+
+// health is the state of the agent served on /healthz, failing once its
+// measurement loop is wedged, for a Kubernetes liveness probe to restart it,
+// and on /readyz, also failing without the kernel support or the privileges
+// to measure, for a readiness probe.
+type health struct {
+	scanner *wss.Scanner
+	// the longest a cycle may last
+	stall time.Duration
+
+	mu      sync.Mutex
+	running bool
+	// the start of the cycle in flight, if any, and the end of the last one
+	started, finished time.Time
+	cycles            int
+}
+
+// healthStatus is the body of /healthz and /readyz: the result of every
+// check, "ok" or why it fails.
+type healthStatus struct {
+	Status    string            `json:"status"`
+	Checks    map[string]string `json:"checks"`
+	Cycles    int               `json:"cycles"`
+	LastCycle *time.Time        `json:"last_cycle,omitempty"`
+}
+
+func (h *health) setRunning(running bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = running
+}
+
+// begin records the start of a cycle, and end its end.
+func (h *health) begin() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = time.Now()
+}
+
+func (h *health) end() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = time.Time{}
+	h.finished = time.Now()
+	h.cycles++
+}
+
+// loop returns why the measurement loop isn't making progress, if so: it
+// isn't running, or the cycle in flight lasts longer than stall, eg, stuck
+// on the CRI runtime.
+func (h *health) loop() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case !h.running:
+		return errors.New("Measurement loop not running")
+	case !h.started.IsZero() && time.Since(h.started) > h.stall:
+		return fmt.Errorf("Cycle in flight for %s, longer than %s", time.Since(h.started).Round(time.Second), h.stall)
+	}
+	return nil
+}
+
+// serveHealth serves /healthz: the progress of the measurement loop only,
+// restarting wss not helping with the kernel or its privileges.
+func (h *health) serveHealth(w http.ResponseWriter, r *http.Request) {
+	h.reply(w, map[string]error{"loop": h.loop()})
+}
+
+// serveReady serves /readyz: the checks of wss at startup, rerun, and the
+// progress of the measurement loop.
+func (h *health) serveReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{"kernel": nil, "permissions": nil, "loop": h.loop()}
+	if err := h.scanner.Check(); errors.Is(err, os.ErrPermission) {
+		checks["permissions"] = err
+	} else if err != nil {
+		checks["kernel"] = err
+	}
+	h.reply(w, checks)
+}
+
+func (h *health) reply(w http.ResponseWriter, checks map[string]error) {
+	status := healthStatus{Status: "ok", Checks: make(map[string]string)}
+	code := http.StatusOK
+	for name, err := range checks {
+		status.Checks[name] = "ok"
+		if err != nil {
+			status.Checks[name] = err.Error()
+			status.Status = "failing"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	h.mu.Lock()
+	status.Cycles = h.cycles
+	if !h.finished.IsZero() {
+		finished := h.finished
+		status.LastCycle = &finished
+	}
+	h.mu.Unlock()
+	reply(w, code, status)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"math/bits"
+	"os"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+const (
+	// HEATMAP_CELLS bounds the cells of a heatmap, the pages per cell are
+	// doubled until the mappings fit
+	HEATMAP_CELLS = 16384
+	// HEATMAP_COLUMNS are the cells per row of a mapping
+	HEATMAP_COLUMNS = 128
+	// HEATMAP_CELL is the size of a cell, in pixels
+	HEATMAP_CELL = 6
+)
+
+// heatmapRow is a line of a heatmap: the title of a process or mapping, or
+// cells, the pages referenced and resident of every bin of a mapping.
+type heatmapRow struct {
+	title      string
+	referenced []int
+	resident   []int
+	start      uint64 // address of the first cell
+	cellsize   uint64 // bytes per cell
+}
+
+// writeHeatmap renders the referenced and idle pages of the mappings of
+// results, walked with Scanner.HotPages, to the SVG file path, the
+// --heatmap: a band of cells per mapping, in address order, each covering
+// the same number of pages, from gray for those not resident, through blue
+// for the idle ones, to red for those all referenced.
+func writeHeatmap(path string, results []wss.Result, duration float64) error {
+	var pages int
+	for _, res := range results {
+		for _, m := range res.Maps {
+			if m.WalkedPages > 0 {
+				pages += int(m.Size() / uint64(res.PageSize))
+			}
+		}
+	}
+	bin := 1
+	for pages/bin > HEATMAP_CELLS {
+		bin *= 2
+	}
+
+	var rows []heatmapRow
+	for _, res := range results {
+		pagesize := uint64(res.PageSize)
+		rows = append(rows, heatmapRow{title: fmt.Sprintf("PID %d (%s): Ref(MB) %.2f of Walked(MB) %.2f",
+			res.PID, wss.Comm(res.PID), res.ReferencedMB(), mb(res.WalkedPages, res.PageSize))})
+		for _, m := range res.Maps {
+			if m.WalkedPages == 0 {
+				continue
+			}
+			path := m.Path
+			if path == "" {
+				path = "[anon]"
+			}
+			rows = append(rows, heatmapRow{title: fmt.Sprintf("%x-%x %s %s: Ref(MB) %.2f of Walked(MB) %.2f",
+				m.Start, m.End, m.Perms, path, mb(m.ActivePages, res.PageSize), mb(m.WalkedPages, res.PageSize))})
+			cells := (int(m.Size()/pagesize) + bin - 1) / bin
+			referenced, resident := binPages(m.Hot, cells, bin), binPages(m.Resident, cells, bin)
+			for c := 0; c < cells; c += HEATMAP_COLUMNS {
+				end := min(c+HEATMAP_COLUMNS, cells)
+				rows = append(rows, heatmapRow{
+					referenced: referenced[c:end],
+					resident:   resident[c:end],
+					start:      m.Start + uint64(c*bin)*pagesize,
+					cellsize:   uint64(bin) * pagesize,
+				})
+			}
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Can't create heatmap %s", err)
+	}
+	w := bufio.NewWriter(f)
+	const margin, line = 10, 16
+	height := 2*margin + 2*line
+	for _, row := range rows {
+		if row.title != "" {
+			height += line
+		} else {
+			height += HEATMAP_CELL
+		}
+	}
+	width := 2*margin + HEATMAP_COLUMNS*HEATMAP_CELL
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"monospace\" font-size=\"11\">\n", width, height)
+	fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\">Referenced pages during %.2f seconds, %d pages per cell: %s</text>\n", margin, margin+11, duration, bin,
+		"<tspan fill=\"#cccccc\">not resident</tspan> <tspan fill=\"#6baed6\">idle</tspan> <tspan fill=\"#cb181d\">referenced</tspan>")
+	y := margin + 2*line
+	for _, row := range rows {
+		if row.title != "" {
+			fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\">%s</text>\n", margin, y+11, html.EscapeString(row.title))
+			y += line
+			continue
+		}
+		for c := range row.resident {
+			start := row.start + uint64(c)*row.cellsize
+			fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"><title>%x: %d of %d referenced</title></rect>\n",
+				margin+c*HEATMAP_CELL, y, HEATMAP_CELL, HEATMAP_CELL, heatColor(row.referenced[c], row.resident[c]), start, row.referenced[c], row.resident[c])
+		}
+		y += HEATMAP_CELL
+	}
+	fmt.Fprintln(w, "</svg>")
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("Can't write heatmap %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Can't write heatmap %s", err)
+	}
+	return nil
+}
+
+// binPages counts the bits set of bitmap, a bit per page, in cells of bin
+// pages.
+func binPages(bitmap []uint64, cells, bin int) []int {
+	counts := make([]int, cells)
+	for i, word := range bitmap {
+		for word != 0 {
+			page := i*64 + bits.TrailingZeros64(word)
+			word &= word - 1
+			counts[page/bin]++
+		}
+	}
+	return counts
+}
+
+// heatColor is the color of a cell of referenced pages of resident: gray
+// without resident pages, else from blue, all idle, to red, all referenced.
+func heatColor(referenced, resident int) string {
+	if resident == 0 {
+		return "#cccccc"
+	}
+	f := float64(referenced) / float64(resident)
+	idle, hot := [3]float64{0x6b, 0xae, 0xd6}, [3]float64{0xcb, 0x18, 0x1d}
+	var rgb [3]int
+	for i := range rgb {
+		rgb[i] = int(idle[i] + f*(hot[i]-idle[i]))
+	}
+	return fmt.Sprintf("#%02x%02x%02x", rgb[0], rgb[1], rgb[2])
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/bits"
+	"os"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// hotPageDump writes the virtual address of every page referenced by every
+// measurement to a file, the --dump-hot-pages: a line per page, with the
+// mapping of the page, eg, to correlate the hot pages with the arenas of an
+// allocator, or to madvise the cold ranges.
+type hotPageDump struct {
+	f    *os.File
+	w    *bufio.Writer
+	path string
+}
+
+// newHotPageDump creates the dump file path, starting with a comment naming
+// the columns.
+func newHotPageDump(path string) (*hotPageDump, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't create hot page dump %s", err)
+	}
+	d := &hotPageDump{f: f, w: bufio.NewWriter(f), path: path}
+	fmt.Fprintln(d.w, "# time pid address start-end perms offset path")
+	return d, nil
+}
+
+// record writes the pages referenced of results, of the mappings walked.
+func (d *hotPageDump) record(results []wss.Result) error {
+	for _, res := range results {
+		pagesize := uint64(res.PageSize)
+		time := float64(res.Time.UnixMilli()) / 1000
+		for _, m := range res.Maps {
+			path := m.Path
+			if path == "" {
+				path = "[anon]"
+			}
+			for i, word := range m.Hot {
+				for word != 0 {
+					page := uint64(i*64 + bits.TrailingZeros64(word))
+					word &= word - 1
+					fmt.Fprintf(d.w, "%.3f %d %x %x-%x %s %x %s\n", time, res.PID, m.Start+page*pagesize, m.Start, m.End, m.Perms, m.Offset, path)
+				}
+			}
+		}
+	}
+	if err := d.w.Flush(); err != nil {
+		return fmt.Errorf("Can't write hot page dump %s", err)
+	}
+	return nil
+}
+
+// Close completes the dump file.
+func (d *hotPageDump) Close() error {
+	if err := d.w.Flush(); err != nil {
+		d.f.Close()
+		return fmt.Errorf("Can't write hot page dump %s", err)
+	}
+	if err := d.f.Close(); err != nil {
+		return fmt.Errorf("Can't write hot page dump %s", err)
+	}
+	return nil
+}
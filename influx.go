@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// INFLUX_TOKEN_ENV is the environment variable of the API token of InfluxDB
+// 2.x, sent with the writes of --influx, if set.
+const INFLUX_TOKEN_ENV = "INFLUX_TOKEN"
+
+// influxEscaper escapes the tag keys and values of the line protocol.
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// influxLine appends the line protocol line of res to b: the wss measurement,
+// tagged with the host, the pid and comm, and the labels of res, with the
+// metrics of /metrics as fields, named referenced_bytes and so on, at the
+// time of the measurement.
+func influxLine(b *bytes.Buffer, host string, res wss.Result) {
+	tags := map[string]string{"host": host}
+	if res.PID != 0 {
+		tags["pid"] = strconv.Itoa(res.PID)
+		tags["comm"] = wss.Comm(res.PID)
+	}
+	for name, value := range res.Labels {
+		tags[name] = value
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("wss")
+	for _, name := range names {
+		if tags[name] == "" {
+			// empty tag values are invalid
+			continue
+		}
+		fmt.Fprintf(b, ",%s=%s", influxEscaper.Replace(name), influxEscaper.Replace(tags[name]))
+	}
+	sep := " "
+	for _, m := range metrics {
+		if m.name == "wss_last_measurement_timestamp_seconds" {
+			// the timestamp of the line
+			continue
+		}
+		fmt.Fprintf(b, "%s%s=%s", sep, strings.TrimPrefix(m.name, "wss_"), strconv.FormatFloat(m.value(res), 'f', -1, 64))
+		sep = ","
+	}
+	t := res.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	fmt.Fprintf(b, " %d\n", t.UnixNano())
+}
+
+// hostname returns the host name of the host tag, or "" if unknown.
+func hostname() string {
+	host, _ := os.Hostname()
+	return host
+}
+
+// influxPrinter writes a line protocol line per measurement, the -o influx
+// output.
+type influxPrinter struct {
+	w    io.Writer
+	host string
+	buf  bytes.Buffer
+}
+
+func (p *influxPrinter) banner(format string, a ...any) {}
+
+func (p *influxPrinter) header() {}
+
+func (p *influxPrinter) row(res wss.Result) {
+	p.buf.Reset()
+	influxLine(&p.buf, p.host, res)
+	p.w.Write(p.buf.Bytes())
+}
+
+func (p *influxPrinter) total(res wss.Result) {
+	p.row(res)
+}
+
+func (p *influxPrinter) summary(runs int, sums []summary) {}
+
+func (p *influxPrinter) flush() {}
+
+// influxSink writes the results of every measurement to an InfluxDB, or
+// Telegraf, write endpoint, eg, the /api/v2/write?org=ORG&bucket=BUCKET URL
+// of InfluxDB 2.x, or /write?db=DB of InfluxDB 1.x, or to stdout.
+type influxSink struct {
+	url    string
+	token  string
+	host   string
+	client *http.Client
+	// out writes to stdout, for "-"
+	out *influxPrinter
+}
+
+// newInfluxSink returns a sink writing to the endpoint url, with the token of
+// INFLUX_TOKEN_ENV, or to stdout for "-".
+func newInfluxSink(url string) (*influxSink, error) {
+	if url == "-" {
+		return &influxSink{out: &influxPrinter{w: os.Stdout, host: hostname()}}, nil
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("Bad InfluxDB URL %s, expected http:// or https://", url)
+	}
+	return &influxSink{
+		url:    url,
+		token:  os.Getenv(INFLUX_TOKEN_ENV),
+		host:   hostname(),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *influxSink) record(results []wss.Result, failed int) {
+	if s.out != nil {
+		for _, res := range results {
+			s.out.row(res)
+		}
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+	// a request per cycle
+	var b bytes.Buffer
+	for _, res := range results {
+		influxLine(&b, s.host, res)
+	}
+	req, err := http.NewRequest("POST", s.url, &b)
+	if err != nil {
+		slog.Warn("Error writing to InfluxDB", "url", s.url, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		slog.Warn("Error writing to InfluxDB", "url", s.url, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		slog.Warn("Error writing to InfluxDB", "url", s.url, "status", resp.Status, "body", strings.TrimSpace(string(body)))
+	}
+}
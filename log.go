@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// logFlags are the logging options of every subcommand. The logs go to
+// stderr, leaving stdout to the results.
+type logFlags struct {
+	verbose bool
+	trace   bool
+	format  string
+}
+
+// addLogFlags adds the logging options to fs.
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	l := &logFlags{}
+	fs.BoolVar(&l.verbose, "v", false, "verbose: log the timings and counts of the measurements, and the mappings walked")
+	fs.BoolVar(&l.trace, "vv", false, "very verbose: also log every page walked")
+	fs.StringVar(&l.format, "log-format", "text", "log `format`: text or json")
+	return l
+}
+
+// setup sets the default logger from the options.
+func (l *logFlags) setup() error {
+	level := slog.LevelInfo
+	if l.verbose {
+		level = slog.LevelDebug
+	}
+	if l.trace {
+		level = wss.LevelTrace
+	}
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// rather than DEBUG-4
+			if a.Key == slog.LevelKey && a.Value.Any() == wss.LevelTrace {
+				a.Value = slog.StringValue("TRACE")
+			}
+			return a
+		},
+	}
+	switch l.format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("Unknown log format %q", l.format)
+	}
+	return nil
+}
@@ -5,6 +5,18 @@
 * Re-written in golang for better integration with rest of Platform9 stack
 * Requirements: Linux 4.3+
 * USAGE: wss PID duration
+*        wss -i secs [-c count] PID
+*        wss -p PID,PID... duration
+*        wss --ages 1,10,60 PID
+*        wss --name comm duration
+*        wss serve --listen :9400 PID...
+*        wss agent --listen :9400
+*        wss top --duration 10 --top 20
+*        wss file --duration 10 path...
+*        wss snapshot PID -o file
+*        wss analyze file...
+*        wss diff before after
+*        wss check
 
   - COLUMNS:
   - - Est(s):  Estimated WSS measurement duration: this accounts for delays
@@ -12,6 +24,14 @@
   - intended sleep duration.
   - - Ref(MB): Referenced (Mbytes) during the specified duration.
   - This is the working set size metric.
+  - - Walked(MB): Resident memory walked in the pagemap (-x).
+  - - Swap(MB): Swapped out memory of the walked mappings (-x).
+  - - Mapped(MB), Unmapped(MB): Address space mapped and unmapped during
+  - the duration (-x).
+  - - Hot(%): Ref(MB) as a percentage of the RSS (-x).
+  - - Cold(MB): RSS not referenced during the duration (--cold).
+  - - Reclaim(MB): Cold memory deemed reclaimable, discounted for short
+  - durations (--cold).
     *
   - WARNING: This tool sets and reads system and process page flags, which can
   - take over one second of CPU time, during which application may experience
@@ -31,263 +51,676 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"time"
-	"unsafe"
-)
-
-// see Documentation/vm/pagemap.txt:
-// also https://fivelinesofcode.blogspot.com/2014/03/how-to-translate-virtual-to-physical.html
-// and also https://www.kernel.org/doc/Documentation/vm/idle_page_tracking.txt
-
-const (
-	NUM_BYTE_64        uint64 = 8
-	PFN_MASK                  = uint64(1)<<55 - 1
-	PATHSIZE                  = 128
-	LINESIZE                  = 256
-	PAGEMAP_CHUNK_SIZE        = 8
-	IDLEMAP_CHUNK_SIZE        = 8
-	IDLEMAP_BUF_SIZE          = 4096
 
-	// big enough to span 740 GB (TODO check if this is enough)
-	MAX_IDLEMAP_SIZE = 20 * 1024 * 1024
-
-	// Following two constants should come from some linux headers, but hardcoded there
-	// from mm/page_idle.c
-	BITMAP_CHUNK_SIZE = 8
-	PAGE_OFFSET       = 0xffff880000000000
+	"github.com/roopakparikh/wss/pkg/wss"
 )
 
-// globals
-var (
-	g_debug       = 0 // 1 == some, 2==verbose
-	g_activepages = 0
-	g_walkedpages = 0
-	g_idlepath    = "/sys/kernel/mm/page_idle/bitmap"
-	g_idlebuf     = make([]uint64, MAX_IDLEMAP_SIZE)
-	g_idlebufsize uint64
-)
-
-/*
- * This code must operate on bits in the pageidle bitmap and process pagemap.
- * Doing this one by one via syscall read/write on a large process can take too
- * long, eg, 7 minutes for a 130 Gbyte process. Instead, I copy (snapshot) the
- * idle bitmap and pagemap into our memory with the fewest syscalls allowed,
- * and then process them with load/stores. Much faster, at the cost of some memory.
- */
-func mapidle(pid int, mapstart, mapend uint64) error {
-
-	var offset, pfn, idlemapp, idlebits, i uint64
-
-	pagesize := os.Getpagesize()
-
-	pagebufsize := (PAGEMAP_CHUNK_SIZE * (mapend - mapstart)) / uint64(pagesize)
-
-	// create a pagebuf which is equivalent to pagebufsize in bytes
-	pagebuf := make([]uint64, pagebufsize)
-
-	// open pagemap for virtual to PFN translation
-	pagepath := fmt.Sprintf("/proc/%d/pagemap", pid)
-
-	pagefd, err := os.Open(pagepath)
-	if err != nil {
-		return fmt.Errorf("Can't read pagemap file %s", err)
+func measureUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("USAGE: wss [measure] [options] PID duration(s)")
+		fmt.Println("       wss -i secs [-c count] PID")
+		fmt.Println("       wss -p PID,PID... [options] duration(s)")
+		fmt.Println("       wss --name comm|--cmdline-regex re [options] duration(s)")
+		fmt.Println("       wss --cgroup path [options] duration(s)")
+		fmt.Println("       wss --pgid PGID|--sid SID [options] duration(s)")
+		fmt.Println("       wss --container id|name [options] duration(s)")
+		fmt.Println("       wss --cri-container id|name [options] duration(s)")
+		fmt.Println("       wss --pod namespace/name[/container] [options] duration(s)")
+		fmt.Println("       wss -P steps PID duration(s)")
+		fmt.Println("       wss --ages secs,secs... PID")
+		fmt.Println("       wss serve [options] PID...")
+		fmt.Println("       wss agent [options]")
+		fmt.Println("       wss top [options]")
+		fmt.Println("       wss file [options] path...")
+		fmt.Println("       wss snapshot [options] PID")
+		fmt.Println("       wss analyze [options] file...")
+		fmt.Println("       wss diff [options] before after")
+		fmt.Println("       wss check [options]")
+		fs.PrintDefaults()
+		fmt.Println("   eg,")
+		fmt.Println("\twss 181 0.01        # measure PID 181 WSS for 10 milliseconds")
+		fmt.Println("\twss -i 5 -c 0 181   # measure PID 181 WSS every 5 seconds, forever")
+		fmt.Println("\twss -i 1 -c 10 181  # measure PID 181 WSS every second, 10 times")
+		fmt.Println("\twss -p 181,182 1    # measure PIDs 181 and 182 during the same second")
+		fmt.Println("\twss --children 181 1  # total of PID 181 and all its descendants")
+		fmt.Println("\twss --name nginx 1  # measure all nginx processes during the same second")
+		fmt.Println("\twss --cgroup /sys/fs/cgroup/system.slice/nginx.service 1  # nginx cgroup total")
+		fmt.Println("\twss --cgroup system.slice/nginx.service 1  # same, in the mounted v2 or v1 memory hierarchy")
+		fmt.Println("\twss --pgid 4113 1  # total of the processes of the pipeline of process group 4113")
+		fmt.Println("\twss --sid 902 1  # total of the processes of session 902, eg, a login shell")
+		fmt.Println("\twss --container web 1  # docker container web total")
+		fmt.Println("\twss --cri-container 3f2a 1  # containerd/CRI-O container 3f2a... total")
+		fmt.Println("\twss --pod default/web-0 1  # totals of each container of pod web-0, and of the pod")
+		fmt.Println("\twss --pidns web 7 1  # PID 7 as seen inside the docker container web")
+		fmt.Println("\twss --per-map 181 1  # referenced memory of each mapping of PID 181")
+		fmt.Println("\twss --per-file 181 1  # referenced memory of each file mapped by PID 181, eg, libfoo.so: 120MB of 400MB mapped")
+		fmt.Println("\twss --hot-symbols 20 181 1  # the 20 functions of PID 181 with the most code pages referenced")
+		fmt.Println("\twss --only heap 181 1  # referenced memory of the heap of PID 181")
+		fmt.Println("\twss --tid 1907 1  # referenced memory of the stack of thread 1907, eg, of a thread pool")
+		fmt.Println("\twss --map-filter 'libjvm.so|\\.jar$' 181 1  # referenced memory of the JVM code and jars")
+		fmt.Println("\twss --parallelism 8 181 1  # walk the mappings of a large PID 181 with 8 goroutines")
+		fmt.Println("\twss --max-cpu-pct 10 181 1  # scan with at most 10% of a CPU, slower, next to a latency-sensitive service")
+		fmt.Println("\twss --targeted 181 1  # only set the idle flags of the pages of PID 181")
+		fmt.Println("\twss --sparse -p 181,182 1  # load only the idle bitmap of the memory of PIDs 181 and 182")
+		fmt.Println("\twss --io-uring 181 1  # read the page maps of the thousands of mappings of PID 181 in batches")
+		fmt.Println("\twss --sample 1/64 181 1  # quick estimate of a huge PID 181, inspecting 1 page of every 64")
+		fmt.Println("\twss --numa 181 1    # referenced memory of PID 181 per NUMA node")
+		fmt.Println("\twss --hugepages 181 1  # count whole huge pages, and show THP and hugetlb memory")
+		fmt.Println("\twss --ksm 181 1     # how much of the referenced memory of PID 181 is KSM merged")
+		fmt.Println("\twss --locked 181 1  # how much of the referenced memory of PID 181 is mlocked, never reclaimed")
+		fmt.Println("\twss --zero-pages 181 1  # memory of PID 181 only ever read, mapped to the zero page, out of the WSS")
+		fmt.Println("\twss --skip-special 181 1  # the WSS of PID 181 without the [vdso] and [vvar] of the kernel")
+		fmt.Println("\twss --shared -p 181,182 1  # referenced memory private to each PID, and shared")
+		fmt.Println("\twss --overhead 181 1  # also show what measuring PID 181 cost wss, CPU time and I/O per phase")
+		fmt.Println("\twss -x 181 1       # also show the walked (resident) and swapped out memory")
+		fmt.Println("\twss --cgroup system.slice/batch.service --recommend-reclaim --apply -i 600 -c 0  # proactive reclaim of the cold memory")
+		fmt.Println("\twss --cold 181 300  # how much of PID 181 could be reclaimed, from a 5 minute window")
+		fmt.Println("\twss --rollup 181 1  # compare the WSS of PID 181 with its Rss and Pss")
+		fmt.Println("\twss --backend clearrefs 181 1  # without idle page tracking, using clear_refs and smaps")
+		fmt.Println("\twss --backend softdirty 181 1  # write working set: memory written by PID 181 during the second")
+		fmt.Println("\twss --backend damon 181 10  # low overhead estimate of a large process, from DAMON regions")
+		fmt.Println("\twss --backend faults 181 1  # memory newly faulted in by PID 181, without the idle bitmap")
+		fmt.Println("\twss --backend memsample 181 5  # statistical hot set of PID 181, from sampled memory loads")
+		fmt.Println("\twss -P 10 181 0.01  # 10 step 1-2-5 profile, starting with 0.01s")
+		fmt.Println("\twss -o csv -i 5 -c 0 181 >> wss.csv  # append CSV rows every 5 seconds")
+		fmt.Println("\twss -i 1 -c 0 --watch 181  # redraw the WSS of PID 181 and the last runs every second")
+		fmt.Println("\twss -i 10 -c 0 --trend 181  # watch the WSS of PID 181 for growth, eg, a leak")
+		fmt.Println("\twss --pod default/web-0 --recommend-vpa vpa.json -i 60 -c 60  # memory requests of the containers of web-0, from an hour")
+		fmt.Println("\twss -i 1 -c 60 --summary wss-summary.csv 181  # steady-state WSS of PID 181 over a minute")
+		fmt.Println("\twss -i 10 -c 0 --statsd localhost:8125 181  # also send the WSS of PID 181 to DogStatsD")
+		fmt.Println("\twss -o ndjson -i 10 -c 0 181 >> /var/log/wss.ndjson  # a JSON object per measurement, eg, tailed by Fluent Bit")
+		fmt.Println("\twss -o influx -i 10 -c 0 181 >> wss.lp  # append line protocol, eg, for the tail input of Telegraf")
+		fmt.Println("\twss -i 10 -c 0 --influx 'http://localhost:8086/api/v2/write?org=ops&bucket=wss' 181  # also write the WSS of PID 181 to InfluxDB")
+		fmt.Println("\twss -i 60 -c 0 --graphite carbon:2003 --graphite-prefix apps.wss 181  # also send the WSS of PID 181 to Graphite")
+		fmt.Println("\twss --name postgres --pushgateway http://pushgateway:9091 1  # push the WSS of the postgres processes, eg, from cron")
+		fmt.Println("\twss --per-map --store /var/lib/wss/history.db -i 60 -c 0 181  # keep the history of PID 181, and of its mappings")
+		fmt.Println("\twss --parquet maps.parquet -i 60 -c 60 181  # the referenced memory of every mapping of PID 181 for an hour, for analysis")
+		fmt.Println("\twss --dump-hot-pages hot.txt 181 10  # the addresses of the pages of PID 181 referenced during 10 seconds")
+		fmt.Println("\twss --heatmap wss.svg 181 10  # a map of the hot and idle regions of PID 181, eg, to spot hot mmap'd files")
+		fmt.Println("\twss --ages 1,10,60 181  # how many pages of PID 181 were last referenced within 1s, 10s, 60s, or not")
+		fmt.Println("\twss measure 181 1   # same as wss 181 1")
+		fmt.Println("\twss -v --log-format json 181 1  # also log the timings and mappings walked, as JSON on stderr")
 	}
+}
 
-	defer pagefd.Close()
-	// cache pagemap to get PFN, then operate on PFN from idlemap
-	offset = PAGEMAP_CHUNK_SIZE * mapstart / uint64(pagesize)
+// subcommands are the subcommands of wss, by name; without one, wss
+// measures.
+var subcommands = map[string]func(args []string){
+	"measure":  measureMain,
+	"serve":    serveMain,
+	"agent":    agentMain,
+	"top":      topMain,
+	"file":     fileMain,
+	"snapshot": snapshotMain,
+	"analyze":  analyzeMain,
+	"diff":     diffMain,
+	"check":    checkMain,
+}
 
-	if _, err := pagefd.Seek(int64(offset), 0); err != nil {
-		return fmt.Errorf("Can't seek pagemap file %s", err)
+func main() {
+	if len(os.Args) > 1 {
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			sub(os.Args[2:])
+			return
+		}
 	}
+	measureMain(os.Args[1:])
+}
 
-	// optimized: read this in one syscall, but do we need to read the file again and gain till the
-	// length == the bytes read ?
-	read, err := pagefd.Read((*(*[]byte)(unsafe.Pointer(&pagebuf)))[:])
-	if err != nil {
-		return fmt.Errorf("Read page map failed %s", err)
-	}
-	if read <= 0 {
-		return fmt.Errorf("Read page map failed only read %d", read)
+// measureMain measures the targets once, in repeat mode, or in a profile
+// run, and prints the results: the default subcommand.
+func measureMain(args []string) {
+	// options
+	fs := flag.NewFlagSet("measure", flag.ExitOnError)
+	var sel selector
+	fs.Var(&sel.pids, "p", "comma-separated `PIDs` to measure in the same idle page cycle")
+	fs.Var(&sel.pids, "pid", "same as -p, may be repeated")
+	fs.StringVar(&sel.name, "name", "", "measure all processes with this command `name`")
+	fs.Var(&sel.cmdline, "cmdline-regex", "measure all processes with a command line matching this `regexp`")
+	fs.IntVar(&sel.pgid, "pgid", 0, "measure all processes of the process group `PGID`, eg, a shell pipeline, and report their total")
+	fs.IntVar(&sel.sid, "sid", 0, "measure all processes of the session `SID`, eg, started from a login shell or a pre-systemd service tree, and report their total")
+	fs.StringVar(&sel.container, "container", "", "measure all processes of the docker container `id|name`, and report their total")
+	fs.StringVar(&sel.criContainer, "cri-container", "", "measure all processes of the CRI (containerd, CRI-O) container or pod sandbox `id|name`")
+	fs.StringVar(&sel.criEndpoint, "cri-endpoint", "", "CRI runtime `socket`, default $CONTAINER_RUNTIME_ENDPOINT or the first one found")
+	fs.StringVar(&sel.pod, "pod", "", "measure all containers of the pod `namespace/name[/container]` on this node, using the CRI runtime")
+	fs.StringVar(&sel.pidns, "pidns", "", "the PIDs are those seen in the PID namespace `ns|id|name`, its inode, eg, 4026532198 or pid:[4026532198], or that of a docker or CRI container, translated to the host PIDs with the NSpid of /proc/PID/status")
+	fs.BoolVar(&sel.children, "children", false, "include all descendants of the PIDs, and report the total of each process tree")
+	fs.StringVar(&sel.cgroup, "cgroup", "", "measure all processes of the cgroup `path` (v2, or v1 memory controller), and report their total")
+	interval := fs.Float64("i", 0, "repeat mode: measure every `secs` seconds (the measurement duration)")
+	count := fs.Int("c", 1, "number of measurements in repeat mode, 0 for forever")
+	vpaPath := fs.String("recommend-vpa", "", "with --pod, --cgroup or a container, write VerticalPodAutoscaler memory recommendations from the p95 and max Ref(MB) over the runs, plus headroom, as JSON to `file`, - for stdout")
+	headroom := fs.Float64("headroom", 15, "`percent` added to the WSS in the --recommend-vpa recommendations")
+	statsd := fs.String("statsd", "", "also send the results of every measurement to the StatsD, or DogStatsD, server at the UDP `host:port`")
+	influx := fs.String("influx", "", "also write the results of every measurement in line protocol to the InfluxDB, or Telegraf, write `url`, eg, http://localhost:8086/api/v2/write?org=ORG&bucket=BUCKET, with the token of $INFLUX_TOKEN, - for stdout")
+	graphite := fs.String("graphite", "", "also send the results of every measurement to the Graphite carbon server at the TCP `host:port`, in the plaintext protocol")
+	graphitePrefix := fs.String("graphite-prefix", GRAPHITE_PREFIX, "`prefix` of the Graphite metric paths")
+	pushgateway := fs.String("pushgateway", "", "also push the results of every measurement to the Prometheus Pushgateway at `url`, eg, for one-shot runs from cron, grouped by --push-job, the host name as instance, and the target")
+	pushJob := fs.String("push-job", PUSH_JOB, "job `name` of the metrics pushed to the Pushgateway")
+	store := fs.String("store", "", "also record the results of every measurement in the SQLite history database `file`, eg, /var/lib/wss/history.db, with the mappings with --per-map (builds with -tags sqlite)")
+	parquetPath := fs.String("parquet", "", "also write the referenced memory of every mapping walked by every measurement, a row per mapping, to the Parquet `file`, eg, for DuckDB or pandas")
+	hotPath := fs.String("dump-hot-pages", "", "write the virtual address of every page referenced, with its mapping, a line per page, to `file`")
+	heatmapPath := fs.String("heatmap", "", "render the referenced and idle pages across the mappings walked, binned, to the SVG `file`, of the last measurement in repeat mode")
+	summaryPath := fs.String("summary", "", "write the min, max, mean, median and p95 of Ref(MB) over the runs of repeat mode as CSV to `file`, - for stdout")
+	profile := fs.Int("P", 0, "profile run (cumulative) of `steps` durations, from duration(s)")
+	var ages agesFlag
+	fs.Var(&ages, "ages", "page age mode: show how long ago the resident pages were last referenced, within each of these comma-separated `secs`, eg, 1,10,60, or never, in consecutive windows, rather than a duration (idle or softdirty backend)")
+	output := fs.String("o", "text", "output `format`: text, csv, influx (line protocol) or ndjson (a JSON object per line)")
+	backend := backendFlag(wss.BACKEND_IDLE)
+	fs.Var(&backend, "backend", "`method` of finding the referenced pages: idle (page_idle bitmap), clearrefs (clear_refs and smaps), softdirty (pages written, from the soft-dirty bits), damon (accessed DAMON regions), faults (pages faulted in, from perf page fault samples), or memsample (pages of sampled memory loads, eg, Intel PEBS); all but idle and softdirty measure whole processes only")
+	samplePeriod := fs.Int("sample-period", wss.MEMSAMPLE_PERIOD, "memory loads per sample of the memsample backend")
+	var only kindList
+	fs.Var(&only, "only", "only walk the mappings of these `kinds`: anon|file|heap|stack|shmem, comma-separated")
+	var mapFilter regexpFlag
+	fs.Var(&mapFilter, "map-filter", "only walk the mappings whose path matches this `regexp`")
+	fs.IntVar(&sel.tid, "tid", 0, "only walk the mappings of the thread `TID`, its stack and thread-local storage, of its process, from its stack pointer")
+	maxCPU := fs.Float64("max-cpu-pct", 0, "cap the CPU time of wss while setting, loading and walking the page flags to `percent` of a CPU, with pauses, trading longer scans for less interference with latency-sensitive workloads, 0 for no cap")
+	idleChunk := bytesFlag(wss.IDLEMAP_BUF_SIZE)
+	fs.Var(&idleChunk, "idle-chunk", "`size` of the idle bitmap set per write, eg, 64K, in bytes without a unit, a multiple of 8 bytes, up to 1M")
+	idleDelay := fs.Float64("idle-delay", 0, "pause `secs` between the writes of the idle bitmap, eg, 0.0001, to spread the setting of the idle flags of large hosts over time")
+	parallelism := fs.Int("parallelism", 1, "walk the mappings of a process with `N` goroutines, for large processes")
+	var sample sampleFlag
+	fs.Var(&sample, "sample", "only inspect one page of every N of each mapping, `1/N`, eg, 1/64, from a random offset, scaling the counts, for a quick estimate of huge processes")
+	ioUring := fs.Bool("io-uring", false, "read the page maps and the idle bitmap in batches with io_uring, a system call per batch, for processes with thousands of mappings, falling back to pread where unavailable")
+	sparse := fs.Bool("sparse", false, "only load the chunks of the idle bitmap of the pages mapped by the measured processes, rather than the bitmap of the whole host, for less memory on large hosts")
+	targeted := fs.Bool("targeted", false, "only set the idle flags of the pages of the measured processes, leaving the other processes alone")
+	numa := fs.Bool("numa", false, "show the referenced memory per NUMA node (text output)")
+	hugepages := fs.Bool("hugepages", false, "account huge pages with /proc/kpageflags, and show the referenced memory per page size (text output)")
+	ksm := fs.Bool("ksm", false, "show the referenced memory merged by KSM, with /proc/kpageflags (text output)")
+	locked := fs.Bool("locked", false, "show the referenced memory mlocked or unevictable, which can't be reclaimed, with /proc/kpageflags (text output)")
+	zero := fs.Bool("zero-pages", false, "leave out the pages mapped to the shared zero page, read but never written, with /proc/kpageflags, and show them apart (text output)")
+	skipSpecial := fs.Bool("skip-special", false, "leave the [vdso] and [vvar] mappings of the kernel out of the walk, as the [vsyscall], and show their memory apart (text output)")
+	shared := fs.Bool("shared", false, "split the referenced memory into private and shared pages with /proc/kpagecount (text output)")
+	extended := fs.Bool("x", false, "extended text output: add the Walked(MB), Swap(MB), Mapped(MB), Unmapped(MB) and Hot(%) columns")
+	recommend := fs.Bool("recommend-reclaim", false, "with --cgroup, print the memory safe to reclaim from the cgroup v2, its reclaimable cold memory, see --cold (text output)")
+	apply := fs.Bool("apply", false, "with --recommend-reclaim, reclaim it by writing to the memory.reclaim of the cgroup, Linux 5.19+")
+	cold := fs.Bool("cold", false, "add the Cold(MB) column, the resident memory not referenced, and the Reclaim(MB) column, the part of it deemed reclaimable, discounted for short durations (text output)")
+	rollup := fs.Bool("rollup", false, "add the Rss(MB), Pss(MB) and Referenced(MB) columns of smaps_rollup, to compare the resident and the working set memory (text output)")
+	watch := fs.Bool("watch", false, "in repeat mode on a terminal, redraw the current estimate and the last runs in place rather than scrolling, for a single PID (text output)")
+	trend := fs.Bool("trend", false, "add the EMA(MB) column, a moving average of Ref(MB) over the runs of repeat mode, and the Delta(MB) column, the change since the previous run (text output)")
+	alpha := fs.Float64("ema-alpha", 0.3, "smoothing factor of the EMA(MB) column, the weight of the last run, from 0 to 1")
+	perMap := fs.Bool("per-map", false, "show the referenced memory of every mapping (text and ndjson output)")
+	hotSymbols := fs.Int("hot-symbols", 0, "show the `N` functions, from the ELF symbols, with the most pages referenced of the executable file mappings, eg, the hot code of the binary and libraries (text output)")
+	overhead := fs.Bool("overhead", false, "show the CPU time, read and write system calls, and bytes read and written, of wss itself, of every phase of every measurement (text output)")
+	perFile := fs.Bool("per-file", false, "show the referenced, resident and mapped memory of every file mapped, eg, the shared libraries, by decreasing referenced memory (text output)")
+	logging := addLogFlags(fs)
+	fs.Usage = measureUsage(fs)
+	fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_USAGE)
 	}
 
-	// reading
-	// 1 unint64 is 8 bytes
-	for i = 0; i < pagebufsize/8; i++ {
-
-		// convert virtual address p to physical PFN
-		//pfn = binary.LittleEndian.Uint64(pagebuf[i]) & PFN_MASK
-		pfn = pagebuf[i] & PFN_MASK
-		if pfn == 0 {
-			continue
+	args = fs.Args()
+	if sel.pgid < 0 || sel.sid < 0 {
+		fmt.Println("--pgid and --sid must be > 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if sel.tid != 0 {
+		if !sel.empty() || sel.pidns != "" || sel.children {
+			fmt.Println("--tid measures the process of the thread, without other targets, --pidns or --children. Exiting.")
+			os.Exit(EXIT_USAGE)
 		}
-		// read idle bit
-		idlemapp = (pfn / 64) * BITMAP_CHUNK_SIZE
-		if ((idlemapp) > g_idlebufsize) || ((idlemapp) > uint64(len(g_idlebuf))) {
-			return fmt.Errorf("ERROR: bad PFN read from page map. read %d and buf size  %d, buf len %d", idlemapp, g_idlebufsize, len(g_idlebuf))
+		pid := wss.Tgid(sel.tid)
+		if pid == 0 {
+			fmt.Printf("No thread %d. Exiting.\n", sel.tid)
+			os.Exit(EXIT_GONE)
 		}
-
-		if g_debug != 0 {
-			fmt.Printf("Mapping idle page idlebuf %d idlemapp start %d idlemapp end %d \n", g_idlebufsize, idlemapp, idlemapp+NUM_BYTE_64)
+		sel.pids = append(sel.pids, pid)
+	}
+	if sel.empty() {
+		if len(args) < 1 {
+			fs.Usage()
+			os.Exit(EXIT_USAGE)
 		}
-
-		//idlebits = binary.LittleEndian.Uint64(g_idlebuf[idlemapp : idlemapp+NUM_BYTE_64])
-		idlebits = g_idlebuf[idlemapp]
-		if g_debug > 1 {
-			fmt.Printf("R: p %llx pfn %llx idlebits %llx\n", pagebuf[i], pfn, idlebits)
+		pid, err := parsePID(args[0])
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
 		}
-		if idlebits&(1<<(pfn%64)) == 0 {
-			g_activepages++
+		sel.pids = append(sel.pids, pid)
+		args = args[1:]
+	}
+	if len(args) < 1 && *interval == 0 && ages == nil {
+		fs.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	if len(args) > 1 {
+		fmt.Printf("Unexpected arguments %s. Exiting.\n", strings.Join(args[1:], " "))
+		os.Exit(EXIT_USAGE)
+	}
+	if ages != nil && len(args) > 0 {
+		fmt.Println("Page age mode measures during the last of the --ages, without a duration. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	duration := *interval
+	if ages != nil {
+		duration = ages[len(ages)-1].Seconds()
+	}
+	if len(args) > 0 {
+		var err error
+		if duration, err = strconv.ParseFloat(args[0], 64); err != nil {
+			fmt.Printf("Bad duration %s. Exiting.\n", args[0])
+			os.Exit(EXIT_USAGE)
 		}
-		g_walkedpages++
 	}
-	return nil
-}
-
-func walkmaps(pid int) error {
-
-	// read virtual mappings
-	mapsfile, err := os.OpenFile(fmt.Sprintf("/proc/%d/maps", pid), os.O_RDONLY, 0644)
+	if duration < 0.01 {
+		fmt.Println("Interval too short. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *count < 0 {
+		fmt.Println("Count must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *profile != 0 && *interval != 0 {
+		fmt.Println("Can't combine -i and -P. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if ages != nil && (*interval != 0 || *profile != 0) {
+		fmt.Println("Can't combine --ages with -i or -P. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if ages != nil && (backend != wss.BACKEND_IDLE && backend != wss.BACKEND_SOFTDIRTY || len(sel.pids) > 1 || sel.dynamic() || *output != "text") {
+		fmt.Println("Page age mode measures a single PID, with the idle or softdirty backend and the text output. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if sel.pidns != "" && len(sel.pids) == 0 {
+		fmt.Println("--pidns needs PIDs. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *recommend && sel.cgroup == "" {
+		fmt.Println("--recommend-reclaim needs --cgroup. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *vpaPath != "" && sel.pod == "" && sel.cgroup == "" && sel.container == "" && sel.criContainer == "" {
+		fmt.Println("--recommend-vpa needs --pod, --cgroup, --container or --cri-container. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *headroom < 0 {
+		fmt.Println("Headroom must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *apply && !*recommend {
+		fmt.Println("--apply needs --recommend-reclaim. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *watch && (*count == 1 || *profile != 0 || len(sel.pids) > 1 || sel.dynamic() || sel.children) {
+		fmt.Println("--watch needs repeat mode, -c other than 1, of a single PID. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *trend && (*count == 1 || *profile != 0) {
+		fmt.Println("--trend needs repeat mode, -c other than 1. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *alpha <= 0 || *alpha > 1 {
+		fmt.Println("EMA alpha must be > 0 and <= 1. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *summaryPath != "" && (*count == 1 || *profile != 0) {
+		fmt.Println("--summary needs repeat mode, -c other than 1. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *profile != 0 && (backend == wss.BACKEND_DAMON || backend == wss.BACKEND_FAULTS || backend == wss.BACKEND_MEMSAMPLE) {
+		fmt.Println("Profile mode needs the idle, clearrefs or softdirty backend. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *profile != 0 && (len(sel.pids) > 1 || sel.dynamic()) {
+		fmt.Println("Profile mode measures a single PID. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if (*numa || *hugepages || *ksm || *locked || *zero || *shared || *extended || *trend || *watch || *rollup || *cold || *recommend || *perFile || *hotSymbols != 0 || *overhead) && *output != "text" {
+		fmt.Println("-x, --watch, --recommend-reclaim, --cold, --rollup, --trend, --per-file, --hot-symbols, --overhead, --numa, --hugepages, --ksm, --locked, --zero-pages and --shared need the text output. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *perMap && *output != "text" && *output != "ndjson" {
+		fmt.Println("--per-map needs the text or ndjson output. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *targeted && backend != wss.BACKEND_IDLE {
+		fmt.Println("--targeted needs the idle backend. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *sparse && backend != wss.BACKEND_IDLE {
+		fmt.Println("--sparse needs the idle backend. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *hotSymbols < 0 {
+		fmt.Println("Hot symbols must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *maxCPU < 0 {
+		fmt.Println("Max CPU percent must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	checkIdleFlags(idleChunk, *idleDelay)
+	if *parallelism < 1 {
+		fmt.Println("Parallelism must be >= 1. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *samplePeriod < 1 {
+		fmt.Println("Sample period must be >= 1. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if backend != wss.BACKEND_IDLE && backend != wss.BACKEND_SOFTDIRTY && (*perMap || *perFile || *hotSymbols != 0 || *parquetPath != "" || *hotPath != "" || *heatmapPath != "" || *numa || *hugepages || *ksm || *locked || *zero || *skipSpecial || *shared || len(only) > 0 || mapFilter.re != nil || sel.tid != 0 || sample > 1) {
+		fmt.Printf("The %s backend measures whole processes, without --per-map, --per-file, --hot-symbols, --parquet, --dump-hot-pages, --heatmap, --only, --map-filter, --tid, --numa, --hugepages, --ksm, --locked, --zero-pages, --skip-special, --shared and --sample. Exiting.\n", backend)
+		os.Exit(EXIT_USAGE)
+	}
+	out, err := newPrinter(*output, os.Stdout, printOptions{
+		multi:     len(sel.pids) > 1 || sel.dynamic(),
+		hugepages: *hugepages,
+		ksm:       *ksm,
+		locked:    *locked,
+		zero:      *zero,
+		special:   *skipSpecial,
+		shared:    *shared,
+		extended:  *extended,
+		cold:      *cold,
+		rollup:    *rollup,
+		trend:     *trend,
+		// elsewhere, eg, redirected to a file, the output scrolls
+		watch:    *watch && isTerminal(os.Stdout),
+		alpha:    *alpha,
+		sampling: backend == wss.BACKEND_MEMSAMPLE,
+		perMap:   *perMap,
+		perFile:  *perFile,
+		overhead: *overhead,
+		interval: sample > 1,
+	})
 	if err != nil {
-		return fmt.Errorf("Can't read maps file %s", err)
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_USAGE)
 	}
-	linescanner := bufio.NewScanner(mapsfile)
-
-	defer mapsfile.Close()
-
-	for linescanner.Scan() {
-		var mapstart, mapend uint64
-		line := linescanner.Text()
-		_, err := fmt.Sscanf(line, "%x-%x", &mapstart, &mapend)
+	defer out.flush()
+	var sinks []sink
+	if *statsd != "" {
+		s, err := newStatsdSink(*statsd)
 		if err != nil {
-			return fmt.Errorf("Error parsing line %s, err %s", line, err)
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
 		}
-		if g_debug != 0 {
-			fmt.Printf("MAP %x-%x\n", mapstart, mapend)
+		sinks = append(sinks, s)
+	}
+	if *influx != "" {
+		s, err := newInfluxSink(*influx)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
 		}
-		if mapstart > PAGE_OFFSET {
-			continue // page idle tracking is user mem only
+		sinks = append(sinks, s)
+	}
+	if *graphite != "" {
+		s, err := newGraphiteSink(*graphite, *graphitePrefix)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
 		}
-		err = mapidle(pid, mapstart, mapend)
+		sinks = append(sinks, s)
+	}
+	if *store != "" {
+		s, err := newStoreSink(*store, sel.describe())
 		if err != nil {
-			return fmt.Errorf("Error setting map %x-%x. Exiting. \n%s\n", mapstart, mapend, err)
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(exitStatus(err, 0))
 		}
+		sinks = append(sinks, s)
 	}
-	if err := linescanner.Err(); err != nil {
-		return fmt.Errorf("Error reading standard input: %s", err)
+	if *pushgateway != "" {
+		s, err := newPushgatewaySink(*pushgateway, *pushJob, sel.describe())
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		sinks = append(sinks, s)
 	}
 
-	return nil
-}
-
-func setidlemap() error {
-
-	idlefd, err := os.OpenFile(g_idlepath, os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("Can't write idlemap file %s", err)
+	// the scanner resets its per-run counters on every Measure
+	scanner := wss.NewScanner()
+	scanner.Backend = string(backend)
+	scanner.SamplePeriod = *samplePeriod
+	scanner.PerMap = *perMap || *perFile || *hotSymbols != 0 || *parquetPath != "" || *hotPath != "" || *heatmapPath != ""
+	scanner.HotPages = *hotPath != "" || *heatmapPath != "" || *hotSymbols != 0
+	scanner.Only = only
+	scanner.MapFilter = mapFilter.re
+	scanner.SkipSpecial = *skipSpecial
+	scanner.TID = sel.tid
+	scanner.Targeted = *targeted
+	scanner.Sparse = *sparse
+	scanner.IOUring = *ioUring
+	scanner.PageSample = int(sample)
+	scanner.Parallelism = *parallelism
+	scanner.MaxCPU = *maxCPU
+	scanner.IdleChunk = int(idleChunk)
+	scanner.IdleDelay = time.Duration(*idleDelay * float64(time.Second))
+	scanner.NUMA = *numa
+	scanner.PageFlags = *hugepages || *ksm || *locked || *zero
+	scanner.PageCount = *shared
+	scanner.Rollup = *rollup
+	if err := scanner.Check(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
 	}
-	defer idlefd.Close()
-
-	buf := make([]byte, IDLEMAP_BUF_SIZE)
-	for i := 0; i < IDLEMAP_BUF_SIZE; i++ {
-		buf[i] = 0xff
+	defer scanner.Close()
+	// the Parquet file, and the hot page dump, are only complete once closed
+	var files []io.Closer
+	closeFiles := func() {
+		for _, f := range files {
+			if err := f.Close(); err != nil {
+				fmt.Printf("%s\n", err)
+			}
+		}
+		files = nil
 	}
-	// set entire idlemap flags
-	for {
-		_, err := idlefd.Write(buf)
-		if err != nil {
-			break
+	defer closeFiles()
+	var parquet *parquetSink
+	if *parquetPath != "" {
+		if parquet, err = newParquetSink(*parquetPath, sel.describe()); err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
 		}
+		files = append(files, parquet)
 	}
-	return nil
-}
-
-
-func loadidlemap() error {
-	idlefd, err := os.OpenFile(g_idlepath, os.O_RDONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("Can't read idlemap file %s", err)
+	var symbols *symbolizer
+	if *hotSymbols != 0 {
+		symbols = newSymbolizer()
 	}
-	defer idlefd.Close()
-	count := 0
-	for {
-		n, err := idlefd.Read((*(*[]byte)(unsafe.Pointer(&g_idlebuf)))[:])
-		if err != nil {
-			if err != io.EOF {
-				return fmt.Errorf("Error reading file %s", err)
+	var hot *hotPageDump
+	if *hotPath != "" {
+		if hot, err = newHotPageDump(*hotPath); err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			closeFiles()
+			os.Exit(EXIT_USAGE)
+		}
+		files = append(files, hot)
+	}
+
+	// repeat mode ends with a summary of the runs, and the VPA
+	// recommendations are written, also on Ctrl-C or errors
+	runs := newRunStats()
+	summarize := func() {
+		if runs.runs == 0 {
+			return
+		}
+		if *count != 1 {
+			out.summary(runs.runs, runs.summaries())
+		}
+		out.flush()
+		if *summaryPath != "" {
+			if err := writeSummaries(*summaryPath, runs.summaries()); err != nil {
+				fmt.Printf("%s\n", err)
+			}
+		}
+		if *vpaPath != "" {
+			if err := writeVPA(*vpaPath, recommendVPA(runs.summaries(), *headroom/100)); err != nil {
+				fmt.Printf("%s\n", err)
 			}
-			break
 		}
-		count = count + n
-		g_idlebufsize += uint64(n)
 	}
-	if g_debug != 0 {
-		fmt.Printf("Size of the buffer %d, idlebufsize%d \n", len(g_idlebuf), g_idlebufsize)
+	// os.Exit skips the deferred calls
+	exit := func(status int) {
+		summarize()
+		out.flush()
+		closeFiles()
+		scanner.Close()
+		os.Exit(status)
+	}
+	var reclaim *reclaimer
+	if *recommend {
+		if reclaim, err = newReclaimer(sel.cgroup, *apply); err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			exit(exitStatus(err, 0))
+		}
 	}
-	return nil
-}
 
-func main() {
-	pid, _ := strconv.Atoi(os.Args[1])
-	duration, _ := strconv.ParseFloat(os.Args[2], 64)
-	var ts1, ts2, ts3, ts4 time.Time
-	var set_us, read_us, dur_us, slp_us, est_us int64
-	// options
-	if len(os.Args) < 3 {
-		fmt.Println("USAGE: wss PID duration(s)")
-		os.Exit(0)
+	// Ctrl-C ends the measurement early, and prints what was walked so far;
+	// a second one kills wss
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+	interrupted := func(start time.Time) {
+		fmt.Printf("Interrupted after %.2f seconds, the results are partial. Exiting.\n", time.Since(start).Seconds())
+		exit(EXIT_PARTIAL)
 	}
-	if duration < 0.01 {
-		fmt.Println("Interval too short. Exiting.")
-		os.Exit(1)
+
+	// the single PID of profile and page age modes, on this host
+	var pid int
+	if *profile != 0 || ages != nil {
+		pids, err := sel.hostPIDs()
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			exit(exitStatus(err, 0))
+		}
+		pid = pids[0]
 	}
-	fmt.Printf("Watching PID %d page references during %.2f seconds...\n", pid, duration)
-	// set idle flags
-	ts1 = time.Now()
-	err := setidlemap()
-	if err != nil {
-		fmt.Printf("Error setting idle map  %s", err)
+
+	if *profile != 0 {
+		out.banner("Watching PID %d page references grow, profile beginning with %.2f seconds, %d steps...", pid, duration, *profile)
+		steps := wss.ProfileSteps(time.Duration(duration*float64(time.Second)), *profile)
+		start := time.Now()
+		results, err := scanner.ProfileContext(ctx, pid, steps)
+		out.header()
+		for _, res := range results {
+			out.row(res)
+		}
+		if ctx.Err() != nil {
+			interrupted(start)
+		}
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			exit(exitStatus(err, len(results)))
+		}
 		return
 	}
-	// sleep
-	ts2 = time.Now()
-	time.Sleep(time.Duration(duration * float64(time.Second)))
-	ts3 = time.Now()
-	// read idle flags
-	err = loadidlemap()
-	if err != nil {
-		fmt.Printf("Error loading idle map  %s", err)
+
+	if ages != nil {
+		out.banner("Watching PID %d page ages over %.2f seconds, %d windows...", pid, duration, len(ages))
+		start := time.Now()
+		res, err := scanner.AgesContext(ctx, pid, ages)
+		if ctx.Err() != nil {
+			interrupted(start)
+		}
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			exit(exitStatus(err, 0))
+		}
+		printAges(os.Stdout, res)
 		return
 	}
-	err = walkmaps(pid)
-	if err != nil {
-		fmt.Printf("Error walking map  %s", err)
-		return
+
+	if sample > 1 {
+		out.banner("Watching %s page references during %.2f seconds, inspecting %s of the pages...", sel.describe(), duration, &sample)
+	} else {
+		out.banner("Watching %s page references during %.2f seconds...", sel.describe(), duration)
+	}
+	out.header()
+	meta := newContainerMetadata(sel.criSocket())
+	for i := 0; *count == 0 || i < *count; i++ {
+		start := time.Now()
+		pids, err := sel.resolve()
+		if err != nil && sel.dynamic() && *count != 1 {
+			// keep watching, the processes may be restarting
+			fmt.Printf("%s\n", err)
+			select {
+			case <-ctx.Done():
+				interrupted(start)
+			case <-time.After(time.Duration(duration * float64(time.Second))):
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			exit(exitStatus(err, 0))
+		}
+		results, err := scanner.MeasureAllContext(ctx, pids, time.Duration(duration*float64(time.Second)))
+		for i := range results {
+			results[i].Labels = sel.labels(results[i].PID)
+			meta.label(&results[i])
+			res := results[i]
+			if !*perMap && !*perFile {
+				// the mappings are only walked for --parquet,
+				// --dump-hot-pages or --heatmap
+				res.Maps = nil
+			}
+			out.row(res)
+			if symbols != nil {
+				symbols.print(os.Stdout, results[i], *hotSymbols)
+			}
+		}
+		groupTotals := totals(sel.groups, results)
+		for _, total := range groupTotals {
+			out.total(total)
+		}
+		if ctx.Err() != nil {
+			interrupted(start)
+		}
+		if err == nil {
+			runs.add(results, groupTotals)
+		}
+		if parquet != nil {
+			parquet.record(results, len(pids)-len(results))
+		}
+		if hot != nil {
+			if err := hot.record(results); err != nil {
+				fmt.Printf("%s. Exiting.\n", err)
+				exit(EXIT_ERROR)
+			}
+		}
+		if *heatmapPath != "" && len(results) > 0 {
+			if err := writeHeatmap(*heatmapPath, results, duration); err != nil {
+				fmt.Printf("%s. Exiting.\n", err)
+				exit(EXIT_ERROR)
+			}
+		}
+		if !*perMap {
+			for i := range results {
+				results[i].Maps = nil
+			}
+		}
+		for _, s := range sinks {
+			s.record(append(results, groupTotals...), len(pids)-len(results))
+		}
+		if err == nil && reclaim != nil {
+			if err := reclaim.run(groupTotals); err != nil {
+				fmt.Printf("%s. Exiting.\n", err)
+				exit(exitStatus(err, 0))
+			}
+		}
+		if onlyExited(err) && sel.dynamic() {
+			// keep watching the processes left, or those starting
+			fmt.Printf("%s\n", err)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			exit(exitStatus(err, len(results)))
+		}
 	}
-	ts4 = time.Now()
-	// calculate times
-	set_us = int64(ts2.Sub(ts1).Seconds() * 1000000)
-	slp_us = int64(ts3.Sub(ts2).Seconds() * 1000000)
-	read_us = int64(ts4.Sub(ts3).Seconds() * 1000000)
-	dur_us = int64(ts4.Sub(ts1).Seconds() * 1000000)
-	est_us = dur_us - (set_us / 2) - (read_us / 2)
-	if g_debug != 0 {
-		fmt.Printf("set time  : %.3f s\n", float64(set_us)/1000000)
-		fmt.Printf("sleep time: %.3f s\n", float64(slp_us)/1000000)
-		fmt.Printf("read time : %.3f s\n", float64(read_us)/1000000)
-		fmt.Printf("dur time  : %.3f s\n", float64(dur_us)/1000000)
-		// assume getpagesize() sized pages:
-		fmt.Printf("referenced: %d pages, %d Kbytes\n", g_activepages, g_activepages*os.Getpagesize())
-		fmt.Printf("walked    : %d pages, %d Kbytes\n", g_walkedpages, g_walkedpages*os.Getpagesize())
-	}
-	// assume getpagesize() sized pages:
-	mbytes := float64(g_activepages*os.Getpagesize()) / (1024 * 1024)
-	fmt.Printf("%-7s %10s\n", "Est(s)", "Ref(MB)")
-	fmt.Printf("%-7.3f %10.2f", float64(est_us)/1000000, mbytes)
-	os.Exit(0)
+	summarize()
 }
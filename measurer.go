@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// measurer queues the measurements of a scanner, shared by the periodic
+// measurements of wss serve and the on-demand ones of the gRPC service and
+// the API, so they don't interfere in the idle bitmap. The measurements of
+// the same duration requested while waiting for their turn share its cycle:
+// the idle bitmap is set, and loaded, once for all of them, and each only
+// walks its own processes.
+type measurer struct {
+	scanner *wss.Scanner
+	queue   *cycleQueue
+
+	mu sync.Mutex
+	// the batches waiting for their turn, by duration
+	pending map[time.Duration]*batch
+}
+
+// batch is a cycle shared by measurements, of the union of their PIDs, and
+// abandoned once all of them are.
+type batch struct {
+	pids []int
+	// the measurements, and those not abandoned
+	members, active int
+	ctx             context.Context
+	cancel          context.CancelFunc
+
+	done    chan struct{}
+	results []wss.Result
+	err     error
+}
+
+func (m *measurer) measure(ctx context.Context, pids []int, d time.Duration) ([]wss.Result, error) {
+	m.mu.Lock()
+	b, ok := m.pending[d]
+	if !ok {
+		b = &batch{done: make(chan struct{})}
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+		if m.pending == nil {
+			m.pending = make(map[time.Duration]*batch)
+		}
+		m.pending[d] = b
+		go m.run(b, d)
+	}
+	b.pids = append(b.pids, pids...)
+	b.members++
+	b.active++
+	m.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if b.active--; b.active == 0 {
+			if m.pending[d] == b {
+				delete(m.pending, d)
+			}
+			b.cancel()
+		}
+	})
+	defer stop()
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var results []wss.Result
+	for _, res := range b.results {
+		if slices.Contains(pids, res.PID) {
+			results = append(results, res)
+		}
+	}
+	return results, ownErrors(b.err, pids)
+}
+
+// run measures the batch b once its turn comes, no more measurements joining
+// it then.
+func (m *measurer) run(b *batch, d time.Duration) {
+	defer close(b.done)
+	defer b.cancel()
+	release, err := m.queue.acquire(b.ctx)
+	m.mu.Lock()
+	if m.pending[d] == b {
+		delete(m.pending, d)
+	}
+	pids := slices.Compact(slices.Sorted(slices.Values(b.pids)))
+	members := b.members
+	m.mu.Unlock()
+	if err != nil {
+		b.err = err
+		return
+	}
+	defer release()
+	if members > 1 {
+		slog.Debug("Sharing a cycle", "measurements", members, "pids", len(pids), "duration", d)
+	}
+	b.results, b.err = m.scanner.MeasureAllContext(b.ctx, pids, d)
+}
+
+// ownErrors returns the errors of err of a shared cycle but those of the
+// processes of the other measurements which exited.
+func ownErrors(err error, pids []int) error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return err
+	}
+	var errs []error
+	for _, err := range joined.Unwrap() {
+		var exited *wss.ExitedError
+		if errors.As(err, &exited) && !slices.Contains(pids, exited.PID) {
+			continue
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// measureTargets measures the processes of sel during d, and returns their
+// results, labeled, the totals of the groups of sel, and the number of
+// processes which could not be measured, eg, exited.
+func (m *measurer) measureTargets(ctx context.Context, sel *selector, d time.Duration) (results, sums []wss.Result, failed int, err error) {
+	pids, err := sel.resolve()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	results, err = m.measure(ctx, pids, d)
+	if ctx.Err() != nil {
+		return nil, nil, 0, ctx.Err()
+	}
+	if err != nil && len(results) == 0 {
+		return nil, nil, 0, err
+	}
+	for i := range results {
+		results[i].Labels = sel.labels(results[i].PID)
+	}
+	return results, totals(sel.groups, results), len(pids) - len(results), nil
+}
+
+// measureRequest is an on-demand measurement: of the process pid, and its
+// descendants with children, and/or the processes of the cgroup, during
+// duration seconds.
+type measureRequest struct {
+	pid      int
+	cgroup   string
+	duration float64
+	children bool
+}
+
+// target returns the selector of the targets of req, and the measurement
+// duration, default 1 second.
+func (req measureRequest) target() (*selector, time.Duration, error) {
+	if req.pid < 0 || req.pid == 0 && req.cgroup == "" {
+		return nil, 0, fmt.Errorf("Expected a pid or a cgroup")
+	}
+	if req.children && req.pid == 0 {
+		return nil, 0, fmt.Errorf("Children needs a pid")
+	}
+	if req.duration == 0 {
+		req.duration = 1
+	}
+	if req.duration < 0.01 {
+		return nil, 0, fmt.Errorf("Duration too short")
+	}
+	sel := &selector{cgroup: req.cgroup, children: req.children}
+	if req.pid != 0 {
+		sel.pids = pidList{req.pid}
+	}
+	return sel, time.Duration(req.duration * float64(time.Second)), nil
+}
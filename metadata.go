@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// METADATA_REFRESH is the least time between two listings of the pods and
+// containers of the CRI runtime, for those not known yet
+const METADATA_REFRESH = 30 * time.Second
+
+// containerMetadata labels the results of the processes running in
+// containers with their pod and container, from their cgroup path and the
+// CRI runtime on endpoint, listed again when an unknown one shows up.
+type containerMetadata struct {
+	endpoint string
+
+	mu sync.Mutex
+	// by UID, and by ID
+	sandboxes  map[string]wss.CRISandbox
+	containers map[string]wss.CRIContainer
+	listed     time.Time
+}
+
+func newContainerMetadata(endpoint string) *containerMetadata {
+	return &containerMetadata{endpoint: endpoint}
+}
+
+// labels returns the labels of the container pid runs in, if any: its
+// container_id and pod_uid, from its cgroup path, and its container, pod and
+// namespace, once known to the CRI runtime.
+func (m *containerMetadata) labels(pid int) map[string]string {
+	path, err := wss.ProcessCgroup(pid)
+	if err != nil {
+		return nil
+	}
+	podUID, id := wss.CgroupContainer(path)
+	if podUID == "" && id == "" {
+		return nil
+	}
+	labels := make(map[string]string)
+	if id != "" {
+		labels["container_id"] = shortID(id)
+	}
+	if podUID != "" {
+		labels["pod_uid"] = podUID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctr, ok := m.containers[id]
+	if id != "" && !ok || podUID != "" && m.sandboxes[podUID].UID == "" {
+		m.list()
+		ctr = m.containers[id]
+	}
+	if ctr.Name != "" {
+		labels["container"] = ctr.Name
+	}
+	sb := m.sandboxes[podUID]
+	if sb.UID == "" && ctr.SandboxID != "" {
+		// the pod UID isn't in the cgroup path of every runtime
+		for _, s := range m.sandboxes {
+			if s.ID == ctr.SandboxID {
+				sb = s
+				labels["pod_uid"] = s.UID
+			}
+		}
+	}
+	if sb.UID != "" {
+		labels["namespace"] = sb.Namespace
+		labels["pod"] = sb.Name
+	}
+	return labels
+}
+
+// list lists the pods and containers of the CRI runtime again, at most every
+// METADATA_REFRESH.
+func (m *containerMetadata) list() {
+	if time.Since(m.listed) < METADATA_REFRESH {
+		return
+	}
+	m.listed = time.Now()
+	client := wss.NewCRIClient(m.endpoint)
+	sandboxes, err := client.ListPodSandbox()
+	if err != nil {
+		slog.Debug("Error listing pods for their labels", "endpoint", m.endpoint, "err", err)
+		return
+	}
+	containers, err := client.ListContainers("")
+	if err != nil {
+		slog.Debug("Error listing containers for their labels", "endpoint", m.endpoint, "err", err)
+		return
+	}
+	m.sandboxes = make(map[string]wss.CRISandbox)
+	for _, sb := range sandboxes {
+		m.sandboxes[sb.UID] = sb
+	}
+	m.containers = make(map[string]wss.CRIContainer)
+	for _, ctr := range containers {
+		m.containers[ctr.ID] = ctr
+	}
+}
+
+// label adds the labels of the container of its process to res, keeping
+// those it has.
+func (m *containerMetadata) label(res *wss.Result) {
+	labels := m.labels(res.PID)
+	if len(labels) == 0 {
+		return
+	}
+	// rather than to the labels of its group, shared by its processes
+	maps.Copy(labels, res.Labels)
+	res.Labels = labels
+}
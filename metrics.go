@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// exporter keeps the results of the last measurement cycle, and exposes them
+// on /metrics in the Prometheus text exposition format, labeled with the
+// labels of each result.
+type exporter struct {
+	mu      sync.Mutex
+	results []wss.Result
+	// the last results of every schedule of the agent, by job
+	scheduled map[string][]wss.Result
+	cycles    int
+	errors    int
+	// the measurements summarized per target, by promLabels, 0 for none
+	window  time.Duration
+	history map[string]*windowSeries
+}
+
+func newExporter() *exporter {
+	return &exporter{}
+}
+
+// record replaces the results with those of a new measurement cycle, so
+// targets that are gone are no longer exported. failed is the number of
+// targets that could not be measured.
+func (e *exporter) record(results []wss.Result, failed int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.results = results
+	e.observe(results)
+	e.cycles++
+	e.errors += failed
+}
+
+// recordSchedules replaces the results of the schedules measured by a cycle
+// only, by key, keeping those of the other schedules of the agent, measured
+// in other cycles.
+func (e *exporter) recordSchedules(results map[string][]wss.Result, failed int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.scheduled == nil {
+		e.scheduled = make(map[string][]wss.Result)
+	}
+	maps.Copy(e.scheduled, results)
+	for _, k := range slices.Sorted(maps.Keys(results)) {
+		e.observe(results[k])
+	}
+	e.results = nil
+	for _, k := range slices.Sorted(maps.Keys(e.scheduled)) {
+		e.results = append(e.results, e.scheduled[k]...)
+	}
+	e.cycles++
+	e.errors += failed
+}
+
+type metric struct {
+	name, help, typ string
+	value           func(res wss.Result) float64
+}
+
+var metrics = []metric{
+	{"wss_referenced_bytes", "Bytes referenced during the last measurement, the working set size.", "gauge",
+		func(res wss.Result) float64 { return float64(res.ReferencedBytes()) }},
+	{"wss_resident_bytes", "Resident memory (RSS) at the end of the last measurement.", "gauge",
+		func(res wss.Result) float64 { return float64(res.RssPages) * float64(res.PageSize) }},
+	{"wss_hot_ratio", "Working set size as a fraction of the resident memory.", "gauge",
+		func(res wss.Result) float64 { return res.HotPercent() / 100 }},
+	{"wss_cold_bytes", "Resident bytes not referenced during the last measurement.", "gauge",
+		func(res wss.Result) float64 { return float64(res.ColdPages()) * float64(res.PageSize) }},
+	{"wss_reclaimable_bytes", "Conservative estimate of the cold bytes reclaimable without hurting the process, discounted for short measurements.", "gauge",
+		func(res wss.Result) float64 { return float64(res.ReclaimablePages()) * float64(res.PageSize) }},
+	{"wss_walked_pages", "Resident pages walked during the last measurement.", "gauge",
+		func(res wss.Result) float64 { return float64(res.WalkedPages) }},
+	{"wss_estimated_duration_seconds", "Estimated duration of the last measurement.", "gauge",
+		func(res wss.Result) float64 { return res.Est.Seconds() }},
+	{"wss_set_duration_seconds", "Time spent setting the idle page flags.", "gauge",
+		func(res wss.Result) float64 { return res.SetTime.Seconds() }},
+	{"wss_read_duration_seconds", "Time spent reading the idle page flags and walking the maps.", "gauge",
+		func(res wss.Result) float64 { return res.ReadTime.Seconds() }},
+	{"wss_overhead_cpu_seconds", "CPU time, user and system, wss spent on the last measurement.", "gauge",
+		func(res wss.Result) float64 { return res.Overhead.Total().CPUTime.Seconds() }},
+	{"wss_overhead_read_syscalls", "Read system calls wss made for the last measurement.", "gauge",
+		func(res wss.Result) float64 { return float64(res.Overhead.Total().ReadCalls) }},
+	{"wss_overhead_read_bytes", "Bytes wss read for the last measurement, from the idle bitmap, pagemaps and other kernel files.", "gauge",
+		func(res wss.Result) float64 { return float64(res.Overhead.Total().ReadBytes) }},
+	{"wss_overhead_write_syscalls", "Write system calls wss made for the last measurement.", "gauge",
+		func(res wss.Result) float64 { return float64(res.Overhead.Total().WriteCalls) }},
+	{"wss_overhead_write_bytes", "Bytes wss wrote for the last measurement, to the idle bitmap or clear_refs.", "gauge",
+		func(res wss.Result) float64 { return float64(res.Overhead.Total().WriteBytes) }},
+	{"wss_last_measurement_timestamp_seconds", "Unix time the last measurement completed.", "gauge",
+		func(res wss.Result) float64 { return float64(res.Time.UnixNano()) / 1e9 }},
+}
+
+// promLabels formats labels as a Prometheus label set, sorted by name.
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+`="`+escaper.Replace(value)+`"`)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeMetrics writes the metrics of results in the Prometheus text
+// exposition format.
+func writeMetrics(w io.Writer, results []wss.Result) {
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, res := range results {
+			fmt.Fprintf(w, "%s%s %g\n", m.name, promLabels(res.Labels), m.value(res))
+		}
+	}
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, e.results)
+	e.writeWindow(w)
+	fmt.Fprintf(w, "# HELP wss_measurement_cycles_total Measurement cycles completed.\n# TYPE wss_measurement_cycles_total counter\n")
+	fmt.Fprintf(w, "wss_measurement_cycles_total %d\n", e.cycles)
+	fmt.Fprintf(w, "# HELP wss_measurement_errors_total Targets that could not be measured.\n# TYPE wss_measurement_errors_total counter\n")
+	fmt.Fprintf(w, "wss_measurement_errors_total %d\n", e.errors)
+}
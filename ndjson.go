@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// ndjsonRecord is a line of the NDJSON output: a result, as in the API, with
+// the host, self-contained for the log shippers, eg, Fluent Bit or Vector.
+type ndjsonRecord struct {
+	Host string `json:"host"`
+	// Total is set for the totals of a group of processes, eg, a container
+	Total bool `json:"total,omitempty"`
+	apiResult
+}
+
+// ndjsonPrinter writes a JSON object per line per measurement, the -o ndjson
+// output.
+type ndjsonPrinter struct {
+	enc  *json.Encoder
+	host string
+	// comm is the command name of the processes, when not measured on this
+	// host, eg, of a snapshot
+	comm string
+}
+
+func newNDJSONPrinter(w io.Writer) *ndjsonPrinter {
+	return &ndjsonPrinter{enc: json.NewEncoder(w), host: hostname()}
+}
+
+func (p *ndjsonPrinter) banner(format string, a ...any) {}
+
+func (p *ndjsonPrinter) header() {}
+
+func (p *ndjsonPrinter) row(res wss.Result) {
+	r := newAPIResult(res)
+	if p.comm != "" && res.PID != 0 {
+		r.Comm = p.comm
+	}
+	p.enc.Encode(ndjsonRecord{Host: p.host, Total: res.PID == 0, apiResult: r})
+}
+
+func (p *ndjsonPrinter) total(res wss.Result) {
+	p.row(res)
+}
+
+func (p *ndjsonPrinter) summary(runs int, sums []summary) {}
+
+func (p *ndjsonPrinter) flush() {}
+
+// ndjsonSink appends the results of every cycle to an NDJSON file, to be
+// tailed by a log shipper.
+type ndjsonSink struct {
+	out *ndjsonPrinter
+}
+
+// newNDJSONSink returns a sink appending to the file path, or writing to
+// stdout for "-".
+func newNDJSONSink(path string) (*ndjsonSink, error) {
+	w := os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Can't open NDJSON file %s", err)
+		}
+		w = f
+	}
+	return &ndjsonSink{out: newNDJSONPrinter(w)}, nil
+}
+
+func (s *ndjsonSink) record(results []wss.Result, failed int) {
+	for _, res := range results {
+		s.out.row(res)
+	}
+}
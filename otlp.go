@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// OTLP_HISTOGRAM_BOUNDS are the bucket bounds, in MB, of the
+// wss.referenced_bytes.distribution histogram of the WSS of the targets of a
+// cycle.
+var OTLP_HISTOGRAM_BOUNDS = []float64{1, 4, 16, 64, 256, 1024, 4096, 16384}
+
+// OTLP_HEADERS_ENV is the environment variable of the headers sent with the
+// OTLP requests, name=value pairs separated by commas, as for the OTel SDKs,
+// eg, for authentication.
+const OTLP_HEADERS_ENV = "OTEL_EXPORTER_OTLP_HEADERS"
+
+// The aggregation temporality of the OTLP sums and histograms.
+const OTLP_TEMPORALITY_DELTA = 1
+
+// otlpResourceLabels are the labels of the results that are resource
+// attributes, with their OpenTelemetry semantic convention names. The other
+// labels are attributes of the data points.
+var otlpResourceLabels = map[string]string{
+	"namespace": "k8s.namespace.name",
+	"pod":       "k8s.pod.name",
+	"container": "k8s.container.name",
+}
+
+// The OTLP/JSON encoding of an ExportMetricsServiceRequest, see
+// https://github.com/open-telemetry/opentelemetry-proto. The 64 bit integers
+// are strings.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          *float64        `json:"asDouble,omitempty"`
+	AsInt             string          `json:"asInt,omitempty"`
+}
+
+type otlpHistogramDataPoint struct {
+	StartTimeUnixNano string    `json:"startTimeUnixNano"`
+	TimeUnixNano      string    `json:"timeUnixNano"`
+	Count             string    `json:"count"`
+	Sum               float64   `json:"sum"`
+	BucketCounts      []string  `json:"bucketCounts"`
+	ExplicitBounds    []float64 `json:"explicitBounds"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+}
+
+// otlpString returns the string attribute key=value.
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+// otlpNanos formats t as OTLP nanoseconds.
+func otlpNanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpUnit returns the unit of the metric name, from its suffix.
+func otlpUnit(name string) string {
+	switch {
+	case strings.HasSuffix(name, "_bytes"):
+		return "By"
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_pages"):
+		return "{page}"
+	}
+	return "1"
+}
+
+// otlpSink pushes the results of every measurement cycle to an OpenTelemetry
+// collector, over OTLP/HTTP with the JSON encoding: the metrics of /metrics
+// as gauges, named wss.referenced_bytes and so on, with a resource per pod or
+// container, and a histogram of the WSS of the targets of the cycle, with the
+// measurement counters, on the resource of the node.
+type otlpSink struct {
+	url     string
+	headers map[string]string
+	node    []otlpAttribute
+	client  *http.Client
+	// last is the end of the previous cycle, the start of the deltas
+	last time.Time
+}
+
+// newOTLPSink returns a sink pushing to the collector at url, eg,
+// http://localhost:4318, or its /v1/metrics endpoint, with the headers of
+// OTLP_HEADERS_ENV.
+func newOTLPSink(url string) (*otlpSink, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("Bad OTLP URL %s, expected http:// or https://", url)
+	}
+	if !strings.HasSuffix(url, "/v1/metrics") {
+		url = strings.TrimSuffix(url, "/") + "/v1/metrics"
+	}
+	headers := make(map[string]string)
+	if env := os.Getenv(OTLP_HEADERS_ENV); env != "" {
+		for _, pair := range strings.Split(env, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("Bad %s header %q, expected name=value", OTLP_HEADERS_ENV, pair)
+			}
+			headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	host := hostname()
+	// set from the downward API in the DaemonSet of the agent
+	node := os.Getenv("NODE_NAME")
+	if node == "" {
+		node = host
+	}
+	return &otlpSink{
+		url:     url,
+		headers: headers,
+		node:    []otlpAttribute{otlpString("service.name", "wss"), otlpString("host.name", host), otlpString("k8s.node.name", node)},
+		client:  &http.Client{Timeout: 10 * time.Second},
+		last:    time.Now(),
+	}, nil
+}
+
+// request returns the request of the results of a cycle ending at now.
+func (s *otlpSink) request(results []wss.Result, failed int, now time.Time) otlpRequest {
+	scope := otlpScope{Name: "github.com/roopakparikh/wss"}
+
+	// a resource per pod or container, in the order of the results
+	var keys []string
+	resources := make(map[string]*otlpResourceMetrics)
+	gauges := make(map[string]map[string]*otlpMetric)
+	for _, res := range results {
+		attrs := append([]otlpAttribute(nil), s.node...)
+		var points []otlpAttribute
+		if res.PID != 0 {
+			points = append(points,
+				otlpAttribute{Key: "process.pid", Value: otlpValue{IntValue: strconv.Itoa(res.PID)}},
+				otlpString("process.executable.name", wss.Comm(res.PID)))
+		}
+		var names []string
+		for name := range res.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		key := ""
+		for _, name := range names {
+			if semconv, ok := otlpResourceLabels[name]; ok {
+				attrs = append(attrs, otlpString(semconv, res.Labels[name]))
+				key += name + "=" + res.Labels[name] + ","
+			} else {
+				points = append(points, otlpString(name, res.Labels[name]))
+			}
+		}
+		rm, ok := resources[key]
+		if !ok {
+			rm = &otlpResourceMetrics{Resource: otlpResource{Attributes: attrs}}
+			resources[key] = rm
+			gauges[key] = make(map[string]*otlpMetric)
+			keys = append(keys, key)
+		}
+		for _, m := range metrics {
+			if m.name == "wss_last_measurement_timestamp_seconds" {
+				// the time of the data points
+				continue
+			}
+			g, ok := gauges[key][m.name]
+			if !ok {
+				g = &otlpMetric{
+					Name:        strings.Replace(m.name, "wss_", "wss.", 1),
+					Description: m.help,
+					Unit:        otlpUnit(m.name),
+					Gauge:       &otlpGauge{},
+				}
+				gauges[key][m.name] = g
+			}
+			v := m.value(res)
+			g.Gauge.DataPoints = append(g.Gauge.DataPoints, otlpNumberDataPoint{
+				Attributes:   points,
+				TimeUnixNano: otlpNanos(res.Time),
+				AsDouble:     &v,
+			})
+		}
+	}
+	var req otlpRequest
+	for _, key := range keys {
+		rm := resources[key]
+		sm := otlpScopeMetrics{Scope: scope}
+		for _, m := range metrics {
+			if g, ok := gauges[key][m.name]; ok {
+				sm.Metrics = append(sm.Metrics, *g)
+			}
+		}
+		rm.ScopeMetrics = []otlpScopeMetrics{sm}
+		req.ResourceMetrics = append(req.ResourceMetrics, *rm)
+	}
+
+	// the histogram and counters of the cycle, on the node
+	hist := otlpHistogramDataPoint{
+		StartTimeUnixNano: otlpNanos(s.last),
+		TimeUnixNano:      otlpNanos(now),
+		ExplicitBounds:    make([]float64, len(OTLP_HISTOGRAM_BOUNDS)),
+	}
+	counts := make([]int, len(OTLP_HISTOGRAM_BOUNDS)+1)
+	for i, bound := range OTLP_HISTOGRAM_BOUNDS {
+		hist.ExplicitBounds[i] = bound * 1024 * 1024
+	}
+	for _, res := range results {
+		ref := float64(res.ReferencedBytes())
+		counts[sort.SearchFloat64s(hist.ExplicitBounds, ref)]++
+		hist.Sum += ref
+	}
+	for _, n := range counts {
+		hist.BucketCounts = append(hist.BucketCounts, strconv.Itoa(n))
+	}
+	hist.Count = strconv.Itoa(len(results))
+	counter := func(name, description string, n int) otlpMetric {
+		return otlpMetric{
+			Name:        name,
+			Description: description,
+			Unit:        "1",
+			Sum: &otlpSum{
+				DataPoints:             []otlpNumberDataPoint{{StartTimeUnixNano: otlpNanos(s.last), TimeUnixNano: otlpNanos(now), AsInt: strconv.Itoa(n)}},
+				AggregationTemporality: OTLP_TEMPORALITY_DELTA,
+				IsMonotonic:            true,
+			},
+		}
+	}
+	req.ResourceMetrics = append(req.ResourceMetrics, otlpResourceMetrics{
+		Resource: otlpResource{Attributes: s.node},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: scope, Metrics: []otlpMetric{
+			{
+				Name:        "wss.referenced_bytes.distribution",
+				Description: "Distribution of the working set sizes of the targets measured in the cycle.",
+				Unit:        "By",
+				Histogram:   &otlpHistogram{DataPoints: []otlpHistogramDataPoint{hist}, AggregationTemporality: OTLP_TEMPORALITY_DELTA},
+			},
+			counter("wss.measurement_cycles", "Measurement cycles completed.", 1),
+			counter("wss.measurement_errors", "Targets that could not be measured.", failed),
+		}}},
+	})
+	return req
+}
+
+func (s *otlpSink) record(results []wss.Result, failed int) {
+	now := time.Now()
+	body, err := json.Marshal(s.request(results, failed, now))
+	s.last = now
+	if err != nil {
+		slog.Warn("Error pushing to OTLP", "url", s.url, "err", err)
+		return
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Error pushing to OTLP", "url", s.url, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		slog.Warn("Error pushing to OTLP", "url", s.url, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		slog.Warn("Error pushing to OTLP", "url", s.url, "status", resp.Status, "body", strings.TrimSpace(string(msg)))
+	}
+}
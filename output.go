@@ -0,0 +1,536 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// printer writes measurement results in one of the -o output formats.
+type printer interface {
+	// banner is the "Watching PID ..." line, only shown for human output
+	banner(format string, a ...any)
+	header()
+	row(res wss.Result)
+	// total is the aggregate row of a group of processes, eg, a cgroup
+	total(res wss.Result)
+	// summary is the distribution of Ref(MB) over the runs of repeat mode,
+	// only shown for human output
+	summary(runs int, sums []summary)
+	flush()
+}
+
+// printOptions are the optional parts of the human output.
+type printOptions struct {
+	// multi adds a PID column, when more than one process is measured
+	multi bool
+	// hugepages shows the referenced memory per page size
+	hugepages bool
+	// ksm shows the referenced memory merged by KSM
+	ksm bool
+	// locked shows the referenced memory mlocked or unevictable
+	locked bool
+	// zero shows the memory mapped to the shared zero page, left out of the
+	// walked memory
+	zero bool
+	// special shows the memory of the [vdso], [vvar] and [vsyscall] mappings,
+	// left out of the walk
+	special bool
+	// shared shows the referenced memory mapped once and more than once
+	shared bool
+	// sampling shows the samples of the memsample backend
+	sampling bool
+	// extended adds the Walked(MB), Swap(MB), Mapped(MB), Unmapped(MB) and
+	// Hot(%) columns
+	extended bool
+	// trend adds the EMA(MB) column, the exponential moving average of
+	// Ref(MB) with the smoothing factor alpha, and the Delta(MB) column, the
+	// change since the previous run
+	trend bool
+	alpha float64
+	// cold adds the Cold(MB) and Reclaim(MB) columns, the resident memory
+	// not referenced, and the part of it deemed reclaimable
+	cold bool
+	// watch redraws the current estimate and the last rows in place, on a
+	// terminal
+	watch bool
+	// rollup adds the Rss(MB), Pss(MB) and Referenced(MB) columns, from
+	// smaps_rollup
+	rollup bool
+	// perMap shows the referenced memory of every mapping, and perFile that
+	// of every file mapped, ranked
+	perMap, perFile bool
+	// overhead shows the CPU time and I/O of every measurement cycle, per
+	// phase
+	overhead bool
+	// interval adds the Low(MB) and High(MB) columns, the confidence
+	// interval of the Ref(MB) estimated with --sample
+	interval bool
+}
+
+// column is a column of the human output.
+type column struct {
+	name   string
+	header string // format of the name
+	format string // format of the value, of the same width
+	value  func(res wss.Result) float64
+}
+
+// mb converts pages of pagesize to Mbytes.
+func mb(pages, pagesize int) float64 {
+	return float64(pages) * float64(pagesize) / (1024 * 1024)
+}
+
+var (
+	defaultColumns = []column{
+		{"Est(s)", "%-7s", "%-7.3f", func(res wss.Result) float64 { return res.Est.Seconds() }},
+		{"Ref(MB)", "%10s", "%10.2f", func(res wss.Result) float64 { return res.ReferencedMB() }},
+	}
+	// extendedColumns are added by -x
+	extendedColumns = []column{
+		{"Walked(MB)", "%10s", "%10.2f", func(res wss.Result) float64 { return mb(res.WalkedPages, res.PageSize) }},
+		{"Swap(MB)", "%10s", "%10.2f", func(res wss.Result) float64 { return mb(res.SwappedPages, res.PageSize) }},
+		{"Mapped(MB)", "%10s", "%10.2f", func(res wss.Result) float64 { return mb(res.MappedPages, res.PageSize) }},
+		{"Unmapped(MB)", "%12s", "%12.2f", func(res wss.Result) float64 { return mb(res.UnmappedPages, res.PageSize) }},
+		{"Hot(%)", "%7s", "%7.1f", func(res wss.Result) float64 { return res.HotPercent() }},
+	}
+	// intervalColumns are added by --sample
+	intervalColumns = []column{
+		{"Low(MB)", "%10s", "%10.2f", func(res wss.Result) float64 { lo, _ := res.ActiveInterval(); return mb(lo, res.PageSize) }},
+		{"High(MB)", "%10s", "%10.2f", func(res wss.Result) float64 { _, hi := res.ActiveInterval(); return mb(hi, res.PageSize) }},
+	}
+	// coldColumns are added by --cold
+	coldColumns = []column{
+		{"Cold(MB)", "%10s", "%10.2f", func(res wss.Result) float64 { return mb(res.ColdPages(), res.PageSize) }},
+		{"Reclaim(MB)", "%11s", "%11.2f", func(res wss.Result) float64 { return mb(res.ReclaimablePages(), res.PageSize) }},
+	}
+	// rollupColumns are added by --rollup
+	rollupColumns = []column{
+		{"Rss(MB)", "%10s", "%10.2f", func(res wss.Result) float64 { return mb(res.RssPages, res.PageSize) }},
+		{"Pss(MB)", "%10s", "%10.2f", func(res wss.Result) float64 { return mb(res.PssPages, res.PageSize) }},
+		{"Referenced(MB)", "%14s", "%14.2f", func(res wss.Result) float64 { return mb(res.ReferencedPages, res.PageSize) }},
+	}
+)
+
+// newPrinter returns the printer for format.
+func newPrinter(format string, w io.Writer, opts printOptions) (printer, error) {
+	switch format {
+	case "", "text":
+		if opts.watch {
+			return newWatchPrinter(w, opts), nil
+		}
+		return &textPrinter{w: w, printOptions: opts}, nil
+	case "csv":
+		return &csvPrinter{w: csv.NewWriter(w)}, nil
+	case "influx":
+		return &influxPrinter{w: w, host: hostname()}, nil
+	case "ndjson":
+		return newNDJSONPrinter(w), nil
+	}
+	return nil, fmt.Errorf("Unknown output format %q", format)
+}
+
+// formatLabels returns the labels as sorted name=value pairs, separated by
+// commas.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+type textPrinter struct {
+	w io.Writer
+	printOptions
+	// the moving average and last Ref(MB) of every process and total, for
+	// the trend columns
+	ema  map[string]float64
+	last map[string]float64
+	// the time of the last cycle whose overhead was shown
+	lastCycle time.Time
+}
+
+func (p *textPrinter) banner(format string, a ...any) {
+	fmt.Fprintf(p.w, format+"\n", a...)
+}
+
+// columns returns the columns after the PID column.
+func (p *textPrinter) columns() []column {
+	columns := defaultColumns[:len(defaultColumns):len(defaultColumns)]
+	if p.interval {
+		columns = append(columns, intervalColumns...)
+	}
+	if p.extended {
+		columns = append(columns, extendedColumns...)
+	}
+	if p.cold {
+		columns = append(columns, coldColumns...)
+	}
+	if p.rollup {
+		columns = append(columns, rollupColumns...)
+	}
+	return columns
+}
+
+func (p *textPrinter) header() {
+	if p.multi {
+		fmt.Fprintf(p.w, "%-7s ", "PID")
+	}
+	for i, c := range p.columns() {
+		if i > 0 {
+			fmt.Fprint(p.w, " ")
+		}
+		fmt.Fprintf(p.w, c.header, c.name)
+	}
+	if p.trend {
+		fmt.Fprintf(p.w, " %10s %10s", "EMA(MB)", "Delta(MB)")
+	}
+	fmt.Fprintln(p.w)
+}
+
+// values prints the columns of res.
+func (p *textPrinter) values(res wss.Result) {
+	for i, c := range p.columns() {
+		if i > 0 {
+			fmt.Fprint(p.w, " ")
+		}
+		fmt.Fprintf(p.w, c.format, c.value(res))
+	}
+}
+
+// trends prints the trend columns of res, the result of the process or
+// total key.
+func (p *textPrinter) trends(key string, res wss.Result) {
+	if p.ema == nil {
+		p.ema = make(map[string]float64)
+		p.last = make(map[string]float64)
+	}
+	ref := res.ReferencedMB()
+	last, ok := p.last[key]
+	if !ok {
+		// the first run starts the average, and has no delta
+		p.ema[key] = ref
+		fmt.Fprintf(p.w, " %10.2f %10s", ref, "-")
+	} else {
+		p.ema[key] = p.alpha*ref + (1-p.alpha)*p.ema[key]
+		fmt.Fprintf(p.w, " %10.2f %+10.2f", p.ema[key], ref-last)
+	}
+	p.last[key] = ref
+}
+
+func (p *textPrinter) row(res wss.Result) {
+	if p.multi {
+		fmt.Fprintf(p.w, "%-7d ", res.PID)
+	}
+	p.values(res)
+	if p.trend {
+		p.trends(strconv.Itoa(res.PID), res)
+	}
+	fmt.Fprintln(p.w)
+	if len(res.Maps) > 0 && (p.perMap || !p.perFile) {
+		p.maps(res)
+	}
+	if p.perFile {
+		p.files(res)
+	}
+	if p.overhead && !res.Time.Equal(p.lastCycle) {
+		p.costs(res.Overhead)
+		p.lastCycle = res.Time
+	}
+	if res.NodePages != nil {
+		p.nodes(res)
+	}
+	if res.HugetlbfsPages > 0 {
+		p.untracked(res)
+	}
+	if p.hugepages {
+		p.pagesizes(res)
+	}
+	if p.ksm {
+		p.merged(res)
+	}
+	if p.locked {
+		p.unevictable(res)
+	}
+	if p.zero {
+		p.zeroed(res)
+	}
+	if p.special {
+		p.kernelMaps(res)
+	}
+	if p.shared {
+		p.sharing(res)
+	}
+	if p.sampling {
+		p.samples(res)
+	}
+}
+
+// pagesizes prints the referenced memory of res in base pages, transparent
+// huge pages, and hugetlb pages.
+func (p *textPrinter) pagesizes(res wss.Result) {
+	base := res.ActivePages - res.THPPages - res.HugetlbPages
+	fmt.Fprintf(p.w, "    %10s %10s %12s\n", "Base(MB)", "THP(MB)", "Hugetlb(MB)")
+	fmt.Fprintf(p.w, "    %10.2f %10.2f %12.2f\n", mb(base, res.PageSize), mb(res.THPPages, res.PageSize), mb(res.HugetlbPages, res.PageSize))
+}
+
+// nodes prints the referenced memory per NUMA node of res.
+func (p *textPrinter) nodes(res wss.Result) {
+	nodes := make([]int, 0, len(res.NodePages))
+	for node := range res.NodePages {
+		nodes = append(nodes, node)
+	}
+	sort.Ints(nodes)
+	fmt.Fprintf(p.w, "    %-7s %10s\n", "NODE", "Ref(MB)")
+	for _, node := range nodes {
+		name := strconv.Itoa(node)
+		if node < 0 {
+			name = "?"
+		}
+		fmt.Fprintf(p.w, "    %-7s %10.2f\n", name, mb(res.NodePages[node], res.PageSize))
+	}
+}
+
+// maps prints the per mapping breakdown of res, of the resident mappings.
+func (p *textPrinter) maps(res wss.Result) {
+	fmt.Fprintf(p.w, "    %-33s %-5s %10s %10s %s\n", "START-END", "PERMS", "Walked(MB)", "Ref(MB)", "PATH")
+	for _, m := range res.Maps {
+		if m.WalkedPages == 0 {
+			continue
+		}
+		fmt.Fprintf(p.w, "    %016x-%016x %-5s %10.2f %10.2f %s\n", m.Start, m.End, m.Perms, mb(m.WalkedPages, res.PageSize), mb(m.ActivePages, res.PageSize), m.Path)
+	}
+}
+
+// costs prints the overhead of a measurement cycle per phase, once per cycle.
+func (p *textPrinter) costs(o wss.Overhead) {
+	fmt.Fprintf(p.w, "    %-7s %9s %8s %9s %8s %11s\n", "PHASE", "CPU(ms)", "Reads", "Read(MB)", "Writes", "Written(MB)")
+	for _, phase := range []struct {
+		name string
+		cost wss.Cost
+	}{{"set", o.Set}, {"load", o.Load}, {"walk", o.Walk}, {"total", o.Total()}} {
+		c := phase.cost
+		fmt.Fprintf(p.w, "    %-7s %9.1f %8d %9.2f %8d %11.2f\n", phase.name, float64(c.CPUTime.Microseconds())/1000, c.ReadCalls,
+			float64(c.ReadBytes)/(1024*1024), c.WriteCalls, float64(c.WriteBytes)/(1024*1024))
+	}
+}
+
+// files prints the memory referenced, walked (resident) and mapped of every
+// file mapped by res, of all its mappings, by decreasing referenced memory.
+func (p *textPrinter) files(res wss.Result) {
+	type file struct {
+		path                   string
+		active, walked, mapped int
+	}
+	var files []*file
+	byPath := make(map[string]*file)
+	for _, m := range res.Maps {
+		if !m.Is("file") {
+			continue
+		}
+		f, ok := byPath[m.Path]
+		if !ok {
+			f = &file{path: m.Path}
+			byPath[m.Path] = f
+			files = append(files, f)
+		}
+		f.active += m.ActivePages
+		f.walked += m.WalkedPages
+		f.mapped += int(m.Size() / uint64(res.PageSize))
+	}
+	slices.SortFunc(files, func(a, b *file) int {
+		return cmp.Or(b.active-a.active, b.walked-a.walked, strings.Compare(a.path, b.path))
+	})
+	fmt.Fprintf(p.w, "    %10s %10s %10s %7s %s\n", "Ref(MB)", "Walked(MB)", "Mapped(MB)", "Hot(%)", "FILE")
+	for _, f := range files {
+		var hot float64
+		if f.walked > 0 {
+			hot = 100 * float64(f.active) / float64(f.walked)
+		}
+		fmt.Fprintf(p.w, "    %10.2f %10.2f %10.2f %7.1f %s\n", mb(f.active, res.PageSize), mb(f.walked, res.PageSize), mb(f.mapped, res.PageSize), hot, f.path)
+	}
+}
+
+func (p *textPrinter) total(res wss.Result) {
+	fmt.Fprintf(p.w, "%-7s ", "total")
+	p.values(res)
+	if p.trend {
+		p.trends("total "+formatLabels(res.Labels), res)
+	}
+	if len(res.Labels) > 0 {
+		fmt.Fprintf(p.w, "  %s", formatLabels(res.Labels))
+	}
+	fmt.Fprintln(p.w)
+	if res.NodePages != nil {
+		p.nodes(res)
+	}
+	if res.HugetlbfsPages > 0 {
+		p.untracked(res)
+	}
+	if p.hugepages {
+		p.pagesizes(res)
+	}
+	if p.ksm {
+		p.merged(res)
+	}
+	if p.locked {
+		p.unevictable(res)
+	}
+	if p.zero {
+		p.zeroed(res)
+	}
+	if p.special {
+		p.kernelMaps(res)
+	}
+	if p.shared {
+		p.sharing(res)
+	}
+	if p.sampling {
+		p.samples(res)
+	}
+}
+
+// merged prints the referenced memory of res merged by KSM.
+func (p *textPrinter) merged(res wss.Result) {
+	fmt.Fprintf(p.w, "    %10s %10s\n", "KSM(MB)", "KSM(%)")
+	var pct float64
+	if res.ActivePages > 0 {
+		pct = 100 * float64(res.KSMPages) / float64(res.ActivePages)
+	}
+	fmt.Fprintf(p.w, "    %10.2f %10.1f\n", mb(res.KSMPages, res.PageSize), pct)
+}
+
+// unevictable prints the referenced memory of res mlocked or unevictable, which
+// can't be reclaimed.
+func (p *textPrinter) unevictable(res wss.Result) {
+	fmt.Fprintf(p.w, "    %10s %10s\n", "Locked(MB)", "Locked(%)")
+	var pct float64
+	if res.ActivePages > 0 {
+		pct = 100 * float64(res.LockedPages) / float64(res.ActivePages)
+	}
+	fmt.Fprintf(p.w, "    %10.2f %10.1f\n", mb(res.LockedPages, res.PageSize), pct)
+}
+
+// untracked prints the resident memory of the hugetlbfs mappings of res,
+// whose references idle page tracking can't tell.
+func (p *textPrinter) untracked(res wss.Result) {
+	fmt.Fprintf(p.w, "    %13s\n", "Hugetlbfs(MB)")
+	fmt.Fprintf(p.w, "    %13.2f\n", mb(res.HugetlbfsPages, res.PageSize))
+}
+
+// zeroed prints the memory of res mapped to the shared zero page, read but
+// never written, out of the walked memory.
+func (p *textPrinter) zeroed(res wss.Result) {
+	fmt.Fprintf(p.w, "    %10s\n", "Zero(MB)")
+	fmt.Fprintf(p.w, "    %10.2f\n", mb(res.ZeroPages, res.PageSize))
+}
+
+// kernelMaps prints the memory of the [vdso], [vvar] and [vsyscall] mappings
+// of res, out of the walked memory.
+func (p *textPrinter) kernelMaps(res wss.Result) {
+	fmt.Fprintf(p.w, "    %12s\n", "Special(MB)")
+	fmt.Fprintf(p.w, "    %12.2f\n", mb(res.SpecialPages, res.PageSize))
+}
+
+// sharing prints the referenced memory of res mapped only once (private), and
+// more than once (shared).
+func (p *textPrinter) sharing(res wss.Result) {
+	private := res.ActivePages - res.SharedPages
+	fmt.Fprintf(p.w, "    %11s %10s\n", "Private(MB)", "Shared(MB)")
+	fmt.Fprintf(p.w, "    %11.2f %10.2f\n", mb(private, res.PageSize), mb(res.SharedPages, res.PageSize))
+}
+
+// samples prints the samples res was estimated from, the sample period, and
+// the estimated coverage of the accesses by the pages sampled.
+func (p *textPrinter) samples(res wss.Result) {
+	fmt.Fprintf(p.w, "    %10s %10s %11s\n", "Samples", "Period", "Coverage(%)")
+	fmt.Fprintf(p.w, "    %10d %10d %11.1f\n", res.Samples, res.SamplePeriod, 100*res.Coverage())
+}
+
+// summary prints the min, max, mean, median and 95th percentile of the
+// Ref(MB) of every process and total over the runs.
+func (p *textPrinter) summary(runs int, sums []summary) {
+	fmt.Fprintf(p.w, "\nRef(MB) over %d runs:\n", runs)
+	fmt.Fprintf(p.w, "%-7s %5s %10s %10s %10s %10s %10s\n", "PID", "Runs", "Min", "Max", "Mean", "Median", "P95")
+	for _, s := range sums {
+		fmt.Fprintf(p.w, "%-7s %5d %10.2f %10.2f %10.2f %10.2f %10.2f", s.pid, s.runs, s.min, s.max, s.mean, s.median, s.p95)
+		if len(s.labels) > 0 {
+			fmt.Fprintf(p.w, "  %s", formatLabels(s.labels))
+		}
+		fmt.Fprintln(p.w)
+	}
+}
+
+func (p *textPrinter) flush() {}
+
+// printAges prints the page age histogram a: the resident memory last
+// referenced within each of the ages, and not within the previous one, and
+// cumulated, eg, the WSS of 10s, then that never referenced.
+func printAges(w io.Writer, a wss.PageAges) {
+	walked := a.Walked()
+	fmt.Fprintf(w, "%-7s %10s %10s %8s\n", "AGE", "Ref(MB)", "Cum(MB)", "Cum(%)")
+	var cum int
+	for i, pages := range a.Pages {
+		age := "never"
+		if i < len(a.Bounds) {
+			age = strconv.FormatFloat(a.Bounds[i].Seconds(), 'g', -1, 64) + "s"
+		}
+		cum += pages
+		var pct float64
+		if walked > 0 {
+			pct = 100 * float64(cum) / float64(walked)
+		}
+		fmt.Fprintf(w, "%-7s %10.2f %10.2f %8.1f\n", age, mb(pages, a.PageSize), mb(cum, a.PageSize), pct)
+	}
+}
+
+// csvPrinter writes one row per measurement, so results can be appended to
+// files and loaded into analysis tools.
+type csvPrinter struct {
+	w *csv.Writer
+}
+
+func (p *csvPrinter) banner(format string, a ...any) {}
+
+func (p *csvPrinter) header() {
+	p.w.Write([]string{"timestamp", "pid", "est_s", "ref_mb", "walked_pages", "swapped_pages", "labels"})
+	p.w.Flush()
+}
+
+func (p *csvPrinter) row(res wss.Result) {
+	p.write(strconv.Itoa(res.PID), res)
+}
+
+func (p *csvPrinter) total(res wss.Result) {
+	p.write("total", res)
+}
+
+func (p *csvPrinter) write(pid string, res wss.Result) {
+	p.w.Write([]string{
+		res.Time.Format(time.RFC3339Nano),
+		pid,
+		strconv.FormatFloat(res.Est.Seconds(), 'f', 3, 64),
+		strconv.FormatFloat(res.ReferencedMB(), 'f', 2, 64),
+		strconv.Itoa(res.WalkedPages),
+		strconv.Itoa(res.SwappedPages),
+		formatLabels(res.Labels),
+	})
+	// flush every row, so repeat mode output can be tailed
+	p.w.Flush()
+}
+
+func (p *csvPrinter) summary(runs int, sums []summary) {}
+
+func (p *csvPrinter) flush() {
+	p.w.Flush()
+}
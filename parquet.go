@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// PARQUET_ROW_GROUP is the number of rows of a row group of the --parquet
+// files, buffered in memory until written.
+const PARQUET_ROW_GROUP = 65536
+
+// The Parquet physical types, converted types and encodings used, see
+// https://github.com/apache/parquet-format/blob/master/src/main/thrift/parquet.thrift.
+const (
+	PARQUET_INT32      = 1
+	PARQUET_INT64      = 2
+	PARQUET_DOUBLE     = 5
+	PARQUET_BYTE_ARRAY = 6
+
+	PARQUET_UTF8             = 0
+	PARQUET_TIMESTAMP_MICROS = 10
+
+	PARQUET_PLAIN = 0
+	PARQUET_RLE   = 3
+)
+
+// The Thrift compact protocol types.
+const (
+	THRIFT_I32    = 5
+	THRIFT_I64    = 6
+	THRIFT_BINARY = 8
+	THRIFT_LIST   = 9
+	THRIFT_STRUCT = 12
+)
+
+// thriftWriter encodes structs in the Thrift compact protocol, for the
+// Parquet metadata.
+type thriftWriter struct {
+	b []byte
+	// the last field id of every struct being written
+	last []int
+}
+
+func (t *thriftWriter) field(id int, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.b = append(t.b, byte(delta)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = binary.AppendVarint(t.b, int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int, v int32) {
+	t.field(id, THRIFT_I32)
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *thriftWriter) i64(id int, v int64) {
+	t.field(id, THRIFT_I64)
+	t.b = binary.AppendVarint(t.b, v)
+}
+
+func (t *thriftWriter) binary(v string) {
+	t.b = binary.AppendUvarint(t.b, uint64(len(v)))
+	t.b = append(t.b, v...)
+}
+
+func (t *thriftWriter) string(id int, v string) {
+	t.field(id, THRIFT_BINARY)
+	t.binary(v)
+}
+
+// list starts the list field id of n elements of typ, which follow.
+func (t *thriftWriter) list(id int, typ byte, n int) {
+	t.field(id, THRIFT_LIST)
+	if n < 15 {
+		t.b = append(t.b, byte(n)<<4|typ)
+	} else {
+		t.b = append(t.b, 0xf0|typ)
+		t.b = binary.AppendUvarint(t.b, uint64(n))
+	}
+}
+
+// begin starts a struct, the field id, or a list element for id 0, ended by
+// end.
+func (t *thriftWriter) begin(id int) {
+	if id != 0 {
+		t.field(id, THRIFT_STRUCT)
+	}
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.b = append(t.b, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// parquetColumn is a required column of a Parquet file, with the PLAIN
+// encoded values of the row group being written.
+type parquetColumn struct {
+	name      string
+	typ       int32
+	converted int32 // -1 for none
+	values    []byte
+}
+
+// parquetChunk is the metadata of a column chunk written.
+type parquetChunk struct {
+	offset, size int64
+}
+
+// parquetGroup is the metadata of a row group written.
+type parquetGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+// parquetWriter writes a Parquet file of a flat schema of required columns,
+// uncompressed, with a data page per column chunk. The file is only
+// readable once closed, which writes the footer.
+type parquetWriter struct {
+	w       io.WriteCloser
+	offset  int64
+	columns []parquetColumn
+	rows    int64
+	groups  []parquetGroup
+	err     error
+}
+
+func newParquetWriter(w io.WriteCloser, columns []parquetColumn) (*parquetWriter, error) {
+	p := &parquetWriter{w: w, columns: columns}
+	p.write([]byte("PAR1"))
+	return p, p.err
+}
+
+func (p *parquetWriter) write(b []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	p.err = err
+}
+
+// row adds a row of values, an int32, int64, float64 or string per column,
+// of its type.
+func (p *parquetWriter) row(values ...any) error {
+	for i, v := range values {
+		c := &p.columns[i]
+		switch v := v.(type) {
+		case int32:
+			c.values = binary.LittleEndian.AppendUint32(c.values, uint32(v))
+		case int64:
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(v))
+		case float64:
+			c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(v))
+		case string:
+			c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(v)))
+			c.values = append(c.values, v...)
+		}
+	}
+	p.rows++
+	if p.rows == PARQUET_ROW_GROUP {
+		p.flush()
+	}
+	return p.err
+}
+
+// flush writes the rows buffered as a row group.
+func (p *parquetWriter) flush() {
+	if p.rows == 0 {
+		return
+	}
+	group := parquetGroup{rows: p.rows}
+	for i := range p.columns {
+		c := &p.columns[i]
+		// the PageHeader of a DATA_PAGE
+		t := &thriftWriter{}
+		t.begin(0)
+		t.i32(1, 0)
+		t.i32(2, int32(len(c.values)))
+		t.i32(3, int32(len(c.values)))
+		t.begin(5)
+		t.i32(1, int32(p.rows))
+		t.i32(2, PARQUET_PLAIN)
+		t.i32(3, PARQUET_RLE)
+		t.i32(4, PARQUET_RLE)
+		t.end()
+		t.end()
+		chunk := parquetChunk{offset: p.offset, size: int64(len(t.b) + len(c.values))}
+		p.write(t.b)
+		p.write(c.values)
+		group.chunks = append(group.chunks, chunk)
+		c.values = c.values[:0]
+	}
+	p.groups = append(p.groups, group)
+	p.rows = 0
+}
+
+// Close writes the last row group and the footer, the FileMetaData, and
+// closes the file.
+func (p *parquetWriter) Close() error {
+	p.flush()
+	t := &thriftWriter{}
+	t.begin(0)
+	t.i32(1, 1)
+	// the schema, the root and its columns
+	t.list(2, THRIFT_STRUCT, len(p.columns)+1)
+	t.begin(0)
+	t.string(4, "schema")
+	t.i32(5, int32(len(p.columns)))
+	t.end()
+	for _, c := range p.columns {
+		t.begin(0)
+		t.i32(1, c.typ)
+		t.i32(3, 0) // REQUIRED
+		t.string(4, c.name)
+		if c.converted >= 0 {
+			t.i32(6, c.converted)
+		}
+		t.end()
+	}
+	var rows int64
+	for _, g := range p.groups {
+		rows += g.rows
+	}
+	t.i64(3, rows)
+	t.list(4, THRIFT_STRUCT, len(p.groups))
+	for _, g := range p.groups {
+		var size int64
+		t.begin(0)
+		t.list(1, THRIFT_STRUCT, len(g.chunks))
+		for i, chunk := range g.chunks {
+			c := p.columns[i]
+			t.begin(0)
+			t.i64(2, chunk.offset)
+			// the ColumnMetaData
+			t.begin(3)
+			t.i32(1, c.typ)
+			t.list(2, THRIFT_I32, 1)
+			t.b = binary.AppendVarint(t.b, PARQUET_PLAIN)
+			t.list(3, THRIFT_BINARY, 1)
+			t.binary(c.name)
+			t.i32(4, 0) // UNCOMPRESSED
+			t.i64(5, g.rows)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.end()
+			t.end()
+			size += chunk.size
+		}
+		t.i64(2, size)
+		t.i64(3, g.rows)
+		t.end()
+	}
+	t.string(6, "wss")
+	t.end()
+	p.write(t.b)
+	p.write(binary.LittleEndian.AppendUint32(nil, uint32(len(t.b))))
+	p.write([]byte("PAR1"))
+	if err := p.w.Close(); p.err == nil {
+		p.err = err
+	}
+	return p.err
+}
+
+// mappingKind returns the most specific of the MAPPING_KINDS of m.
+func mappingKind(m wss.Mapping) string {
+	for _, kind := range []string{"heap", "stack", "shmem", "file", "anon"} {
+		if m.Is(kind) {
+			return kind
+		}
+	}
+	return ""
+}
+
+// parquetSink writes the mappings walked by every measurement to a Parquet
+// file, a row per mapping of every process, for analysis across a fleet
+// with the usual data tools.
+type parquetSink struct {
+	w      *parquetWriter
+	path   string
+	host   string
+	target string
+}
+
+// newParquetSink creates the Parquet file path, for the results of target.
+func newParquetSink(path, target string) (*parquetSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't create Parquet file %s", err)
+	}
+	str := func(name string) parquetColumn {
+		return parquetColumn{name: name, typ: PARQUET_BYTE_ARRAY, converted: PARQUET_UTF8}
+	}
+	i64 := func(name string) parquetColumn {
+		return parquetColumn{name: name, typ: PARQUET_INT64, converted: -1}
+	}
+	w, err := newParquetWriter(f, []parquetColumn{
+		{name: "time", typ: PARQUET_INT64, converted: PARQUET_TIMESTAMP_MICROS},
+		str("host"),
+		str("target"),
+		{name: "pid", typ: PARQUET_INT32, converted: -1},
+		str("comm"),
+		str("labels"),
+		{name: "duration_seconds", typ: PARQUET_DOUBLE, converted: -1},
+		i64("start_address"),
+		i64("end_address"),
+		str("perms"),
+		i64("file_offset"),
+		str("path"),
+		str("kind"),
+		i64("size_bytes"),
+		i64("walked_bytes"),
+		i64("referenced_bytes"),
+	})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Can't write Parquet file %s", err)
+	}
+	return &parquetSink{w: w, path: path, host: hostname(), target: target}, nil
+}
+
+func (s *parquetSink) record(results []wss.Result, failed int) {
+	for _, res := range results {
+		// the totals have no mappings
+		if len(res.Maps) == 0 {
+			continue
+		}
+		comm := wss.Comm(res.PID)
+		labels := formatLabels(res.Labels)
+		pagesize := int64(res.PageSize)
+		for _, m := range res.Maps {
+			err := s.w.row(res.Time.UnixMicro(), s.host, s.target, int32(res.PID), comm, labels, res.Est.Seconds(),
+				int64(m.Start), int64(m.End), m.Perms, int64(m.Offset), m.Path, mappingKind(m),
+				int64(m.Size()), int64(m.WalkedPages)*pagesize, int64(m.ActivePages)*pagesize)
+			if err != nil {
+				slog.Warn("Error writing the Parquet file", "path", s.path, "err", err)
+				return
+			}
+		}
+	}
+}
+
+// Close completes the Parquet file.
+func (s *parquetSink) Close() error {
+	if err := s.w.Close(); err != nil {
+		return fmt.Errorf("Can't write Parquet file %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// thriftStruct is a struct decoded from the Thrift compact protocol, its
+// values by field id: int64, string, []any or thriftStruct.
+type thriftStruct map[int]any
+
+// thriftReader decodes the Thrift compact protocol written by thriftWriter.
+type thriftReader struct {
+	b   []byte
+	err error
+}
+
+func (r *thriftReader) byte() byte {
+	if len(r.b) == 0 {
+		r.err = fmt.Errorf("short Thrift data")
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = fmt.Errorf("bad Thrift varint")
+		r.b = nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = fmt.Errorf("bad Thrift varint")
+		r.b = nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case THRIFT_I32, THRIFT_I64:
+		return r.varint()
+	case THRIFT_BINARY:
+		n := r.uvarint()
+		if uint64(len(r.b)) < n {
+			r.err = fmt.Errorf("short Thrift binary")
+			r.b = nil
+			return ""
+		}
+		s := string(r.b[:n])
+		r.b = r.b[n:]
+		return s
+	case THRIFT_LIST:
+		header := r.byte()
+		n := uint64(header >> 4)
+		if n == 15 {
+			n = r.uvarint()
+		}
+		var list []any
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			list = append(list, r.value(header&0x0f))
+		}
+		return list
+	case THRIFT_STRUCT:
+		return r.structure()
+	}
+	r.err = fmt.Errorf("unexpected Thrift type %d", typ)
+	return nil
+}
+
+func (r *thriftReader) structure() thriftStruct {
+	s := thriftStruct{}
+	id := 0
+	for r.err == nil {
+		header := r.byte()
+		if header == 0 {
+			break
+		}
+		if delta := int(header >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int(r.varint())
+		}
+		s[id] = r.value(header & 0x0f)
+	}
+	return s
+}
+
+// readParquet reads back the Parquet file path: it checks its magic bytes and
+// footer length, and returns its FileMetaData.
+func readParquet(t *testing.T, path string) ([]byte, thriftStruct) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 12 || string(b[:4]) != "PAR1" || string(b[len(b)-4:]) != "PAR1" {
+		t.Fatalf("no PAR1 magic bytes around the %d bytes of the file", len(b))
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	if n <= 0 || n > len(b)-12 {
+		t.Fatalf("footer length %d of a file of %d bytes", n, len(b))
+	}
+	r := &thriftReader{b: b[len(b)-8-n : len(b)-8]}
+	meta := r.structure()
+	if r.err != nil || len(r.b) != 0 {
+		t.Fatalf("bad FileMetaData, %d bytes left: %v", len(r.b), r.err)
+	}
+	return b, meta
+}
+
+// columnValues returns the PLAIN encoded values of the column chunk of the
+// ColumnChunk cc of file b, after the PageHeader of its data page.
+func columnValues(t *testing.T, b []byte, cc thriftStruct, rows int64) []byte {
+	t.Helper()
+	md := cc[3].(thriftStruct)
+	offset, size := md[9].(int64), md[7].(int64)
+	if offset != cc[2].(int64) || offset < 4 || offset+size > int64(len(b)) {
+		t.Fatalf("column chunk at %d of %d bytes", offset, size)
+	}
+	r := &thriftReader{b: b[offset : offset+size]}
+	header := r.structure()
+	if r.err != nil {
+		t.Fatalf("bad PageHeader: %v", r.err)
+	}
+	dp := header[5].(thriftStruct)
+	if header[1] != int64(0) || header[2] != int64(len(r.b)) || header[3] != int64(len(r.b)) || dp[1] != rows || dp[2] != int64(PARQUET_PLAIN) {
+		t.Fatalf("PageHeader %v of a page of %d bytes", header, len(r.b))
+	}
+	return r.b
+}
+
+func TestParquetWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maps.parquet")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newParquetWriter(f, []parquetColumn{
+		{name: "time", typ: PARQUET_INT64, converted: PARQUET_TIMESTAMP_MICROS},
+		{name: "pid", typ: PARQUET_INT32, converted: -1},
+		{name: "path", typ: PARQUET_BYTE_ARRAY, converted: PARQUET_UTF8},
+		{name: "duration_seconds", typ: PARQUET_DOUBLE, converted: -1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.row(int64(1700000000000000), int32(181), "/usr/lib/libc.so.6", 0.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.row(int64(1700000001000000), int32(182), "", 1.25); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, meta := readParquet(t, path)
+	if meta[1] != int64(1) || meta[3] != int64(2) || meta[6] != "wss" {
+		t.Errorf("FileMetaData version %v, rows %v, created by %v", meta[1], meta[3], meta[6])
+	}
+	var schema []string
+	for _, e := range meta[2].([]any) {
+		s := e.(thriftStruct)
+		schema = append(schema, fmt.Sprint(s[4], " ", s[1], " ", s[3], " ", s[5], " ", s[6]))
+	}
+	wantSchema := []string{
+		"schema <nil> <nil> 4 <nil>",
+		"time 2 0 <nil> 10",
+		"pid 1 0 <nil> <nil>",
+		"path 6 0 <nil> 0",
+		"duration_seconds 5 0 <nil> <nil>",
+	}
+	if !reflect.DeepEqual(schema, wantSchema) {
+		t.Errorf("schema %q, want %q", schema, wantSchema)
+	}
+
+	groups := meta[4].([]any)
+	if len(groups) != 1 {
+		t.Fatalf("%d row groups, want 1", len(groups))
+	}
+	group := groups[0].(thriftStruct)
+	chunks := group[1].([]any)
+	if group[3] != int64(2) || len(chunks) != 4 {
+		t.Fatalf("row group of %v rows and %d column chunks", group[3], len(chunks))
+	}
+	names := []string{"time", "pid", "path", "duration_seconds"}
+	var size int64
+	var values [][]byte
+	for i, c := range chunks {
+		cc := c.(thriftStruct)
+		md := cc[3].(thriftStruct)
+		if !reflect.DeepEqual(md[3], []any{names[i]}) || md[5] != int64(2) || md[4] != int64(0) {
+			t.Errorf("ColumnMetaData %v of column %d", md, i)
+		}
+		size += md[7].(int64)
+		values = append(values, columnValues(t, b, cc, 2))
+	}
+	if group[2] != size {
+		t.Errorf("row group of %v bytes, want %d", group[2], size)
+	}
+	le := binary.LittleEndian
+	want := [][]byte{
+		le.AppendUint64(le.AppendUint64(nil, 1700000000000000), 1700000001000000),
+		le.AppendUint32(le.AppendUint32(nil, 181), 182),
+		le.AppendUint32(append(le.AppendUint32(nil, 18), "/usr/lib/libc.so.6"...), 0),
+		le.AppendUint64(le.AppendUint64(nil, math.Float64bits(0.5)), math.Float64bits(1.25)),
+	}
+	for i := range want {
+		if !bytes.Equal(values[i], want[i]) {
+			t.Errorf("values of column %d % x, want % x", i, values[i], want[i])
+		}
+	}
+}
+
+func TestParquetWriterRowGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maps.parquet")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newParquetWriter(f, []parquetColumn{{name: "pid", typ: PARQUET_INT32, converted: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < PARQUET_ROW_GROUP+10; i++ {
+		if err := w.row(int32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, meta := readParquet(t, path)
+	if meta[3] != int64(PARQUET_ROW_GROUP+10) {
+		t.Errorf("%v rows, want %d", meta[3], PARQUET_ROW_GROUP+10)
+	}
+	groups := meta[4].([]any)
+	if len(groups) != 2 {
+		t.Fatalf("%d row groups, want 2", len(groups))
+	}
+	first := int32(0)
+	for i, rows := range []int64{PARQUET_ROW_GROUP, 10} {
+		group := groups[i].(thriftStruct)
+		if group[3] != rows {
+			t.Errorf("row group %d of %v rows, want %d", i, group[3], rows)
+		}
+		values := columnValues(t, b, group[1].([]any)[0].(thriftStruct), rows)
+		if len(values) != int(rows)*4 || int32(binary.LittleEndian.Uint32(values)) != first {
+			t.Errorf("row group %d of %d bytes of values, from %d", i, len(values), int32(binary.LittleEndian.Uint32(values)))
+		}
+		first += int32(rows)
+	}
+}
+
+func TestParquetWriterEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maps.parquet")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newParquetWriter(f, []parquetColumn{{name: "pid", typ: PARQUET_INT32, converted: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, meta := readParquet(t, path)
+	if meta[3] != int64(0) || len(meta[4].([]any)) != 0 {
+		t.Errorf("empty file of %v rows, row groups %v", meta[3], meta[4])
+	}
+}
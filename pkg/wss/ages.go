@@ -0,0 +1,89 @@
+package wss
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// PageAges is the recency distribution of the resident pages of a process:
+// how long ago they were last referenced.
+type PageAges struct {
+	PID      int
+	PageSize int
+	Time     time.Time // when the last window ended
+	// Bounds are the ages, increasing, eg, 1s, 10s and 60s
+	Bounds []time.Duration
+	// Pages are the resident pages referenced within each of the Bounds, and
+	// not within the previous one, and last, those not referenced within
+	// the last one, or never
+	Pages []int
+}
+
+// Walked is the number of resident pages walked.
+func (a PageAges) Walked() int {
+	var walked int
+	for _, pages := range a.Pages {
+		walked += pages
+	}
+	return walked
+}
+
+// Ages is AgesContext, without a context.
+func (s *Scanner) Ages(pid int, bounds []time.Duration) (PageAges, error) {
+	return s.AgesContext(context.Background(), pid, bounds)
+}
+
+// AgesContext measures the page ages of pid, in consecutive windows ending
+// at the bounds before the end of the last one, eg, for 1s, 10s and 60s, of
+// 50s, 9s and 1s, without forgetting the pages referenced in the previous
+// windows: each page has the age of the last window it was referenced in.
+// The ages are those of the pages resident at the end, by their virtual
+// address. As CaptureContext, it needs BACKEND_IDLE or BACKEND_SOFTDIRTY.
+func (s *Scanner) AgesContext(ctx context.Context, pid int, bounds []time.Duration) (PageAges, error) {
+	ages := PageAges{PID: pid, PageSize: os.Getpagesize(), Bounds: bounds, Pages: make([]int, len(bounds)+1)}
+	for i, bound := range bounds {
+		if bound <= 0 || i > 0 && bound <= bounds[i-1] {
+			return ages, fmt.Errorf("Bad ages, expected increasing durations")
+		}
+	}
+	pagesize := uint64(ages.PageSize)
+	// the window each page was last referenced in, by address
+	last := make(map[uint64]int)
+	var snap *Snapshot
+	for w := len(bounds) - 1; w >= 0; w-- {
+		d := bounds[w]
+		if w > 0 {
+			d -= bounds[w-1]
+		}
+		var err error
+		if snap, err = s.CaptureContext(ctx, pid, d); err != nil {
+			return ages, err
+		}
+		for _, ms := range snap.Maps {
+			for i, word := range ms.Referenced {
+				for bit := 0; word != 0; bit++ {
+					if word&1 != 0 {
+						last[ms.Start+uint64(i*64+bit)*pagesize] = w
+					}
+					word >>= 1
+				}
+			}
+		}
+	}
+	for _, ms := range snap.Maps {
+		for i, e := range ms.Pagemap {
+			if pagemapEntry(e).pfn() == 0 {
+				continue // not resident, or the PFNs are hidden
+			}
+			if w, ok := last[ms.Start+uint64(i)*pagesize]; ok {
+				ages.Pages[w]++
+			} else {
+				ages.Pages[len(bounds)]++
+			}
+		}
+	}
+	ages.Time = snap.Result.Time
+	return ages, nil
+}
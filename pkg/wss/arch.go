@@ -0,0 +1,70 @@
+package wss
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// USER_SPACE_ENDS are the ends of the user address space of the
+// architectures, by the machine of uname(2), TASK_SIZE with the largest
+// virtual addresses their kernels support, above which the mappings are of
+// the kernel, eg, the [vsyscall] of x86_64, or the [vectors] of arm. The 32
+// bit tasks of a 64 bit kernel have a smaller TASK_SIZE, all their mappings
+// are below it.
+var USER_SPACE_ENDS = map[string]uint64{
+	// 5-level paging, 57 bit addresses, 1<<47 with 4 levels
+	"x86_64": 1<<56 - 4096,
+	// 52 bit VAs
+	"aarch64":    1 << 52,
+	"aarch64_be": 1 << 52,
+	// Sv57
+	"riscv64": 1 << 56,
+	// 4 PB
+	"ppc64":   1 << 52,
+	"ppc64le": 1 << 52,
+	// the 3G/1G split of CONFIG_PAGE_OFFSET by default, i386 to i686, and
+	// armv5tel to armv7l
+	"i386": 0xc0000000,
+	"arm":  0xc0000000,
+}
+
+// userSpaceEnd returns the end of the user address space of the running
+// kernel, rather than of the architecture wss is built for, eg, a 386 build
+// on a x86_64 kernel, or else the 64 bit address space halved, the upper half
+// being the kernel's on the others. The kernel of s390x has its own address
+// space, none of its mappings are in those of the processes. Without the
+// machine, the addresses aren't clipped.
+var userSpaceEnd = sync.OnceValue(func() uint64 {
+	machine, err := kernelMachine()
+	if err != nil {
+		return math.MaxUint64
+	}
+	switch {
+	case len(machine) == 4 && machine[0] == 'i' && strings.HasSuffix(machine, "86"):
+		machine = "i386"
+	case strings.HasPrefix(machine, "arm"):
+		machine = "arm"
+	}
+	if end, ok := USER_SPACE_ENDS[machine]; ok {
+		return end
+	}
+	return 1 << 63
+})
+
+// kernelMachine returns the machine of the running kernel, eg, x86_64.
+func kernelMachine() (string, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, c := range uts.Machine {
+		if c == 0 {
+			break
+		}
+		b.WriteByte(byte(c))
+	}
+	return b.String(), nil
+}
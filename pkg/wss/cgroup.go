@@ -0,0 +1,267 @@
+package wss
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// from include/uapi/linux/magic.h
+	CGROUP_SUPER_MAGIC  = 0x27e0eb
+	CGROUP2_SUPER_MAGIC = 0x63677270
+
+	MOUNTINFO_PATH = "/proc/self/mountinfo"
+)
+
+var (
+	// the pod<UID> of the cgroup of a pod, with underscores with the
+	// systemd cgroup driver
+	cgroupPodUID = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+	// the ID of the cgroup of a container, eg, cri-containerd-ID.scope,
+	// crio-ID.scope, docker-ID.scope, libpod-ID.scope, or ID alone
+	cgroupContainerID = regexp.MustCompile(`(?:^|-)([0-9a-f]{64})(?:\.scope)?$`)
+)
+
+// ErrReclaimShort is returned by CgroupReclaim when the kernel reclaimed less
+// than requested, eg, as the memory was used again meanwhile.
+var ErrReclaimShort = errors.New("Reclaimed less than requested")
+
+// CgroupVersion returns the cgroup hierarchy version, 1 or 2, of the cgroup
+// directory path, from the type of the filesystem it is on.
+func CgroupVersion(path string) (int, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, fmt.Errorf("Can't read cgroup %w", err)
+	}
+	switch st.Type {
+	case CGROUP2_SUPER_MAGIC:
+		return 2, nil
+	case CGROUP_SUPER_MAGIC:
+		return 1, nil
+	}
+	return 0, fmt.Errorf("%s is not a cgroup directory", path)
+}
+
+// CgroupMounts returns the mount points of the cgroup v2 hierarchy and of the
+// cgroup v1 memory controller, either of which may be "" when not mounted. On
+// hybrid hierarchies both are mounted.
+func CgroupMounts() (v2, v1memory string, err error) {
+	f, err := os.Open(MOUNTINFO_PATH)
+	if err != nil {
+		return "", "", fmt.Errorf("Can't read mountinfo %w", err)
+	}
+	defer f.Close()
+	linescanner := bufio.NewScanner(f)
+	for linescanner.Scan() {
+		// 36 35 0:30 / /sys/fs/cgroup/memory rw,relatime shared:16 - cgroup cgroup rw,memory
+		fields := strings.Fields(linescanner.Text())
+		sep := slices.Index(fields, "-")
+		if sep < 5 || sep+3 >= len(fields) {
+			continue
+		}
+		mountpoint, fstype, options := fields[4], fields[sep+1], fields[sep+3]
+		switch {
+		case fstype == "cgroup2" && v2 == "":
+			v2 = mountpoint
+		case fstype == "cgroup" && v1memory == "" && slices.Contains(strings.Split(options, ","), "memory"):
+			v1memory = mountpoint
+		}
+	}
+	return v2, v1memory, linescanner.Err()
+}
+
+// ResolveCgroup returns the directory of the cgroup path. Absolute paths are
+// used as is, others are taken relative to the mounted hierarchy: the cgroup
+// v2 one if the cgroup exists there, else the v1 memory controller one.
+func ResolveCgroup(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	v2, v1memory, err := CgroupMounts()
+	if err != nil {
+		return "", err
+	}
+	for _, mount := range []string{v2, v1memory} {
+		if mount == "" {
+			continue
+		}
+		dir := filepath.Join(mount, path)
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("Can't find cgroup %s in the mounted hierarchies (v2 %q, v1 memory %q)", path, v2, v1memory)
+}
+
+// ProcessCgroup returns the directory of the cgroup pid belongs to, from
+// /proc/PID/cgroup. The v1 memory controller cgroup is preferred when it is
+// mounted, as that is where memory is accounted on hybrid hierarchies.
+func ProcessCgroup(pid int) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", fmt.Errorf("Can't read cgroup of PID %d %w", pid, err)
+	}
+	defer f.Close()
+	v2, v1memory, err := CgroupMounts()
+	if err != nil {
+		return "", err
+	}
+	var unified, memory string
+	linescanner := bufio.NewScanner(f)
+	for linescanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(linescanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			unified = fields[2]
+		} else if slices.Contains(strings.Split(fields[1], ","), "memory") {
+			memory = fields[2]
+		}
+	}
+	if err := linescanner.Err(); err != nil {
+		return "", fmt.Errorf("Error reading cgroup of PID %d %w", pid, err)
+	}
+	switch {
+	case memory != "" && v1memory != "":
+		return filepath.Join(v1memory, memory), nil
+	case unified != "" && v2 != "":
+		return filepath.Join(v2, unified), nil
+	}
+	return "", fmt.Errorf("Can't find the cgroup of PID %d in the mounted hierarchies", pid)
+}
+
+// CgroupContainer returns the pod UID and the container ID of the cgroup
+// path of a container, eg,
+// /kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<UID>.slice/cri-containerd-<ID>.scope
+// with the systemd cgroup driver, /kubepods/burstable/pod<UID>/<ID> with
+// cgroupfs, or /system.slice/docker-<ID>.scope outside of Kubernetes, each
+// "" if path isn't of one.
+func CgroupContainer(path string) (podUID, containerID string) {
+	if m := cgroupContainerID.FindStringSubmatch(filepath.Base(path)); m != nil {
+		containerID = m[1]
+	}
+	if m := cgroupPodUID.FindStringSubmatch(path); m != nil {
+		podUID = strings.ReplaceAll(m[1], "_", "-")
+	}
+	return podUID, containerID
+}
+
+// CgroupMembers returns the PIDs of the processes in the cgroup directory path
+// and its descendants, from whichever hierarchy version path belongs to.
+func CgroupMembers(path string) ([]int, error) {
+	version, err := CgroupVersion(path)
+	if err != nil {
+		return nil, err
+	}
+	if version == 1 {
+		return CgroupV1Tasks(path)
+	}
+	return CgroupProcs(path)
+}
+
+// CgroupV1Tasks returns the PIDs of the processes in the cgroup v1 directory
+// path, eg, of the memory controller, and of all its descendant cgroups. The
+// tasks files list threads, which are mapped to their process.
+func CgroupV1Tasks(path string) ([]int, error) {
+	tids, err := cgroupPids(path, "tasks")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	var pids []int
+	for _, tid := range tids {
+		pid := Tgid(tid)
+		if pid == 0 || seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// CgroupProcs returns the PIDs of the processes in the cgroup v2 directory
+// path and all of its descendant cgroups, read from their cgroup.procs files.
+func CgroupProcs(path string) ([]int, error) {
+	return cgroupPids(path, "cgroup.procs")
+}
+
+// cgroupPids reads the PIDs listed in the file named procs of the cgroup
+// directory path and of all its descendants.
+func cgroupPids(path, procs string) ([]int, error) {
+	if _, err := os.Stat(filepath.Join(path, procs)); err != nil {
+		return nil, fmt.Errorf("Can't read cgroup %w", err)
+	}
+	var pids []int
+	err := filepath.WalkDir(path, func(dir string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(filepath.Join(dir, procs))
+		if err != nil {
+			// the cgroup may have been removed since
+			return nil
+		}
+		defer f.Close()
+		linescanner := bufio.NewScanner(f)
+		for linescanner.Scan() {
+			pid, err := strconv.Atoi(linescanner.Text())
+			if err != nil {
+				return fmt.Errorf("Error parsing %s line %s", filepath.Join(dir, procs), linescanner.Text())
+			}
+			pids = append(pids, pid)
+		}
+		return linescanner.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error reading cgroup %s %w", path, err)
+	}
+	return pids, nil
+}
+
+// CgroupMemoryCurrent returns the memory charged to the cgroup v2 directory
+// path and its descendants, from memory.current, in bytes.
+func CgroupMemoryCurrent(path string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(path, "memory.current"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, unsupportedf("No memory.current in %s: proactive reclaim needs a cgroup v2 with the memory controller", path)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Can't read memory.current %w", err)
+	}
+	current, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad memory.current %w", err)
+	}
+	return current, nil
+}
+
+// CgroupReclaim has the kernel reclaim bytes from the cgroup v2 directory
+// path, by writing them to memory.reclaim (Linux 5.19+). It returns
+// ErrReclaimShort if less was reclaimed.
+func CgroupReclaim(path string, bytes uint64) error {
+	err := os.WriteFile(filepath.Join(path, "memory.reclaim"), []byte(strconv.FormatUint(bytes, 10)), 0644)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return unsupportedf("No memory.reclaim in %s: proactive reclaim needs a cgroup v2 with the memory controller, and Linux 5.19+", path)
+	case errors.Is(err, syscall.EAGAIN):
+		return fmt.Errorf("%w, %d bytes from %s", ErrReclaimShort, bytes, path)
+	case err != nil:
+		return fmt.Errorf("Can't write memory.reclaim %w", err)
+	}
+	return nil
+}
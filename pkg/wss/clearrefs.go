@@ -0,0 +1,130 @@
+package wss
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// see Documentation/filesystems/proc.rst
+const (
+	// clear the referenced and accessed bits of all the pages of a process
+	CLEAR_REFS_ALL = "1"
+	// clear the soft-dirty bits of all the pages of a process
+	CLEAR_REFS_SOFT_DIRTY = "4"
+)
+
+// The methods of finding the referenced pages, for Scanner.Backend.
+const (
+	// BACKEND_IDLE uses the idle page bitmap, and walks the pagemap
+	BACKEND_IDLE = "idle"
+	// BACKEND_CLEARREFS is the wss.pl method: the referenced bits of each
+	// process are cleared with /proc/PID/clear_refs, and the Referenced
+	// memory is read from smaps. This works without
+	// CONFIG_IDLE_PAGE_TRACKING, but only measures whole processes, and
+	// clearing the bits also affects the page reclaim of the process.
+	BACKEND_CLEARREFS = "clearrefs"
+	// BACKEND_SOFTDIRTY measures the write working set: the soft-dirty bits
+	// of each process are cleared with /proc/PID/clear_refs, and the pages
+	// written are those with the soft-dirty bit set in the pagemap. This
+	// needs CONFIG_MEM_SOFT_DIRTY.
+	BACKEND_SOFTDIRTY = "softdirty"
+)
+
+var BACKENDS = []string{BACKEND_IDLE, BACKEND_CLEARREFS, BACKEND_SOFTDIRTY, BACKEND_DAMON, BACKEND_FAULTS, BACKEND_MEMSAMPLE}
+
+// clearrefs writes value to the clear_refs file of pid.
+func clearrefs(pid int, value string) error {
+	err := os.WriteFile(fmt.Sprintf("/proc/%d/clear_refs", pid), []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("Can't write clear_refs file %w", err)
+	}
+	return nil
+}
+
+// smaps returns the sums of the kB fields of the smaps of pid, from
+// smaps_rollup (Linux 4.14+) or else smaps.
+func smaps(pid int) (map[string]int, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/smaps_rollup", pid))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(fmt.Sprintf("/proc/%d/smaps", pid))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't read smaps file %w", err)
+	}
+	defer f.Close()
+
+	fields := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// eg, "Referenced:         1234 kB"
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value, unit, ok := strings.Cut(strings.TrimSpace(value), " ")
+		if !ok || unit != "kB" {
+			continue
+		}
+		kb, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		fields[name] += kb
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Can't read smaps file %w", err)
+	}
+	return fields, nil
+}
+
+// walkrefs returns the referenced memory of pid since its referenced bits
+// were cleared, from its smaps.
+func (s *Scanner) walkrefs(pid int, d time.Duration) (Result, error) {
+	fields, err := smaps(pid)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{PID: pid, Duration: d, PageSize: os.Getpagesize()}
+	kbpages := func(kb int) int {
+		return kb * 1024 / res.PageSize
+	}
+	res.ActivePages = kbpages(fields["Referenced"])
+	res.WalkedPages = kbpages(fields["Rss"])
+	res.SwappedPages = kbpages(fields["Swap"])
+	return res, nil
+}
+
+// resident returns b, reading the resident memory of each process after
+// walking it: its RSS from statm, or with Scanner.Rollup, its Rss, Pss and
+// Referenced memory from smaps.
+func (s *Scanner) resident(b backend) backend {
+	walk := b.walk
+	b.walk = func(ctx context.Context, pid int, d time.Duration) (Result, error) {
+		res, err := walk(ctx, pid, d)
+		if err != nil {
+			return res, err
+		}
+		if !s.Rollup {
+			res.RssPages = Resident(pid)
+			return res, nil
+		}
+		fields, err := smaps(pid)
+		if err != nil {
+			return res, err
+		}
+		kbpages := func(kb int) int {
+			return kb * 1024 / res.PageSize
+		}
+		res.RssPages = kbpages(fields["Rss"])
+		res.PssPages = kbpages(fields["Pss"])
+		res.ReferencedPages = kbpages(fields["Referenced"])
+		return res, nil
+	}
+	return b
+}
@@ -0,0 +1,403 @@
+package wss
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default CRI runtime sockets, tried in order when CONTAINER_RUNTIME_ENDPOINT
+// is not set.
+var CRI_SOCKETS = []string{
+	"/run/containerd/containerd.sock",
+	"/run/crio/crio.sock",
+	"/var/run/cri-dockerd.sock",
+}
+
+// from the CRI api, runtime/v1/api.proto
+const (
+	CONTAINER_RUNNING = 1
+	SANDBOX_READY     = 0
+)
+
+// CRIEndpoint returns the CRI runtime socket, from CONTAINER_RUNTIME_ENDPOINT
+// (as used by crictl) or else the first of CRI_SOCKETS that exists.
+func CRIEndpoint() string {
+	if endpoint := os.Getenv("CONTAINER_RUNTIME_ENDPOINT"); endpoint != "" {
+		return strings.TrimPrefix(endpoint, "unix://")
+	}
+	for _, socket := range CRI_SOCKETS {
+		if _, err := os.Stat(socket); err == nil {
+			return socket
+		}
+	}
+	return CRI_SOCKETS[0]
+}
+
+// CRIClient is a minimal client of the CRI RuntimeService, the gRPC API
+// implemented by containerd and CRI-O. Only the calls needed to resolve
+// containers and pod sandboxes to processes are implemented.
+type CRIClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewCRIClient(endpoint string) *CRIClient {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", endpoint)
+		},
+	}
+	// gRPC is HTTP/2 without TLS
+	tr.Protocols = new(http.Protocols)
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	return &CRIClient{
+		endpoint: endpoint,
+		client:   &http.Client{Transport: tr, Timeout: 10 * time.Second},
+	}
+}
+
+// call makes the unary gRPC call method of the RuntimeService with the
+// encoded request message, and returns the encoded response message.
+func (c *CRIClient) call(method string, req []byte) ([]byte, error) {
+	// gRPC length-prefixed message: compressed flag, big endian length
+	body := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(req)))
+	body = append(body, req...)
+
+	httpreq, err := http.NewRequest("POST", "http://localhost/runtime.v1.RuntimeService/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpreq.Header.Set("Content-Type", "application/grpc")
+	httpreq.Header.Set("TE", "trailers")
+	resp, err := c.client.Do(httpreq)
+	if err != nil {
+		return nil, fmt.Errorf("Can't query CRI runtime %s %w", c.endpoint, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CRI %s response %w", method, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CRI %s failed: %s", method, resp.Status)
+	}
+	// the status is in the trailers, or in the headers for errors without a body
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		message, _ = url.PathUnescape(message)
+		return nil, fmt.Errorf("CRI %s failed: status %s %s", method, status, message)
+	}
+	if len(data) < 5 || data[0] != 0 {
+		return nil, fmt.Errorf("CRI %s: unexpected response", method)
+	}
+	size := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < size {
+		return nil, fmt.Errorf("CRI %s: %s", method, errProtoTruncated)
+	}
+	return data[5 : 5+size], nil
+}
+
+// CRIContainer is a container as listed by the CRI runtime.
+type CRIContainer struct {
+	ID        string
+	SandboxID string
+	Name      string
+	Image     string
+	Labels    map[string]string
+}
+
+// ListContainers returns the running containers, of the pod sandbox
+// sandboxID only unless it is "".
+func (c *CRIClient) ListContainers(sandboxID string) ([]CRIContainer, error) {
+	var filter []byte
+	filter = protoAppendBytes(filter, 2, protoAppendVarint(nil, 1, CONTAINER_RUNNING))
+	if sandboxID != "" {
+		filter = protoAppendString(filter, 3, sandboxID)
+	}
+	resp, err := c.call("ListContainers", protoAppendBytes(nil, 1, filter))
+	if err != nil {
+		return nil, err
+	}
+	var containers []CRIContainer
+	err = protoDecode(resp, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		ctr := CRIContainer{Labels: make(map[string]string)}
+		err := protoDecode(f.data, func(f protoField) error {
+			switch f.num {
+			case 1:
+				ctr.ID = string(f.data)
+			case 2:
+				ctr.SandboxID = string(f.data)
+			case 3: // metadata
+				return protoDecode(f.data, func(f protoField) error {
+					if f.num == 1 {
+						ctr.Name = string(f.data)
+					}
+					return nil
+				})
+			case 4: // image spec
+				return protoDecode(f.data, func(f protoField) error {
+					if f.num == 1 {
+						ctr.Image = string(f.data)
+					}
+					return nil
+				})
+			case 8:
+				return protoMapEntry(f.data, ctr.Labels)
+			}
+			return nil
+		})
+		containers = append(containers, ctr)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding CRI containers %w", err)
+	}
+	return containers, nil
+}
+
+// CRISandbox is a pod sandbox as listed by the CRI runtime.
+type CRISandbox struct {
+	ID        string
+	Name      string
+	UID       string
+	Namespace string
+	Labels    map[string]string
+}
+
+// ListPodSandbox returns the ready pod sandboxes.
+func (c *CRIClient) ListPodSandbox() ([]CRISandbox, error) {
+	// the ready state is 0, so an empty state value message
+	filter := protoAppendBytes(nil, 2, nil)
+	resp, err := c.call("ListPodSandbox", protoAppendBytes(nil, 1, filter))
+	if err != nil {
+		return nil, err
+	}
+	var sandboxes []CRISandbox
+	err = protoDecode(resp, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		sb := CRISandbox{Labels: make(map[string]string)}
+		err := protoDecode(f.data, func(f protoField) error {
+			switch f.num {
+			case 1:
+				sb.ID = string(f.data)
+			case 2: // metadata
+				return protoDecode(f.data, func(f protoField) error {
+					switch f.num {
+					case 1:
+						sb.Name = string(f.data)
+					case 2:
+						sb.UID = string(f.data)
+					case 3:
+						sb.Namespace = string(f.data)
+					}
+					return nil
+				})
+			case 5:
+				return protoMapEntry(f.data, sb.Labels)
+			}
+			return nil
+		})
+		sandboxes = append(sandboxes, sb)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding CRI pod sandboxes %w", err)
+	}
+	return sandboxes, nil
+}
+
+// statusPid makes a verbose ContainerStatus or PodSandboxStatus call for id,
+// and returns the PID from the runtime specific info, which both containerd
+// and CRI-O report as {"pid": N}.
+func (c *CRIClient) statusPid(method, id string) (int, error) {
+	var req []byte
+	req = protoAppendString(req, 1, id)
+	req = protoAppendVarint(req, 2, 1) // verbose
+	resp, err := c.call(method, req)
+	if err != nil {
+		return 0, err
+	}
+	info := make(map[string]string)
+	err = protoDecode(resp, func(f protoField) error {
+		if f.num == 2 {
+			return protoMapEntry(f.data, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error decoding CRI %s %w", method, err)
+	}
+	var verbose struct {
+		Pid int `json:"pid"`
+	}
+	if err := json.Unmarshal([]byte(info["info"]), &verbose); err != nil || verbose.Pid == 0 {
+		return 0, fmt.Errorf("CRI runtime did not report the PID of %s", id)
+	}
+	return verbose.Pid, nil
+}
+
+// ContainerPid returns the init PID of the container id.
+func (c *CRIClient) ContainerPid(id string) (int, error) {
+	return c.statusPid("ContainerStatus", id)
+}
+
+// SandboxPid returns the PID of the pod sandbox id, ie, of its pause process.
+func (c *CRIClient) SandboxPid(id string) (int, error) {
+	return c.statusPid("PodSandboxStatus", id)
+}
+
+// SandboxCgroup returns the pod cgroup of the sandbox id: the parent of the
+// cgroup of its pause process, which holds the cgroups of all the containers
+// of the pod.
+func (c *CRIClient) SandboxCgroup(id string) (string, error) {
+	pid, err := c.SandboxPid(id)
+	if err != nil {
+		return "", err
+	}
+	cgroup, err := ProcessCgroup(pid)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(cgroup), nil
+}
+
+// InspectCRIContainer resolves idOrName, a running container ID (or unique ID
+// prefix), container name, or pod sandbox ID, to its processes' cgroup using
+// the CRI runtime on endpoint. For a sandbox, the cgroup is the whole pod's.
+func InspectCRIContainer(endpoint, idOrName string) (Container, error) {
+	client := NewCRIClient(endpoint)
+	containers, err := client.ListContainers("")
+	if err != nil {
+		return Container{}, err
+	}
+	var found []CRIContainer
+	for _, ctr := range containers {
+		if ctr.ID == idOrName || ctr.Name == idOrName || strings.HasPrefix(ctr.ID, idOrName) {
+			found = append(found, ctr)
+		}
+	}
+	if len(found) > 1 {
+		return Container{}, fmt.Errorf("%s matches %d CRI containers", idOrName, len(found))
+	}
+	if len(found) == 1 {
+		ctr := found[0]
+		c := Container{ID: ctr.ID, Name: ctr.Name, Image: ctr.Image, SandboxID: ctr.SandboxID, Labels: ctr.Labels}
+		if c.Pid, err = client.ContainerPid(ctr.ID); err != nil {
+			return c, err
+		}
+		c.Cgroup, err = ProcessCgroup(c.Pid)
+		return c, err
+	}
+
+	sandboxes, err := client.ListPodSandbox()
+	if err != nil {
+		return Container{}, err
+	}
+	for _, sb := range sandboxes {
+		if sb.ID == idOrName || strings.HasPrefix(sb.ID, idOrName) {
+			c := Container{ID: sb.ID, Name: sb.Name, SandboxID: sb.ID, Labels: sb.Labels}
+			if c.Pid, err = client.SandboxPid(sb.ID); err != nil {
+				return c, err
+			}
+			cgroup, err := ProcessCgroup(c.Pid)
+			if err != nil {
+				return c, err
+			}
+			c.Cgroup = filepath.Dir(cgroup)
+			return c, nil
+		}
+	}
+	return Container{}, fmt.Errorf("No running CRI container or pod sandbox %s", idOrName)
+}
+
+// Pod is a Kubernetes pod resolved to its containers on this node.
+type Pod struct {
+	Namespace  string
+	Name       string
+	UID        string
+	SandboxID  string
+	Cgroup     string // the pod cgroup, parent of the containers' cgroups
+	Containers []Container
+	// of the pod sandbox, the labels of the pod
+	Labels map[string]string
+}
+
+// InspectPod resolves the pod namespace/name running on this node to its
+// pod cgroup and containers, using the CRI runtime on endpoint.
+func InspectPod(endpoint, namespace, name string) (Pod, error) {
+	client := NewCRIClient(endpoint)
+	sandboxes, err := client.ListPodSandbox()
+	if err != nil {
+		return Pod{}, err
+	}
+	for _, sb := range sandboxes {
+		if sb.Namespace == namespace && sb.Name == name {
+			return client.inspectPod(sb)
+		}
+	}
+	return Pod{}, fmt.Errorf("No pod %s/%s ready on this node", namespace, name)
+}
+
+// ListPods resolves all the pods ready on this node, using the CRI runtime on
+// endpoint. Pods that can't be resolved, eg, as they are terminating, are
+// skipped.
+func ListPods(endpoint string) ([]Pod, error) {
+	client := NewCRIClient(endpoint)
+	sandboxes, err := client.ListPodSandbox()
+	if err != nil {
+		return nil, err
+	}
+	var pods []Pod
+	for _, sb := range sandboxes {
+		pod, err := client.inspectPod(sb)
+		if err != nil {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+func (c *CRIClient) inspectPod(sb CRISandbox) (Pod, error) {
+	var err error
+	pod := Pod{Namespace: sb.Namespace, Name: sb.Name, UID: sb.UID, SandboxID: sb.ID, Labels: sb.Labels}
+	if pod.Cgroup, err = c.SandboxCgroup(sb.ID); err != nil {
+		return pod, err
+	}
+	containers, err := c.ListContainers(sb.ID)
+	if err != nil {
+		return pod, err
+	}
+	for _, ctr := range containers {
+		ct := Container{ID: ctr.ID, Name: ctr.Name, Image: ctr.Image, SandboxID: ctr.SandboxID, Labels: ctr.Labels}
+		if ct.Pid, err = c.ContainerPid(ctr.ID); err != nil {
+			return pod, err
+		}
+		if ct.Cgroup, err = ProcessCgroup(ct.Pid); err != nil {
+			return pod, err
+		}
+		pod.Containers = append(pod.Containers, ct)
+	}
+	return pod, nil
+}
@@ -0,0 +1,205 @@
+package wss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// see Documentation/admin-guide/mm/damon/usage.rst
+const (
+	DAMON_PATH = "/sys/kernel/mm/damon/admin/kdamonds"
+
+	// DAMON checks the access of a page of each region every sample interval
+	DAMON_SAMPLE_US   = 5000
+	DAMON_MIN_REGIONS = 10
+	DAMON_MAX_REGIONS = 1000
+)
+
+// BACKEND_DAMON uses DAMON, Linux 6.2+ with CONFIG_DAMON_VADDR and
+// CONFIG_DAMON_SYSFS: a kdamond monitors the regions of each process, and
+// the referenced memory is the size of the regions accessed during the
+// aggregation interval, which is the duration. DAMON samples one page of a
+// region at a time, so the cost does not grow with the size of the process,
+// but the estimate is only as fine as the regions. It measures whole
+// processes, and can't be used while DAMON is used by others.
+const BACKEND_DAMON = "damon"
+
+// damonWrite writes value to the DAMON sysfs file path, relative to
+// DAMON_PATH.
+func damonWrite(path string, value string) error {
+	err := os.WriteFile(filepath.Join(DAMON_PATH, path), []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("Can't write DAMON file %w", err)
+	}
+	return nil
+}
+
+// damonRead returns the content of the DAMON sysfs file path, relative to
+// DAMON_PATH.
+func damonRead(path string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(DAMON_PATH, path))
+	if err != nil {
+		return "", fmt.Errorf("Can't read DAMON file %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// damonStart starts a kdamond per pid, with an aggregation interval of d and
+// a scheme gathering the regions accessed during the interval.
+func damonStart(pids []int, d time.Duration) error {
+	n, err := damonRead("nr_kdamonds")
+	if errors.Is(err, os.ErrNotExist) {
+		return unsupportedf("No %s: DAMON needs Linux 6.2+ built with CONFIG_DAMON_SYSFS", DAMON_PATH)
+	}
+	if err != nil {
+		return err
+	}
+	if n != "0" {
+		return fmt.Errorf("DAMON is in use, by %s kdamonds", n)
+	}
+	if err := damonWrite("nr_kdamonds", strconv.Itoa(len(pids))); err != nil {
+		return err
+	}
+	for i, pid := range pids {
+		if err := damonWrite(fmt.Sprintf("%d/contexts/nr_contexts", i), "1"); err != nil {
+			damonStop(pids)
+			return err
+		}
+		ctx := fmt.Sprintf("%d/contexts/0/", i)
+		ops, err := damonRead(ctx + "avail_operations")
+		if err != nil {
+			damonStop(pids)
+			return err
+		}
+		if !slices.Contains(strings.Fields(ops), "vaddr") {
+			damonStop(pids)
+			return unsupportedf("DAMON virtual address monitoring is not available, only %q", ops)
+		}
+		files := [][2]string{
+			{"operations", "vaddr"},
+			{"monitoring_attrs/intervals/sample_us", strconv.Itoa(DAMON_SAMPLE_US)},
+			{"monitoring_attrs/intervals/aggr_us", strconv.FormatInt(d.Microseconds(), 10)},
+			{"monitoring_attrs/nr_regions/min", strconv.Itoa(DAMON_MIN_REGIONS)},
+			{"monitoring_attrs/nr_regions/max", strconv.Itoa(DAMON_MAX_REGIONS)},
+			{"targets/nr_targets", "1"},
+			{"targets/0/pid_target", strconv.Itoa(pid)},
+			// the stat action does nothing, but the regions it is tried on
+			// are reported: those accessed at least once, of any size and age
+			{"schemes/nr_schemes", "1"},
+			{"schemes/0/action", "stat"},
+			{"schemes/0/access_pattern/sz/min", "0"},
+			{"schemes/0/access_pattern/sz/max", strconv.FormatUint(^uint64(0), 10)},
+			{"schemes/0/access_pattern/nr_accesses/min", "1"},
+			{"schemes/0/access_pattern/nr_accesses/max", strconv.FormatUint(uint64(^uint32(0)), 10)},
+			{"schemes/0/access_pattern/age/min", "0"},
+			{"schemes/0/access_pattern/age/max", strconv.FormatUint(uint64(^uint32(0)), 10)},
+		}
+		for _, f := range files {
+			if err := damonWrite(ctx+f[0], f[1]); err != nil {
+				damonStop(pids)
+				return err
+			}
+		}
+	}
+	for i := range pids {
+		if err := damonWrite(fmt.Sprintf("%d/state", i), "on"); err != nil {
+			damonStop(pids)
+			return err
+		}
+	}
+	return nil
+}
+
+// damonUpdate waits for the end of the aggregation interval of the kdamonds
+// of pids, and has them report the regions accessed during it.
+func damonUpdate(pids []int) error {
+	for i := range pids {
+		if err := damonWrite(fmt.Sprintf("%d/state", i), "update_schemes_tried_regions"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// damonStop stops the kdamonds of pids, and removes them.
+func damonStop(pids []int) {
+	for i := range pids {
+		damonWrite(fmt.Sprintf("%d/state", i), "off")
+	}
+	damonWrite("nr_kdamonds", "0")
+}
+
+// damonAccessed returns the bytes of the regions accessed of kdamond i.
+func damonAccessed(i int) (uint64, error) {
+	dir := fmt.Sprintf("%d/contexts/0/schemes/0/tried_regions", i)
+	entries, err := os.ReadDir(filepath.Join(DAMON_PATH, dir))
+	if err != nil {
+		return 0, fmt.Errorf("Can't read DAMON regions %w", err)
+	}
+	var bytes uint64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		var addrs [2]uint64
+		for j, name := range []string{"start", "end"} {
+			value, err := damonRead(filepath.Join(dir, entry.Name(), name))
+			if err != nil {
+				return 0, err
+			}
+			if addrs[j], err = strconv.ParseUint(value, 10, 64); err != nil {
+				return 0, fmt.Errorf("Bad DAMON region %s %w", entry.Name(), err)
+			}
+		}
+		bytes += addrs[1] - addrs[0]
+	}
+	return bytes, nil
+}
+
+// damon returns the DAMON backend for pids and the duration d. The update of
+// the regions waits for the end of the aggregation interval, so it is
+// started along with the kdamonds, and the sleep of the measurement runs
+// meanwhile.
+func (s *Scanner) damon(pids []int, d time.Duration) backend {
+	var done chan error
+	return backend{
+		set: func(ctx context.Context) error {
+			if err := damonStart(pids, d); err != nil {
+				return err
+			}
+			done = make(chan error, 1)
+			go func() {
+				done <- damonUpdate(pids)
+			}()
+			return nil
+		},
+		load: func(ctx context.Context) error {
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+		walk: func(ctx context.Context, pid int, d time.Duration) (Result, error) {
+			i := slices.Index(pids, pid)
+			bytes, err := damonAccessed(i)
+			if err != nil {
+				return Result{}, err
+			}
+			res := Result{PID: pid, Duration: d, PageSize: os.Getpagesize()}
+			res.ActivePages = int(bytes / uint64(res.PageSize))
+			return res, nil
+		},
+		stop: func() {
+			damonStop(pids)
+		},
+	}
+}
@@ -0,0 +1,126 @@
+package wss
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DEVICE_VMFLAGS are the VmFlags of smaps of the mappings of device memory,
+// or of memory without struct pages: VM_PFNMAP, VM_IO and VM_MIXEDMAP. Their
+// PFNs, eg, of a GPU BAR, /dev/mem or DAX, aren't in the idle bitmap.
+var DEVICE_VMFLAGS = []string{"pf", "io", "mm"}
+
+// errBadPFN is the error of a PFN past the end of the idle bitmap, of memory
+// without struct pages, eg, of a device, or a file of a DAX filesystem. The
+// walk skips its mapping rather than failing.
+var errBadPFN = errors.New("bad PFN read from page map")
+
+// Device reports whether the mapping may be of device memory, judging from
+// its pathname: a device file, other than /dev/shm and /dev/zero, or an
+// anonymous inode of a driver. Its VmFlags tell, see Scanner.skipDevices.
+// The other mappings of device memory, eg, of the files of a DAX
+// filesystem, are skipped once a PFN of theirs is past the idle bitmap.
+func (m Mapping) Device() bool {
+	switch {
+	case strings.HasPrefix(m.Path, "/dev/shm/"), strings.HasPrefix(m.Path, "/dev/zero"):
+		return false
+	case strings.HasPrefix(m.Path, "/dev/"), strings.HasPrefix(m.Path, "anon_inode:"):
+		return true
+	}
+	return false
+}
+
+// vmInfo is the part of the smaps of a mapping wss needs.
+type vmInfo struct {
+	flags []string
+	// KernelPageSize, in bytes
+	pageSize uint64
+}
+
+// vmInfos returns the VmFlags and KernelPageSize of the mappings of pid, by
+// start address, from its smaps.
+func vmInfos(pid int) (map[uint64]vmInfo, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/smaps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("Can't read smaps file %w", err)
+	}
+	defer f.Close()
+
+	infos := make(map[uint64]vmInfo)
+	var start uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// eg, "VmFlags: rd wr sh mr mw me ms pf io dd"
+		if value, ok := strings.CutPrefix(line, "VmFlags:"); ok {
+			info := infos[start]
+			info.flags = strings.Fields(value)
+			infos[start] = info
+			continue
+		}
+		// eg, "KernelPageSize:     2048 kB"
+		if value, ok := strings.CutPrefix(line, "KernelPageSize:"); ok {
+			if kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64); err == nil {
+				info := infos[start]
+				info.pageSize = kb * 1024
+				infos[start] = info
+			}
+			continue
+		}
+		// a mapping, as in maps, eg, "7f2c1c000000-7f2c1c021000 rw-p ..."
+		if addr, _, ok := strings.Cut(line, "-"); ok && !strings.Contains(addr, ":") {
+			if s, err := strconv.ParseUint(addr, 16, 64); err == nil {
+				start = s
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Can't read smaps file %w", err)
+	}
+	return infos, nil
+}
+
+// skipDevices returns maps without the mappings of device memory, whose
+// PFNs would fail the walk, logging a warning for each path once. The smaps
+// of pid are only read when it maps a device file, being costly.
+func (s *Scanner) skipDevices(pid int, maps []Mapping) []Mapping {
+	if !slices.ContainsFunc(maps, Mapping.Device) {
+		return maps
+	}
+	infos, err := vmInfos(pid)
+	if err != nil {
+		// exited, reported by the walk
+		return maps
+	}
+	return slices.DeleteFunc(maps, func(m Mapping) bool {
+		if !m.Device() {
+			return false
+		}
+		flags := infos[m.Start].flags
+		device := slices.ContainsFunc(flags, func(flag string) bool {
+			return slices.Contains(DEVICE_VMFLAGS, flag)
+		})
+		if device {
+			s.warnDevice(pid, m, fmt.Errorf("VmFlags %s", strings.Join(flags, " ")))
+		}
+		return device
+	})
+}
+
+// warnDevice logs the mapping m of pid skipped as device memory, because of
+// reason, once per path.
+func (s *Scanner) warnDevice(pid int, m Mapping, reason error) {
+	if s.warnedDevices[m.Path] {
+		return
+	}
+	s.logger().Warn("Skipping mapping of device memory", "pid", pid, "range", fmt.Sprintf("%x-%x", m.Start, m.End), "path", m.Path, "reason", reason)
+	if s.warnedDevices == nil {
+		s.warnedDevices = make(map[string]bool)
+	}
+	s.warnedDevices[m.Path] = true
+}
@@ -0,0 +1,88 @@
+package wss
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const DEFAULT_DOCKER_SOCKET = "/var/run/docker.sock"
+
+// Container is a container resolved to its processes on this host.
+type Container struct {
+	ID     string
+	Name   string
+	Image  string
+	Pid    int    // the init process of the container
+	Cgroup string // cgroup directory of the init process
+
+	// CRI containers only
+	SandboxID string
+	Labels    map[string]string
+}
+
+// DockerSocket returns the Docker daemon socket, from DOCKER_HOST when it is
+// a unix:// address, else DEFAULT_DOCKER_SOCKET.
+func DockerSocket() string {
+	if host, ok := strings.CutPrefix(os.Getenv("DOCKER_HOST"), "unix://"); ok {
+		return host
+	}
+	return DEFAULT_DOCKER_SOCKET
+}
+
+// InspectContainer resolves the Docker container idOrName to its init PID
+// and cgroup, using the Docker Engine API on the unix socket.
+func InspectContainer(socket, idOrName string) (Container, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/" + url.PathEscape(idOrName) + "/json")
+	if err != nil {
+		return Container{}, fmt.Errorf("Can't query docker %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Container{}, fmt.Errorf("Can't inspect container %s: docker returned %s", idOrName, resp.Status)
+	}
+
+	var inspect struct {
+		ID     string `json:"Id"`
+		Name   string
+		Config struct {
+			Image string
+		}
+		State struct {
+			Running bool
+			Pid     int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return Container{}, fmt.Errorf("Error decoding container %s %w", idOrName, err)
+	}
+	if !inspect.State.Running || inspect.State.Pid == 0 {
+		return Container{}, fmt.Errorf("Container %s is not running", idOrName)
+	}
+	c := Container{
+		ID:    inspect.ID,
+		Name:  strings.TrimPrefix(inspect.Name, "/"),
+		Image: inspect.Config.Image,
+		Pid:   inspect.State.Pid,
+	}
+	c.Cgroup, err = ProcessCgroup(c.Pid)
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
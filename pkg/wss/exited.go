@@ -0,0 +1,29 @@
+package wss
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ExitedError is the error of a process which exited during a measurement.
+// The Result of the process, if any, holds the pages walked before it was
+// gone.
+type ExitedError struct {
+	PID int
+	// After is the time from the start of the measurement to finding the
+	// process gone, it exited at some point before
+	After time.Duration
+}
+
+func (e *ExitedError) Error() string {
+	return fmt.Sprintf("Process %d exited after %.2f seconds", e.PID, e.After.Seconds())
+}
+
+// exited reports whether pid is gone, once opening or reading its maps or
+// pagemap failed, eg, with ENOENT or ESRCH.
+func exited(pid int) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	return errors.Is(err, os.ErrNotExist)
+}
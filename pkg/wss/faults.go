@@ -0,0 +1,29 @@
+package wss
+
+// BACKEND_FAULTS samples every page fault of the processes with a perf
+// software event, without touching the idle bitmap or the page tables, and
+// counts the distinct pages faulted in during the duration. This is the
+// newly touched memory: pages touched but already mapped do not fault, so
+// it underestimates the WSS of a process in steady state. The threads
+// created during the duration are not sampled, as the ring buffer of an
+// inherited per thread event can't be mapped. It measures whole processes.
+//
+// The perf event is used rather than a BPF program attached to the
+// exceptions:page_fault_user tracepoint: the tracepoint only exists on x86,
+// while the software event samples the faulting address on every
+// architecture; loading a BPF program needs CAP_BPF and a BPF loader, when
+// perf_event_open needs neither, only CAP_PERFMON or perf_event_paranoid;
+// and both see the same faults of the same threads.
+const BACKEND_FAULTS = "faults"
+
+// faults returns the page fault sampling backend for pids.
+func (s *Scanner) faults(pids []int) backend {
+	attr := perfEventAttr{
+		typ:          PERF_TYPE_SOFTWARE,
+		config:       PERF_COUNT_SW_PAGE_FAULTS,
+		samplePeriod: 1,
+	}
+	return s.sampling(pids, attr, func(res *Result, f *perfSampler) {
+		res.ActivePages = len(f.pages)
+	})
+}
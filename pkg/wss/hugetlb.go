@@ -0,0 +1,118 @@
+package wss
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// hugetlbMounts returns the mount points of the hugetlbfs filesystems of
+// pid, as seen by it, like the paths of its maps, from its mountinfo.
+func hugetlbMounts(pid int) []string {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/mountinfo", pid))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// eg, "41 24 0:38 / /dev/hugepages rw,relatime shared:21 - hugetlbfs hugetlbfs rw,pagesize=2M"
+		fields := strings.Fields(scanner.Text())
+		sep := slices.Index(fields, "-")
+		if sep < 5 || sep+1 >= len(fields) || fields[sep+1] != "hugetlbfs" {
+			continue
+		}
+		mounts = append(mounts, fields[4])
+	}
+	return mounts
+}
+
+// hugetlbCandidate reports whether the mapping m may be of hugetlbfs, judging
+// from its pathname: an anonymous MAP_HUGETLB mapping, SysV shared memory,
+// maybe SHM_HUGETLB, or a file under one of mounts.
+func hugetlbCandidate(m Mapping, mounts []string) bool {
+	if strings.HasPrefix(m.Path, "/anon_hugepage") || strings.HasPrefix(m.Path, "/SYSV") {
+		return true
+	}
+	return slices.ContainsFunc(mounts, func(mount string) bool {
+		return strings.HasPrefix(m.Path, strings.TrimSuffix(mount, "/")+"/")
+	})
+}
+
+// hugetlbMaps sets the Mapping.KernelPageSize of the hugetlbfs mappings of
+// maps, flagged ht (VM_HUGETLB) in their VmFlags. The smaps of pid are only
+// read when it may map hugetlbfs, being costly.
+func (s *Scanner) hugetlbMaps(pid int, maps []Mapping) {
+	mounts := hugetlbMounts(pid)
+	if !slices.ContainsFunc(maps, func(m Mapping) bool { return hugetlbCandidate(m, mounts) }) {
+		return
+	}
+	infos, err := vmInfos(pid)
+	if err != nil {
+		// exited, reported by the walk
+		return
+	}
+	pagesize := uint64(os.Getpagesize())
+	for i := range maps {
+		info := infos[maps[i].Start]
+		if slices.Contains(info.flags, "ht") && info.pageSize > pagesize {
+			maps[i].KernelPageSize = info.pageSize
+		}
+	}
+}
+
+// walkhugetlb walks the pagemap entries pagebuf of the hugetlbfs mapping m, a
+// huge page of m.KernelPageSize at a time, its entries being those of its
+// base pages, counted as such. Idle page tracking ignores the hugetlb pages,
+// off the LRU lists, which would all read as referenced: with BACKEND_IDLE,
+// they are counted in hugetlbfspages rather than walked. The soft-dirty bits
+// are those of the huge page.
+func (s *Scanner) walkhugetlb(ctx context.Context, m Mapping, pagebuf, refbits, walkbits []uint64) {
+	per := int(m.KernelPageSize / uint64(os.Getpagesize()))
+	setbits := func(bits []uint64, i, n int) {
+		for j := i; j < i+n; j++ {
+			bits[j/64] |= 1 << (j % 64)
+		}
+	}
+	for i := 0; i < len(pagebuf); i += per {
+		if (i/per)%THROTTLE_PAGES == 0 {
+			s.throttle.pause(ctx)
+		}
+		n := min(per, len(pagebuf)-i)
+		entry := pagemapEntry(pagebuf[i])
+		switch {
+		case entry.swapped():
+			s.swappedpages += n
+			continue
+		case !entry.present():
+			s.notpresentpages += n
+			continue
+		case entry.pfn() == 0:
+			// PFNs are hidden without CAP_SYS_ADMIN, see walk
+			s.hiddenpages += n
+			continue
+		case s.Backend != BACKEND_SOFTDIRTY:
+			s.hugetlbfspages += n
+			continue
+		}
+		if entry.softDirty() {
+			s.activepages += n
+			s.hugetlbpages += n
+			if refbits != nil {
+				setbits(refbits, i, n)
+			}
+		}
+		if entry.exclusive() {
+			s.exclusivepages += n
+		}
+		if walkbits != nil {
+			setbits(walkbits, i, n)
+		}
+		s.walkedpages += n
+	}
+}
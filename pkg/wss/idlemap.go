@@ -0,0 +1,230 @@
+package wss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// maxPFN returns the PFN after the end of the highest memory zone, from
+// ZONEINFO_PATH, which sizes the idle bitmap.
+func maxPFN() (uint64, error) {
+	zoneinfo, err := os.ReadFile(ZONEINFO_PATH)
+	if err != nil {
+		return 0, fmt.Errorf("Can't read zoneinfo file %w", err)
+	}
+	var spanned, maxpfn uint64
+	for _, line := range strings.Split(string(zoneinfo), "\n") {
+		// each zone has "spanned <pages>", then "start_pfn: <pfn>"
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "spanned":
+			spanned, _ = strconv.ParseUint(fields[1], 10, 64)
+		case "start_pfn:":
+			start, err := strconv.ParseUint(fields[1], 10, 64)
+			if err == nil && start+spanned > maxpfn {
+				maxpfn = start + spanned
+			}
+			spanned = 0
+		}
+	}
+	if maxpfn == 0 {
+		return 0, fmt.Errorf("No zone in zoneinfo file")
+	}
+	return maxpfn, nil
+}
+
+func (s *Scanner) setidlemap(ctx context.Context) error {
+
+	idlefd, err := os.OpenFile(s.IdlePath, os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Can't write idlemap file %w", err)
+	}
+	defer idlefd.Close()
+
+	chunk := s.IdleChunk
+	if chunk <= 0 {
+		chunk = IDLEMAP_BUF_SIZE
+	}
+	chunk = min(chunk, MAX_IDLE_CHUNK)
+	buf := make([]byte, chunk)
+	for i := 0; i < chunk; i++ {
+		buf[i] = 0xff
+	}
+	// set entire idlemap flags, at explicit offsets rather than those of
+	// the file, until the write past the last PFN fails
+	// only sets user memory bits; kernel is silently ignored
+	for offset := int64(0); ; offset += int64(chunk) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if offset > 0 && s.IdleDelay > 0 {
+			sleep(ctx, s.IdleDelay)
+		}
+		s.throttle.pause(ctx)
+		_, err := idlefd.WriteAt(buf, offset)
+		if err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// setpidsidlemap sets the idle flags of the pages mapped by pids only, in the
+// walked mappings, rather than of every page of the system, so the other
+// processes keep their accessed bits. A 1 bit written to the bitmap sets the
+// idle flag of its page, and a 0 bit leaves it alone. The pages mapped after
+// this are not idle, so they count as referenced.
+func (s *Scanner) setpidsidlemap(ctx context.Context, pids []int) error {
+
+	// bitmap words of the pages, one 64 bit word covers 64 PFNs
+	words := make(map[uint64]uint64)
+	err := s.mappedPFNs(ctx, pids, func(pfn uint64) {
+		words[pfn/64] |= 1 << (pfn % 64)
+	})
+	if err != nil {
+		return err
+	}
+
+	idlefd, err := os.OpenFile(s.IdlePath, os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Can't write idlemap file %w", err)
+	}
+	defer idlefd.Close()
+
+	// write the runs of consecutive words at once
+	idx := slices.Sorted(maps.Keys(words))
+	for i := 0; i < len(idx); {
+		j := i + 1
+		for j < len(idx) && idx[j] == idx[j-1]+1 {
+			j++
+		}
+		run := make([]uint64, j-i)
+		for k := range run {
+			run[k] = words[idx[i+k]]
+		}
+		_, err := idlefd.WriteAt(encodeWords(run), int64(idx[i]*BITMAP_CHUNK_SIZE))
+		if err != nil && !errors.Is(err, syscall.ENXIO) {
+			// ENXIO past the end of the bitmap, PFNs of device memory
+			return fmt.Errorf("Can't write idlemap file %w", err)
+		}
+		i = j
+	}
+	return nil
+}
+
+// mappedPFNs calls fn with the PFN of every page present of the walked
+// mappings of pids.
+func (s *Scanner) mappedPFNs(ctx context.Context, pids []int, fn func(pfn uint64)) error {
+	for _, pid := range pids {
+		// a process which can't be read is reported by the walk
+		mappings, err := ReadMaps(pid)
+		if err == nil {
+			mappings, err = s.threadmaps(pid, mappings)
+		}
+		if err != nil {
+			continue
+		}
+		mappings = s.skipDevices(pid, mappings)
+		walk := slices.DeleteFunc(mappings, func(m Mapping) bool { return !s.walked(m) })
+		read, done := s.pagemaps(ctx, pid, walk)
+		for i := range walk {
+			if err := ctx.Err(); err != nil {
+				done()
+				return err
+			}
+			s.throttle.pause(ctx)
+			pagebuf, err := read(i)
+			if err != nil {
+				continue
+			}
+			for _, entry := range pagebuf {
+				pfn := pagemapEntry(entry).pfn()
+				if pfn == 0 {
+					continue
+				}
+				fn(pfn)
+			}
+			putPagebuf(pagebuf)
+		}
+		done()
+	}
+	return nil
+}
+
+func (s *Scanner) loadidlemap(ctx context.Context) error {
+	idlefd, err := os.OpenFile(s.IdlePath, os.O_RDONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Can't read idlemap file %w", err)
+	}
+	defer idlefd.Close()
+
+	// one bit per PFN, up to the end of the highest zone, rechecked at each
+	// load, as memory hotplug grows it
+	if maxpfn, err := maxPFN(); err == nil && maxpfn > 0 {
+		if words := (maxpfn + 63) / 64; words > uint64(len(s.idlebuf)) {
+			if s.idlebuf != nil {
+				s.logger().Debug("growing idle bitmap buffer", "from", uint64(len(s.idlebuf))*NUM_BYTE_64, "to", words*NUM_BYTE_64)
+			}
+			s.idlebuf = make([]uint64, words)
+		}
+	} else if s.idlebuf == nil {
+		s.idlebuf = make([]uint64, MAX_IDLEMAP_SIZE)
+	}
+	if s.sparse != nil {
+		s.sparse.close()
+		s.sparse = nil
+	}
+	// read a page of the bitmap at a time, at explicit offsets, as sysfs
+	// returns no more per read(2), and ReadAt would retry in one call
+	words := IDLEMAP_BUF_SIZE / int(NUM_BYTE_64)
+	if ring := s.ring(); ring != nil {
+		var reads []uringRead
+		for w := 0; w < len(s.idlebuf); w += words {
+			reads = append(reads, uringRead{f: idlefd, words: s.idlebuf[w:min(w+words, len(s.idlebuf))], off: int64(w) * int64(NUM_BYTE_64)})
+		}
+		ring.read(ctx, reads, s.throttle)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// up to the first short read, at the end of the bitmap
+		for _, rd := range reads {
+			s.idlebufsize += uint64(rd.n)
+			if rd.err != nil {
+				if rd.err != io.EOF {
+					return fmt.Errorf("Error reading file %w", rd.err)
+				}
+				break
+			}
+		}
+	} else {
+		size := uint64(len(s.idlebuf)) * NUM_BYTE_64
+		for s.idlebufsize < size {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			s.throttle.pause(ctx)
+			w := s.idlebufsize / NUM_BYTE_64
+			n, err := readWordsAt(idlefd, s.idlebuf[w:min(w+uint64(words), uint64(len(s.idlebuf)))], int64(s.idlebufsize))
+			s.idlebufsize += uint64(n)
+			if err != nil {
+				if err != io.EOF {
+					return fmt.Errorf("Error reading file %w", err)
+				}
+				break
+			}
+		}
+	}
+	s.logger().Debug("loaded idle bitmap", "bytes", s.idlebufsize, "buffer", uint64(len(s.idlebuf))*NUM_BYTE_64)
+	return nil
+}
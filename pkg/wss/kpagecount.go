@@ -0,0 +1,12 @@
+package wss
+
+// see Documentation/admin-guide/mm/pagemap.rst
+const (
+	KPAGECOUNT_PATH = "/proc/kpagecount"
+)
+
+// openKpagecount opens /proc/kpagecount, the number of times each page is
+// mapped.
+func openKpagecount() (*pfnReader, error) {
+	return openPfnReader(KPAGECOUNT_PATH, "kpagecount")
+}
@@ -0,0 +1,109 @@
+package wss
+
+import (
+	"fmt"
+	"os"
+)
+
+// see Documentation/admin-guide/mm/pagemap.rst
+const (
+	KPAGEFLAGS_PATH = "/proc/kpageflags"
+
+	KPF_COMPOUND_HEAD = 15
+	KPF_COMPOUND_TAIL = 16
+	KPF_HUGE          = 17
+	KPF_UNEVICTABLE   = 18
+	KPF_KSM           = 21
+	KPF_THP           = 22
+	KPF_ZERO_PAGE     = 24
+	KPF_MLOCKED       = 33
+
+	// kpageflags and kpagecount entries read at once
+	KPAGEFLAGS_CHUNK = 512
+	// the largest huge page, 1 GB of 4 KB pages, bounds the search for a head
+	MAX_COMPOUND_PAGES = 262144
+)
+
+// pfnReader reads a file of one 64 bit entry per PFN, like /proc/kpageflags
+// and /proc/kpagecount, caching a chunk of entries as the PFNs of a mapping
+// are mostly consecutive.
+type pfnReader struct {
+	f     *os.File
+	name  string
+	start uint64 // first PFN of buf
+	buf   []uint64
+	n     int // entries read in buf
+}
+
+func openPfnReader(path, name string) (*pfnReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s file %w", name, err)
+	}
+	return &pfnReader{f: f, name: name, buf: make([]uint64, KPAGEFLAGS_CHUNK)}, nil
+}
+
+func (r *pfnReader) close() {
+	r.f.Close()
+}
+
+// entry returns the entry of pfn.
+func (r *pfnReader) entry(pfn uint64) (uint64, error) {
+	if r.n == 0 || pfn < r.start || pfn >= r.start+uint64(r.n) {
+		r.start = pfn - pfn%KPAGEFLAGS_CHUNK
+		n, err := readWordsAt(r.f, r.buf, int64(r.start*NUM_BYTE_64))
+		r.n = n / int(NUM_BYTE_64)
+		if r.n == 0 {
+			return 0, fmt.Errorf("Read %s failed for PFN %x %w", r.name, pfn, err)
+		}
+		if pfn >= r.start+uint64(r.n) {
+			return 0, fmt.Errorf("Read %s failed, PFN %x out of range", r.name, pfn)
+		}
+	}
+	return r.buf[pfn-r.start], nil
+}
+
+// kpageflags reads /proc/kpageflags.
+type kpageflags struct {
+	*pfnReader
+
+	// the compound page of the last tail page, to avoid searching its head
+	// again for the following tail pages
+	headpfn, lastpfn uint64
+}
+
+func openKpageflags() (*kpageflags, error) {
+	r, err := openPfnReader(KPAGEFLAGS_PATH, "kpageflags")
+	if err != nil {
+		return nil, err
+	}
+	return &kpageflags{pfnReader: r}, nil
+}
+
+// flags returns the kpageflags of pfn.
+func (k *kpageflags) flags(pfn uint64) (uint64, error) {
+	return k.entry(pfn)
+}
+
+// head returns the PFN of the head page of the compound page the tail page
+// pfn is part of.
+func (k *kpageflags) head(pfn uint64) (uint64, error) {
+	if k.lastpfn != 0 && pfn == k.lastpfn+1 {
+		k.lastpfn = pfn
+		return k.headpfn, nil
+	}
+	for p := pfn; p > 0 && pfn-p < MAX_COMPOUND_PAGES; p-- {
+		flags, err := k.flags(p - 1)
+		if err != nil {
+			return 0, err
+		}
+		if flags&(1<<KPF_COMPOUND_HEAD) != 0 {
+			k.headpfn, k.lastpfn = p-1, pfn
+			return p - 1, nil
+		}
+		if flags&(1<<KPF_COMPOUND_TAIL) == 0 {
+			break
+		}
+	}
+	return 0, fmt.Errorf("Can't find the head page of PFN %x", pfn)
+}
@@ -0,0 +1,24 @@
+package wss
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LevelTrace is the level of the logs of every page walked, below
+// slog.LevelDebug as there are millions of them.
+const LevelTrace = slog.LevelDebug - 4
+
+// logger returns the Logger of s, or the default logger.
+func (s *Scanner) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// tracing reports whether the pages walked are logged, which is checked once
+// per walk rather than per page.
+func (s *Scanner) tracing() bool {
+	return s.logger().Enabled(context.Background(), LevelTrace)
+}
@@ -0,0 +1,199 @@
+package wss
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Mapping is a virtual memory area of a process, from /proc/PID/maps, with
+// the pages walked in it when measured.
+type Mapping struct {
+	Start  uint64
+	End    uint64
+	Perms  string // eg, "r-xp"
+	Offset uint64
+	Dev    string
+	Inode  uint64
+	// Path is the backing file, a pseudo path like [heap] or [stack], or ""
+	// for anonymous mappings.
+	Path string
+	// KernelPageSize is the page size of a hugetlbfs mapping, in bytes, 0
+	// for the others, see Scanner.hugetlbMaps
+	KernelPageSize uint64
+
+	ActivePages int
+	WalkedPages int
+	// Hot has a bit per page of the mapping, set for the pages referenced,
+	// when Scanner.HotPages is set
+	Hot []uint64
+	// Resident has a bit per page of the mapping, set for the pages walked,
+	// when Scanner.HotPages is set
+	Resident []uint64
+}
+
+// Size is the size of the mapping in bytes.
+func (m Mapping) Size() uint64 {
+	return m.End - m.Start
+}
+
+// parseMapsLine parses a line of /proc/PID/maps, eg,
+// 7f2c1c000000-7f2c1c021000 rw-p 00000000 00:00 0    [heap]
+func parseMapsLine(line string) (Mapping, error) {
+	var m Mapping
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return m, fmt.Errorf("Error parsing line %s", line)
+	}
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return m, fmt.Errorf("Error parsing line %s", line)
+	}
+	var err error
+	if m.Start, err = strconv.ParseUint(start, 16, 64); err != nil {
+		return m, fmt.Errorf("Error parsing line %s, err %w", line, err)
+	}
+	if m.End, err = strconv.ParseUint(end, 16, 64); err != nil {
+		return m, fmt.Errorf("Error parsing line %s, err %w", line, err)
+	}
+	m.Perms = fields[1]
+	if m.Offset, err = strconv.ParseUint(fields[2], 16, 64); err != nil {
+		return m, fmt.Errorf("Error parsing line %s, err %w", line, err)
+	}
+	m.Dev = fields[3]
+	if m.Inode, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+		return m, fmt.Errorf("Error parsing line %s, err %w", line, err)
+	}
+	if len(fields) > 5 {
+		// the path may contain spaces
+		m.Path = strings.Join(fields[5:], " ")
+	}
+	return m, nil
+}
+
+// ReadMaps returns the virtual memory areas of pid from /proc/PID/maps.
+func ReadMaps(pid int) ([]Mapping, error) {
+	mapsfile, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("Can't read maps file %w", err)
+	}
+	defer mapsfile.Close()
+
+	var maps []Mapping
+	linescanner := bufio.NewScanner(mapsfile)
+	for linescanner.Scan() {
+		m, err := parseMapsLine(linescanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		maps = append(maps, m)
+	}
+	if err := linescanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading maps file: %w", err)
+	}
+	return maps, nil
+}
+
+// subtract returns the parts of the mappings a not covered by the mappings b,
+// both sorted by address.
+func subtract(a, b []Mapping) []Mapping {
+	var parts []Mapping
+	part := func(m Mapping, start, end uint64) {
+		p := m
+		p.Start, p.End = start, end
+		if p.Inode != 0 {
+			p.Offset += start - m.Start
+		}
+		parts = append(parts, p)
+	}
+	j := 0
+	for _, m := range a {
+		for j < len(b) && b[j].End <= m.Start {
+			j++
+		}
+		start := m.Start
+		for k := j; k < len(b) && b[k].Start < m.End; k++ {
+			if b[k].Start > start {
+				part(m, start, b[k].Start)
+			}
+			start = max(start, b[k].End)
+		}
+		if start < m.End {
+			part(m, start, m.End)
+		}
+	}
+	return parts
+}
+
+// union returns the mappings after, read at the end of a measurement, along
+// with the parts of the mappings before, read at its start, which were
+// unmapped meanwhile, sorted by address. mapped and unmapped are the bytes of
+// address space mapped and unmapped between the two reads.
+func union(before, after []Mapping) (maps []Mapping, mapped, unmapped uint64) {
+	for _, m := range subtract(after, before) {
+		mapped += m.Size()
+	}
+	gone := subtract(before, after)
+	for _, m := range gone {
+		unmapped += m.Size()
+	}
+	maps = append(after, gone...)
+	slices.SortFunc(maps, func(a, b Mapping) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	return maps, mapped, unmapped
+}
+
+// The mapping kinds of Mapping.Is.
+var MAPPING_KINDS = []string{"anon", "file", "heap", "stack", "shmem"}
+
+// Is reports whether the mapping is of kind, one of MAPPING_KINDS, judging
+// from its pathname:
+//   - anon: not backed by a file, including the heap and stacks
+//   - file: backed by a regular file
+//   - heap: the [heap]
+//   - stack: the main [stack], or a thread [stack:TID]
+//   - shmem: shared memory, SysV, POSIX (/dev/shm) or memfd
+func (m Mapping) Is(kind string) bool {
+	shmem := strings.HasPrefix(m.Path, "/dev/shm/") || strings.HasPrefix(m.Path, "/SYSV") ||
+		strings.HasPrefix(m.Path, "/memfd:") || strings.HasPrefix(m.Path, "[anon_shmem")
+	switch kind {
+	case "anon":
+		return m.Path == "" || m.Path == "[heap]" || strings.HasPrefix(m.Path, "[stack") ||
+			strings.HasPrefix(m.Path, "[anon:")
+	case "file":
+		return strings.HasPrefix(m.Path, "/") && !shmem
+	case "heap":
+		return m.Path == "[heap]"
+	case "stack":
+		return strings.HasPrefix(m.Path, "[stack")
+	case "shmem":
+		return shmem
+	}
+	return false
+}
+
+// Special reports whether the mapping is one the kernel maps in every
+// process, the [vdso], [vvar] (or [vvar_vclock]) and [vsyscall], rather than
+// memory of the process.
+func (m Mapping) Special() bool {
+	return m.Path == "[vdso]" || strings.HasPrefix(m.Path, "[vvar") || m.Path == "[vsyscall]"
+}
+
+// matches reports whether the mapping is of any of kinds, or true if kinds
+// is empty.
+func (m Mapping) matches(kinds []string) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, kind := range kinds {
+		if m.Is(kind) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package wss
+
+import (
+	"reflect"
+	"testing"
+)
+
+// span returns an anonymous mapping of start to end.
+func span(start, end uint64) Mapping {
+	return Mapping{Start: start, End: end}
+}
+
+func TestSubtract(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []Mapping
+		want []Mapping
+	}{
+		{"nothing subtracted", []Mapping{span(0x1000, 0x3000)}, nil, []Mapping{span(0x1000, 0x3000)}},
+		{"from nothing", nil, []Mapping{span(0x1000, 0x3000)}, nil},
+		{"same", []Mapping{span(0x1000, 0x3000)}, []Mapping{span(0x1000, 0x3000)}, nil},
+		{"disjoint", []Mapping{span(0x1000, 0x2000)}, []Mapping{span(0x5000, 0x6000)}, []Mapping{span(0x1000, 0x2000)}},
+		{"disjoint before", []Mapping{span(0x5000, 0x6000)}, []Mapping{span(0x1000, 0x2000)}, []Mapping{span(0x5000, 0x6000)}},
+		{"adjacent after", []Mapping{span(0x1000, 0x2000)}, []Mapping{span(0x2000, 0x3000)}, []Mapping{span(0x1000, 0x2000)}},
+		{"adjacent before", []Mapping{span(0x2000, 0x3000)}, []Mapping{span(0x1000, 0x2000)}, []Mapping{span(0x2000, 0x3000)}},
+		{"overlapping the start", []Mapping{span(0x2000, 0x5000)}, []Mapping{span(0x1000, 0x3000)}, []Mapping{span(0x3000, 0x5000)}},
+		{"overlapping the end", []Mapping{span(0x2000, 0x5000)}, []Mapping{span(0x4000, 0x6000)}, []Mapping{span(0x2000, 0x4000)}},
+		{"contained", []Mapping{span(0x1000, 0x6000)}, []Mapping{span(0x2000, 0x3000)}, []Mapping{span(0x1000, 0x2000), span(0x3000, 0x6000)}},
+		{"containing", []Mapping{span(0x2000, 0x3000)}, []Mapping{span(0x1000, 0x6000)}, nil},
+		{"holes", []Mapping{span(0x1000, 0x9000)}, []Mapping{span(0x2000, 0x3000), span(0x3000, 0x4000), span(0x6000, 0x7000)},
+			[]Mapping{span(0x1000, 0x2000), span(0x4000, 0x6000), span(0x7000, 0x9000)}},
+		{"one over several", []Mapping{span(0x1000, 0x2000), span(0x3000, 0x4000), span(0x5000, 0x6000)}, []Mapping{span(0x1800, 0x5800)},
+			[]Mapping{span(0x1000, 0x1800), span(0x5800, 0x6000)}},
+	}
+	for _, tt := range tests {
+		if got := subtract(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: subtract(%v, %v) = %v, want %v", tt.name, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSubtractFileOffset(t *testing.T) {
+	file := Mapping{Start: 0x10000, End: 0x20000, Offset: 0x4000, Inode: 42, Path: "/usr/lib/libc.so.6", Perms: "r-xp"}
+	got := subtract([]Mapping{file}, []Mapping{span(0x12000, 0x13000)})
+	head, tail := file, file
+	head.End = 0x12000
+	tail.Start, tail.Offset = 0x13000, 0x7000
+	if want := []Mapping{head, tail}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subtract of a file mapping = %v, want %v", got, want)
+	}
+	// the offset of an anonymous mapping is left alone
+	anon := Mapping{Start: 0x10000, End: 0x20000, Offset: 0x10}
+	if got := subtract([]Mapping{anon}, []Mapping{span(0x10000, 0x11000)}); got[0].Offset != 0x10 {
+		t.Errorf("subtract of an anonymous mapping moved its offset to %x", got[0].Offset)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	tests := []struct {
+		name             string
+		before, after    []Mapping
+		want             []Mapping
+		mapped, unmapped uint64
+	}{
+		{"unchanged", []Mapping{span(0x1000, 0x3000)}, []Mapping{span(0x1000, 0x3000)}, []Mapping{span(0x1000, 0x3000)}, 0, 0},
+		{"mapped disjoint", []Mapping{span(0x1000, 0x2000)}, []Mapping{span(0x1000, 0x2000), span(0x5000, 0x7000)},
+			[]Mapping{span(0x1000, 0x2000), span(0x5000, 0x7000)}, 0x2000, 0},
+		{"unmapped disjoint", []Mapping{span(0x1000, 0x2000), span(0x5000, 0x7000)}, []Mapping{span(0x5000, 0x7000)},
+			[]Mapping{span(0x1000, 0x2000), span(0x5000, 0x7000)}, 0, 0x1000},
+		{"grown adjacent", []Mapping{span(0x1000, 0x2000)}, []Mapping{span(0x1000, 0x3000)}, []Mapping{span(0x1000, 0x3000)}, 0x1000, 0},
+		{"shrunk", []Mapping{span(0x1000, 0x4000)}, []Mapping{span(0x1000, 0x2000)}, []Mapping{span(0x1000, 0x2000), span(0x2000, 0x4000)}, 0, 0x2000},
+		{"overlapping", []Mapping{span(0x1000, 0x4000)}, []Mapping{span(0x3000, 0x6000)}, []Mapping{span(0x1000, 0x3000), span(0x3000, 0x6000)}, 0x2000, 0x2000},
+		{"hole punched", []Mapping{span(0x1000, 0x5000)}, []Mapping{span(0x1000, 0x2000), span(0x3000, 0x5000)},
+			[]Mapping{span(0x1000, 0x2000), span(0x2000, 0x3000), span(0x3000, 0x5000)}, 0, 0x1000},
+		{"contained, remapped", []Mapping{span(0x1000, 0x5000)}, []Mapping{span(0x2000, 0x3000)},
+			[]Mapping{span(0x1000, 0x2000), span(0x2000, 0x3000), span(0x3000, 0x5000)}, 0, 0x3000},
+		{"all gone", []Mapping{span(0x1000, 0x2000)}, nil, []Mapping{span(0x1000, 0x2000)}, 0, 0x1000},
+	}
+	for _, tt := range tests {
+		got, mapped, unmapped := union(tt.before, tt.after)
+		if !reflect.DeepEqual(got, tt.want) || mapped != tt.mapped || unmapped != tt.unmapped {
+			t.Errorf("%s: union(%v, %v) = %v, %#x mapped, %#x unmapped, want %v, %#x, %#x",
+				tt.name, tt.before, tt.after, got, mapped, unmapped, tt.want, tt.mapped, tt.unmapped)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package wss
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// see Documentation/ABI/testing/sysfs-bus-event_source-devices-format
+const (
+	EVENT_SOURCE_PATH = "/sys/bus/event_source/devices"
+	// the precise memory load event, eg, Intel PEBS load latency
+	MEMSAMPLE_EVENT = "mem-loads"
+	// sample one in MEMSAMPLE_PERIOD memory loads, by default
+	MEMSAMPLE_PERIOD = 1000
+)
+
+// the CPU PMUs, hybrid CPUs have one per core type
+var CPU_PMUS = []string{"cpu", "cpu_core", "cpu_atom"}
+
+// BACKEND_MEMSAMPLE samples the data addresses of the memory loads of the
+// processes, with the precise mem-loads event of the CPU (eg, Intel PEBS),
+// and counts the distinct pages sampled. This is a statistical estimate of
+// the hot pages, which costs per sample rather than per page: pages accessed
+// less often than the sample period may not be seen, Result.Coverage tells
+// how much of the accesses were to the pages seen. It measures whole
+// processes.
+const BACKEND_MEMSAMPLE = "memsample"
+
+// memEventAttr returns the attributes of the MEMSAMPLE_EVENT event of the
+// first CPU PMU having it, from its sysfs event and format files.
+func memEventAttr() (perfEventAttr, error) {
+	for _, pmu := range CPU_PMUS {
+		dir := filepath.Join(EVENT_SOURCE_PATH, pmu)
+		spec, err := os.ReadFile(filepath.Join(dir, "events", MEMSAMPLE_EVENT))
+		if err != nil {
+			continue
+		}
+		typ, err := os.ReadFile(filepath.Join(dir, "type"))
+		if err != nil {
+			return perfEventAttr{}, fmt.Errorf("Can't read PMU type %w", err)
+		}
+		var attr perfEventAttr
+		t, err := strconv.ParseUint(strings.TrimSpace(string(typ)), 10, 32)
+		if err != nil {
+			return perfEventAttr{}, fmt.Errorf("Bad PMU type of %s %w", pmu, err)
+		}
+		attr.typ = uint32(t)
+		if err := parseEvent(&attr, dir, strings.TrimSpace(string(spec))); err != nil {
+			return perfEventAttr{}, err
+		}
+		return attr, nil
+	}
+	return perfEventAttr{}, unsupportedf("No %s event in %s, memory access sampling is not supported by this CPU or VM", MEMSAMPLE_EVENT, EVENT_SOURCE_PATH)
+}
+
+// parseEvent sets the config fields of attr from the event spec of the PMU
+// dir, eg, "event=0xcd,umask=0x1,ldlat=3", placing each term in the bits
+// given by its format file, eg, "config:0-7" or "config1:0-15".
+func parseEvent(attr *perfEventAttr, dir, spec string) error {
+	for _, term := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(term, "=")
+		if !ok {
+			value = "1"
+		}
+		v, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return fmt.Errorf("Bad event term %q %w", term, err)
+		}
+		format, err := os.ReadFile(filepath.Join(dir, "format", name))
+		if err != nil {
+			return fmt.Errorf("Can't read event format %w", err)
+		}
+		field, ranges, ok := strings.Cut(strings.TrimSpace(string(format)), ":")
+		if !ok {
+			return fmt.Errorf("Bad event format %q of %s", format, name)
+		}
+		var config *uint64
+		switch field {
+		case "config":
+			config = &attr.config
+		case "config1":
+			config = &attr.config1
+		default:
+			return fmt.Errorf("Unsupported event format %q of %s", format, name)
+		}
+		// the low bits of the value go in the first range
+		for _, r := range strings.Split(ranges, ",") {
+			lo, hi, found := strings.Cut(r, "-")
+			if !found {
+				hi = lo
+			}
+			l, err1 := strconv.Atoi(lo)
+			h, err2 := strconv.Atoi(hi)
+			if err1 != nil || err2 != nil || h < l || h > 63 {
+				return fmt.Errorf("Bad event format %q of %s", format, name)
+			}
+			bits := uint(h - l + 1)
+			mask := uint64(1)<<bits - 1
+			*config |= (v & mask) << l
+			v >>= bits
+		}
+	}
+	return nil
+}
+
+// memsample returns the memory load sampling backend for pids.
+func (s *Scanner) memsample(pids []int) (backend, error) {
+	attr, err := memEventAttr()
+	if err != nil {
+		return backend{}, err
+	}
+	period := s.SamplePeriod
+	if period == 0 {
+		period = MEMSAMPLE_PERIOD
+	}
+	attr.samplePeriod = uint64(period)
+	// PEBS needs precise samples, for the data address
+	attr.flags |= 2 << PERF_ATTR_PRECISE_SHIFT
+	return s.sampling(pids, attr, func(res *Result, f *perfSampler) {
+		res.ActivePages = len(f.pages)
+		res.Samples = f.samples
+		res.SamplePeriod = period
+		for _, n := range f.pages {
+			if n == 1 {
+				res.Singletons++
+			}
+		}
+	}), nil
+}
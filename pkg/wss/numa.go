@@ -0,0 +1,65 @@
+package wss
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	NODE_PATH              = "/sys/devices/system/node"
+	MEMORY_BLOCK_SIZE_PATH = "/sys/devices/system/memory/block_size_bytes"
+)
+
+// numaMap maps PFNs to NUMA nodes, using the memory blocks listed in each
+// /sys/devices/system/node/nodeN directory.
+type numaMap struct {
+	blockpages uint64 // pages per memory block
+	nodes      []int  // node of each memory block, -1 if unknown
+}
+
+func loadNumaMap() (*numaMap, error) {
+	data, err := os.ReadFile(MEMORY_BLOCK_SIZE_PATH)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read memory block size %w", err)
+	}
+	blocksize, err := strconv.ParseUint(strings.TrimSpace(string(data)), 16, 64)
+	if err != nil || blocksize == 0 {
+		return nil, fmt.Errorf("Bad memory block size %q", data)
+	}
+	n := &numaMap{blockpages: blocksize / uint64(os.Getpagesize())}
+
+	nodedirs, err := filepath.Glob(filepath.Join(NODE_PATH, "node[0-9]*"))
+	if err != nil || len(nodedirs) == 0 {
+		return nil, fmt.Errorf("Can't find NUMA nodes in %s", NODE_PATH)
+	}
+	for _, nodedir := range nodedirs {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(nodedir), "node"))
+		if err != nil {
+			continue
+		}
+		blocks, _ := filepath.Glob(filepath.Join(nodedir, "memory[0-9]*"))
+		for _, block := range blocks {
+			b, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(block), "memory"))
+			if err != nil {
+				continue
+			}
+			for len(n.nodes) <= b {
+				n.nodes = append(n.nodes, -1)
+			}
+			n.nodes[b] = node
+		}
+	}
+	return n, nil
+}
+
+// node returns the NUMA node of pfn, or -1 if unknown.
+func (n *numaMap) node(pfn uint64) int {
+	b := pfn / n.blockpages
+	if b >= uint64(len(n.nodes)) {
+		return -1
+	}
+	return n.nodes[b]
+}
@@ -0,0 +1,110 @@
+package wss
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SELF_IO_PATH has the I/O counters of this process.
+const SELF_IO_PATH = "/proc/self/io"
+
+// Cost is what a phase of a measurement cost this process: its CPU time,
+// user and system, from getrusage(2), and the read and write system calls
+// it made, and the bytes they transferred, from /proc/self/io. They are of
+// the whole process, including its other goroutines, eg, of wss serve.
+type Cost struct {
+	CPUTime    time.Duration
+	ReadCalls  uint64
+	WriteCalls uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// Add returns the sum of c and o.
+func (c Cost) Add(o Cost) Cost {
+	return Cost{
+		CPUTime:    c.CPUTime + o.CPUTime,
+		ReadCalls:  c.ReadCalls + o.ReadCalls,
+		WriteCalls: c.WriteCalls + o.WriteCalls,
+		ReadBytes:  c.ReadBytes + o.ReadBytes,
+		WriteBytes: c.WriteBytes + o.WriteBytes,
+	}
+}
+
+// Overhead is the cost of a measurement to the measuring process, per
+// phase: setting the idle flags, or clearing the referenced bits, loading
+// the idle bitmap, and walking the processes. Like the timings, it is that
+// of the whole measurement cycle, the same in the results of all the
+// processes measured together.
+type Overhead struct {
+	Set, Load, Walk Cost
+}
+
+// Total is the cost of all the phases.
+func (o Overhead) Total() Cost {
+	return o.Set.Add(o.Load).Add(o.Walk)
+}
+
+// usage reads the counters of Cost of this process, since it started, or
+// those it could read. They include the read of /proc/self/io, so the cost
+// between two calls excludes the calls.
+func usage() Cost {
+	c := Cost{CPUTime: cpuTime()}
+	f, err := os.Open(SELF_IO_PATH)
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+	// a single read, the counters are those before it
+	buf := make([]byte, 512)
+	n, err := f.Read(buf)
+	if err != nil {
+		return c
+	}
+	c.ReadCalls, c.ReadBytes = 1, uint64(n)
+	for _, line := range strings.Split(string(buf[:n]), "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		count, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "syscr":
+			c.ReadCalls += count
+		case "syscw":
+			c.WriteCalls = count
+		case "rchar":
+			c.ReadBytes += count
+		case "wchar":
+			c.WriteBytes = count
+		}
+	}
+	return c
+}
+
+// cpuTime is the CPU time of this process, user and system, since it
+// started, or 0 if it can't be read.
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// since returns the cost from the counters before to those of c.
+func (c Cost) since(before Cost) Cost {
+	return Cost{
+		CPUTime:    c.CPUTime - before.CPUTime,
+		ReadCalls:  c.ReadCalls - before.ReadCalls,
+		WriteCalls: c.WriteCalls - before.WriteCalls,
+		ReadBytes:  c.ReadBytes - before.ReadBytes,
+		WriteBytes: c.WriteBytes - before.WriteBytes,
+	}
+}
@@ -0,0 +1,143 @@
+package wss
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// fileMap is a file mapped into this process, so the PFNs of its page cache
+// pages can be read from our own pagemap.
+type fileMap struct {
+	path string
+	data []byte
+}
+
+// Files returns the regular files of paths, walking directories recursively.
+// Empty files are skipped, they have no page cache.
+func Files(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Size() > 0 {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Can't read files of %s %w", path, err)
+		}
+	}
+	return files, nil
+}
+
+// mapfile maps path read only, and touches its pages which are in the page
+// cache, so they are present in our pagemap. The pages which are not cached
+// are left alone, as touching them would read them in.
+func mapfile(path string) (*fileMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read file %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Can't read file %w", err)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("Can't map file %s %w", path, err)
+	}
+
+	pagesize := os.Getpagesize()
+	vec := make([]byte, (len(data)+pagesize-1)/pagesize)
+	_, _, errno := syscall.Syscall(syscall.SYS_MINCORE, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		syscall.Munmap(data)
+		return nil, fmt.Errorf("Can't read page cache residency of %s %s", path, errno)
+	}
+	var sum byte
+	for i, v := range vec {
+		if v&1 != 0 {
+			sum += data[i*pagesize]
+		}
+	}
+	touched += sum
+	return &fileMap{path: path, data: data}, nil
+}
+
+// touched keeps the page reads of mapfile from being optimized away.
+var touched byte
+
+func (m *fileMap) unmap() {
+	syscall.Munmap(m.data)
+}
+
+// MeasureFiles watches the page references of the page cache of the files
+// during d: the files are mapped into this process before the idle flags are
+// set, and the idle flags of their cached pages are read through our own
+// pagemap. WalkedPages are the cached pages of a file, and ActivePages those
+// referenced by any process or read(2). Pages cached during d are not seen.
+// The results have a "file" label, and PID 0. This needs BACKEND_IDLE.
+func (s *Scanner) MeasureFiles(files []string, d time.Duration) ([]Result, error) {
+	return s.MeasureFilesContext(context.Background(), files, d)
+}
+
+// MeasureFilesContext is MeasureFiles, cancelled with ctx: the results of the
+// files walked before the cancellation are returned, along with its error.
+func (s *Scanner) MeasureFilesContext(ctx context.Context, files []string, d time.Duration) ([]Result, error) {
+	if s.Backend != "" && s.Backend != BACKEND_IDLE {
+		return nil, fmt.Errorf("Can't measure files with the %s backend", s.Backend)
+	}
+	maps := make([]*fileMap, 0, len(files))
+	defer func() {
+		for _, m := range maps {
+			m.unmap()
+		}
+	}()
+	for _, file := range files {
+		m, err := mapfile(file)
+		if err != nil {
+			return nil, err
+		}
+		maps = append(maps, m)
+	}
+
+	pagesize := uint64(os.Getpagesize())
+	return s.measure(ctx, d, s.idle(nil), func() ([]Result, error) {
+		if err := s.prepare(); err != nil {
+			return nil, err
+		}
+		results := make([]Result, 0, len(maps))
+		for _, m := range maps {
+			if err := ctx.Err(); err != nil {
+				return results, err
+			}
+			s.clear()
+			start := uint64(uintptr(unsafe.Pointer(&m.data[0])))
+			end := start + (uint64(len(m.data))+pagesize-1)/pagesize*pagesize
+			if err := s.mapidle(ctx, os.Getpid(), Mapping{Start: start, End: end}); err != nil {
+				return results, fmt.Errorf("Error walking map of file %s %w", m.path, err)
+			}
+			res := s.result(0, d)
+			res.Labels = map[string]string{"file": m.path}
+			results = append(results, res)
+		}
+		return results, nil
+	})
+}
@@ -0,0 +1,520 @@
+package wss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+)
+
+/*
+ * This code must operate on bits in the pageidle bitmap and process pagemap.
+ * Doing this one by one via syscall read/write on a large process can take too
+ * long, eg, 7 minutes for a 130 Gbyte process. Instead, I copy (snapshot) the
+ * idle bitmap and pagemap into our memory with the fewest syscalls allowed,
+ * and then process them with load/stores. Much faster, at the cost of some memory.
+ */
+// readpagemap returns the pagemap entries of the pages of pid from mapstart
+// to mapend, in a buffer of getPagebuf, to putPagebuf once walked.
+func readpagemap(pid int, mapstart, mapend uint64) ([]uint64, error) {
+
+	pagesize := uint64(os.Getpagesize())
+
+	// one pagemap entry per page
+	pagebufsize := (mapend - mapstart) / pagesize
+
+	pagebuf := getPagebuf(int(pagebufsize))
+
+	// open pagemap for virtual to PFN translation
+	pagepath := fmt.Sprintf("/proc/%d/pagemap", pid)
+
+	pagefd, err := os.Open(pagepath)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read pagemap file %w", err)
+	}
+
+	defer pagefd.Close()
+	// cache pagemap to get PFN, then operate on PFN from idlemap
+	offset := PAGEMAP_CHUNK_SIZE * mapstart / pagesize
+
+	// ReadAt retries the short reads until the buffer is full, and fails
+	// otherwise, rather than returning the entries of part of the range
+	size := len(pagebuf) * PAGEMAP_CHUNK_SIZE
+	read, err := readWordsAt(pagefd, pagebuf, int64(offset))
+	if read < size {
+		putPagebuf(pagebuf)
+		return nil, fmt.Errorf("Read page map failed, only read %d of %d bytes at %x %w", read, size, mapstart, err)
+	}
+	return pagebuf, nil
+}
+
+// pagemapEntry is a /proc/PID/pagemap entry. Bits 0-54 are the PFN of a
+// present page, but the swap type and offset of a swapped out page, so the
+// flags must be checked before using them as a PFN.
+type pagemapEntry uint64
+
+func (e pagemapEntry) present() bool {
+	return uint64(e)&PM_PRESENT != 0
+}
+
+func (e pagemapEntry) swapped() bool {
+	return uint64(e)&PM_SWAP != 0
+}
+
+// exclusive reports whether the page is mapped by this process only.
+func (e pagemapEntry) exclusive() bool {
+	return uint64(e)&PM_EXCLUSIVE != 0
+}
+
+func (e pagemapEntry) softDirty() bool {
+	return uint64(e)&PM_SOFT_DIRTY != 0
+}
+
+// pfn returns the PFN of a present page, 0 otherwise, or when the PFNs are
+// hidden, without CAP_SYS_ADMIN.
+func (e pagemapEntry) pfn() uint64 {
+	if !e.present() || e.swapped() {
+		return 0
+	}
+	return uint64(e) & PFN_MASK
+}
+
+func (s *Scanner) mapidle(ctx context.Context, pid int, m Mapping) error {
+
+	pagebuf, err := readpagemap(pid, m.Start, m.End)
+	if err != nil {
+		return err
+	}
+	err = s.walkpagemap(ctx, m, pagebuf)
+	s.release(pagebuf)
+	return err
+}
+
+// release returns the pagemap entries pagebuf walked for reuse, unless the
+// capture keeps them.
+func (s *Scanner) release(pagebuf []uint64) {
+	if s.capture == nil {
+		putPagebuf(pagebuf)
+	}
+}
+
+// walkpagemap walks the pagemap entries pagebuf of the mapping m. A mapping
+// with a PFN past the end of the idle bitmap fails with errBadPFN before any
+// page is counted.
+func (s *Scanner) walkpagemap(ctx context.Context, m Mapping, pagebuf []uint64) error {
+	var err error
+	mapstart := m.Start
+	var refbits, walkbits, flagbuf []uint64
+	if s.capture != nil || s.HotPages {
+		refbits = make([]uint64, (len(pagebuf)+63)/64)
+		s.refbits = refbits
+	}
+	if s.HotPages {
+		walkbits = make([]uint64, (len(pagebuf)+63)/64)
+		s.walkbits = walkbits
+	}
+	if s.capture != nil {
+		if s.kpageflags != nil {
+			flagbuf = make([]uint64, len(pagebuf))
+		}
+		s.captured = MapSnapshot{Pagemap: pagebuf, Referenced: refbits, Flags: flagbuf}
+	}
+	if m.KernelPageSize > uint64(os.Getpagesize()) {
+		s.walkhugetlb(ctx, m, pagebuf, refbits, walkbits)
+		return nil
+	}
+	if s.Backend != BACKEND_SOFTDIRTY {
+		if err := s.checkPFNs(pagebuf); err != nil {
+			return err
+		}
+	}
+
+	// with PageSample, every step pages from a random first one, each
+	// counted as step pages
+	first, step := 0, 1
+	if s.PageSample > 1 && s.capture == nil {
+		step = s.PageSample
+		first = rand.IntN(step)
+	}
+	for i := first; i < len(pagebuf); i += step {
+		if (i/step)%THROTTLE_PAGES == 0 {
+			s.throttle.pause(ctx)
+		}
+
+		entry := pagemapEntry(pagebuf[i])
+		switch {
+		case entry.swapped():
+			s.swappedpages += step
+			continue
+		case !entry.present():
+			s.notpresentpages += step
+			continue
+		}
+		// convert virtual address p to physical PFN
+		pfn := entry.pfn()
+		if pfn == 0 {
+			// PFNs are hidden without CAP_SYS_ADMIN, see walk
+			s.hiddenpages += step
+			continue
+		}
+		var flags uint64
+		if s.kpageflags != nil {
+			if flags, err = s.kpageflags.flags(pfn); err != nil {
+				return err
+			}
+			if flagbuf != nil {
+				flagbuf[i] = flags
+			}
+			if flags&(1<<KPF_ZERO_PAGE) != 0 {
+				// never written, the shared zero page, or huge zero page,
+				// isn't in the working set, and non-LRU, would read referenced
+				s.zeropages += step
+				continue
+			}
+		}
+		var active bool
+		if s.Backend == BACKEND_SOFTDIRTY {
+			// written since the soft-dirty bits were cleared
+			active = entry.softDirty()
+		} else if active, err = s.referenced(pfn, flags); err != nil {
+			return err
+		}
+		if s.trace {
+			s.logger().Log(context.Background(), LevelTrace, "page", "addr", fmt.Sprintf("%x", mapstart+uint64(i)*uint64(os.Getpagesize())), "pfn", fmt.Sprintf("%x", pfn), "active", active)
+		}
+		if active {
+			s.activepages += step
+			if refbits != nil {
+				refbits[i/64] |= 1 << (i % 64)
+			}
+			if flags&(1<<KPF_THP) != 0 {
+				s.thppages += step
+			}
+			if flags&(1<<KPF_HUGE) != 0 {
+				s.hugetlbpages += step
+			}
+			if flags&(1<<KPF_KSM) != 0 {
+				s.ksmpages += step
+			}
+			if flags&(1<<KPF_UNEVICTABLE|1<<KPF_MLOCKED) != 0 {
+				s.lockedpages += step
+			}
+			if s.nodepages != nil {
+				s.nodepages[s.numa.node(pfn)] += step
+			}
+			if s.kpagecount != nil {
+				count, err := s.kpagecount.entry(pfn)
+				if err != nil {
+					return err
+				}
+				if count > 1 {
+					s.sharedpages += step
+				}
+			}
+		}
+		if entry.exclusive() {
+			s.exclusivepages += step
+		}
+		if walkbits != nil {
+			walkbits[i/64] |= 1 << (i % 64)
+		}
+		s.walkedpages += step
+	}
+	return nil
+}
+
+// checkPFNs checks that the highest PFN of pagebuf is in the idle bitmap,
+// which spans the PFNs up to the end of the memory, so all of them are.
+func (s *Scanner) checkPFNs(pagebuf []uint64) error {
+	var highest uint64
+	for _, entry := range pagebuf {
+		highest = max(highest, pagemapEntry(entry).pfn())
+	}
+	if highest == 0 {
+		return nil
+	}
+	_, err := s.referenced(highest, 0)
+	return err
+}
+
+// referenced reads the idle flag of pfn, with kpageflags flags, from the
+// loaded idle bitmap.
+func (s *Scanner) referenced(pfn, flags uint64) (bool, error) {
+	var err error
+	// the pages of a huge page take the idle flag of its head page
+	idlepfn := pfn
+	if flags&(1<<KPF_COMPOUND_TAIL) != 0 && flags&(1<<KPF_THP|1<<KPF_HUGE) != 0 {
+		if idlepfn, err = s.kpageflags.head(pfn); err != nil {
+			return false, err
+		}
+	}
+	// read idle bit, one 64 bit word of the bitmap covers 64 PFNs
+	idlemapp := idlepfn / 64
+	if s.sparse != nil {
+		idlebits, err := s.sparse.word(idlemapp)
+		if err != nil {
+			return false, err
+		}
+		return idlebits&(1<<(idlepfn%64)) == 0, nil
+	}
+	if idlemapp*BITMAP_CHUNK_SIZE >= s.idlebufsize || idlemapp >= uint64(len(s.idlebuf)) {
+		return false, fmt.Errorf("ERROR: %w. read %d and buf size  %d, buf len %d", errBadPFN, idlemapp*BITMAP_CHUNK_SIZE, s.idlebufsize, len(s.idlebuf))
+	}
+
+	idlebits := s.idlebuf[idlemapp]
+	return idlebits&(1<<(idlepfn%64)) == 0, nil
+}
+
+func (s *Scanner) walkmaps(ctx context.Context, pid int) error {
+
+	// read virtual mappings
+	maps, err := ReadMaps(pid)
+	if err != nil {
+		return err
+	}
+	// the mappings unmapped during the measurement are walked too, their
+	// pages may have been moved elsewhere, eg, by mremap
+	if before, ok := s.before[pid]; ok {
+		var mapped, unmapped uint64
+		maps, mapped, unmapped = union(before, maps)
+		pagesize := uint64(os.Getpagesize())
+		s.mappedpages = int(mapped / pagesize)
+		s.unmappedpages = int(unmapped / pagesize)
+	}
+	if maps, err = s.threadmaps(pid, maps); err != nil {
+		return err
+	}
+	maps = s.skipDevices(pid, maps)
+	s.hugetlbMaps(pid, maps)
+	s.maps = s.maps[:0]
+	if err := s.prepare(); err != nil {
+		return err
+	}
+
+	log := s.logger()
+	debug := log.Enabled(context.Background(), slog.LevelDebug)
+	walk := maps[:0]
+	for _, m := range maps {
+		if s.special(m) {
+			s.specialpages += int(m.Size() / uint64(os.Getpagesize()))
+		}
+		walked := s.walked(m)
+		if debug {
+			log.Debug("map", "range", fmt.Sprintf("%x-%x", m.Start, m.End), "path", m.Path, "walked", walked)
+		}
+		if walked {
+			walk = append(walk, m)
+		}
+	}
+	// the capture walks the mappings in order
+	if s.Parallelism > 1 && len(walk) > 1 && s.capture == nil {
+		return s.walkparallel(ctx, pid, walk)
+	}
+
+	read, done := s.pagemaps(ctx, pid, walk)
+	defer done()
+	for i, m := range walk {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		active, walked := s.activepages, s.walkedpages
+		pagebuf, err := read(i)
+		if err == nil {
+			err = s.walkpagemap(ctx, m, pagebuf)
+			s.release(pagebuf)
+		}
+		if errors.Is(err, errBadPFN) {
+			s.warnDevice(pid, m, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error setting map %x-%x. Exiting. \n%s\n", m.Start, m.End, err)
+		}
+		m.ActivePages = s.activepages - active
+		m.WalkedPages = s.walkedpages - walked
+		if s.HotPages {
+			m.Hot, m.Resident = s.refbits, s.walkbits
+		}
+		if s.PerMap {
+			s.maps = append(s.maps, m)
+		}
+		if s.capture != nil {
+			s.captured.Mapping = m
+			s.capture.Maps = append(s.capture.Maps, s.captured)
+		}
+	}
+
+	return nil
+}
+
+// walkparallel walks the mappings of pid with Parallelism workers, each
+// with its own counters and page table readers, which are added up at the
+// end.
+func (s *Scanner) walkparallel(ctx context.Context, pid int, maps []Mapping) error {
+	workers := make([]*Scanner, min(s.Parallelism, len(maps)))
+	for i := range workers {
+		w, err := s.worker()
+		if err != nil {
+			for _, w := range workers[:i] {
+				w.Close()
+			}
+			return err
+		}
+		workers[i] = w
+	}
+
+	errs := make([]error, len(maps))
+	skipped := make([]error, len(maps))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				m := &maps[i]
+				active, walked := w.activepages, w.walkedpages
+				err := w.mapidle(ctx, pid, *m)
+				if errors.Is(err, errBadPFN) {
+					skipped[i] = err
+					continue
+				}
+				if err != nil {
+					errs[i] = fmt.Errorf("Error setting map %x-%x. Exiting. \n%s\n", m.Start, m.End, err)
+					continue
+				}
+				m.ActivePages = w.activepages - active
+				m.WalkedPages = w.walkedpages - walked
+				if w.HotPages {
+					m.Hot, m.Resident = w.refbits, w.walkbits
+				}
+			}
+		}()
+	}
+	for i := range maps {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, w := range workers {
+		s.merge(w)
+	}
+	if err := errors.Join(append(errs, ctx.Err())...); err != nil {
+		return err
+	}
+	for i, err := range skipped {
+		if err != nil {
+			s.warnDevice(pid, maps[i], err)
+		} else if s.PerMap {
+			s.maps = append(s.maps, maps[i])
+		}
+	}
+	return nil
+}
+
+// worker returns a copy of s for walking mappings concurrently with s, with
+// zero counters and its own page table readers.
+func (s *Scanner) worker() (*Scanner, error) {
+	w := &Scanner{
+		Logger:      s.Logger,
+		trace:       s.trace,
+		Backend:     s.Backend,
+		HotPages:    s.HotPages,
+		PageSample:  s.PageSample,
+		throttle:    s.throttle,
+		idlebuf:     s.idlebuf,
+		numa:        s.numa,
+		idlebufsize: s.idlebufsize,
+		sparse:      s.sparse,
+	}
+	var err error
+	if s.nodepages != nil {
+		w.nodepages = make(map[int]int)
+	}
+	if s.kpageflags != nil {
+		if w.kpageflags, err = openKpageflags(); err != nil {
+			return nil, err
+		}
+	}
+	if s.kpagecount != nil {
+		if w.kpagecount, err = openKpagecount(); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// merge adds the counters of the worker w to s, and closes w.
+func (s *Scanner) merge(w *Scanner) {
+	s.activepages += w.activepages
+	s.walkedpages += w.walkedpages
+	s.swappedpages += w.swappedpages
+	s.notpresentpages += w.notpresentpages
+	s.exclusivepages += w.exclusivepages
+	s.thppages += w.thppages
+	s.hugetlbpages += w.hugetlbpages
+	s.ksmpages += w.ksmpages
+	s.zeropages += w.zeropages
+	s.lockedpages += w.lockedpages
+	s.hiddenpages += w.hiddenpages
+	s.hugetlbfspages += w.hugetlbfspages
+	s.sharedpages += w.sharedpages
+	for node, pages := range w.nodepages {
+		s.nodepages[node] += pages
+	}
+	// the sparse bitmap is that of s
+	w.sparse = nil
+	w.Close()
+}
+
+// walked reports whether the mapping m is walked.
+func (s *Scanner) walked(m Mapping) bool {
+	if m.Start >= userSpaceEnd() || s.special(m) {
+		return false // page idle tracking is user mem only
+	}
+	if !m.matches(s.Only) {
+		return false
+	}
+	return s.MapFilter == nil || s.MapFilter.MatchString(m.Path)
+}
+
+// special reports whether the mapping m is one of the kernel left out of the
+// walk: the [vsyscall], and with SkipSpecial, the [vdso] and [vvar].
+func (s *Scanner) special(m Mapping) bool {
+	return m.Path == "[vsyscall]" || s.SkipSpecial && m.Special()
+}
+
+// prepare opens the page tables the walk of a mapping reads, and resets the
+// per node counts.
+func (s *Scanner) prepare() error {
+	var err error
+	s.trace = s.tracing()
+	s.nodepages = nil
+	if s.NUMA {
+		if s.numa == nil {
+			if s.numa, err = loadNumaMap(); err != nil {
+				return err
+			}
+		}
+		s.nodepages = make(map[int]int)
+	}
+	if s.PageFlags && s.kpageflags == nil {
+		if s.kpageflags, err = openKpageflags(); err != nil {
+			return err
+		}
+	}
+	if s.PageCount && s.kpagecount == nil {
+		if s.kpagecount, err = openKpagecount(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
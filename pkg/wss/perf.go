@@ -0,0 +1,236 @@
+package wss
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// see include/uapi/linux/perf_event.h
+const (
+	PERF_TYPE_SOFTWARE        = 1
+	PERF_COUNT_SW_PAGE_FAULTS = 2
+	PERF_SAMPLE_ADDR          = 1 << 3
+	PERF_RECORD_SAMPLE        = 9
+	PERF_FLAG_FD_CLOEXEC      = 1 << 3
+	PERF_EVENT_IOC_DISABLE    = 0x2401
+	// the perf_event_attr size of the fields we set, PERF_ATTR_SIZE_VER0
+	PERF_ATTR_SIZE_VER0 = 64
+	// data_head and data_tail offsets in the perf_event_mmap_page
+	PERF_DATA_HEAD = 1024
+	PERF_DATA_TAIL = 1032
+	// attr.flags bits of precise_ip, the skid of the samples
+	PERF_ATTR_PRECISE_SHIFT = 15
+
+	// ring buffer pages per thread, a power of 2, after the header page
+	PERF_RING_PAGES = 16
+	// how often the ring buffers are drained during the measurement
+	PERF_POLL = 10 * time.Millisecond
+)
+
+// perfEventAttr is the start of struct perf_event_attr.
+type perfEventAttr struct {
+	typ          uint32
+	size         uint32
+	config       uint64
+	samplePeriod uint64
+	sampleType   uint64
+	readFormat   uint64
+	flags        uint64
+	wakeupEvents uint32
+	bpType       uint32
+	config1      uint64
+}
+
+// perfRing is a sampling event of a thread, and its ring buffer.
+type perfRing struct {
+	fd  int
+	mem []byte
+}
+
+// openPerfRing opens the event attr of the thread tid, sampling the
+// addresses.
+func openPerfRing(tid int, attr perfEventAttr) (*perfRing, error) {
+	attr.size = PERF_ATTR_SIZE_VER0
+	attr.sampleType = PERF_SAMPLE_ADDR
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr)), uintptr(tid), ^uintptr(0), ^uintptr(0), PERF_FLAG_FD_CLOEXEC, 0)
+	if errno != 0 {
+		if errno == syscall.EACCES || errno == syscall.EPERM {
+			return nil, deniedf("Can't open perf event of TID %d %s: run as root, or lower kernel.perf_event_paranoid", tid, errno)
+		}
+		return nil, fmt.Errorf("Can't open perf event of TID %d %s", tid, errno)
+	}
+	mem, err := syscall.Mmap(int(fd), 0, (1+PERF_RING_PAGES)*os.Getpagesize(), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(int(fd))
+		return nil, fmt.Errorf("Can't map perf event of TID %d %w", tid, err)
+	}
+	return &perfRing{fd: int(fd), mem: mem}, nil
+}
+
+// drain adds the samples of each page in the ring buffer to pages, and
+// returns the number of samples.
+func (r *perfRing) drain(pages map[uint64]int) int {
+	var samples int
+	pagesize := uint64(os.Getpagesize())
+	head := atomic.LoadUint64((*uint64)(unsafe.Pointer(&r.mem[PERF_DATA_HEAD])))
+	tailp := (*uint64)(unsafe.Pointer(&r.mem[PERF_DATA_TAIL]))
+	tail := atomic.LoadUint64(tailp)
+	data := r.mem[pagesize:]
+	size := uint64(len(data))
+	// the records may wrap around the end of the buffer
+	read := func(off uint64, n int) []byte {
+		buf := make([]byte, n)
+		for i := range buf {
+			buf[i] = data[(off+uint64(i))%size]
+		}
+		return buf
+	}
+	for tail < head {
+		// struct perf_event_header: type u32, misc u16, size u16
+		hdr := read(tail, 8)
+		typ := binary.NativeEndian.Uint32(hdr[0:4])
+		recsize := uint64(binary.NativeEndian.Uint16(hdr[6:8]))
+		if recsize == 0 {
+			break
+		}
+		if typ == PERF_RECORD_SAMPLE {
+			addr := binary.NativeEndian.Uint64(read(tail+8, 8))
+			pages[addr&^(pagesize-1)]++
+			samples++
+		}
+		tail += recsize
+	}
+	atomic.StoreUint64(tailp, tail)
+	return samples
+}
+
+func (r *perfRing) close() {
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(r.fd), PERF_EVENT_IOC_DISABLE, 0)
+	syscall.Munmap(r.mem)
+	syscall.Close(r.fd)
+}
+
+// perfSampler samples the addresses of an event of all the threads of a
+// process.
+type perfSampler struct {
+	rings   []*perfRing
+	pages   map[uint64]int // samples per page
+	samples int
+}
+
+func newPerfSampler(pid int, attr perfEventAttr) (*perfSampler, error) {
+	tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil, fmt.Errorf("Can't read tasks of PID %d %w", pid, err)
+	}
+	f := &perfSampler{pages: make(map[uint64]int)}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		r, err := openPerfRing(tid, attr)
+		if err != nil {
+			f.close()
+			return nil, err
+		}
+		f.rings = append(f.rings, r)
+	}
+	return f, nil
+}
+
+func (f *perfSampler) drain() {
+	for _, r := range f.rings {
+		f.samples += r.drain(f.pages)
+	}
+}
+
+func (f *perfSampler) close() {
+	for _, r := range f.rings {
+		r.close()
+	}
+	f.rings = nil
+}
+
+// sampling returns a backend sampling the addresses of the event attr of
+// pids, and setting the results with result. The ring buffers are drained
+// during the sleep, so they do not overflow.
+func (s *Scanner) sampling(pids []int, attr perfEventAttr, result func(res *Result, f *perfSampler)) backend {
+	var mu sync.Mutex
+	var samplers map[int]*perfSampler
+	failed := make(map[int]error)
+	var done chan struct{}
+	var wg sync.WaitGroup
+
+	drain := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range samplers {
+			f.drain()
+		}
+	}
+	stop := func() {
+		if done != nil {
+			close(done)
+			wg.Wait()
+			done = nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range samplers {
+			f.close()
+		}
+	}
+	return backend{
+		set: func(ctx context.Context) error {
+			samplers = make(map[int]*perfSampler)
+			clear(failed)
+			for _, pid := range pids {
+				f, err := newPerfSampler(pid, attr)
+				if err != nil {
+					failed[pid] = err
+					continue
+				}
+				samplers[pid] = f
+			}
+			done = make(chan struct{})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ticker := time.NewTicker(PERF_POLL)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+						drain()
+					}
+				}
+			}()
+			return nil
+		},
+		load: func(ctx context.Context) error {
+			drain()
+			stop()
+			return nil
+		},
+		walk: func(ctx context.Context, pid int, d time.Duration) (Result, error) {
+			if err := failed[pid]; err != nil {
+				return Result{}, err
+			}
+			res := Result{PID: pid, Duration: d, PageSize: os.Getpagesize()}
+			result(&res, samplers[pid])
+			return res, nil
+		},
+		stop: stop,
+	}
+}
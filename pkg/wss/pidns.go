@@ -0,0 +1,89 @@
+package wss
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNotInNamespace is the error of translating a PID that isn't in the PID
+// namespace, eg, of a process that exited.
+var ErrNotInNamespace = errors.New("not in PID namespace")
+
+// PidNamespace returns the inode of the PID namespace of pid, from the
+// /proc/PID/ns/pid link, eg, "pid:[4026532198]", as shown by lsns(8).
+func PidNamespace(pid int) (uint64, error) {
+	link, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if err != nil {
+		return 0, fmt.Errorf("Can't read PID namespace of PID %d %w", pid, err)
+	}
+	return ParsePidNamespace(link)
+}
+
+// ParsePidNamespace parses a PID namespace, its inode, eg, 4026532198, or
+// the target of a /proc/PID/ns/pid link, eg, "pid:[4026532198]".
+func ParsePidNamespace(ns string) (uint64, error) {
+	if inode, ok := strings.CutPrefix(ns, "pid:["); ok {
+		ns = strings.TrimSuffix(inode, "]")
+	}
+	inode, err := strconv.ParseUint(ns, 10, 64)
+	if err != nil || inode == 0 {
+		return 0, fmt.Errorf("Bad PID namespace %s", ns)
+	}
+	return inode, nil
+}
+
+// nspids returns the PIDs of pid in the PID namespaces it belongs to, from
+// the NSpid field of /proc/PID/status, from that of /proc to the innermost,
+// or nil if the process is gone. NSpid needs Linux 4.1+.
+func nspids(pid int) []int {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, "NSpid:"); ok {
+			var ids []int
+			for _, field := range strings.Fields(value) {
+				id, _ := strconv.Atoi(field)
+				ids = append(ids, id)
+			}
+			return ids
+		}
+	}
+	return nil
+}
+
+// HostPID translates pid, as seen in the PID namespace ns, eg, inside a
+// container, to its PID on this host, scanning the processes of the
+// namespace. Only the processes of which ns is the innermost namespace are
+// found, not those of the namespaces nested in it.
+func HostPID(ns uint64, pid int) (int, error) {
+	pids, err := Processes()
+	if err != nil {
+		return 0, err
+	}
+	var members int
+	for _, host := range pids {
+		if inode, err := PidNamespace(host); err != nil || inode != ns {
+			continue
+		}
+		members++
+		ids := nspids(host)
+		if len(ids) == 0 {
+			if _, err := os.Stat(fmt.Sprintf("/proc/%d", host)); err == nil {
+				return 0, fmt.Errorf("Can't translate PID %d, no NSpid in /proc/%d/status, Linux 4.1+ is needed", pid, host)
+			}
+			continue
+		}
+		if ids[len(ids)-1] == pid {
+			return host, nil
+		}
+	}
+	if members == 0 {
+		return 0, fmt.Errorf("PID %d %w %d, which has no process", pid, ErrNotInNamespace, ns)
+	}
+	return 0, fmt.Errorf("PID %d %w %d", pid, ErrNotInNamespace, ns)
+}
@@ -0,0 +1,43 @@
+package wss
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	// POOL_MAX_CLASS bounds the pagemap buffers kept for reuse, to 2^21
+	// entries, 16 MB, of 8 GB mappings of 4 KB pages, the larger ones are
+	// left to the garbage collector
+	POOL_MAX_CLASS = 21
+	POOL_MAX_PAGES = 1 << POOL_MAX_CLASS
+)
+
+// pagebufs keeps the pagemap buffers of the mappings walked for reuse by the
+// next mappings and measurements, eg, of the cycles of wss agent, so they
+// don't churn the garbage collector. A pool per power of 2 of entries, the
+// capacity of its buffers.
+var pagebufs [POOL_MAX_CLASS + 1]sync.Pool
+
+// getPagebuf returns a buffer of n pagemap entries, of undefined contents.
+func getPagebuf(n int) []uint64 {
+	if n <= 0 || n > POOL_MAX_PAGES {
+		return make([]uint64, n)
+	}
+	class := bits.Len(uint(n - 1))
+	if buf, ok := pagebufs[class].Get().(*[]uint64); ok {
+		return (*buf)[:n]
+	}
+	return make([]uint64, n, 1<<class)
+}
+
+// putPagebuf returns buf from getPagebuf for reuse, it mustn't be used
+// after.
+func putPagebuf(buf []uint64) {
+	c := cap(buf)
+	if c == 0 || c > POOL_MAX_PAGES || c&(c-1) != 0 {
+		return
+	}
+	buf = buf[:c]
+	pagebufs[bits.Len(uint(c-1))].Put(&buf)
+}
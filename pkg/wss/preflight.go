@@ -0,0 +1,157 @@
+package wss
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// the first Linux release with idle page tracking
+const (
+	IDLE_MIN_MAJOR = 4
+	IDLE_MIN_MINOR = 3
+
+	// see include/uapi/linux/capability.h
+	CAP_SYS_ADMIN = 21
+)
+
+// kindError is an error of a kind, for errors.Is, with its own message.
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// unsupportedf returns an error of a measurement the host does not support,
+// which is errors.ErrUnsupported.
+func unsupportedf(format string, a ...any) error {
+	return &kindError{fmt.Sprintf(format, a...), errors.ErrUnsupported}
+}
+
+// deniedf returns an error of a measurement needing privileges, which is
+// os.ErrPermission.
+func deniedf(format string, a ...any) error {
+	return &kindError{fmt.Sprintf(format, a...), os.ErrPermission}
+}
+
+// HasCapability reports whether this process has the capability cap in its
+// effective set, from the CapEff field of /proc/self/status.
+func HasCapability(cap int) (bool, error) {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false, fmt.Errorf("Can't read status file %w", err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			if err != nil {
+				return false, fmt.Errorf("Bad CapEff %q", value)
+			}
+			return caps&(1<<cap) != 0, nil
+		}
+	}
+	return false, fmt.Errorf("No CapEff in status file")
+}
+
+// KernelRelease returns the major and minor version of the running kernel.
+func KernelRelease() (int, int, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return 0, 0, fmt.Errorf("Can't read kernel release %w", err)
+	}
+	var b strings.Builder
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		b.WriteByte(byte(c))
+	}
+	release := b.String()
+	// eg, 6.8.0-45-generic
+	fields := strings.SplitN(release, ".", 3)
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("Bad kernel release %q", release)
+	}
+	major, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Bad kernel release %q", release)
+	}
+	minor, err := strconv.Atoi(strings.TrimFunc(fields[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Bad kernel release %q", release)
+	}
+	return major, minor, nil
+}
+
+// Check verifies that the Backend can measure on this host, and returns an
+// error telling what is missing and what to do about it otherwise. For
+// BACKEND_IDLE: CAP_SYS_ADMIN, a 4.3+ kernel, with CONFIG_IDLE_PAGE_TRACKING,
+// a writable idle bitmap, and PFNs readable in the pagemap. The other backends check
+// their requirements when measuring. The errors of missing privileges are
+// os.ErrPermission, and those of missing kernel support errors.ErrUnsupported.
+func (s *Scanner) Check() error {
+	if s.Backend != "" && s.Backend != BACKEND_IDLE {
+		return nil
+	}
+	// without it, the idle bitmap can't be written, and the PFNs of the
+	// pagemap read as 0, so nothing would be walked and 0 MB reported
+	if ok, err := HasCapability(CAP_SYS_ADMIN); err == nil && !ok {
+		return deniedf("Writing the idle bitmap and reading PFNs from the pagemap need CAP_SYS_ADMIN: run wss with sudo, or grant it to the binary with 'sudo setcap cap_sys_admin+ep wss'")
+	}
+	path := s.IdlePath
+	if path == "" {
+		path = DEFAULT_IDLE_PATH
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		major, minor, kerr := KernelRelease()
+		if kerr == nil && (major < IDLE_MIN_MAJOR || major == IDLE_MIN_MAJOR && minor < IDLE_MIN_MINOR) {
+			return unsupportedf("No %s: idle page tracking needs Linux %d.%d+, this is %d.%d; the clearrefs backend works without it", path, IDLE_MIN_MAJOR, IDLE_MIN_MINOR, major, minor)
+		}
+		return unsupportedf("No %s: the kernel is built without CONFIG_IDLE_PAGE_TRACKING, or sysfs is not mounted; the clearrefs backend works without it", path)
+	case errors.Is(err, os.ErrPermission):
+		return deniedf("Can't open %s for writing: run wss as root", path)
+	case err != nil:
+		return fmt.Errorf("Can't open %s %w", path, err)
+	}
+	f.Close()
+	return checkPFNs()
+}
+
+// checkPFNs verifies that the PFNs of the pagemap are readable, they read as
+// 0 without CAP_SYS_ADMIN (Linux 4.2+).
+func checkPFNs() error {
+	f, err := os.Open("/proc/self/pagemap")
+	if err != nil {
+		return fmt.Errorf("Can't read pagemap file %w", err)
+	}
+	defer f.Close()
+
+	// a page of ours which is surely present
+	page := make([]uint64, 1)
+	page[0] = 1
+	pagesize := uint64(os.Getpagesize())
+	addr := uint64(uintptr(unsafe.Pointer(&page[0])))
+	entry := make([]uint64, 1)
+	if _, err := readWordsAt(f, entry, int64(addr/pagesize*PAGEMAP_CHUNK_SIZE)); err != nil {
+		return fmt.Errorf("Can't read pagemap file %w", err)
+	}
+	if e := pagemapEntry(entry[0]); e.present() && e.pfn() == 0 {
+		return deniedf("The pagemap PFNs read as 0, no page would be walked: run as root")
+	}
+	runtime.KeepAlive(page)
+	return nil
+}
@@ -0,0 +1,230 @@
+package wss
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Comm returns the command name of pid from /proc/PID/comm, or "" if the
+// process is gone.
+func Comm(pid int) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// Tgid returns the thread group ID, ie, the process ID, of the thread tid from
+// /proc/TID/status, or 0 if the thread is gone.
+func Tgid(tid int) int {
+	return statusField(tid, "Tgid:")
+}
+
+// statusField returns the numeric field name, eg, "Tgid:", of /proc/PID/status,
+// or 0 if the process is gone.
+func statusField(pid int, name string) int {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, name); ok {
+			n, _ := strconv.Atoi(strings.TrimSpace(value))
+			return n
+		}
+	}
+	return 0
+}
+
+// Resident returns the resident pages of pid, its RSS, from the second
+// field of /proc/PID/statm, or 0 if the process is gone.
+func Resident(pid int) int {
+	statm, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0
+	}
+	n, _ := strconv.Atoi(fields[1])
+	return n
+}
+
+// Cmdline returns the command line of pid from /proc/PID/cmdline, with the
+// arguments separated by spaces, or "" if the process is gone.
+func Cmdline(pid int) string {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+}
+
+// Processes returns the PIDs of all processes in /proc, except our own.
+func Processes() ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("Can't read /proc %w", err)
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// FindByName returns the PIDs of the processes whose comm is name.
+func FindByName(name string) ([]int, error) {
+	return findProcesses(func(pid int) bool {
+		return Comm(pid) == name
+	})
+}
+
+// FindByCmdline returns the PIDs of the processes whose command line matches re.
+func FindByCmdline(re *regexp.Regexp) ([]int, error) {
+	return findProcesses(func(pid int) bool {
+		cmdline := Cmdline(pid)
+		return cmdline != "" && re.MatchString(cmdline)
+	})
+}
+
+func findProcesses(match func(pid int) bool) ([]int, error) {
+	pids, err := Processes()
+	if err != nil {
+		return nil, err
+	}
+	var found []int
+	for _, pid := range pids {
+		if match(pid) {
+			found = append(found, pid)
+		}
+	}
+	return found, nil
+}
+
+// Children returns the PIDs of the child processes of pid, from the
+// /proc/PID/task/TID/children files of all its threads. Those need
+// CONFIG_PROC_CHILDREN, without which the process table is scanned instead.
+func Children(pid int) ([]int, error) {
+	tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil, fmt.Errorf("Can't read tasks of PID %d %w", pid, err)
+	}
+	var children []int
+	for _, task := range tasks {
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%s/children", pid, task.Name()))
+		if os.IsNotExist(err) {
+			return childrenFromStatus(pid)
+		}
+		if err != nil {
+			// the thread exited
+			continue
+		}
+		for _, field := range strings.Fields(string(data)) {
+			child, err := strconv.Atoi(field)
+			if err == nil {
+				children = append(children, child)
+			}
+		}
+	}
+	return children, nil
+}
+
+// childrenFromStatus returns the children of pid by scanning the PPid of all
+// processes.
+func childrenFromStatus(pid int) ([]int, error) {
+	return findProcesses(func(p int) bool {
+		return Ppid(p) == pid
+	})
+}
+
+// Ppid returns the parent PID of pid from /proc/PID/status, or 0 if the
+// process is gone.
+func Ppid(pid int) int {
+	return statusField(pid, "PPid:")
+}
+
+// Pgid returns the process group ID of pid from /proc/PID/stat, or 0 if the
+// process is gone.
+func Pgid(pid int) int {
+	return statField(pid, 5)
+}
+
+// Sid returns the session ID of pid from /proc/PID/stat, or 0 if the process
+// is gone.
+func Sid(pid int) int {
+	return statField(pid, 6)
+}
+
+// statField returns the numeric field n, from 1, of /proc/PID/stat, past the
+// comm in parentheses, which may hold spaces, or 0 if the process is gone.
+func statField(pid int, n int) int {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0
+	}
+	// the fields from the state, the third
+	fields := strings.Fields(string(stat[i+1:]))
+	if n < 3 || n-3 >= len(fields) {
+		return 0
+	}
+	value, _ := strconv.Atoi(fields[n-3])
+	return value
+}
+
+// FindByPgid returns the PIDs of the processes of the process group pgid,
+// other than this one.
+func FindByPgid(pgid int) ([]int, error) {
+	self := os.Getpid()
+	return findProcesses(func(pid int) bool {
+		return pid != self && Pgid(pid) == pgid
+	})
+}
+
+// FindBySid returns the PIDs of the processes of the session sid, other than
+// this one, eg, run from the shell of the session.
+func FindBySid(sid int) ([]int, error) {
+	self := os.Getpid()
+	return findProcesses(func(pid int) bool {
+		return pid != self && Sid(pid) == sid
+	})
+}
+
+// Descendants returns the PIDs of all the descendants of pid: its children,
+// their children, and so on.
+func Descendants(pid int) ([]int, error) {
+	var descendants []int
+	queue := []int{pid}
+	seen := map[int]bool{pid: true}
+	for len(queue) > 0 {
+		children, err := Children(queue[0])
+		if err != nil && queue[0] == pid {
+			return nil, err
+		}
+		// descendants may exit while walking the tree
+		queue = queue[1:]
+		for _, child := range children {
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			descendants = append(descendants, child)
+			queue = append(queue, child)
+		}
+	}
+	return descendants, nil
+}
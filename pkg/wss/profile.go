@@ -0,0 +1,97 @@
+package wss
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ProfileSteps returns n cumulative durations beginning with start, growing
+// in a 1-2-5 geometric series: eg, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1 ...
+func ProfileSteps(start time.Duration, n int) []time.Duration {
+	mult := []time.Duration{1, 2, 5}
+	steps := make([]time.Duration, 0, n)
+	scale := start
+	for i := 0; i < n; i++ {
+		steps = append(steps, scale*mult[i%3])
+		if i%3 == 2 {
+			scale *= 10
+		}
+	}
+	return steps
+}
+
+// Profile watches the page references of pid grow over the cumulative
+// durations in steps, which must be increasing. The idle flags are set only
+// once, so each Result is the WSS for the whole window up to that step.
+func (s *Scanner) Profile(pid int, steps []time.Duration) ([]Result, error) {
+	return s.ProfileContext(context.Background(), pid, steps)
+}
+
+// ProfileContext is Profile, cancelled with ctx: the results of the steps
+// completed are returned, along with the partial result of the step walked
+// when cancelled, and the error of ctx.
+func (s *Scanner) ProfileContext(ctx context.Context, pid int, steps []time.Duration) ([]Result, error) {
+	var ts1, ts2, ts3, ts4 time.Time
+
+	results := make([]Result, 0, len(steps))
+	if s.Backend == BACKEND_DAMON || s.Backend == BACKEND_FAULTS || s.Backend == BACKEND_MEMSAMPLE {
+		return results, fmt.Errorf("Can't profile with the %s backend", s.Backend)
+	}
+	b, err := s.backend([]int{pid}, steps[0])
+	if err != nil {
+		return results, err
+	}
+	b = s.resident(b)
+	s.reset()
+
+	// set idle flags, once for all steps
+	ts1 = time.Now()
+	if err := b.set(ctx); err != nil {
+		return results, err
+	}
+	ts2 = time.Now()
+	settime := ts2.Sub(ts1)
+
+	var slept time.Duration
+	for _, step := range steps {
+		if step < slept {
+			return results, fmt.Errorf("Profile steps must be increasing, got %s after %s", step, slept)
+		}
+		// sleep the remainder of this step
+		ts3 = time.Now()
+		sleep(ctx, step-slept)
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		slept = step
+		ts4 = time.Now()
+
+		// read idle flags, without resetting them
+		s.reset()
+		if err := b.load(ctx); err != nil {
+			return results, err
+		}
+		res, err := b.walk(ctx, pid, step)
+		if err != nil && ctx.Err() == nil {
+			if exited(pid) {
+				return results, &ExitedError{PID: pid, After: time.Since(ts1)}
+			}
+			return results, fmt.Errorf("Error walking map %w", err)
+		}
+		ts5 := time.Now()
+
+		res.SetTime = settime
+		res.SleepTime = ts4.Sub(ts3)
+		res.ReadTime = ts5.Sub(ts4)
+		res.TotalTime = ts5.Sub(ts1)
+		res.Est = res.TotalTime - (res.SetTime / 2) - (res.ReadTime / 2)
+		res.Time = ts5
+		results = append(results, res)
+		if err != nil {
+			// cancelled, res has the pages walked so far
+			return results, err
+		}
+	}
+	return results, nil
+}
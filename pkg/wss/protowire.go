@@ -0,0 +1,118 @@
+package wss
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Just enough of the protobuf wire format to talk to the CRI runtime, see
+// https://protobuf.dev/programming-guides/encoding/
+
+const (
+	PROTO_VARINT = 0
+	PROTO_I64    = 1
+	PROTO_BYTES  = 2
+	PROTO_I32    = 5
+)
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+func protoAppendTag(b []byte, num, typ int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(typ))
+}
+
+func protoAppendVarint(b []byte, num int, v uint64) []byte {
+	b = protoAppendTag(b, num, PROTO_VARINT)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoAppendBytes(b []byte, num int, v []byte) []byte {
+	b = protoAppendTag(b, num, PROTO_BYTES)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func protoAppendString(b []byte, num int, v string) []byte {
+	return protoAppendBytes(b, num, []byte(v))
+}
+
+// protoAppendMap appends a map<string, string> field.
+func protoAppendMap(b []byte, num int, m map[string]string) []byte {
+	for k, v := range m {
+		var entry []byte
+		entry = protoAppendString(entry, 1, k)
+		entry = protoAppendString(entry, 2, v)
+		b = protoAppendBytes(b, num, entry)
+	}
+	return b
+}
+
+// protoField is a decoded field: v holds varint and fixed values, data the
+// bytes of length-delimited ones (strings, messages, map entries).
+type protoField struct {
+	num  int
+	typ  int
+	v    uint64
+	data []byte
+}
+
+// protoDecode calls fn for every field of the message b, in order.
+func protoDecode(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3), typ: int(tag & 7)}
+		switch f.typ {
+		case PROTO_VARINT:
+			f.v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case PROTO_I64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			f.v = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case PROTO_I32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			f.v = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case PROTO_BYTES:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errProtoTruncated
+			}
+			f.data = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			return errors.New("unsupported protobuf wire type")
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protoMapEntry decodes a map<string, string> entry into m.
+func protoMapEntry(data []byte, m map[string]string) error {
+	var k, v string
+	err := protoDecode(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			k = string(f.data)
+		case 2:
+			v = string(f.data)
+		}
+		return nil
+	})
+	m[k] = v
+	return err
+}
@@ -0,0 +1,175 @@
+package wss
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// SNAPSHOT_MAGIC starts the snapshot files, followed by the gzipped gob
+// encoding of a Snapshot.
+const SNAPSHOT_MAGIC = "wss snapshot 1\n"
+
+// Snapshot is the raw data of a measurement of a process: the pagemap
+// entries and the referenced flags of the pages of every mapping walked, to
+// analyze it offline, eg, on another host, see Analyze.
+type Snapshot struct {
+	Host    string
+	Comm    string
+	Backend string
+	// Result is the result of the measurement, with its timings and the
+	// resident memory of the process, without the mappings
+	Result Result
+	Maps   []MapSnapshot
+}
+
+// MapSnapshot is the raw data of a mapping walked.
+type MapSnapshot struct {
+	// Mapping is the mapping, with the pages counted during the walk
+	Mapping
+	// Pagemap are the pagemap entries of the pages of the mapping
+	Pagemap []uint64
+	// Referenced has a bit per page of the mapping, set for the pages
+	// referenced during the measurement
+	Referenced []uint64
+	// Flags are the kpageflags of the pages, when Scanner.PageFlags is set
+	Flags []uint64
+}
+
+// Capture is CaptureContext, without a context.
+func (s *Scanner) Capture(pid int, d time.Duration) (*Snapshot, error) {
+	return s.CaptureContext(context.Background(), pid, d)
+}
+
+// CaptureContext watches the page references of pid during d, as
+// MeasureContext, and returns the raw data walked. Only the backends walking
+// the pagemap, BACKEND_IDLE and BACKEND_SOFTDIRTY, can capture them, and the
+// mappings are walked one by one, whatever Parallelism.
+func (s *Scanner) CaptureContext(ctx context.Context, pid int, d time.Duration) (*Snapshot, error) {
+	backend := s.Backend
+	if backend == "" {
+		backend = BACKEND_IDLE
+	}
+	if backend != BACKEND_IDLE && backend != BACKEND_SOFTDIRTY {
+		return nil, fmt.Errorf("The %s backend can't capture the pages, expected %s or %s", backend, BACKEND_IDLE, BACKEND_SOFTDIRTY)
+	}
+	snap := &Snapshot{Comm: Comm(pid), Backend: backend}
+	s.capture = snap
+	defer func() { s.capture = nil }()
+	res, err := s.MeasureContext(ctx, pid, d)
+	if len(snap.Maps) == 0 && err != nil {
+		return nil, err
+	}
+	res.Maps = nil
+	snap.Result = res
+	return snap, err
+}
+
+// Analyze returns the result of the snapshot, counting the pages of the
+// mappings of the only kinds, and whose path matches filter, if set, with a
+// Mapping per mapping in Result.Maps. The huge pages, KSM pages, locked
+// pages and zero pages are counted when the snapshot has the kpageflags.
+func (snap *Snapshot) Analyze(only []string, filter *regexp.Regexp) Result {
+	res := snap.Result
+	res.ActivePages = 0
+	res.WalkedPages = 0
+	res.SwappedPages = 0
+	res.NotPresentPages = 0
+	res.ExclusivePages = 0
+	res.THPPages = 0
+	res.HugetlbPages = 0
+	res.KSMPages = 0
+	res.ZeroPages = 0
+	res.LockedPages = 0
+	res.Maps = make([]Mapping, 0, len(snap.Maps))
+	for _, ms := range snap.Maps {
+		if !ms.matches(only) || filter != nil && !filter.MatchString(ms.Path) {
+			continue
+		}
+		m := ms.Mapping
+		m.ActivePages = 0
+		m.WalkedPages = 0
+		for i := range ms.Pagemap {
+			entry := pagemapEntry(ms.Pagemap[i])
+			switch {
+			case entry.swapped():
+				res.SwappedPages++
+				continue
+			case !entry.present():
+				res.NotPresentPages++
+				continue
+			case entry.pfn() == 0:
+				continue // PFNs are hidden without CAP_SYS_ADMIN
+			case ms.Flags != nil && ms.Flags[i]&(1<<KPF_ZERO_PAGE) != 0:
+				res.ZeroPages++
+				continue
+			}
+			if ms.Referenced[i/64]&(1<<(i%64)) != 0 {
+				m.ActivePages++
+				if ms.Flags != nil {
+					flags := ms.Flags[i]
+					if flags&(1<<KPF_THP) != 0 {
+						res.THPPages++
+					}
+					if flags&(1<<KPF_HUGE) != 0 {
+						res.HugetlbPages++
+					}
+					if flags&(1<<KPF_KSM) != 0 {
+						res.KSMPages++
+					}
+					if flags&(1<<KPF_UNEVICTABLE|1<<KPF_MLOCKED) != 0 {
+						res.LockedPages++
+					}
+				}
+			}
+			if entry.exclusive() {
+				res.ExclusivePages++
+			}
+			m.WalkedPages++
+		}
+		res.ActivePages += m.ActivePages
+		res.WalkedPages += m.WalkedPages
+		res.Maps = append(res.Maps, m)
+	}
+	return res
+}
+
+// Write writes the snapshot to w, gzipped.
+func (snap *Snapshot) Write(w io.Writer) error {
+	if _, err := io.WriteString(w, SNAPSHOT_MAGIC); err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if err := gob.NewEncoder(zw).Encode(snap); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadSnapshot reads a snapshot written by Snapshot.Write from r.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(SNAPSHOT_MAGIC))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != SNAPSHOT_MAGIC {
+		return nil, fmt.Errorf("Not a wss snapshot")
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read snapshot %w", err)
+	}
+	var snap Snapshot
+	if err := gob.NewDecoder(zr).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("Can't read snapshot %w", err)
+	}
+	for _, ms := range snap.Maps {
+		if len(ms.Referenced) < (len(ms.Pagemap)+63)/64 || ms.Flags != nil && len(ms.Flags) != len(ms.Pagemap) {
+			return nil, fmt.Errorf("Bad snapshot, of mapping %x-%x", ms.Start, ms.End)
+		}
+	}
+	return &snap, nil
+}
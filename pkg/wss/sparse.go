@@ -0,0 +1,163 @@
+package wss
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+)
+
+// SPARSE_CHUNK is the bytes of the idle bitmap loaded at once with
+// Scanner.Sparse, those of 4096 PFNs, 16 MB of 4 KB pages
+const SPARSE_CHUNK = 512
+
+// sparseBitmap holds the chunks of the idle bitmap of the pages mapped by the
+// measured processes only, rather than the bitmap of the whole system. The
+// other chunks are loaded on demand, eg, for the pages mapped after the
+// load, or the head pages of huge pages. It is shared by the walkers of a
+// process.
+type sparseBitmap struct {
+	f *os.File
+
+	mu     sync.RWMutex
+	chunks map[uint64][]uint64 // by chunk index, the words read
+	bytes  uint64              // loaded
+}
+
+func openSparseBitmap(path string) (*sparseBitmap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read idlemap file %w", err)
+	}
+	return &sparseBitmap{f: f, chunks: make(map[uint64][]uint64)}, nil
+}
+
+func (b *sparseBitmap) close() {
+	b.f.Close()
+}
+
+// load reads the chunks, sorted, reading the runs of consecutive chunks at
+// once, or with ring, submitting the reads of the runs in batches, of a
+// page of the bitmap at most, as sysfs returns no more per read(2).
+func (b *sparseBitmap) load(ctx context.Context, chunks []uint64, t *throttle, ring *uring) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	words := SPARSE_CHUNK / int(NUM_BYTE_64)
+	var bufs [][]uint64
+	var reads []uringRead
+	for i := 0; i < len(chunks); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		j := i + 1
+		for j < len(chunks) && chunks[j] == chunks[j-1]+1 && (ring == nil || j-i < IDLEMAP_BUF_SIZE/SPARSE_CHUNK) {
+			j++
+		}
+		if ring != nil {
+			buf := make([]uint64, (j-i)*words)
+			bufs = append(bufs, buf)
+			reads = append(reads, uringRead{f: b.f, words: buf, off: int64(chunks[i] * SPARSE_CHUNK)})
+		} else {
+			t.pause(ctx)
+			if err := b.read(chunks[i], j-i); err != nil {
+				return err
+			}
+		}
+		i = j
+	}
+	if ring == nil {
+		return nil
+	}
+	ring.read(ctx, reads, t)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for k, rd := range reads {
+		if err := b.store(uint64(rd.off/SPARSE_CHUNK), bufs[k], rd.n, rd.err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read reads n chunks from the chunk first, with b.mu held. Those past the
+// end of the bitmap are left out, and the last one read may be short.
+func (b *sparseBitmap) read(first uint64, n int) error {
+	buf := make([]uint64, n*SPARSE_CHUNK/int(NUM_BYTE_64))
+	read, err := readWordsAt(b.f, buf, int64(first*SPARSE_CHUNK))
+	return b.store(first, buf, read, err)
+}
+
+// store keeps the chunks from first of buf, of which read bytes were read,
+// with the error err of the read, with b.mu held.
+func (b *sparseBitmap) store(first uint64, buf []uint64, read int, err error) error {
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Error reading file %w", err)
+	}
+	words := uint64(SPARSE_CHUNK / NUM_BYTE_64)
+	b.bytes += uint64(read)
+	buf = buf[:uint64(read)/NUM_BYTE_64]
+	for c := first; len(buf) > 0; c++ {
+		chunk := buf[:min(words, uint64(len(buf)))]
+		b.chunks[c] = chunk
+		buf = buf[len(chunk):]
+	}
+	return nil
+}
+
+// word returns the word idx of the bitmap, of the PFNs idx*64 to idx*64+63,
+// loading its chunk if needed.
+func (b *sparseBitmap) word(idx uint64) (uint64, error) {
+	words := uint64(SPARSE_CHUNK / NUM_BYTE_64)
+	c := idx / words
+	b.mu.RLock()
+	chunk, ok := b.chunks[c]
+	b.mu.RUnlock()
+	if !ok {
+		b.mu.Lock()
+		if chunk, ok = b.chunks[c]; !ok {
+			if err := b.read(c, 1); err != nil {
+				b.mu.Unlock()
+				return 0, err
+			}
+			// nil past the end of the bitmap, read again on every miss
+			chunk = b.chunks[c]
+		}
+		b.mu.Unlock()
+	}
+	if idx%words >= uint64(len(chunk)) {
+		return 0, fmt.Errorf("ERROR: %w. read %d past the end of the idle bitmap", errBadPFN, idx*BITMAP_CHUNK_SIZE)
+	}
+	return chunk[idx%words], nil
+}
+
+// loadsparse loads the chunks of the idle bitmap of the pages mapped by
+// pids, for Scanner.Sparse, replacing those of the previous load.
+func (s *Scanner) loadsparse(ctx context.Context, pids []int) error {
+	if s.sparse != nil {
+		s.sparse.close()
+		s.sparse = nil
+	}
+	b, err := openSparseBitmap(s.IdlePath)
+	if err != nil {
+		return err
+	}
+	words := uint64(SPARSE_CHUNK / NUM_BYTE_64)
+	chunks := make(map[uint64]bool)
+	err = s.mappedPFNs(ctx, pids, func(pfn uint64) {
+		chunks[pfn/64/words] = true
+	})
+	if err == nil {
+		err = b.load(ctx, slices.Sorted(maps.Keys(chunks)), s.throttle, s.ring())
+	}
+	if err != nil {
+		b.close()
+		return err
+	}
+	s.sparse = b
+	s.logger().Debug("loaded sparse idle bitmap", "bytes", b.bytes, "chunks", len(b.chunks))
+	return nil
+}
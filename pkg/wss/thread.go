@@ -0,0 +1,76 @@
+package wss
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// THREAD_SP_TRIES are the reads of the stack pointer of a thread running
+	// on a CPU, whose registers aren't reported, before giving up
+	THREAD_SP_TRIES = 100
+	THREAD_SP_WAIT  = time.Millisecond
+)
+
+// stackPointer returns the stack pointer of the thread tid of pid, from
+// /proc/PID/task/TID/syscall, eg, "202 0x7f... ... 0x7f3a1c7fdd50 0x7f3a...",
+// the system call and its arguments followed by the stack pointer and
+// program counter, or "-1 sp pc" when blocked outside of a system call.
+// They aren't reported while the thread runs on a CPU, so the file is read
+// again for a while.
+func stackPointer(pid, tid int) (uint64, error) {
+	path := fmt.Sprintf("/proc/%d/task/%d/syscall", pid, tid)
+	for try := 0; ; try++ {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return 0, fmt.Errorf("Can't read stack pointer of thread %d %w", tid, err)
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) >= 3 {
+			sp, err := strconv.ParseUint(strings.TrimPrefix(fields[len(fields)-2], "0x"), 16, 64)
+			if err != nil {
+				return 0, fmt.Errorf("Error parsing %s %w", path, err)
+			}
+			return sp, nil
+		}
+		if try == THREAD_SP_TRIES {
+			return 0, fmt.Errorf("Can't read stack pointer of thread %d, it keeps running", tid)
+		}
+		time.Sleep(THREAD_SP_WAIT)
+	}
+}
+
+// threadmaps returns the mappings of maps of the thread Scanner.TID of pid:
+// the mapping holding its stack pointer, its stack, which also holds its
+// thread-local storage with glibc, and for the main thread, the [stack].
+// The other mappings, eg, the malloc arenas, aren't attributed to threads by
+// the kernel. Without TID, it returns maps.
+func (s *Scanner) threadmaps(pid int, maps []Mapping) ([]Mapping, error) {
+	if s.TID == 0 {
+		return maps, nil
+	}
+	switch tgid := Tgid(s.TID); tgid {
+	case pid:
+	case 0:
+		return nil, fmt.Errorf("Thread %d exited", s.TID)
+	default:
+		return nil, fmt.Errorf("Thread %d is not of PID %d", s.TID, pid)
+	}
+	sp, err := stackPointer(pid, s.TID)
+	if err != nil && s.TID != pid {
+		return nil, err
+	}
+	var thread []Mapping
+	for _, m := range maps {
+		if err == nil && sp >= m.Start && sp < m.End || s.TID == pid && m.Path == "[stack]" {
+			thread = append(thread, m)
+		}
+	}
+	if len(thread) == 0 {
+		return nil, fmt.Errorf("Can't find the stack of thread %d", s.TID)
+	}
+	return thread, nil
+}
@@ -0,0 +1,69 @@
+package wss
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// THROTTLE_CHECK is the interval at which the CPU time of a throttled
+	// phase is checked
+	THROTTLE_CHECK = 10 * time.Millisecond
+	// THROTTLE_PAGES are the pages walked between checks of the interval
+	THROTTLE_PAGES = 1024
+)
+
+// throttle caps the CPU time of this process during a phase of a
+// measurement to a percentage of a CPU, Scanner.MaxCPU, pausing it when over
+// budget. It is shared by the walkers of a process.
+type throttle struct {
+	pct float64
+
+	mu    sync.Mutex
+	start time.Time
+	cpu   time.Duration // at start
+	last  time.Time     // of the last check
+}
+
+// newThrottle returns a throttle to pct percent of a CPU, or nil for 0.
+func newThrottle(pct float64) *throttle {
+	if pct <= 0 {
+		return nil
+	}
+	return &throttle{pct: pct}
+}
+
+// begin starts a phase, whose CPU time is budgeted from now on, so the
+// sleep of the measurement doesn't accrue budget.
+func (t *throttle) begin() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.start = time.Now()
+	t.last = t.start
+	t.cpu = cpuTime()
+}
+
+// pause sleeps for as long as the CPU time of the phase is over the budget
+// of its elapsed time, or until ctx is cancelled.
+func (t *throttle) pause(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if now.Sub(t.last) < THROTTLE_CHECK {
+		t.mu.Unlock()
+		return
+	}
+	t.last = now
+	used := cpuTime() - t.cpu
+	wait := time.Duration(float64(used)*100/t.pct) - now.Sub(t.start)
+	t.mu.Unlock()
+	if wait > 0 {
+		sleep(ctx, wait)
+	}
+}
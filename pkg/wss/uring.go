@@ -0,0 +1,376 @@
+package wss
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// see include/uapi/linux/io_uring.h
+const (
+	SYS_IO_URING_SETUP = 425
+	SYS_IO_URING_ENTER = 426
+
+	IORING_OP_READ         = 22
+	IORING_ENTER_GETEVENTS = 1
+	IORING_OFF_SQ_RING     = 0
+	IORING_OFF_CQ_RING     = 0x8000000
+	IORING_OFF_SQES        = 0x10000000
+
+	URING_SQE_SIZE = 64
+	URING_CQE_SIZE = 16
+
+	// URING_ENTRIES are the reads submitted at once
+	URING_ENTRIES = 64
+	// URING_BATCH bounds the bytes of the pagemaps read ahead in a batch
+	URING_BATCH = 64 * 1024 * 1024
+	// URING_MAX_READ is the largest read submitted, the larger ones are made
+	// with pread(2), as the kernel caps a read at 2 GB
+	URING_MAX_READ = 1024 * 1024 * 1024
+	// URING_DRAIN_TIMEOUT bounds the wait for the reads submitted to complete
+	// once io_uring_enter(2) failed
+	URING_DRAIN_TIMEOUT = time.Second
+)
+
+// uringAbandoned keeps the scratch bytes of the rings whose reads didn't
+// complete after a failure, which the kernel may still write into: they are
+// neither collected nor reused.
+var uringAbandoned struct {
+	sync.Mutex
+	scratch [][]byte
+}
+
+// uringParams is struct io_uring_params, with struct io_sqring_offsets and
+// struct io_cqring_offsets.
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+
+	sqHead, sqTail, sqMask, sqRingEntries, sqFlags, sqDropped, sqArray, sqResv uint32
+	sqUserAddr                                                                 uint64
+
+	cqHead, cqTail, cqMask, cqRingEntries, cqOverflow, cqCqes, cqFlags, cqResv uint32
+	cqUserAddr                                                                 uint64
+}
+
+// uringSQE is struct io_uring_sqe, of a read.
+type uringSQE struct {
+	opcode   uint8
+	flags    uint8
+	ioprio   uint16
+	fd       int32
+	off      uint64
+	addr     uint64
+	len      uint32
+	rwFlags  uint32
+	userData uint64
+	pad      [3]uint64
+}
+
+// uringRead is a read of words at off of f, and its result, the bytes read
+// and the error, like that of readWordsAt.
+type uringRead struct {
+	f     *os.File
+	words []uint64
+	off   int64
+
+	n   int
+	err error
+}
+
+// size returns the bytes of the read.
+func (rd *uringRead) size() int {
+	return len(rd.words) * int(NUM_BYTE_64)
+}
+
+// uring is an io_uring(7) instance, submitting batches of reads with a
+// single system call, rather than a pread(2) each. It is not safe for
+// concurrent use.
+type uring struct {
+	fd           int
+	sqring, sqes []byte
+	cqring       []byte
+	sqTail       *uint32
+	sqMask       uint32
+	sqArray      []uint32
+	cqHead       *uint32
+	cqTail       *uint32
+	cqMask       uint32
+	cqes         []byte
+	entries      int
+	// the bytes the reads of a batch are made into, decoded into their
+	// words once complete
+	scratch []byte
+	// err is set when the ring is left in an unknown state, so it isn't
+	// used anymore
+	err error
+}
+
+// newUring sets up an io_uring of entries submissions.
+func newUring(entries int) (*uring, error) {
+	var p uringParams
+	fd, _, errno := syscall.Syscall(SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("Can't set up io_uring %s", errno)
+	}
+	r := &uring{fd: int(fd), entries: int(p.sqEntries)}
+	var err error
+	if r.sqring, err = syscall.Mmap(r.fd, IORING_OFF_SQ_RING, int(p.sqArray+p.sqEntries*4), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, fmt.Errorf("Can't map io_uring %w", err)
+	}
+	if r.cqring, err = syscall.Mmap(r.fd, IORING_OFF_CQ_RING, int(p.cqCqes+p.cqEntries*URING_CQE_SIZE), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, fmt.Errorf("Can't map io_uring %w", err)
+	}
+	if r.sqes, err = syscall.Mmap(r.fd, IORING_OFF_SQES, int(p.sqEntries*URING_SQE_SIZE), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, fmt.Errorf("Can't map io_uring %w", err)
+	}
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqring[p.sqTail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqring[p.sqMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqring[p.sqArray])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqring[p.cqHead]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqring[p.cqTail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqring[p.cqMask]))
+	r.cqes = r.cqring[p.cqCqes:]
+	return r, nil
+}
+
+func (r *uring) close() {
+	for _, mem := range [][]byte{r.sqring, r.cqring, r.sqes} {
+		if mem != nil {
+			syscall.Munmap(mem)
+		}
+	}
+	syscall.Close(r.fd)
+}
+
+// read makes the reads, a batch of entries at a time, pausing with t
+// between the batches, until ctx is cancelled.
+func (r *uring) read(ctx context.Context, reads []uringRead, t *throttle) {
+	for len(reads) > 0 {
+		if err := ctx.Err(); err != nil {
+			for i := range reads {
+				reads[i].err = err
+			}
+			return
+		}
+		t.pause(ctx)
+		batch := reads[:min(len(reads), r.entries)]
+		reads = reads[len(batch):]
+		r.submit(batch)
+	}
+}
+
+// submit makes a batch of reads, at most the entries of r, with a single
+// io_uring_enter(2) unless interrupted, into the scratch bytes of r. The
+// short reads, eg, of sysfs files, which return a page at most, are completed
+// with pread(2), like f.ReadAt.
+func (r *uring) submit(batch []uringRead) {
+	var total int
+	for i := range batch {
+		if batch[i].size() <= URING_MAX_READ {
+			total += batch[i].size()
+		}
+	}
+	if r.err == nil && len(r.scratch) < total {
+		r.scratch = make([]byte, total)
+	}
+	bufs := make([][]byte, len(batch))
+	var used int
+	tail := *r.sqTail
+	var pending int
+	for i := range batch {
+		rd := &batch[i]
+		if r.err != nil || rd.size() > URING_MAX_READ {
+			rd.n, rd.err = readWordsAt(rd.f, rd.words, rd.off)
+			continue
+		}
+		bufs[i] = r.scratch[used : used+rd.size()]
+		used += rd.size()
+		idx := tail & r.sqMask
+		*(*uringSQE)(unsafe.Pointer(&r.sqes[idx*URING_SQE_SIZE])) = uringSQE{
+			opcode:   IORING_OP_READ,
+			fd:       int32(rd.f.Fd()),
+			off:      uint64(rd.off),
+			addr:     uint64(uintptr(unsafe.Pointer(unsafe.SliceData(bufs[i])))),
+			len:      uint32(len(bufs[i])),
+			userData: uint64(i),
+		}
+		r.sqArray[idx] = idx
+		tail++
+		pending++
+	}
+	atomic.StoreUint32(r.sqTail, tail)
+
+	completed := make([]bool, len(batch))
+	submit := pending
+	// the reads submitted left incomplete by a failure
+	var inflight int
+	for pending > 0 {
+		n, _, errno := syscall.Syscall6(SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(submit), uintptr(pending), IORING_ENTER_GETEVENTS, 0, 0)
+		if errno == syscall.EINTR || errno == syscall.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			// the reads submitted may still complete into the scratch bytes,
+			// those left in the submission queue won't, the ring unused
+			r.err = fmt.Errorf("Can't submit io_uring reads %s", errno)
+			inflight = pending - submit
+			inflight -= r.drain(batch, completed, inflight)
+			for i := range batch {
+				if bufs[i] != nil && !completed[i] {
+					batch[i].err = r.err
+				}
+			}
+			break
+		}
+		submit -= int(n)
+		pending -= r.reap(batch, completed)
+	}
+	runtime.KeepAlive(batch)
+
+	for i := range batch {
+		rd := &batch[i]
+		if bufs[i] == nil {
+			continue
+		}
+		switch {
+		case rd.err != nil, rd.n == len(bufs[i]):
+		case rd.n == 0:
+			rd.err = io.EOF
+		default:
+			n, err := rd.f.ReadAt(bufs[i][rd.n:], rd.off+int64(rd.n))
+			rd.n += n
+			rd.err = err
+		}
+		decodeWords(rd.words, bufs[i][:rd.n])
+	}
+	switch {
+	case inflight > 0:
+		// never reused, see uringAbandoned
+		uringAbandoned.Lock()
+		uringAbandoned.scratch = append(uringAbandoned.scratch, r.scratch)
+		uringAbandoned.Unlock()
+		r.scratch = nil
+	case len(r.scratch) > URING_BATCH:
+		// of a huge mapping, not kept
+		r.scratch = nil
+	}
+}
+
+// reap consumes the completions of the reads of batch, setting their result,
+// and marking them completed, and returns how many.
+func (r *uring) reap(batch []uringRead, completed []bool) int {
+	var reaped int
+	head := atomic.LoadUint32(r.cqHead)
+	for ; head != atomic.LoadUint32(r.cqTail); head++ {
+		cqe := r.cqes[(head&r.cqMask)*URING_CQE_SIZE:]
+		i := *(*uint64)(unsafe.Pointer(&cqe[0]))
+		rd := &batch[i]
+		res := *(*int32)(unsafe.Pointer(&cqe[8]))
+		if res < 0 {
+			rd.err = syscall.Errno(-res)
+		} else {
+			rd.n = int(res)
+		}
+		completed[i] = true
+		reaped++
+	}
+	atomic.StoreUint32(r.cqHead, head)
+	return reaped
+}
+
+// drain waits for the pending reads of batch, submitted before io_uring_enter(2)
+// failed, to complete, polling the completion queue for URING_DRAIN_TIMEOUT at
+// most, and returns how many did.
+func (r *uring) drain(batch []uringRead, completed []bool, pending int) int {
+	var drained int
+	deadline := time.Now().Add(URING_DRAIN_TIMEOUT)
+	for {
+		drained += r.reap(batch, completed)
+		if drained >= pending || time.Now().After(deadline) {
+			return drained
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// ring returns the io_uring of Scanner.IOUring, set up on first use, or nil
+// without IOUring or where it is unavailable, to read with pread(2).
+func (s *Scanner) ring() *uring {
+	if !s.IOUring {
+		return nil
+	}
+	if s.uring == nil && s.uringErr == nil {
+		if s.uring, s.uringErr = newUring(URING_ENTRIES); s.uringErr != nil {
+			s.logger().Debug("reading with pread", "err", s.uringErr)
+		}
+	}
+	if s.uring == nil || s.uring.err != nil {
+		return nil
+	}
+	return s.uring
+}
+
+// pagemaps returns the reader of the pagemaps of the mappings maps of pid,
+// by increasing index, like readpagemap. With IOUring, those of a batch of mappings are read
+// ahead with a single submission, else each is read with pread(2). done
+// releases it.
+func (s *Scanner) pagemaps(ctx context.Context, pid int, maps []Mapping) (read func(i int) ([]uint64, error), done func()) {
+	ring := s.ring()
+	if ring == nil {
+		return func(i int) ([]uint64, error) {
+			return readpagemap(pid, maps[i].Start, maps[i].End)
+		}, func() {}
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/pagemap", pid))
+	if err != nil {
+		return func(i int) ([]uint64, error) {
+			return nil, fmt.Errorf("Can't read pagemap file %w", err)
+		}, func() {}
+	}
+
+	pagesize := uint64(os.Getpagesize())
+	var first int
+	var bufs [][]uint64
+	var reads []uringRead
+	read = func(i int) ([]uint64, error) {
+		if i < first || i >= first+len(reads) {
+			first, bufs, reads = i, nil, nil
+			var bytes uint64
+			for _, m := range maps[i:] {
+				size := (m.End - m.Start) / pagesize * PAGEMAP_CHUNK_SIZE
+				if len(reads) == URING_ENTRIES || len(reads) > 0 && bytes+size > URING_BATCH {
+					break
+				}
+				bytes += size
+				buf := getPagebuf(int(size / PAGEMAP_CHUNK_SIZE))
+				bufs = append(bufs, buf)
+				reads = append(reads, uringRead{f: f, words: buf, off: int64(m.Start / pagesize * PAGEMAP_CHUNK_SIZE)})
+			}
+			ring.read(ctx, reads, nil)
+		}
+		rd := reads[i-first]
+		if rd.n < rd.size() {
+			putPagebuf(bufs[i-first])
+			return nil, fmt.Errorf("Read page map failed, only read %d of %d bytes at %x %w", rd.n, rd.size(), maps[i].Start, rd.err)
+		}
+		return bufs[i-first], nil
+	}
+	return read, func() { f.Close() }
+}
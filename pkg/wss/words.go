@@ -0,0 +1,59 @@
+package wss
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// WORDS_CHUNK is the bytes read at once by readWordsAt
+const WORDS_CHUNK = 64 * 1024
+
+// wordsScratch keeps the byte buffers of readWordsAt for reuse.
+var wordsScratch = sync.Pool{New: func() any {
+	buf := make([]byte, WORDS_CHUNK)
+	return &buf
+}}
+
+// The 64 bit words of the pagemap, kpageflags, kpagecount and the idle
+// bitmap are in the byte order of the kernel, that of this host, and are
+// decoded with encoding/binary, rather than read into the memory of a
+// []uint64, on the little and big-endian architectures alike, eg, s390x.
+
+// decodeWords decodes the words of b into words, and returns how many, a
+// trailing partial word left out.
+func decodeWords(words []uint64, b []byte) int {
+	n := min(len(words), len(b)/int(NUM_BYTE_64))
+	for i := range n {
+		words[i] = binary.NativeEndian.Uint64(b[i*int(NUM_BYTE_64):])
+	}
+	return n
+}
+
+// encodeWords returns the bytes of words, to be written to the kernel.
+func encodeWords(words []uint64) []byte {
+	b := make([]byte, 0, len(words)*int(NUM_BYTE_64))
+	for _, w := range words {
+		b = binary.NativeEndian.AppendUint64(b, w)
+	}
+	return b
+}
+
+// readWordsAt reads len(words) words at off of f, like f.ReadAt, a chunk at
+// a time, and returns the bytes read, of which the words read whole are
+// decoded into words.
+func readWordsAt(f io.ReaderAt, words []uint64, off int64) (int, error) {
+	scratch := wordsScratch.Get().(*[]byte)
+	defer wordsScratch.Put(scratch)
+	var read int
+	for len(words) > 0 {
+		buf := (*scratch)[:min(len(*scratch), len(words)*int(NUM_BYTE_64))]
+		n, err := f.ReadAt(buf, off+int64(read))
+		words = words[decodeWords(words, buf[:n]):]
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
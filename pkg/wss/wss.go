@@ -0,0 +1,778 @@
+/*
+Package wss estimates the working set size (WSS) of a Linux process using
+idle page tracking (Linux 4.3+).
+
+It is the library form of the wss tool: the whole system idle bitmap is set,
+the caller sleeps for the measurement window, then the bitmap is snapshotted
+and the target's pagemap is walked to count the pages that were referenced
+in the meantime. See Documentation/admin-guide/mm/idle_page_tracking.rst.
+
+WARNING: setting the idle bitmap touches system wide page flags and can take
+over one second of CPU time on large hosts. See the README for details.
+*/
+package wss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"time"
+)
+
+// see Documentation/vm/pagemap.txt:
+// also https://fivelinesofcode.blogspot.com/2014/03/how-to-translate-virtual-to-physical.html
+// and also https://www.kernel.org/doc/Documentation/vm/idle_page_tracking.txt
+
+const (
+	NUM_BYTE_64        uint64 = 8
+	PFN_MASK                  = uint64(1)<<55 - 1
+	PM_SOFT_DIRTY             = uint64(1) << 55
+	PM_EXCLUSIVE              = uint64(1) << 56
+	PM_SWAP                   = uint64(1) << 62
+	PM_PRESENT                = uint64(1) << 63
+	PAGEMAP_CHUNK_SIZE        = 8
+	IDLEMAP_CHUNK_SIZE        = 8
+	IDLEMAP_BUF_SIZE          = 4096
+	// MAX_IDLE_CHUNK caps Scanner.IdleChunk, the buffer of a write
+	MAX_IDLE_CHUNK = 1024 * 1024
+
+	// idle bitmap words, when the highest PFN can't be read from
+	// ZONEINFO_PATH: 20M words of 64 PFNs span 5 TB of 4 KB pages
+	MAX_IDLEMAP_SIZE = 20 * 1024 * 1024
+	ZONEINFO_PATH    = "/proc/zoneinfo"
+
+	// Following constant should come from some linux headers, but hardcoded there
+	// from mm/page_idle.c
+	BITMAP_CHUNK_SIZE = 8
+
+	DEFAULT_IDLE_PATH = "/sys/kernel/mm/page_idle/bitmap"
+
+	// COLD_WINDOW is the measurement duration at which half of the cold
+	// memory is deemed reclaimable, see Result.ReclaimablePages
+	COLD_WINDOW = 60 * time.Second
+
+	// CONFIDENCE_Z is the z-score of the confidence interval of the
+	// estimates of Scanner.PageSample, 95%, see Result.ActiveInterval
+	CONFIDENCE_Z = 1.96
+)
+
+// Scanner measures the working set size of processes. A Scanner holds the
+// snapshot of the idle bitmap between measurements, so it is not safe for
+// concurrent use; the idle bitmap is system global anyway.
+type Scanner struct {
+	// Logger receives the logs of the measurements: the timings and counts
+	// of every result and the mappings walked at slog.LevelDebug, and every
+	// page walked at LevelTrace. Defaults to slog.Default().
+	Logger *slog.Logger
+	// Backend is the method of finding the referenced pages, one of
+	// BACKENDS, defaults to BACKEND_IDLE. The options below are of the
+	// backends walking the pagemap, BACKEND_IDLE and BACKEND_SOFTDIRTY.
+	Backend string
+	// SamplePeriod is the number of memory loads per sample of
+	// BACKEND_MEMSAMPLE, defaults to MEMSAMPLE_PERIOD
+	SamplePeriod int
+	// IdlePath is the idle page bitmap, defaults to DEFAULT_IDLE_PATH
+	IdlePath string
+	// PerMap reports the pages of every mapping in Result.Maps
+	PerMap bool
+	// HotPages reports the pages referenced, and walked, of every mapping of
+	// Result.Maps in Mapping.Hot and Mapping.Resident, with PerMap
+	HotPages bool
+	// Only restricts the walk to the mappings of these MAPPING_KINDS
+	Only []string
+	// MapFilter restricts the walk to the mappings whose path matches
+	MapFilter *regexp.Regexp
+	// SkipSpecial leaves the [vdso] and [vvar] mappings out of the walk, as
+	// the [vsyscall] always is, counting their pages in Result.SpecialPages
+	SkipSpecial bool
+	// Parallelism is the number of goroutines walking the mappings of a
+	// process concurrently, 0 or 1 walks them one by one
+	Parallelism int
+	// Targeted sets the idle flags of the pages of the measured processes
+	// only, rather than of the whole system, so the accessed bits of the
+	// other processes are left alone. The pages the processes map during
+	// the measurement count as referenced.
+	Targeted bool
+	// NUMA reports the referenced pages per NUMA node in Result.NodePages
+	NUMA bool
+	// PageFlags reads /proc/kpageflags for every walked page, to account
+	// huge pages: the pages of a transparent or hugetlb huge page take the
+	// idle flag of its head page, and are counted in Result.THPPages and
+	// Result.HugetlbPages. The referenced KSM merged pages are counted in
+	// Result.KSMPages, and the mlocked or unevictable ones in
+	// Result.LockedPages. The pages mapped to the shared zero page, read but
+	// never written, are left out of the walked and referenced pages, and
+	// counted in Result.ZeroPages. This costs a read of kpageflags per page.
+	PageFlags bool
+	// PageCount reads /proc/kpagecount for every referenced page, to split
+	// the referenced pages mapped more than once, eg, shared libraries and
+	// shmem, in Result.SharedPages.
+	PageCount bool
+	// Rollup reads /proc/PID/smaps_rollup after the walk of every process,
+	// for its Rss, Pss and Referenced memory in Result.RssPages,
+	// Result.PssPages and Result.ReferencedPages, with any backend, rather
+	// than only its RSS from /proc/PID/statm.
+	Rollup bool
+	// MaxCPU caps the CPU time of this process while setting the idle flags,
+	// loading the idle bitmap and walking the processes to this percentage
+	// of a CPU, with pauses, trading longer measurements for less
+	// interference with the other workloads. 0 for no cap.
+	MaxCPU float64
+	// IdleChunk is the bytes of the idle bitmap set by every write, a
+	// multiple of 8, defaults to IDLEMAP_BUF_SIZE, up to MAX_IDLE_CHUNK, and IdleDelay the pause
+	// between the writes, to spread the setting of the idle flags of large
+	// hosts over time. The kernel sets a page of the bitmap per write(2) at
+	// most, so larger chunks mean fewer pauses rather than fewer calls.
+	IdleChunk int
+	IdleDelay time.Duration
+	// Sparse loads the chunks of the idle bitmap of the pages mapped by the
+	// measured processes only, rather than the bitmap of the whole system,
+	// cutting the memory of this process on large hosts at the cost of a
+	// walk of their page tables at the load. The chunks of the pages mapped
+	// later are loaded as they are walked. With BACKEND_IDLE.
+	Sparse bool
+	// IOUring reads the pagemaps of the mappings walked, a batch of them at
+	// a time, and the idle bitmap with io_uring(7), a system call per batch
+	// rather than per read, for processes with thousands of mappings. It
+	// falls back to pread(2) where io_uring is unavailable, eg, disabled
+	// with kernel.io_uring_disabled, or by seccomp. The walkers of
+	// Parallelism read with pread.
+	IOUring bool
+	// PageSample inspects one page of every PageSample pages of each
+	// mapping walked, from a random offset, counting each as PageSample
+	// pages, for a quick estimate of huge processes, 0 or 1 for all pages.
+	// The pagemaps are still read whole, and CaptureContext inspects every
+	// page.
+	PageSample int
+	// TID restricts the walk to the mappings of the thread TID of the
+	// process measured: the mapping of its stack pointer, its stack and
+	// thread-local storage, or the [stack] of the main thread. The pages
+	// of the other mappings, eg, the heap and malloc arenas, can't be
+	// attributed to a thread.
+	TID int
+
+	idlebuf     []uint64
+	idlebufsize uint64
+	activepages int
+	walkedpages int
+	maps        []Mapping
+	numa        *numaMap
+	nodepages   map[int]int
+
+	swappedpages    int
+	notpresentpages int
+	exclusivepages  int
+	// present, but read as PFN 0
+	hiddenpages int
+
+	kpageflags   *kpageflags
+	thppages     int
+	hugetlbpages int
+	ksmpages     int
+	zeropages    int
+	lockedpages  int
+	// of the hugetlbfs mappings, not walked with BACKEND_IDLE
+	hugetlbfspages int
+
+	kpagecount  *pfnReader
+	sharedpages int
+
+	// log every page walked
+	trace bool
+
+	// the MaxCPU of the phase running
+	throttle *throttle
+
+	// the idle bitmap loaded with Sparse, rather than idlebuf
+	sparse *sparseBitmap
+	// the io_uring of IOUring, or why it can't be set up
+	uring    *uring
+	uringErr error
+
+	// the raw data of the walk, for CaptureContext, and of the mapping
+	// being walked
+	capture  *Snapshot
+	captured MapSnapshot
+	// the pages referenced of the mapping walked last, for HotPages and
+	// CaptureContext
+	refbits []uint64
+	// the pages walked of the mapping walked last, for HotPages
+	walkbits []uint64
+
+	// the maps of each process at the start of the measurement
+	before        map[int][]Mapping
+	mappedpages   int
+	unmappedpages int
+	specialpages  int
+
+	// the paths of the mappings of device memory skipped, warned once
+	warnedDevices map[string]bool
+}
+
+// Result is a single WSS measurement of a process.
+type Result struct {
+	PID      int
+	Duration time.Duration // requested sleep duration
+
+	SetTime   time.Duration // time spent setting the idle bitmap
+	SleepTime time.Duration // actual sleep time
+	ReadTime  time.Duration // time spent loading the idle bitmap and walking the maps
+	TotalTime time.Duration // full duration, from setting to reading the page flags
+	// Est is the estimated measurement duration, this accounts for delays with
+	// setting and reading pagemap data, which inflates the intended sleep duration.
+	Est time.Duration
+	// Overhead is the CPU time and I/O the measurement cost this process
+	Overhead Overhead
+
+	Time time.Time // when the measurement completed
+
+	ActivePages int // pages referenced during the measurement
+	WalkedPages int // resident pages walked in the pagemap
+	// SwappedPages are the swapped out pages of the walked mappings, and
+	// NotPresentPages those neither resident nor swapped out, eg, never
+	// touched. Neither are part of WalkedPages.
+	SwappedPages    int
+	NotPresentPages int
+	// ExclusivePages are the walked pages mapped by this process only,
+	// Linux 4.2+.
+	ExclusivePages int
+	PageSize       int
+
+	// Referenced pages in transparent huge pages and hugetlb pages, when
+	// Scanner.PageFlags is set. The rest of ActivePages are base pages.
+	THPPages     int
+	HugetlbPages int
+	// HugetlbfsPages are the resident pages of the hugetlbfs mappings, with
+	// BACKEND_IDLE, which can't tell their references, not counted in
+	// WalkedPages and ActivePages. The soft-dirty backend walks them.
+	HugetlbfsPages int
+	// KSMPages are the referenced pages merged by KSM, when
+	// Scanner.PageFlags is set. The same physical page may back the
+	// ActivePages of many processes, or VMs.
+	KSMPages int
+	// LockedPages are the referenced pages mlocked, or otherwise
+	// unevictable, eg, of ramfs or SHM_LOCK, when Scanner.PageFlags is set.
+	// They can't be reclaimed, however cold they get.
+	LockedPages int
+	// ZeroPages are the pages mapped to the shared zero page, when
+	// Scanner.PageFlags is set, not counted in WalkedPages and ActivePages.
+	ZeroPages int
+
+	// SharedPages are the referenced pages mapped more than once, when
+	// Scanner.PageCount is set. The rest of ActivePages are private pages.
+	// Summing SharedPages over processes counts a page once per process.
+	SharedPages int
+
+	// MappedPages and UnmappedPages are the address space mapped and
+	// unmapped during the measurement, from the maps read before and after
+	// it, by the backends walking the pagemap. The mappings unmapped are
+	// walked too.
+	MappedPages   int
+	UnmappedPages int
+
+	// SpecialPages are the pages of the [vdso], [vvar] and [vsyscall]
+	// mappings left out of the walk, see Scanner.SkipSpecial. They are
+	// mapped by the kernel, not the working set of the process.
+	SpecialPages int
+
+	// RssPages is the resident memory of the process after the walk, to
+	// compare with the working set, see HotPercent. PssPages and
+	// ReferencedPages are the Pss and Referenced memory of smaps_rollup,
+	// when Scanner.Rollup is set. Referenced counts the pages with the
+	// accessed bit set, whichever backend measured.
+	RssPages        int
+	PssPages        int
+	ReferencedPages int
+
+	// Samples are the memory loads sampled by BACKEND_MEMSAMPLE, one every
+	// SamplePeriod loads, and Singletons the pages sampled only once.
+	Samples      int
+	SamplePeriod int
+	Singletons   int
+
+	// PageSample is the Scanner.PageSample the pages were counted with, the
+	// counts are estimates scaled from one page of every PageSample, 0 for
+	// all pages
+	PageSample int
+
+	// Maps are the mappings walked, with their pages, when Scanner.PerMap is set
+	Maps []Mapping
+
+	// NodePages are the referenced pages per NUMA node, -1 for pages of
+	// unknown node, when Scanner.NUMA is set
+	NodePages map[int]int
+
+	// Labels describe the target, eg, the container the process runs in.
+	// They are set by the caller, Measure leaves them empty.
+	Labels map[string]string
+}
+
+// ReferencedBytes is the working set size in bytes. The pages are counted
+// in getpagesize() sized pages, those of huge pages too, eg, 512 for a 2 MB
+// hugetlbfs page, as their pagemap entries.
+func (r Result) ReferencedBytes() uint64 {
+	return uint64(r.ActivePages) * uint64(r.PageSize)
+}
+
+// HotPercent is the working set as a percentage of the resident memory,
+// ActivePages / RssPages, or 0 without RssPages.
+func (r Result) HotPercent() float64 {
+	if r.RssPages == 0 {
+		return 0
+	}
+	return 100 * float64(r.ActivePages) / float64(r.RssPages)
+}
+
+// ColdPages are the resident pages not referenced during the measurement,
+// RssPages - ActivePages.
+func (r Result) ColdPages() int {
+	return max(r.RssPages-r.ActivePages, 0)
+}
+
+// ReclaimablePages is a conservative estimate of the cold pages which could
+// be reclaimed, or swapped out, without hurting the process. A page idle
+// during a short window may still be used every minute, so the cold pages
+// are discounted by the duration d of the measurement: d / (d +
+// COLD_WINDOW) of them count, half for a minute, 91% for 10 minutes.
+func (r Result) ReclaimablePages() int {
+	d := r.Duration.Seconds()
+	return int(float64(r.ColdPages()) * d / (d + COLD_WINDOW.Seconds()))
+}
+
+// Coverage is the estimated fraction of the memory accesses to the pages
+// sampled by BACKEND_MEMSAMPLE, 1 - Singletons/Samples (the Good-Turing
+// estimate): the closer to 1, the fewer hot pages are missing from the
+// estimate. It is 0 without samples.
+func (r Result) Coverage() float64 {
+	if r.Samples == 0 {
+		return 0
+	}
+	return 1 - float64(r.Singletons)/float64(r.Samples)
+}
+
+// ActiveInterval is the 95% confidence interval of ActivePages, when
+// estimated from one page of every PageSample: the Wilson score interval of
+// the ratio of the pages inspected which were referenced, with the finite
+// population correction, scaled to WalkedPages. The sample is taken as a
+// simple random one, which overstates the spread of the pages inspected at
+// regular intervals. Both are ActivePages for the results of every page.
+func (r Result) ActiveInterval() (lo, hi int) {
+	if r.PageSample <= 1 || r.WalkedPages == 0 {
+		return r.ActivePages, r.ActivePages
+	}
+	n := float64(r.WalkedPages / r.PageSample)
+	p := float64(r.ActivePages) / float64(r.WalkedPages)
+	z2 := CONFIDENCE_Z * CONFIDENCE_Z
+	center := (p + z2/(2*n)) / (1 + z2/n)
+	half := CONFIDENCE_Z / (1 + z2/n) * math.Sqrt(p*(1-p)/n+z2/(4*n*n))
+	// the pages inspected are 1/PageSample of those walked, not drawn with
+	// replacement
+	half *= math.Sqrt(1 - 1/float64(r.PageSample))
+	walked := float64(r.WalkedPages)
+	return int(math.Max(center-half, 0) * walked), int(math.Ceil(math.Min(center+half, 1) * walked))
+}
+
+// ReferencedMB is the working set size in Mbytes, the Ref(MB) column.
+func (r Result) ReferencedMB() float64 {
+	return float64(r.ReferencedBytes()) / (1024 * 1024)
+}
+
+// NewScanner returns a Scanner using the default idle page bitmap.
+func NewScanner() *Scanner {
+	return &Scanner{IdlePath: DEFAULT_IDLE_PATH}
+}
+
+// Close releases the files the Scanner keeps open between measurements.
+func (s *Scanner) Close() error {
+	if s.kpageflags != nil {
+		s.kpageflags.close()
+		s.kpageflags = nil
+	}
+	if s.kpagecount != nil {
+		s.kpagecount.close()
+		s.kpagecount = nil
+	}
+	if s.sparse != nil {
+		s.sparse.close()
+		s.sparse = nil
+	}
+	if s.uring != nil {
+		s.uring.close()
+		s.uring = nil
+	}
+	return nil
+}
+
+// Measure watches the page references of pid during d and returns the result.
+func (s *Scanner) Measure(pid int, d time.Duration) (Result, error) {
+	return s.MeasureContext(context.Background(), pid, d)
+}
+
+// MeasureContext is Measure, cancelled with ctx.
+func (s *Scanner) MeasureContext(ctx context.Context, pid int, d time.Duration) (Result, error) {
+	results, err := s.MeasureAllContext(ctx, []int{pid}, d)
+	if len(results) == 0 {
+		return Result{PID: pid, Duration: d, PageSize: os.Getpagesize()}, err
+	}
+	return results[0], err
+}
+
+// MeasureAll watches the page references of all pids during d. The idle
+// bitmap is set and loaded once, and then the maps of each pid are walked, so
+// the expensive bitmap operations are amortized across processes. A result is
+// returned for every pid that could be walked, along with the errors of those
+// that could not. The processes which exited during the measurement have an
+// ExitedError, and a partial result if some of their pages were walked.
+func (s *Scanner) MeasureAll(pids []int, d time.Duration) ([]Result, error) {
+	return s.MeasureAllContext(context.Background(), pids, d)
+}
+
+// MeasureAllContext is MeasureAll, cancelled with ctx. Once the idle flags
+// are set, a cancellation ends the sleep, the loading of the bitmap and the
+// walks early: a result is returned for every pid, with the pages walked so
+// far and the timings, along with the error of ctx.
+func (s *Scanner) MeasureAllContext(ctx context.Context, pids []int, d time.Duration) ([]Result, error) {
+	b, err := s.backend(pids, d)
+	if err != nil {
+		return nil, err
+	}
+	b = s.resident(b)
+	start := time.Now()
+	return s.measure(ctx, d, b, func() ([]Result, error) {
+		results := make([]Result, 0, len(pids))
+		var errs []error
+		for _, pid := range pids {
+			if ctx.Err() != nil {
+				results = append(results, Result{PID: pid, Duration: d, PageSize: os.Getpagesize()})
+				continue
+			}
+			s.throttle.pause(ctx)
+			res, err := b.walk(ctx, pid, d)
+			if err != nil && ctx.Err() != nil {
+				// the pages walked before the cancellation
+				results = append(results, res)
+				continue
+			}
+			if err != nil && exited(pid) {
+				if res.WalkedPages > 0 {
+					results = append(results, res)
+				}
+				errs = append(errs, &ExitedError{PID: pid, After: time.Since(start)})
+				continue
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Error walking map of PID %d %w", pid, err))
+				continue
+			}
+			results = append(results, res)
+		}
+		return results, errors.Join(append(errs, ctx.Err())...)
+	})
+}
+
+// backend starts and ends the measurement window, and walks a process after
+// it. stop, if set, releases what set started.
+type backend struct {
+	set  func(ctx context.Context) error
+	load func(ctx context.Context) error
+	walk func(ctx context.Context, pid int, d time.Duration) (Result, error)
+	stop func()
+}
+
+// backend returns the Backend of s, for the processes pids and the duration d.
+func (s *Scanner) backend(pids []int, d time.Duration) (backend, error) {
+	switch s.Backend {
+	case "", BACKEND_IDLE:
+		return s.snapshot(s.idle(pids), pids), nil
+	case BACKEND_CLEARREFS:
+		return s.clearing(pids, CLEAR_REFS_ALL, func(ctx context.Context, pid int, d time.Duration) (Result, error) {
+			return s.walkrefs(pid, d)
+		}), nil
+	case BACKEND_SOFTDIRTY:
+		return s.snapshot(s.clearing(pids, CLEAR_REFS_SOFT_DIRTY, s.walk), pids), nil
+	case BACKEND_DAMON:
+		return s.damon(pids, d), nil
+	case BACKEND_FAULTS:
+		return s.faults(pids), nil
+	case BACKEND_MEMSAMPLE:
+		return s.memsample(pids)
+	}
+	return backend{}, fmt.Errorf("Unknown backend %q", s.Backend)
+}
+
+// clearing returns a backend writing value to the clear_refs file of each of
+// pids, and walking them with walk.
+func (s *Scanner) clearing(pids []int, value string, walk func(ctx context.Context, pid int, d time.Duration) (Result, error)) backend {
+	// the processes whose bits could not be cleared are not walked
+	failed := make(map[int]error)
+	return backend{
+		set: func(ctx context.Context) error {
+			clear(failed)
+			for _, pid := range pids {
+				s.throttle.pause(ctx)
+				if err := clearrefs(pid, value); err != nil {
+					failed[pid] = err
+				}
+			}
+			return nil
+		},
+		load: func(ctx context.Context) error { return nil },
+		walk: func(ctx context.Context, pid int, d time.Duration) (Result, error) {
+			if err := failed[pid]; err != nil {
+				return Result{}, err
+			}
+			return walk(ctx, pid, d)
+		},
+	}
+}
+
+// idle returns the idle page bitmap backend, for the processes pids when
+// Targeted is set.
+func (s *Scanner) idle(pids []int) backend {
+	return backend{
+		set: func(ctx context.Context) error {
+			setidlemap := s.setidlemap
+			if s.Targeted && pids != nil {
+				setidlemap = func(ctx context.Context) error { return s.setpidsidlemap(ctx, pids) }
+			}
+			if err := setidlemap(ctx); err != nil {
+				return fmt.Errorf("Error setting idle map %w", err)
+			}
+			return nil
+		},
+		load: func(ctx context.Context) error {
+			loadidlemap := s.loadidlemap
+			if s.Sparse && pids != nil {
+				loadidlemap = func(ctx context.Context) error { return s.loadsparse(ctx, pids) }
+			}
+			if err := loadidlemap(ctx); err != nil {
+				return fmt.Errorf("Error loading idle map %w", err)
+			}
+			return nil
+		},
+		walk: s.walk,
+	}
+}
+
+// snapshot returns b, reading the maps of pids once b is set, so the walk
+// accounts for the mappings changed during the measurement.
+func (s *Scanner) snapshot(b backend, pids []int) backend {
+	set := b.set
+	b.set = func(ctx context.Context) error {
+		if err := set(ctx); err != nil {
+			return err
+		}
+		s.before = make(map[int][]Mapping, len(pids))
+		for _, pid := range pids {
+			// a process which can't be read fails the walk
+			if maps, err := ReadMaps(pid); err == nil {
+				s.before[pid] = maps
+			}
+		}
+		return nil
+	}
+	return b
+}
+
+// measure starts the measurement window with b, sleeps d and ends it, then
+// calls walk to walk the targets, and fills in the timings of the results.
+// Once the window is started, a cancellation of ctx ends it early, and walk
+// is still called, for the partial results.
+func (s *Scanner) measure(ctx context.Context, d time.Duration, b backend, walk func() ([]Result, error)) ([]Result, error) {
+	var ts1, ts2, ts3, ts4 time.Time
+	var overhead Overhead
+
+	s.reset()
+	s.throttle = newThrottle(s.MaxCPU)
+
+	// set idle flags, or clear the referenced bits
+	ts1 = time.Now()
+	s.throttle.begin()
+	u := usage()
+	if err := b.set(ctx); err != nil {
+		return nil, err
+	}
+	overhead.Set = usage().since(u)
+	if b.stop != nil {
+		defer b.stop()
+	}
+	// sleep
+	ts2 = time.Now()
+	sleep(ctx, d)
+	ts3 = time.Now()
+	// read idle flags
+	s.throttle.begin()
+	u = usage()
+	if err := b.load(ctx); err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	loaded := usage()
+	overhead.Load = loaded.since(u)
+	results, err := walk()
+	overhead.Walk = usage().since(loaded)
+	ts4 = time.Now()
+
+	for i := range results {
+		res := &results[i]
+		// calculate times
+		res.SetTime = ts2.Sub(ts1)
+		res.SleepTime = ts3.Sub(ts2)
+		res.ReadTime = ts4.Sub(ts3)
+		res.TotalTime = ts4.Sub(ts1)
+		res.Est = res.TotalTime - (res.SetTime / 2) - (res.ReadTime / 2)
+		res.Time = ts4
+		res.Overhead = overhead
+
+		s.logger().Debug("measured",
+			"pid", res.PID,
+			"set", res.SetTime,
+			"sleep", res.SleepTime,
+			"read", res.ReadTime,
+			"total", res.TotalTime,
+			"cpu", overhead.Total().CPUTime,
+			"referenced_pages", res.ActivePages,
+			"walked_pages", res.WalkedPages,
+			"swapped_pages", res.SwappedPages,
+			"not_present_pages", res.NotPresentPages,
+			"exclusive_pages", res.ExclusivePages,
+			"mapped_pages", res.MappedPages,
+			"unmapped_pages", res.UnmappedPages)
+	}
+	return results, err
+}
+
+// sleep sleeps d, or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// walk walks the maps of pid against the loaded idle bitmap, and returns the
+// page counts of the result; the timings are left to the caller. On error,
+// the counts are those of the pages walked so far. A process whose pages
+// present all read as PFN 0, without CAP_SYS_ADMIN, fails with a permission
+// error rather than measuring 0 bytes.
+func (s *Scanner) walk(ctx context.Context, pid int, d time.Duration) (Result, error) {
+	s.clear()
+	if err := s.walkmaps(ctx, pid); err != nil {
+		return s.result(pid, d), err
+	}
+	if s.walkedpages == 0 && s.hiddenpages > 0 {
+		return s.result(pid, d), deniedf("The PFNs of the %d pages present of PID %d read as 0, none could be walked: run as root, with CAP_SYS_ADMIN", s.hiddenpages, pid)
+	}
+	return s.result(pid, d), nil
+}
+
+// clear zeroes the page counters of a walk.
+func (s *Scanner) clear() {
+	s.activepages = 0
+	s.walkedpages = 0
+	s.swappedpages = 0
+	s.notpresentpages = 0
+	s.exclusivepages = 0
+	s.hiddenpages = 0
+	s.thppages = 0
+	s.hugetlbpages = 0
+	s.hugetlbfspages = 0
+	s.ksmpages = 0
+	s.zeropages = 0
+	s.lockedpages = 0
+	s.sharedpages = 0
+	s.mappedpages = 0
+	s.unmappedpages = 0
+	s.specialpages = 0
+}
+
+// result returns the page counts of the last walk.
+func (s *Scanner) result(pid int, d time.Duration) Result {
+	res := Result{PID: pid, Duration: d, PageSize: os.Getpagesize()}
+	res.ActivePages = s.activepages
+	res.WalkedPages = s.walkedpages
+	res.SwappedPages = s.swappedpages
+	res.NotPresentPages = s.notpresentpages
+	res.ExclusivePages = s.exclusivepages
+	res.THPPages = s.thppages
+	res.HugetlbPages = s.hugetlbpages
+	res.HugetlbfsPages = s.hugetlbfspages
+	res.KSMPages = s.ksmpages
+	res.ZeroPages = s.zeropages
+	res.LockedPages = s.lockedpages
+	res.SharedPages = s.sharedpages
+	res.MappedPages = s.mappedpages
+	res.UnmappedPages = s.unmappedpages
+	res.SpecialPages = s.specialpages
+	if s.PageSample > 1 && s.capture == nil {
+		res.PageSample = s.PageSample
+	}
+	if s.PerMap {
+		res.Maps = append([]Mapping(nil), s.maps...)
+	}
+	res.NodePages = s.nodepages
+	return res
+}
+
+// reset clears the per-run counters.
+func (s *Scanner) reset() {
+	if s.IdlePath == "" {
+		s.IdlePath = DEFAULT_IDLE_PATH
+	}
+	s.idlebufsize = 0
+	s.activepages = 0
+	s.walkedpages = 0
+	s.swappedpages = 0
+	s.notpresentpages = 0
+	s.exclusivepages = 0
+}
+
+// Sum aggregates results of the same measurement cycle, eg, of all the
+// processes of a cgroup. The timings are those of the first result, and the
+// PID is 0. Pages shared between the processes are counted once per process.
+func Sum(results []Result) Result {
+	var total Result
+	for i, res := range results {
+		if i == 0 {
+			total = res
+			total.PID = 0
+			total.Maps = nil
+			if res.NodePages != nil {
+				total.NodePages = make(map[int]int)
+				for node, pages := range res.NodePages {
+					total.NodePages[node] = pages
+				}
+			}
+			continue
+		}
+		total.ActivePages += res.ActivePages
+		total.WalkedPages += res.WalkedPages
+		total.SwappedPages += res.SwappedPages
+		total.NotPresentPages += res.NotPresentPages
+		total.ExclusivePages += res.ExclusivePages
+		total.THPPages += res.THPPages
+		total.HugetlbPages += res.HugetlbPages
+		total.HugetlbfsPages += res.HugetlbfsPages
+		total.KSMPages += res.KSMPages
+		total.ZeroPages += res.ZeroPages
+		total.LockedPages += res.LockedPages
+		total.SharedPages += res.SharedPages
+		total.MappedPages += res.MappedPages
+		total.UnmappedPages += res.UnmappedPages
+		total.SpecialPages += res.SpecialPages
+		total.RssPages += res.RssPages
+		total.PssPages += res.PssPages
+		total.ReferencedPages += res.ReferencedPages
+		total.Samples += res.Samples
+		total.Singletons += res.Singletons
+		for node, pages := range res.NodePages {
+			total.NodePages[node] += pages
+		}
+	}
+	return total
+}
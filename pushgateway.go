@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// PUSH_JOB is the default job label of the metrics pushed to the Pushgateway.
+const PUSH_JOB = "wss"
+
+// pushgatewaySink pushes the metrics of /metrics of every measurement to a
+// Prometheus Pushgateway, for one-shot runs, eg, from cron, that don't serve
+// them. The metrics of a run replace those of the previous run of the same
+// job, instance and target, the grouping key.
+type pushgatewaySink struct {
+	url    string
+	client *http.Client
+}
+
+// pushgatewayKey returns the name/value path of the grouping key label name,
+// in base64 if value has slashes, or is empty.
+func pushgatewayKey(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return "/" + name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
+
+// newPushgatewaySink returns a sink pushing to the Pushgateway at addr, eg,
+// http://pushgateway:9091, with the grouping key job, the host name as
+// instance, and target.
+func newPushgatewaySink(addr, job, target string) (*pushgatewaySink, error) {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		return nil, fmt.Errorf("Bad Pushgateway URL %s, expected http:// or https://", addr)
+	}
+	if job == "" {
+		return nil, fmt.Errorf("The Pushgateway job can't be empty")
+	}
+	return &pushgatewaySink{
+		url: strings.TrimSuffix(addr, "/") + "/metrics" + pushgatewayKey("job", job) +
+			pushgatewayKey("instance", hostname()) + pushgatewayKey("target", target),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *pushgatewaySink) record(results []wss.Result, failed int) {
+	if len(results) == 0 {
+		// the metrics of the last run are kept
+		return
+	}
+	// the processes are told apart by their pid and comm
+	labeled := make([]wss.Result, len(results))
+	for i, res := range results {
+		labeled[i] = res
+		if res.PID != 0 {
+			labeled[i].Labels = map[string]string{"pid": strconv.Itoa(res.PID), "comm": wss.Comm(res.PID)}
+			for name, value := range res.Labels {
+				labeled[i].Labels[name] = value
+			}
+		}
+	}
+	var b bytes.Buffer
+	writeMetrics(&b, labeled)
+	// PUT replaces all the metrics of the group, so targets that are gone
+	// are no longer pushed
+	req, err := http.NewRequest("PUT", s.url, &b)
+	if err != nil {
+		slog.Warn("Error pushing to the Pushgateway", "url", s.url, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		slog.Warn("Error pushing to the Pushgateway", "url", s.url, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		slog.Warn("Error pushing to the Pushgateway", "url", s.url, "status", resp.Status, "body", strings.TrimSpace(string(body)))
+	}
+}
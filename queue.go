@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// CYCLE_LOCK_PATH is the default lock file of the idle page cycles of the
+	// wss processes of the host, its modification time the start of the
+	// last one
+	CYCLE_LOCK_PATH = "/run/wss.lock"
+	// CYCLE_LOCK_POLL is the wait between two tries of the lock held by
+	// another wss process
+	CYCLE_LOCK_POLL = 100 * time.Millisecond
+)
+
+// cycleQueue runs the idle page cycles of wss one at a time, in the order
+// they are queued, as they would interfere in the idle bitmap, global to
+// the host: those of the schedules, and of the on-demand measurements, and
+// with lock, those of the other wss processes of the host, eg, wss agent
+// and wss serve. A cycle resets the bitmap cooldown after the last reset on
+// the host at the earliest, sparing the workloads back-to-back cycles.
+type cycleQueue struct {
+	turn     chan struct{}
+	lock     string
+	cooldown time.Duration
+	// the last reset of this process, without lock
+	last   time.Time
+	warned bool
+}
+
+func newCycleQueue(lock string, cooldown time.Duration) *cycleQueue {
+	return &cycleQueue{turn: make(chan struct{}, 1), lock: lock, cooldown: cooldown}
+}
+
+// acquire waits for the turn of a cycle, the lock of the host, and the
+// cooldown, until ctx is done, and returns the release of the turn.
+func (q *cycleQueue) acquire(ctx context.Context) (func(), error) {
+	select {
+	case q.turn <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	f, err := q.lockHost(ctx)
+	if err != nil {
+		<-q.turn
+		return nil, err
+	}
+	release := func() {
+		if f != nil {
+			syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+			f.Close()
+		}
+		<-q.turn
+	}
+
+	last := q.last
+	if f != nil {
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			last = info.ModTime()
+		}
+	}
+	if wait := time.Until(last.Add(q.cooldown)); wait > 0 {
+		slog.Debug("Cooling down", "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	q.last = time.Now()
+	if f != nil {
+		// the start of the cycle, for the cooldown of the next one
+		if err := f.Truncate(0); err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+		}
+	}
+	return release, nil
+}
+
+// lockHost takes the lock file of the host, if any, until ctx is done. The
+// cycles of this process are still serialized without it, eg, when it can't
+// be created.
+func (q *cycleQueue) lockHost(ctx context.Context) (*os.File, error) {
+	if q.lock == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(q.lock, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		q.warn(err)
+		return nil, nil
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			q.warn(err)
+			return nil, nil
+		}
+		select {
+		case <-time.After(CYCLE_LOCK_POLL):
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// warn logs the first error of the lock of the host.
+func (q *cycleQueue) warn(err error) {
+	if !q.warned {
+		slog.Warn("Error taking the cycle lock, not waiting for the other wss processes", "lock", q.lock, "err", err)
+		q.warned = true
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// reclaimer recommends, and optionally applies, a proactive reclaim of a
+// cgroup v2 from the cold memory of its processes.
+type reclaimer struct {
+	cgroup string // as given on the command line, the label of its total
+	path   string
+	apply  bool
+}
+
+// newReclaimer returns the reclaimer of the cgroup, which must be a cgroup
+// v2 with the memory controller.
+func newReclaimer(cgroup string, apply bool) (*reclaimer, error) {
+	path, err := wss.ResolveCgroup(cgroup)
+	if err != nil {
+		return nil, err
+	}
+	// a cgroup v1 has no memory.current
+	if _, err := wss.CgroupMemoryCurrent(path); err != nil {
+		return nil, err
+	}
+	return &reclaimer{cgroup: cgroup, path: path, apply: apply}, nil
+}
+
+// recommend returns the bytes deemed safe to reclaim from the cgroup, with
+// total the total of its processes: their reclaimable cold memory, at most
+// the memory charged to the cgroup, as the RSS of the processes counts their
+// shared pages once per process.
+func (r *reclaimer) recommend(total wss.Result) (uint64, error) {
+	current, err := wss.CgroupMemoryCurrent(r.path)
+	if err != nil {
+		return 0, err
+	}
+	return min(uint64(total.ReclaimablePages())*uint64(total.PageSize), current), nil
+}
+
+// run prints the recommended reclaim of the cgroup, from its total in
+// totals, and reclaims it with apply. A short reclaim is only reported.
+func (r *reclaimer) run(totals []wss.Result) error {
+	for _, total := range totals {
+		if total.Labels["cgroup"] != r.cgroup {
+			continue
+		}
+		bytes, err := r.recommend(total)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reclaim of cgroup %s: %.2f MB recommended, of %.2f MB cold\n", r.cgroup,
+			float64(bytes)/(1024*1024), mb(total.ColdPages(), total.PageSize))
+		if !r.apply || bytes == 0 {
+			return nil
+		}
+		err = wss.CgroupReclaim(r.path, bytes)
+		if errors.Is(err, wss.ErrReclaimShort) {
+			fmt.Printf("%s\n", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reclaimed %.2f MB\n", float64(bytes)/(1024*1024))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CRON_HORIZON bounds the search of the next time of a cron schedule, which
+// may never match, eg, on February 30
+const CRON_HORIZON = 5 * 366 * 24 * time.Hour
+
+// schedule is when the agent measures a target.
+type schedule interface {
+	// next returns the time of the next measurement, of the one started
+	// at start, and finished at now; in the past to measure at once.
+	next(start, now time.Time) time.Time
+	String() string
+}
+
+// everySchedule measures every interval, from the start of the last
+// measurement.
+type everySchedule time.Duration
+
+func (e everySchedule) next(start, now time.Time) time.Time {
+	return start.Add(time.Duration(e))
+}
+
+func (e everySchedule) String() string {
+	return "@every " + time.Duration(e).String()
+}
+
+// cronSchedule measures at the minutes matching a crontab(5) time and date
+// specification, in local time, skipping the times missed while measuring.
+type cronSchedule struct {
+	spec   string
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool // from 1
+	month  [13]bool // from 1
+	dow    [7]bool  // from Sunday
+	// the day of the month and the day of the week are restricted, a day
+	// matching either then matches, as cron does
+	domStar, dowStar bool
+}
+
+// parseSchedule parses a schedule: "@every" and a duration, eg, "@every
+// 5m", a crontab(5) specification of the minute, hour, day of the month,
+// month and day of the week, eg, "15 * * * *", hourly at :15, or one of
+// @hourly, @daily, @weekly and @monthly.
+func parseSchedule(spec string) (schedule, error) {
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("Bad schedule %s, expected a duration of 1s or more", spec)
+		}
+		return everySchedule(every), nil
+	}
+	cron := spec
+	switch spec {
+	case "@hourly":
+		cron = "0 * * * *"
+	case "@daily", "@midnight":
+		cron = "0 0 * * *"
+	case "@weekly":
+		cron = "0 0 * * 0"
+	case "@monthly":
+		cron = "0 0 1 * *"
+	}
+	fields := strings.Fields(cron)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Bad schedule %s, expected @every duration, or the 5 fields of a crontab", spec)
+	}
+	c := &cronSchedule{spec: spec, domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	var dow [8]bool
+	for i, f := range []struct {
+		set      []bool
+		min, max int
+	}{
+		{c.minute[:], 0, 59},
+		{c.hour[:], 0, 23},
+		{c.dom[:], 1, 31},
+		{c.month[:], 1, 12},
+		// 7 is Sunday too
+		{dow[:], 0, 7},
+	} {
+		if err := parseCronField(fields[i], f.set, f.min, f.max); err != nil {
+			return nil, fmt.Errorf("Bad schedule %s: %s", spec, err)
+		}
+	}
+	copy(c.dow[:], dow[:7])
+	c.dow[0] = c.dow[0] || dow[7]
+	return c, nil
+}
+
+// parseCronField sets the values of set matching field, a comma-separated
+// list of *, values and ranges, each with an optional /step, eg, "*/15" or
+// "1-5,10", of min to max.
+func parseCronField(field string, set []bool, min, max int) error {
+	for _, part := range strings.Split(field, ",") {
+		rng, step, hasStep := strings.Cut(part, "/")
+		every := 1
+		if hasStep {
+			var err error
+			if every, err = strconv.Atoi(step); err != nil || every < 1 {
+				return fmt.Errorf("bad step %s", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return fmt.Errorf("bad value %s", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return fmt.Errorf("bad value %s", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%s out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += every {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// next returns the first minute matching after now. The hours and minutes
+// are stepped in elapsed time, as time.Date normalizes the times skipped by
+// a DST transition to before it, and picks either of those repeated.
+func (c *cronSchedule) next(start, now time.Time) time.Time {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	for horizon := now.Add(CRON_HORIZON); t.Before(horizon); {
+		var next time.Time
+		switch {
+		case !c.month[t.Month()]:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.day(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour[t.Hour()]:
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case !c.minute[t.Minute()]:
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if !next.After(t) {
+			// a midnight skipped by a DST transition
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	// never, in practice
+	return now.Add(CRON_HORIZON)
+}
+
+// day reports whether the day of t matches.
+func (c *cronSchedule) day(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[t.Weekday()]
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (c *cronSchedule) String() string {
+	return c.spec
+}
+
+// job is a measurement of the agent on a schedule: of the pods, if pods, of
+// targets, and of those discovered by rules. The jobs due at the same time are measured in the same
+// idle page cycle.
+type job struct {
+	key      string
+	pods     bool
+	targets  []*selector
+	rules    []*rule
+	schedule schedule
+	// of the next measurement
+	due time.Time
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// values returns the values set in set.
+func values(set []bool) []int {
+	var v []int
+	for i, ok := range set {
+		if ok {
+			v = append(v, i)
+		}
+	}
+	return v
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+	}{
+		{"*", 0, 6, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"5", 0, 59, []int{5}},
+		{"5/20", 0, 59, []int{5, 25, 45}},
+		{"1-5", 1, 31, []int{1, 2, 3, 4, 5}},
+		{"1-10/3", 1, 31, []int{1, 4, 7, 10}},
+		{"0-23/6", 0, 23, []int{0, 6, 12, 18}},
+		{"1-5,10,20-21", 1, 31, []int{1, 2, 3, 4, 5, 10, 20, 21}},
+		{"*/5,7", 1, 12, []int{1, 6, 7, 11}},
+	}
+	for _, tt := range tests {
+		set := make([]bool, tt.max+1)
+		if err := parseCronField(tt.field, set, tt.min, tt.max); err != nil {
+			t.Errorf("parseCronField(%q) failed: %s", tt.field, err)
+			continue
+		}
+		if got := values(set); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCronField(%q) = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronFieldErrors(t *testing.T) {
+	tests := []struct {
+		field, want string
+	}{
+		{"*/0", "bad step */0"},
+		{"*/x", "bad step */x"},
+		{"x", "bad value x"},
+		{"1-x", "bad value 1-x"},
+		{"60", "60 out of range 0-59"},
+		{"10-5", "10-5 out of range 0-59"},
+		{"50-60/2", "50-60/2 out of range 0-59"},
+	}
+	for _, tt := range tests {
+		set := make([]bool, 60)
+		err := parseCronField(tt.field, set, 0, 59)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parseCronField(%q) error = %v, want %q", tt.field, err, tt.want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	s, err := parseSchedule("@every 5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	if got := s.next(start, start.Add(time.Minute)); !got.Equal(start.Add(5 * time.Minute)) {
+		t.Errorf("@every 5m next = %s, want 5m after the start", got)
+	}
+
+	tests := []struct {
+		spec string
+		dow  []int
+	}{
+		{"0 0 * * 7", []int{0}},
+		{"0 0 * * 0", []int{0}},
+		{"0 0 * * 5-7", []int{0, 5, 6}},
+		{"0 0 * * 1-5", []int{1, 2, 3, 4, 5}},
+		{"@weekly", []int{0}},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q) failed: %s", tt.spec, err)
+			continue
+		}
+		if got := values(s.(*cronSchedule).dow[:]); !reflect.DeepEqual(got, tt.dow) {
+			t.Errorf("parseSchedule(%q) days of the week = %v, want %v", tt.spec, got, tt.dow)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct {
+		spec, want string
+	}{
+		{"@every 500ms", "Bad schedule @every 500ms, expected a duration of 1s or more"},
+		{"@every soon", "Bad schedule @every soon, expected a duration of 1s or more"},
+		{"@yearly", "Bad schedule @yearly, expected @every duration, or the 5 fields of a crontab"},
+		{"* * * *", "Bad schedule * * * *, expected @every duration, or the 5 fields of a crontab"},
+		{"61 * * * *", "Bad schedule 61 * * * *: 61 out of range 0-59"},
+		{"0 0 0 * *", "Bad schedule 0 0 0 * *: 0 out of range 1-31"},
+		{"0 0 * 13 *", "Bad schedule 0 0 * 13 *: 13 out of range 1-12"},
+		{"0 0 * * 8", "Bad schedule 0 0 * * 8: 8 out of range 0-7"},
+	}
+	for _, tt := range tests {
+		_, err := parseSchedule(tt.spec)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parseSchedule(%q) error = %v, want %q", tt.spec, err, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(month time.Month, day, hour, minute, sec int) time.Time {
+		return time.Date(2024, month, day, hour, minute, sec, 0, time.UTC)
+	}
+	tests := []struct {
+		spec      string
+		now, want time.Time
+	}{
+		// the next minute, never now
+		{"* * * * *", utc(5, 1, 10, 0, 30), utc(5, 1, 10, 1, 0)},
+		{"* * * * *", utc(5, 1, 10, 0, 0), utc(5, 1, 10, 1, 0)},
+		{"*/15 * * * *", utc(5, 1, 10, 0, 0), utc(5, 1, 10, 15, 0)},
+		{"*/15 * * * *", utc(5, 1, 10, 50, 0), utc(5, 1, 11, 0, 0)},
+		{"0 9-17/4 * * *", utc(5, 1, 13, 0, 0), utc(5, 1, 17, 0, 0)},
+		{"0 9-17/4 * * *", utc(5, 1, 17, 0, 0), utc(5, 2, 9, 0, 0)},
+		{"@monthly", utc(12, 15, 0, 0, 0), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// 2024-10-11 is a Friday, the 13th a Sunday: either matches when
+		// both are restricted
+		{"0 0 13 * 5", utc(10, 10, 12, 0, 0), utc(10, 11, 0, 0, 0)},
+		{"0 0 13 * 5", utc(10, 11, 0, 0, 0), utc(10, 13, 0, 0, 0)},
+		{"0 0 13 * 5", utc(10, 13, 0, 0, 0), utc(10, 18, 0, 0, 0)},
+		// only one of them otherwise
+		{"0 0 13 * *", utc(10, 10, 12, 0, 0), utc(10, 13, 0, 0, 0)},
+		{"0 0 * * 5", utc(10, 11, 0, 0, 0), utc(10, 18, 0, 0, 0)},
+		{"0 0 * * 7", utc(10, 11, 0, 0, 0), utc(10, 13, 0, 0, 0)},
+		// February 29 of the next leap year
+		{"0 0 29 2 *", utc(3, 1, 0, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// never
+		{"0 0 30 2 *", utc(1, 1, 0, 0, 0), utc(1, 1, 0, 0, 0).Add(CRON_HORIZON)},
+		{"0 0 31 4,6,9,11 *", utc(1, 1, 0, 0, 0), utc(1, 1, 0, 0, 0).Add(CRON_HORIZON)},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("parseSchedule(%q) failed: %s", tt.spec, err)
+		}
+		if got := s.next(tt.now, tt.now); !got.Equal(tt.want) {
+			t.Errorf("%q next after %s = %s, want %s", tt.spec, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, ny)
+	}
+	// 2024-03-10 02:00 EST is 03:00 EDT, 2024-11-03 02:00 EDT is 01:00 EST:
+	// 01:30 is 90 minutes after midnight, then 150
+	midnight := at(11, 3, 0, 0)
+	tests := []struct {
+		name, spec string
+		now, want  time.Time
+	}{
+		{"hourly over the gap", "0 * * * *", at(3, 10, 1, 30), at(3, 10, 3, 0)},
+		{"a minute over the gap", "* * * * *", at(3, 10, 1, 59), at(3, 10, 3, 0)},
+		{"skipped time of the day", "30 2 * * *", at(3, 10, 0, 0), at(3, 11, 2, 30)},
+		{"daily after the gap", "0 4 * * *", at(3, 10, 0, 0), at(3, 10, 4, 0)},
+		{"hourly into the repeated hour", "0 * * * *", at(11, 3, 0, 30), midnight.Add(time.Hour)},
+		{"hourly through the repeated hour", "0 * * * *", midnight.Add(90 * time.Minute), midnight.Add(2 * time.Hour)},
+		{"hourly out of the repeated hour", "0 * * * *", midnight.Add(150 * time.Minute), midnight.Add(3 * time.Hour)},
+		{"quarter hours through the fold", "*/15 * * * *", midnight.Add(110 * time.Minute), midnight.Add(2 * time.Hour)},
+		{"daily after the fold", "0 3 * * *", at(11, 3, 0, 0), at(11, 3, 3, 0)},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("parseSchedule(%q) failed: %s", tt.spec, err)
+		}
+		got := s.next(tt.now, tt.now)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: %q next after %s = %s, want %s", tt.name, tt.spec, tt.now, got, tt.want)
+		}
+		if !got.After(tt.now) {
+			t.Errorf("%s: %q next %s not after %s", tt.name, tt.spec, got, tt.now)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+func serveUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("USAGE: wss serve [options] PID...")
+		fmt.Println("       wss serve --api|--grpc address [options] [PID...]")
+		fs.PrintDefaults()
+		fmt.Println("   eg,")
+		fmt.Println("\twss serve --listen :9400 181 182  # export WSS of PIDs 181 and 182")
+		fmt.Println("\twss serve --api --listen :9400  # measure processes and cgroups on demand, with the HTTP API")
+		fmt.Println("\twss serve --grpc :7443  # measure processes and cgroups on demand, with the WSS service of wss.proto")
+		fmt.Println("\twss serve --pprof --listen :9400 181  # also serve the profiles and Go runtime metrics of wss itself")
+	}
+}
+
+// serveMain runs the Prometheus exporter: the targets are measured on a
+// schedule and the last results are served on /metrics. With --api or
+// --grpc, the API or the gRPC service measure targets on demand, alongside.
+func serveMain(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":9400", "`address` to serve /metrics on")
+	duration := fs.Float64("duration", 1, "measurement duration in `secs`")
+	interval := fs.Float64("interval", 60, "`secs` between the start of measurements")
+	grace := fs.Float64("grace", GRACE, "on SIGTERM, `secs` given to the measurement in flight to finish before abandoning it")
+	window := fs.Float64("window", WINDOW, "summarize the WSS of every PID over the measurements of the last `secs` on /metrics, its quantiles, 0 for none")
+	statsd := fs.String("statsd", "", "also send the results to the StatsD, or DogStatsD, server at the UDP `host:port`")
+	influx := fs.String("influx", "", "also write the results in line protocol to the InfluxDB, or Telegraf, write `url`, with the token of $INFLUX_TOKEN, - for stdout")
+	graphite := fs.String("graphite", "", "also send the results to the Graphite carbon server at the TCP `host:port`, in the plaintext protocol")
+	graphitePrefix := fs.String("graphite-prefix", GRAPHITE_PREFIX, "`prefix` of the Graphite metric paths")
+	store := fs.String("store", "", "also record the results in the SQLite history database `file` (builds with -tags sqlite)")
+	maxCPU := fs.Float64("max-cpu-pct", 0, "cap the CPU time of wss while setting, loading and walking the page flags to `percent` of a CPU, with pauses, trading longer scans for less interference with latency-sensitive workloads, 0 for no cap")
+	ioUring := fs.Bool("io-uring", false, "read the page maps and the idle bitmap in batches with io_uring, a system call per batch, for processes with thousands of mappings, falling back to pread where unavailable")
+	parallelism := fs.Int("parallelism", 1, "walk the mappings of a process with `N` goroutines, bounding the concurrent walks of a measurement")
+	cooldown := fs.Float64("cooldown", 0, "start the measurements `secs` after the start of the last one of the host at the earliest, those of the other wss processes included")
+	cycleLock := fs.String("cycle-lock", CYCLE_LOCK_PATH, "lock `file` of the measurements of the wss processes of the host, which take turns, \"\" for none")
+	sparse := fs.Bool("sparse", false, "only load the chunks of the idle bitmap of the pages mapped by the measured processes, rather than the bitmap of the whole host, for less memory on large hosts")
+	idleChunk := bytesFlag(wss.IDLEMAP_BUF_SIZE)
+	fs.Var(&idleChunk, "idle-chunk", "`size` of the idle bitmap set per write, eg, 64K, in bytes without a unit, a multiple of 8 bytes, up to 1M")
+	idleDelay := fs.Float64("idle-delay", 0, "pause `secs` between the writes of the idle bitmap, eg, 0.0001, to spread the setting of the idle flags of large hosts over time")
+	pprof := fs.Bool("pprof", false, "also serve the profiles of wss itself on /debug/pprof/, and its Go runtime metrics on /debug/metrics, on --listen")
+	debugListen := fs.String("debug-listen", "", "serve /debug/pprof/ and /debug/metrics on `address` instead, eg, localhost:6060, out of reach of the scrapers")
+	apiOn := fs.Bool("api", false, "also serve the measurement API on --listen: POST /v1/measurements to queue one, GET /v1/measurements/ID for its result; the PIDs are optional")
+	grpcAddr := fs.String("grpc", "", "also serve the gRPC WSS service of wss.proto on `address`, eg, :7443, the PIDs are optional")
+	grpcCert := fs.String("grpc-cert", "", "TLS certificate `file` of the gRPC service, cleartext HTTP/2 without")
+	grpcKey := fs.String("grpc-key", "", "TLS key `file` of the gRPC service")
+	logging := addLogFlags(fs)
+	fs.Usage = serveUsage(fs)
+	fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+
+	if fs.NArg() < 1 && *grpcAddr == "" && !*apiOn {
+		fs.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	var pids []int
+	for _, arg := range fs.Args() {
+		pid, err := parsePID(arg)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		pids = append(pids, pid)
+	}
+	if *duration < 0.01 {
+		fmt.Println("Interval too short. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *grace < 0 || *window < 0 {
+		fmt.Println("Grace and window must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *maxCPU < 0 || *cooldown < 0 {
+		fmt.Println("Max CPU percent and cooldown must be >= 0. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *parallelism < 1 {
+		fmt.Println("Parallelism must be >= 1. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	checkIdleFlags(idleChunk, *idleDelay)
+	if (*grpcCert == "") != (*grpcKey == "") {
+		fmt.Println("--grpc-cert and --grpc-key go together. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+
+	exp := newExporter()
+	exp.window = time.Duration(*window * float64(time.Second))
+	sinks := []sink{exp}
+	if *statsd != "" {
+		s, err := newStatsdSink(*statsd)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		sinks = append(sinks, s)
+	}
+	if *influx != "" {
+		s, err := newInfluxSink(*influx)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		sinks = append(sinks, s)
+	}
+	if *graphite != "" {
+		s, err := newGraphiteSink(*graphite, *graphitePrefix)
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+		sinks = append(sinks, s)
+	}
+	if *store != "" {
+		s, err := newStoreSink(*store, "PIDs "+strings.Join(fs.Args(), ","))
+		if err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(exitStatus(err, 0))
+		}
+		sinks = append(sinks, s)
+	}
+	scanner := wss.NewScanner()
+	scanner.MaxCPU = *maxCPU
+	scanner.IdleChunk = int(idleChunk)
+	scanner.IdleDelay = time.Duration(*idleDelay * float64(time.Second))
+	scanner.Sparse = *sparse
+	scanner.IOUring = *ioUring
+	if err := scanner.Check(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
+	}
+	// the API, the RPCs and the schedule take turns
+	scanner.Parallelism = *parallelism
+	m := &measurer{scanner: scanner, queue: newCycleQueue(*cycleLock, time.Duration(*cooldown*float64(time.Second)))}
+	if *grpcAddr != "" {
+		go func() {
+			if err := serveGRPC(*grpcAddr, newGRPCServer(m), *grpcCert, *grpcKey); err != nil {
+				slog.Error("Error serving gRPC", "err", err)
+				os.Exit(exitStatus(err, 0))
+			}
+		}()
+	}
+	d := &daemon{listen: *listen, mux: http.NewServeMux(), debug: *debugListen, grace: time.Duration(*grace * float64(time.Second))}
+	if len(pids) > 0 {
+		meta := newContainerMetadata(wss.CRIEndpoint())
+		d.loop = func(stop, ctx context.Context) {
+			for stop.Err() == nil {
+				start := time.Now()
+				results, err := m.measure(ctx, pids, time.Duration(*duration*float64(time.Second)))
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					slog.Warn("Error measuring", "err", err)
+				}
+				for i := range results {
+					results[i].Labels = map[string]string{
+						"pid":  strconv.Itoa(results[i].PID),
+						"comm": wss.Comm(results[i].PID),
+					}
+					meta.label(&results[i])
+				}
+				for _, s := range sinks {
+					s.record(results, len(pids)-len(results))
+				}
+				select {
+				case <-stop.Done():
+				case <-time.After(time.Until(start.Add(time.Duration(*interval * float64(time.Second))))):
+				}
+			}
+		}
+	} else if *grpcAddr != "" && !*apiOn && !*pprof {
+		// the RPCs only
+		d.listen = ""
+	}
+
+	if d.listen != "" {
+		d.mux.Handle("/metrics", exp)
+		if *apiOn {
+			newAPI(m).register(d.mux)
+		}
+		if *pprof && *debugListen == "" {
+			debugHandlers(d.mux)
+		}
+		slog.Info("Serving WSS metrics", "pids", len(pids), "listen", *listen, "api", *apiOn)
+	}
+	d.run()
+}
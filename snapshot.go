@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+func snapshotUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("USAGE: wss snapshot [options] PID")
+		fs.PrintDefaults()
+		fmt.Println("   eg,")
+		fmt.Println("\twss snapshot 181 -o db1-181.snap  # capture the pages of PID 181 referenced during a second, for wss analyze")
+		fmt.Println("\twss snapshot --duration 60 --page-flags 181 -o db1-181.snap  # during a minute, with the huge pages and KSM pages")
+	}
+}
+
+// snapshotMain measures a process, and saves the raw data walked, the
+// pagemap entries and referenced flags of its mappings, to a file, to be
+// analyzed offline with wss analyze, eg, on another host.
+func snapshotMain(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	path := fs.String("o", "", "`file` to write the snapshot to, default wss-PID.snap, - for stdout")
+	duration := fs.Float64("duration", 1, "measurement duration in `secs`")
+	backend := backendFlag(wss.BACKEND_IDLE)
+	fs.Var(&backend, "backend", "`method` of finding the referenced pages: idle (page_idle bitmap) or softdirty (pages written, from the soft-dirty bits)")
+	var only kindList
+	fs.Var(&only, "only", "only capture the mappings of these `kinds`: anon|file|heap|stack|shmem, comma-separated")
+	var mapFilter regexpFlag
+	fs.Var(&mapFilter, "map-filter", "only capture the mappings whose path matches this `regexp`")
+	targeted := fs.Bool("targeted", false, "only set the idle flags of the pages of the process, leaving the other processes alone")
+	pageFlags := fs.Bool("page-flags", false, "also capture the /proc/kpageflags of the pages, for the --hugepages, --ksm, --locked and --zero-pages of wss analyze")
+	rollup := fs.Bool("rollup", false, "also capture the Rss, Pss and Referenced memory of smaps_rollup")
+	logging := addLogFlags(fs)
+	fs.Usage = snapshotUsage(fs)
+	fs.Parse(args)
+	// the options may also follow the PID
+	var pid int
+	if fs.NArg() > 0 {
+		var err error
+		if pid, err = strconv.Atoi(fs.Arg(0)); err != nil || pid <= 0 {
+			fmt.Printf("Bad PID %s. Exiting.\n", fs.Arg(0))
+			os.Exit(EXIT_USAGE)
+		}
+		fs.Parse(fs.Args()[1:])
+	}
+	if err := logging.setup(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+
+	if pid == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	if *duration < 0.01 {
+		fmt.Println("Interval too short. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if backend != wss.BACKEND_IDLE && backend != wss.BACKEND_SOFTDIRTY {
+		fmt.Printf("The %s backend can't capture the pages, expected idle or softdirty. Exiting.\n", backend)
+		os.Exit(EXIT_USAGE)
+	}
+	if *targeted && backend != wss.BACKEND_IDLE {
+		fmt.Println("--targeted needs the idle backend. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if *path == "" {
+		*path = fmt.Sprintf("wss-%d.snap", pid)
+	}
+
+	scanner := wss.NewScanner()
+	scanner.Backend = string(backend)
+	scanner.Only = only
+	scanner.MapFilter = mapFilter.re
+	scanner.Targeted = *targeted
+	scanner.PageFlags = *pageFlags
+	scanner.Rollup = *rollup
+	if err := scanner.Check(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
+	}
+	defer scanner.Close()
+
+	// Ctrl-C ends the measurement early, and saves what was walked so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *path != "-" {
+		fmt.Printf("Capturing PID %d page references during %.2f seconds...\n", pid, *duration)
+	}
+	snap, err := scanner.CaptureContext(ctx, pid, time.Duration(*duration*float64(time.Second)))
+	if snap == nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
+	}
+	snap.Host = hostname()
+	if err := writeSnapshot(*path, snap); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_ERROR)
+	}
+	if *path != "-" {
+		res := snap.Result
+		fmt.Printf("Saved %d mappings, %.2f MB walked, %.2f MB referenced, to %s\n", len(snap.Maps), mb(res.WalkedPages, res.PageSize), res.ReferencedMB(), *path)
+	}
+	if err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 1))
+	}
+}
+
+// writeSnapshot writes snap to the file path, or to stdout for "-".
+func writeSnapshot(path string, snap *wss.Snapshot) error {
+	if path == "-" {
+		return snap.Write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Can't create snapshot %s", err)
+	}
+	if err := snap.Write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("Can't write snapshot %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Can't write snapshot %s", err)
+	}
+	return nil
+}
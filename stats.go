@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// summary is the distribution of the Ref(MB) of a process, or of a total,
+// over the runs of repeat mode.
+type summary struct {
+	// pid is the PID, or "total"
+	pid    string
+	labels map[string]string
+	runs   int
+	min    float64
+	max    float64
+	mean   float64
+	median float64
+	p95    float64
+}
+
+// runStats collects the Ref(MB) of the processes and totals of every run.
+type runStats struct {
+	runs   int
+	keys   []string
+	series map[string]*series
+}
+
+type series struct {
+	pid    string
+	labels map[string]string
+	values []float64
+}
+
+func newRunStats() *runStats {
+	return &runStats{series: make(map[string]*series)}
+}
+
+// add adds the results and totals of a run.
+func (r *runStats) add(results, totals []wss.Result) {
+	r.runs++
+	for _, res := range results {
+		r.value(strconv.Itoa(res.PID), nil, res)
+	}
+	for _, res := range totals {
+		r.value("total", res.Labels, res)
+	}
+}
+
+func (r *runStats) value(pid string, labels map[string]string, res wss.Result) {
+	key := pid + " " + formatLabels(labels)
+	s, ok := r.series[key]
+	if !ok {
+		s = &series{pid: pid, labels: labels}
+		r.series[key] = s
+		r.keys = append(r.keys, key)
+	}
+	s.values = append(s.values, res.ReferencedMB())
+}
+
+// summaries returns the summaries of the processes and totals, in the order
+// they were first measured.
+func (r *runStats) summaries() []summary {
+	sums := make([]summary, 0, len(r.keys))
+	for _, key := range r.keys {
+		s := r.series[key]
+		values := slices.Sorted(slices.Values(s.values))
+		n := len(values)
+		sum := summary{pid: s.pid, labels: s.labels, runs: n, min: values[0], max: values[n-1]}
+		for _, v := range values {
+			sum.mean += v
+		}
+		sum.mean /= float64(n)
+		sum.median = values[n/2]
+		if n%2 == 0 {
+			sum.median = (values[n/2-1] + values[n/2]) / 2
+		}
+		sum.p95 = quantile(values, 0.95)
+		sums = append(sums, sum)
+	}
+	return sums
+}
+
+// writeSummaries writes the summaries as CSV to the file path, or to stdout
+// for "-".
+func writeSummaries(path string, sums []summary) error {
+	f := os.Stdout
+	if path != "-" {
+		var err error
+		if f, err = os.Create(path); err != nil {
+			return fmt.Errorf("Can't write summary file %s", err)
+		}
+		defer f.Close()
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"pid", "runs", "min_mb", "max_mb", "mean_mb", "median_mb", "p95_mb", "labels"})
+	for _, s := range sums {
+		w.Write([]string{
+			s.pid,
+			strconv.Itoa(s.runs),
+			strconv.FormatFloat(s.min, 'f', 2, 64),
+			strconv.FormatFloat(s.max, 'f', 2, 64),
+			strconv.FormatFloat(s.mean, 'f', 2, 64),
+			strconv.FormatFloat(s.median, 'f', 2, 64),
+			strconv.FormatFloat(s.p95, 'f', 2, 64),
+			formatLabels(s.labels),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("Can't write summary file %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// STATSD_PACKET_SIZE is the largest UDP packet sent to StatsD, so it is not
+// fragmented on common networks.
+const STATSD_PACKET_SIZE = 1432
+
+// statsdSink sends the results of every measurement to a StatsD, or
+// DogStatsD, server as gauges, with the labels of each result as DogStatsD
+// tags. The metrics are those of /metrics, named wss.referenced_bytes and so
+// on.
+type statsdSink struct {
+	conn net.Conn
+}
+
+// newStatsdSink returns a sink sending to the StatsD server at addr, a UDP
+// host:port.
+func newStatsdSink(addr string) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Can't connect to StatsD %s", err)
+	}
+	return &statsdSink{conn: conn}, nil
+}
+
+// statsdTags formats the labels of res, with its pid and comm, as DogStatsD
+// tags, sorted by name.
+func statsdTags(res wss.Result) string {
+	labels := make(map[string]string, len(res.Labels)+2)
+	if res.PID != 0 {
+		labels["pid"] = strconv.Itoa(res.PID)
+		labels["comm"] = wss.Comm(res.PID)
+	}
+	for name, value := range res.Labels {
+		labels[name] = value
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	// the separators of the tags and of the fields can't be escaped
+	escaper := strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+	tags := make([]string, 0, len(labels))
+	for name, value := range labels {
+		tags = append(tags, name+":"+escaper.Replace(value))
+	}
+	sort.Strings(tags)
+	return "|#" + strings.Join(tags, ",")
+}
+
+func (s *statsdSink) record(results []wss.Result, failed int) {
+	var lines []string
+	for _, res := range results {
+		tags := statsdTags(res)
+		for _, m := range metrics {
+			if m.name == "wss_last_measurement_timestamp_seconds" {
+				// StatsD timestamps the metrics itself
+				continue
+			}
+			name := strings.Replace(m.name, "wss_", "wss.", 1)
+			value := strconv.FormatFloat(m.value(res), 'f', -1, 64)
+			lines = append(lines, name+":"+value+"|g"+tags)
+		}
+	}
+	lines = append(lines, "wss.measurement_cycles:1|c")
+	if failed > 0 {
+		lines = append(lines, fmt.Sprintf("wss.measurement_errors:%d|c", failed))
+	}
+	// as many lines per packet as fit
+	var packet []byte
+	for i, line := range lines {
+		packet = append(packet, line...)
+		if i+1 < len(lines) && len(packet)+1+len(lines[i+1]) <= STATSD_PACKET_SIZE {
+			packet = append(packet, '\n')
+			continue
+		}
+		if _, err := s.conn.Write(packet); err != nil {
+			slog.Warn("Error sending to StatsD", "addr", s.conn.RemoteAddr(), "err", err)
+			return
+		}
+		packet = packet[:0]
+	}
+}
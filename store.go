@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// STORE_DRIVER is the database/sql driver of the --store history, registered
+// by store_sqlite.go in the builds with -tags sqlite.
+const STORE_DRIVER = "sqlite"
+
+// STORE_SCHEMA creates the tables of the history: a row per result in
+// measurements, the totals with a NULL pid, and with --per-map, a row per
+// mapping walked in mappings. The times are Unix nanoseconds.
+const STORE_SCHEMA = `
+CREATE TABLE IF NOT EXISTS measurements (
+	id INTEGER PRIMARY KEY,
+	time INTEGER NOT NULL,
+	target TEXT NOT NULL,
+	pid INTEGER,
+	comm TEXT,
+	labels TEXT NOT NULL,
+	duration_seconds REAL NOT NULL,
+	referenced_bytes INTEGER NOT NULL,
+	walked_bytes INTEGER NOT NULL,
+	resident_bytes INTEGER NOT NULL,
+	swapped_bytes INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS measurements_time ON measurements (time);
+CREATE INDEX IF NOT EXISTS measurements_pid ON measurements (pid, time);
+CREATE TABLE IF NOT EXISTS mappings (
+	measurement_id INTEGER NOT NULL REFERENCES measurements (id),
+	start_address INTEGER NOT NULL,
+	end_address INTEGER NOT NULL,
+	perms TEXT NOT NULL,
+	file_offset INTEGER NOT NULL,
+	path TEXT NOT NULL,
+	referenced_bytes INTEGER NOT NULL,
+	walked_bytes INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS mappings_measurement ON mappings (measurement_id);
+`
+
+// errNoSQLite is the error of --store in the builds without SQLite.
+type errNoSQLite struct{}
+
+func (errNoSQLite) Error() string {
+	return "This wss is built without SQLite, rebuild it with -tags sqlite for --store"
+}
+
+func (errNoSQLite) Unwrap() error {
+	return errors.ErrUnsupported
+}
+
+// storeSink persists the results of every measurement in the SQLite history
+// database, for later querying, eg, with the sqlite3 shell, without a TSDB.
+type storeSink struct {
+	db     *sql.DB
+	path   string
+	target string
+}
+
+// newStoreSink opens, or creates, the history database path, recording the
+// results of the target, a description of the measured processes.
+func newStoreSink(path, target string) (*storeSink, error) {
+	if !slices.Contains(sql.Drivers(), STORE_DRIVER) {
+		return nil, errNoSQLite{}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Can't create the history directory %s", err)
+	}
+	db, err := sql.Open(STORE_DRIVER, path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open the history %s", err)
+	}
+	// a single writer, and the readers querying while the measurements are
+	// recorded
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000", STORE_SCHEMA} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Can't create the history %s", err)
+		}
+	}
+	return &storeSink{db: db, path: path, target: target}, nil
+}
+
+// insert records the results in a transaction.
+func (s *storeSink) insert(results []wss.Result) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, res := range results {
+		var pid, comm any
+		if res.PID != 0 {
+			pid, comm = res.PID, wss.Comm(res.PID)
+		}
+		pagesize := int64(res.PageSize)
+		row, err := tx.Exec(`INSERT INTO measurements (time, target, pid, comm, labels, duration_seconds,
+			referenced_bytes, walked_bytes, resident_bytes, swapped_bytes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			res.Time.UnixNano(), s.target, pid, comm, formatLabels(res.Labels), res.Est.Seconds(),
+			int64(res.ReferencedBytes()), int64(res.WalkedPages)*pagesize, int64(res.RssPages)*pagesize, int64(res.SwappedPages)*pagesize)
+		if err != nil {
+			return err
+		}
+		if len(res.Maps) == 0 {
+			continue
+		}
+		id, err := row.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for _, m := range res.Maps {
+			if _, err := tx.Exec(`INSERT INTO mappings (measurement_id, start_address, end_address, perms, file_offset,
+				path, referenced_bytes, walked_bytes) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				id, int64(m.Start), int64(m.End), m.Perms, int64(m.Offset), m.Path,
+				int64(m.ActivePages)*pagesize, int64(m.WalkedPages)*pagesize); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *storeSink) record(results []wss.Result, failed int) {
+	if len(results) == 0 {
+		return
+	}
+	if err := s.insert(results); err != nil {
+		slog.Warn("Error recording the history", "path", s.path, "err", err)
+	}
+}
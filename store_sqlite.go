@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package main
+
+// the SQLite driver of --store, in pure Go, so wss builds without cgo
+import _ "modernc.org/sqlite"
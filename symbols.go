@@ -0,0 +1,200 @@
+package main
+
+import (
+	"cmp"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// elfSymbols are the functions and sections of an ELF file, to resolve the
+// file offsets of its mappings.
+type elfSymbols struct {
+	progs    []elf.ProgHeader // PT_LOAD
+	sections []*elf.Section
+	funcs    []elf.Symbol // by address
+	// maxSize is the size of the largest function
+	maxSize uint64
+}
+
+// loadSymbols reads the symbols of the ELF file path, those of the symbol
+// table, or the dynamic ones of a stripped file.
+func loadSymbols(path string) (*elfSymbols, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &elfSymbols{}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD {
+			s.progs = append(s.progs, p.ProgHeader)
+		}
+	}
+	for _, sec := range f.Sections {
+		if sec.Flags&elf.SHF_ALLOC != 0 && sec.Size > 0 {
+			s.sections = append(s.sections, sec)
+		}
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		syms, _ = f.DynamicSymbols()
+	}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value != 0 {
+			s.funcs = append(s.funcs, sym)
+		}
+	}
+	slices.SortFunc(s.funcs, func(a, b elf.Symbol) int {
+		return cmp.Or(cmp.Compare(a.Value, b.Value), strings.Compare(a.Name, b.Name))
+	})
+	// aliases, eg, memcpy and __memcpy, are the same function
+	s.funcs = slices.CompactFunc(s.funcs, func(a, b elf.Symbol) bool {
+		return a.Value == b.Value && a.Size == b.Size
+	})
+	for _, sym := range s.funcs {
+		s.maxSize = max(s.maxSize, sym.Size)
+	}
+	return s, nil
+}
+
+// vaddr returns the address in the ELF file of the file offset off, and
+// whether it is loaded.
+func (s *elfSymbols) vaddr(off uint64) (uint64, bool) {
+	for _, p := range s.progs {
+		if off >= p.Off && off < p.Off+p.Filesz {
+			return p.Vaddr + off - p.Off, true
+		}
+	}
+	return 0, false
+}
+
+// section returns the name of the section at addr, or "?".
+func (s *elfSymbols) section(addr uint64) string {
+	for _, sec := range s.sections {
+		if addr >= sec.Addr && addr < sec.Addr+sec.Size {
+			return sec.Name
+		}
+	}
+	return "?"
+}
+
+// lookup returns the functions overlapping the addresses lo to hi.
+func (s *elfSymbols) lookup(lo, hi uint64) []elf.Symbol {
+	var funcs []elf.Symbol
+	i := sort.Search(len(s.funcs), func(i int) bool { return s.funcs[i].Value >= hi })
+	for i--; i >= 0 && s.funcs[i].Value+s.maxSize >= lo; i-- {
+		sym := s.funcs[i]
+		if sym.Value+max(sym.Size, 1) > lo {
+			funcs = append(funcs, sym)
+		}
+	}
+	return funcs
+}
+
+// hotSymbol is a function, or a section without symbols, of an executable
+// mapping, with the pages of it referenced.
+type hotSymbol struct {
+	file, section, name string
+	size                uint64
+	pages               int
+}
+
+// symbolizer resolves the pages referenced of the executable mappings to
+// the functions they hold, the --hot-symbols, keeping the symbols of the
+// files read, by device and inode.
+type symbolizer struct {
+	files map[string]*elfSymbols
+}
+
+func newSymbolizer() *symbolizer {
+	return &symbolizer{files: make(map[string]*elfSymbols)}
+}
+
+// symbols returns the symbols of the file of m mapped by pid, in its mount
+// namespace, or nil if they can't be read, eg, the file was deleted.
+func (z *symbolizer) symbols(pid int, m wss.Mapping) *elfSymbols {
+	key := fmt.Sprintf("%s %d", m.Dev, m.Inode)
+	if s, ok := z.files[key]; ok {
+		return s
+	}
+	s, err := loadSymbols(fmt.Sprintf("/proc/%d/root%s", pid, m.Path))
+	if err != nil {
+		slog.Debug("Can't read symbols", "path", m.Path, "err", err)
+	}
+	z.files[key] = s
+	return s
+}
+
+// hot returns the functions, or sections without symbols, of the pages
+// referenced of the executable file mappings of res, walked with
+// Scanner.HotPages, by decreasing pages referenced.
+func (z *symbolizer) hot(res wss.Result) []*hotSymbol {
+	pagesize := uint64(res.PageSize)
+	byName := make(map[string]*hotSymbol)
+	var hot []*hotSymbol
+	add := func(file, section, name string, size uint64) {
+		key := file + " " + section + " " + name
+		h, ok := byName[key]
+		if !ok {
+			h = &hotSymbol{file: file, section: section, name: name, size: size}
+			byName[key] = h
+			hot = append(hot, h)
+		}
+		h.pages++
+	}
+	for _, m := range res.Maps {
+		if !m.Is("file") || !strings.Contains(m.Perms, "x") || m.ActivePages == 0 {
+			continue
+		}
+		s := z.symbols(res.PID, m)
+		if s == nil {
+			continue
+		}
+		for i, word := range m.Hot {
+			for word != 0 {
+				page := uint64(i*64 + bits.TrailingZeros64(word))
+				word &= word - 1
+				lo, ok := s.vaddr(m.Offset + page*pagesize)
+				if !ok {
+					continue
+				}
+				funcs := s.lookup(lo, lo+pagesize)
+				if len(funcs) == 0 {
+					add(m.Path, s.section(lo), "", 0)
+				}
+				for _, sym := range funcs {
+					add(m.Path, s.section(sym.Value), sym.Name, sym.Size)
+				}
+			}
+		}
+	}
+	slices.SortFunc(hot, func(a, b *hotSymbol) int {
+		return cmp.Or(b.pages-a.pages, cmp.Compare(b.size, a.size), strings.Compare(a.name, b.name))
+	})
+	return hot
+}
+
+// print prints the n functions of res with the most pages referenced.
+func (z *symbolizer) print(w io.Writer, res wss.Result, n int) {
+	hot := z.hot(res)
+	if len(hot) > n {
+		hot = hot[:n]
+	}
+	fmt.Fprintf(w, "    %6s %9s %-10s %s\n", "Pages", "Size(KB)", "SECTION", "SYMBOL")
+	for _, h := range hot {
+		name := h.name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "    %6d %9.1f %-10s %s (%s)\n", h.pages, float64(h.size)/1024, h.section, name, filepath.Base(h.file))
+	}
+}
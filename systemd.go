@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// GRACE is the default seconds given to the measurement in flight to
+	// finish on stop
+	GRACE = 10
+	// SHUTDOWN_TIMEOUT bounds the wait for the HTTP requests in flight on
+	// stop
+	SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+// sdNotify sends state, eg, "READY=1", to the service manager on the socket
+// of $NOTIFY_SOCKET, as sd_notify(3), for units of Type=notify. It does
+// nothing when not run by systemd.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdog pings the watchdog of the service manager, of WatchdogSec=, at
+// half its interval, $WATCHDOG_USEC, until ctx is done. It does nothing
+// when the watchdog isn't enabled for this process.
+func watchdog(ctx context.Context) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Error pinging the systemd watchdog", "err", err)
+			}
+		}
+	}
+}
+
+// daemon runs the measurements of wss serve and wss agent, loop, if any,
+// and serves mux on listen, unless "", and the debug endpoints on debug, if
+// any, until SIGTERM or SIGINT. systemd is notified once listening, and its
+// watchdog pinged. On the signal, loop is to stop starting measurements,
+// with stop done, and the measurement in flight is given grace to finish,
+// then abandoned, with ctx cancelled.
+type daemon struct {
+	listen string
+	mux    *http.ServeMux
+	debug  string
+	grace  time.Duration
+	loop   func(stop, ctx context.Context)
+}
+
+// serve serves handler on addr, or exits if it can't listen.
+func serve(addr string, handler http.Handler) *http.Server {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("Error serving metrics", "err", err)
+		os.Exit(exitStatus(err, 0))
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving metrics", "err", err)
+			os.Exit(exitStatus(err, 0))
+		}
+	}()
+	return srv
+}
+
+// run runs the daemon, and returns once stopped.
+func (d *daemon) run() {
+	var servers []*http.Server
+	if d.listen != "" {
+		servers = append(servers, serve(d.listen, d.mux))
+	}
+	if d.debug != "" {
+		mux := http.NewServeMux()
+		debugHandlers(mux)
+		servers = append(servers, serve(d.debug, mux))
+	}
+
+	stop, stopped := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopped()
+	ctx, abandon := context.WithCancel(context.Background())
+	defer abandon()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if d.loop != nil {
+			d.loop(stop, ctx)
+		}
+	}()
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Error notifying systemd", "err", err)
+	}
+	go watchdog(stop)
+
+	<-stop.Done()
+	// a second signal kills wss
+	stopped()
+	sdNotify("STOPPING=1")
+	slog.Info("Stopping", "grace", d.grace)
+	select {
+	case <-done:
+	case <-time.After(d.grace):
+		slog.Warn("Abandoning the measurement in flight")
+		abandon()
+		<-done
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(shutdown)
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// pidList is a flag accepting a comma-separated list of PIDs, and which
+// may be repeated.
+type pidList []int
+
+func (l *pidList) String() string {
+	s := make([]string, len(*l))
+	for i, pid := range *l {
+		s[i] = strconv.Itoa(pid)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (l *pidList) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		pid, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || pid <= 0 {
+			return fmt.Errorf("bad PID %q", field)
+		}
+		*l = append(*l, pid)
+	}
+	return nil
+}
+
+// parsePID parses a PID argument, which must be positive.
+func parsePID(arg string) (int, error) {
+	pid, err := strconv.Atoi(arg)
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("Bad PID %s", arg)
+	}
+	return pid, nil
+}
+
+// regexpFlag is a flag holding a compiled regular expression.
+type regexpFlag struct {
+	re *regexp.Regexp
+}
+
+func (f *regexpFlag) String() string {
+	if f.re == nil {
+		return ""
+	}
+	return f.re.String()
+}
+
+func (f *regexpFlag) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	f.re = re
+	return nil
+}
+
+// group is a set of the selected processes that is reported as a whole,
+// eg, a container, with labels describing it.
+type group struct {
+	labels map[string]string
+	pids   []int
+}
+
+// kindList is a flag accepting a comma-separated list of mapping kinds, and
+// which may be repeated.
+type kindList []string
+
+func (l *kindList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *kindList) Set(value string) error {
+	for _, kind := range strings.Split(value, ",") {
+		if !slices.Contains(wss.MAPPING_KINDS, kind) {
+			return fmt.Errorf("bad mapping kind %q, expected one of %s", kind, strings.Join(wss.MAPPING_KINDS, "|"))
+		}
+		*l = append(*l, kind)
+	}
+	return nil
+}
+
+// backendFlag is a flag accepting one of the measurement backends.
+type backendFlag string
+
+func (b *backendFlag) String() string {
+	return string(*b)
+}
+
+func (b *backendFlag) Set(value string) error {
+	if !slices.Contains(wss.BACKENDS, value) {
+		return fmt.Errorf("bad backend %q, expected one of %s", value, strings.Join(wss.BACKENDS, "|"))
+	}
+	*b = backendFlag(value)
+	return nil
+}
+
+// agesFlag is a flag accepting a comma-separated list of increasing ages in
+// seconds, eg, 1,10,60.
+type agesFlag []time.Duration
+
+func (f *agesFlag) String() string {
+	s := make([]string, len(*f))
+	for i, age := range *f {
+		s[i] = strconv.FormatFloat(age.Seconds(), 'g', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *agesFlag) Set(value string) error {
+	var ages agesFlag
+	for _, field := range strings.Split(value, ",") {
+		secs, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		age := time.Duration(secs * float64(time.Second))
+		if err != nil || age < 10*time.Millisecond || len(ages) > 0 && age <= ages[len(ages)-1] {
+			return fmt.Errorf("bad ages %q, expected increasing seconds >= 0.01, eg, 1,10,60", value)
+		}
+		ages = append(ages, age)
+	}
+	*f = ages
+	return nil
+}
+
+// sampleFlag is a flag accepting the fraction of the pages inspected, 1/N,
+// or N.
+type sampleFlag int
+
+func (f *sampleFlag) String() string {
+	if *f <= 1 {
+		return "1"
+	}
+	return fmt.Sprintf("1/%d", int(*f))
+}
+
+func (f *sampleFlag) Set(value string) error {
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(value), "1/"))
+	if err != nil || n < 1 {
+		return fmt.Errorf("bad sample %q, expected a fraction of the pages, eg, 1/64", value)
+	}
+	*f = sampleFlag(n)
+	return nil
+}
+
+// sizeFlag is a flag accepting a size in bytes, with a unit, eg, 50MB or
+// 1.5G, in powers of 1024 like the MB columns, or in MB without a unit.
+type sizeFlag uint64
+
+// SIZE_UNITS are the units of sizeFlag, by suffix.
+var SIZE_UNITS = map[string]float64{
+	"B": 1,
+	"K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+	"M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+	"G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+	"T": 1 << 40, "TB": 1 << 40, "TIB": 1 << 40,
+}
+
+func (f *sizeFlag) String() string {
+	return fmt.Sprintf("%gMB", float64(*f)/(1<<20))
+}
+
+func (f *sizeFlag) Set(value string) error {
+	n, err := parseSize(value, 1<<20)
+	if err != nil {
+		return fmt.Errorf("bad size %q, expected eg, 50MB or 1.5G", value)
+	}
+	*f = sizeFlag(n)
+	return nil
+}
+
+// bytesFlag is a flag accepting a size in bytes, with a unit like sizeFlag,
+// eg, 64K, or in bytes without a unit.
+type bytesFlag uint64
+
+func (f *bytesFlag) String() string {
+	return strconv.FormatUint(uint64(*f), 10)
+}
+
+func (f *bytesFlag) Set(value string) error {
+	n, err := parseSize(value, 1)
+	if err != nil {
+		return fmt.Errorf("bad size %q, expected eg, 4096 or 64K", value)
+	}
+	*f = bytesFlag(n)
+	return nil
+}
+
+// parseSize parses the size value, with a unit of SIZE_UNITS, or else in
+// units of scale.
+func parseSize(value string, scale float64) (float64, error) {
+	number := strings.TrimRight(value, "BKMGTIbkmgti")
+	if unit := strings.ToUpper(value[len(number):]); unit != "" {
+		var ok bool
+		if scale, ok = SIZE_UNITS[unit]; !ok {
+			return 0, fmt.Errorf("bad unit %q", unit)
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad number %q", number)
+	}
+	return n * scale, nil
+}
+
+// checkIdleFlags exits when the --idle-chunk chunk or the --idle-delay
+// delay of a subcommand are bad.
+func checkIdleFlags(chunk bytesFlag, delay float64) {
+	if chunk%8 != 0 || chunk > wss.MAX_IDLE_CHUNK || delay < 0 {
+		fmt.Printf("The idle chunk must be a multiple of 8 bytes, up to %d, and the idle delay >= 0. Exiting.\n", wss.MAX_IDLE_CHUNK)
+		os.Exit(EXIT_USAGE)
+	}
+}
+
+// errNoProcess is the error of resolving a selector to no process.
+var errNoProcess = errors.New("No process found")
+
+// selector resolves the processes to measure. It is resolved again on every
+// measurement cycle, so processes that restart are picked up.
+type selector struct {
+	pids    pidList
+	name    string
+	cmdline regexpFlag
+	cgroup  string
+	pgid    int
+	sid     int
+	// PID namespace of the PIDs, its inode or a container id|name
+	pidns string
+
+	container    string
+	criContainer string
+	criEndpoint  string
+	pod          string // namespace/name[/container]
+
+	// include the descendants of the given PIDs
+	children bool
+	// the thread of the PID whose mappings only are measured
+	tid int
+
+	// groups found by the last resolve
+	groups []group
+}
+
+// dynamic is true when the targets are searched for rather than given as PIDs.
+func (s *selector) dynamic() bool {
+	return s.children || s.searched()
+}
+
+// searched is true when processes are selected other than by PID.
+func (s *selector) searched() bool {
+	return s.name != "" || s.cmdline.re != nil || s.cgroup != "" || s.pgid != 0 || s.sid != 0 || s.container != "" || s.criContainer != "" || s.pod != ""
+}
+
+func (s *selector) empty() bool {
+	return len(s.pids) == 0 && !s.searched()
+}
+
+func (s *selector) describe() string {
+	var desc []string
+	if len(s.pids) == 1 {
+		desc = append(desc, fmt.Sprintf("PID %d", s.pids[0]))
+	} else if len(s.pids) > 1 {
+		desc = append(desc, "PIDs "+s.pids.String())
+	}
+	if len(s.pids) > 0 && s.pidns != "" {
+		desc[0] += " of PID namespace " + s.pidns
+	}
+	if len(s.pids) > 0 && s.tid != 0 {
+		desc[0] = fmt.Sprintf("thread %d of %s", s.tid, desc[0])
+	}
+	if len(s.pids) > 0 && s.children {
+		desc[0] += " and descendants"
+	}
+	if s.name != "" {
+		desc = append(desc, fmt.Sprintf("processes named %s", s.name))
+	}
+	if s.cmdline.re != nil {
+		desc = append(desc, fmt.Sprintf("processes matching /%s/", s.cmdline.re))
+	}
+	if s.cgroup != "" {
+		desc = append(desc, fmt.Sprintf("cgroup %s", s.cgroup))
+	}
+	if s.pgid != 0 {
+		desc = append(desc, fmt.Sprintf("process group %d", s.pgid))
+	}
+	if s.sid != 0 {
+		desc = append(desc, fmt.Sprintf("session %d", s.sid))
+	}
+	if s.container != "" {
+		desc = append(desc, fmt.Sprintf("container %s", s.container))
+	}
+	if s.criContainer != "" {
+		desc = append(desc, fmt.Sprintf("CRI container %s", s.criContainer))
+	}
+	if s.pod != "" {
+		desc = append(desc, fmt.Sprintf("pod %s", s.pod))
+	}
+	return strings.Join(desc, " and ")
+}
+
+// labels returns the labels of the group pid was found in, if any.
+func (s *selector) labels(pid int) map[string]string {
+	for _, g := range s.groups {
+		if slices.Contains(g.pids, pid) {
+			return g.labels
+		}
+	}
+	return nil
+}
+
+func (s *selector) criSocket() string {
+	if s.criEndpoint != "" {
+		return s.criEndpoint
+	}
+	return wss.CRIEndpoint()
+}
+
+// namespace returns the inode of the PID namespace of pidns, or of the init
+// process of the docker or CRI container pidns.
+func (s *selector) namespace() (uint64, error) {
+	if ns, err := wss.ParsePidNamespace(s.pidns); err == nil {
+		return ns, nil
+	}
+	c, err := wss.InspectContainer(wss.DockerSocket(), s.pidns)
+	if err != nil {
+		var criErr error
+		if c, criErr = wss.InspectCRIContainer(s.criSocket(), s.pidns); criErr != nil {
+			return 0, fmt.Errorf("Can't find PID namespace %s: %s; %s", s.pidns, err, criErr)
+		}
+	}
+	return wss.PidNamespace(c.Pid)
+}
+
+// hostPIDs returns the PIDs given, translated to this host from the PID
+// namespace pidns, if any. They are translated again every time, as the
+// container may have been restarted.
+func (s *selector) hostPIDs() ([]int, error) {
+	if s.pidns == "" || len(s.pids) == 0 {
+		return append([]int(nil), s.pids...), nil
+	}
+	ns, err := s.namespace()
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, len(s.pids))
+	for i, pid := range s.pids {
+		if pids[i], err = wss.HostPID(ns, pid); err != nil {
+			return nil, err
+		}
+	}
+	return pids, nil
+}
+
+// containerGroup returns the group of the processes of container c.
+func containerGroup(c wss.Container) (group, error) {
+	pids, err := wss.CgroupMembers(c.Cgroup)
+	if err != nil {
+		return group{}, err
+	}
+	labels := map[string]string{
+		"container":    c.Name,
+		"container_id": shortID(c.ID),
+	}
+	if c.Image != "" {
+		labels["image"] = c.Image
+	}
+	if ns := c.Labels["io.kubernetes.pod.namespace"]; ns != "" {
+		labels["namespace"] = ns
+		labels["pod"] = c.Labels["io.kubernetes.pod.name"]
+	}
+	return group{labels: labels, pids: pids}, nil
+}
+
+// podGroups returns a group per container of pod, or only of the container
+// named container unless it is "", followed by a group for the whole pod.
+func podGroups(pod wss.Pod, container string) ([]group, error) {
+	var groups []group
+	for _, c := range pod.Containers {
+		if container != "" && c.Name != container {
+			continue
+		}
+		g, err := containerGroup(c)
+		if err != nil {
+			return nil, err
+		}
+		g.labels["namespace"] = pod.Namespace
+		g.labels["pod"] = pod.Name
+		groups = append(groups, g)
+	}
+	if container != "" {
+		if len(groups) == 0 {
+			return nil, fmt.Errorf("No container %s in pod %s/%s", container, pod.Namespace, pod.Name)
+		}
+		return groups, nil
+	}
+	// the pod cgroup also holds the pause process
+	pids, err := wss.CgroupMembers(pod.Cgroup)
+	if err != nil {
+		return nil, err
+	}
+	groups = append(groups, group{
+		labels: map[string]string{"namespace": pod.Namespace, "pod": pod.Name},
+		pids:   pids,
+	})
+	return groups, nil
+}
+
+// resolve returns the sorted, deduplicated PIDs currently selected, and
+// updates the groups.
+func (s *selector) resolve() ([]int, error) {
+	pids, err := s.hostPIDs()
+	if err != nil {
+		return nil, err
+	}
+	s.groups = nil
+	if s.children {
+		for _, pid := range pids {
+			descendants, err := wss.Descendants(pid)
+			if err != nil {
+				return nil, err
+			}
+			s.groups = append(s.groups, group{
+				labels: map[string]string{"tree": strconv.Itoa(pid), "comm": wss.Comm(pid)},
+				pids:   append([]int{pid}, descendants...),
+			})
+		}
+	}
+	if s.name != "" {
+		found, err := wss.FindByName(s.name)
+		if err != nil {
+			return nil, err
+		}
+		pids = append(pids, found...)
+	}
+	if s.cmdline.re != nil {
+		found, err := wss.FindByCmdline(s.cmdline.re)
+		if err != nil {
+			return nil, err
+		}
+		pids = append(pids, found...)
+	}
+	if s.cgroup != "" {
+		path, err := wss.ResolveCgroup(s.cgroup)
+		if err != nil {
+			return nil, err
+		}
+		found, err := wss.CgroupMembers(path)
+		if err != nil {
+			return nil, err
+		}
+		s.groups = append(s.groups, group{labels: map[string]string{"cgroup": s.cgroup}, pids: found})
+	}
+	if s.pgid != 0 {
+		found, err := wss.FindByPgid(s.pgid)
+		if err != nil {
+			return nil, err
+		}
+		s.groups = append(s.groups, group{labels: map[string]string{"pgid": strconv.Itoa(s.pgid)}, pids: found})
+	}
+	if s.sid != 0 {
+		found, err := wss.FindBySid(s.sid)
+		if err != nil {
+			return nil, err
+		}
+		s.groups = append(s.groups, group{labels: map[string]string{"sid": strconv.Itoa(s.sid)}, pids: found})
+	}
+	// containers are resolved again every time, they may have been restarted
+	if s.container != "" {
+		c, err := wss.InspectContainer(wss.DockerSocket(), s.container)
+		if err != nil {
+			return nil, err
+		}
+		g, err := containerGroup(c)
+		if err != nil {
+			return nil, err
+		}
+		s.groups = append(s.groups, g)
+	}
+	if s.criContainer != "" {
+		c, err := wss.InspectCRIContainer(s.criSocket(), s.criContainer)
+		if err != nil {
+			return nil, err
+		}
+		g, err := containerGroup(c)
+		if err != nil {
+			return nil, err
+		}
+		s.groups = append(s.groups, g)
+	}
+	if s.pod != "" {
+		fields := strings.SplitN(s.pod, "/", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Bad pod %s, expected namespace/name[/container]", s.pod)
+		}
+		pod, err := wss.InspectPod(s.criSocket(), fields[0], fields[1])
+		if err != nil {
+			return nil, err
+		}
+		container := ""
+		if len(fields) == 3 {
+			container = fields[2]
+		}
+		groups, err := podGroups(pod, container)
+		if err != nil {
+			return nil, err
+		}
+		s.groups = append(s.groups, groups...)
+	}
+	for _, g := range s.groups {
+		pids = append(pids, g.pids...)
+	}
+	sort.Ints(pids)
+	uniq := pids[:0]
+	for i, pid := range pids {
+		if i == 0 || pid != pids[i-1] {
+			uniq = append(uniq, pid)
+		}
+	}
+	if len(uniq) == 0 {
+		return nil, fmt.Errorf("%w for %s", errNoProcess, s.describe())
+	}
+	return uniq, nil
+}
+
+// totals returns the aggregate result of every group, from the results of
+// their processes.
+func totals(groups []group, results []wss.Result) []wss.Result {
+	var sums []wss.Result
+	for _, g := range groups {
+		var members []wss.Result
+		for _, res := range results {
+			if slices.Contains(g.pids, res.PID) {
+				members = append(members, res)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		total := wss.Sum(members)
+		total.Labels = g.labels
+		sums = append(sums, total)
+	}
+	return sums
+}
+
+// shortID abbreviates a container ID the way docker ps does.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
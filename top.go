@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+func topUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("USAGE: wss top [options]")
+		fs.PrintDefaults()
+		fmt.Println("   eg,")
+		fmt.Println("\twss top --duration 10 --top 20  # 20 processes with the largest WSS over 10 seconds")
+		fmt.Println("\twss top --sort hot% --top 10 --min-wss 50MB  # hottest processes of 50 MB WSS or more")
+		fmt.Println("\twss top -i 10  # live table of the processes, measured every 10 seconds, like htop")
+	}
+}
+
+// topMain measures every process on the host in one idle page cycle, and
+// prints them sorted by referenced memory, or with -i, shows them in a live
+// table.
+func topMain(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	duration := fs.Float64("duration", 1, "measurement duration in `secs`")
+	top := fs.Int("top", 20, "show the top `N` processes, 0 for all")
+	interval := fs.Float64("i", 0, "interactive mode: a live table of the processes, measured every `secs` seconds (the measurement duration)")
+	sortKey := fs.String("sort", TOP_SORT_REF, "sort the processes by `column`: ref (or wss), rss, hot (or hot%), pid or comm")
+	var minWSS sizeFlag
+	fs.Var(&minWSS, "min-wss", "only show the processes referencing at least `size`, eg, 50MB, and only measure those with as much RSS")
+	logging := addLogFlags(fs)
+	fs.Usage = topUsage(fs)
+	fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+
+	if *interval != 0 {
+		*duration = *interval
+	}
+	if *duration < 0.01 {
+		fmt.Println("Interval too short. Exiting.")
+		os.Exit(EXIT_USAGE)
+	}
+	if alias, ok := TOP_SORT_ALIASES[*sortKey]; ok {
+		*sortKey = alias
+	}
+	if !slices.Contains(TOP_SORTS, *sortKey) {
+		fmt.Printf("Unknown sort column %q. Exiting.\n", *sortKey)
+		os.Exit(EXIT_USAGE)
+	}
+	pids, err := topProcesses(uint64(minWSS))
+	if err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
+	}
+
+	scanner := wss.NewScanner()
+	if err := scanner.Check(); err != nil {
+		fmt.Printf("%s. Exiting.\n", err)
+		os.Exit(exitStatus(err, 0))
+	}
+	if *interval != 0 {
+		v := &topView{sort: *sortKey, duration: *duration, minWSS: uint64(minWSS)}
+		if err := v.run(scanner, time.Duration(*duration*float64(time.Second))); err != nil {
+			fmt.Printf("%s. Exiting.\n", err)
+			os.Exit(exitStatus(err, 0))
+		}
+		return
+	}
+	fmt.Printf("Watching %d processes page references during %.2f seconds...\n", len(pids), *duration)
+	// processes exit during the measurement, those are not shown
+	results, _ := scanner.MeasureAll(pids, time.Duration(*duration*float64(time.Second)))
+	if len(results) == 0 {
+		fmt.Println("No process measured.")
+		os.Exit(EXIT_GONE)
+	}
+
+	comms := make(map[int]string, len(results))
+	for _, res := range results {
+		comms[res.PID] = wss.Comm(res.PID)
+	}
+	shown := topRows(results, comms, *sortKey, false, "", uint64(minWSS))
+	if *top > 0 && len(shown) > *top {
+		shown = shown[:*top]
+	}
+
+	fmt.Printf("Est(s): %.3f\n", results[0].Est.Seconds())
+	fmt.Printf("%-7s %-16s %12s %10s %7s\n", "PID", "COMM", "Walked(MB)", "Ref(MB)", "Hot(%)")
+	for _, res := range shown {
+		walked := float64(res.WalkedPages*res.PageSize) / (1024 * 1024)
+		fmt.Printf("%-7d %-16s %12.2f %10.2f %7.1f\n", res.PID, comms[res.PID], walked, res.ReferencedMB(), res.HotPercent())
+	}
+}
+
+// The sort columns of wss top.
+const (
+	TOP_SORT_REF  = "ref"
+	TOP_SORT_RSS  = "rss"
+	TOP_SORT_HOT  = "hot"
+	TOP_SORT_PID  = "pid"
+	TOP_SORT_COMM = "comm"
+)
+
+var TOP_SORTS = []string{TOP_SORT_REF, TOP_SORT_RSS, TOP_SORT_HOT, TOP_SORT_PID, TOP_SORT_COMM}
+
+// TOP_SORT_ALIASES are the other names of the sort columns.
+var TOP_SORT_ALIASES = map[string]string{"wss": TOP_SORT_REF, "hot%": TOP_SORT_HOT}
+
+// topProcesses returns the PIDs of all processes with at least min bytes
+// resident, the others can't reference min bytes, and are not measured.
+func topProcesses(min uint64) ([]int, error) {
+	pids, err := wss.Processes()
+	if err != nil || min == 0 {
+		return pids, err
+	}
+	pagesize := uint64(os.Getpagesize())
+	return slices.DeleteFunc(pids, func(pid int) bool {
+		return uint64(wss.Resident(pid))*pagesize < min
+	}), nil
+}
+
+// topRows returns the results of the processes with user memory whose
+// command name contains filter, and referencing at least min bytes, sorted
+// by the column key: the memory columns in decreasing order, the others in
+// increasing order, or the reverse.
+func topRows(results []wss.Result, comms map[int]string, key string, reverse bool, filter string, min uint64) []wss.Result {
+	var rows []wss.Result
+	for _, res := range results {
+		// kernel threads have no user memory
+		if res.WalkedPages > 0 && strings.Contains(comms[res.PID], filter) && res.ReferencedBytes() >= min {
+			rows = append(rows, res)
+		}
+	}
+	less := func(a, b wss.Result) bool {
+		switch key {
+		case TOP_SORT_RSS:
+			return a.RssPages > b.RssPages
+		case TOP_SORT_HOT:
+			return a.HotPercent() > b.HotPercent()
+		case TOP_SORT_PID:
+			return a.PID < b.PID
+		case TOP_SORT_COMM:
+			return comms[a.PID] < comms[b.PID]
+		}
+		return a.ActivePages > b.ActivePages
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if reverse {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+	return rows
+}
+
+// topView is the live table of the interactive mode of wss top.
+type topView struct {
+	duration float64
+	minWSS   uint64
+	results  []wss.Result
+	comms    map[int]string
+	est      time.Duration
+	updated  time.Time
+	err      error
+
+	sort    string
+	reverse bool
+	filter  string
+	// editing is set while the filter is typed, in input
+	editing bool
+	input   []byte
+}
+
+// topUpdate is the result of a measurement of all processes.
+type topUpdate struct {
+	results []wss.Result
+	comms   map[int]string
+	err     error
+}
+
+// run shows the live table until q or Ctrl-C, measuring all processes during
+// d in turn.
+func (v *topView) run(scanner *wss.Scanner, d time.Duration) error {
+	t, err := openTerminal()
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	updates := make(chan topUpdate)
+	go func() {
+		for {
+			var u topUpdate
+			pids, err := topProcesses(v.minWSS)
+			if err == nil {
+				u.results, err = scanner.MeasureAllContext(ctx, pids, d)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			u.err = err
+			u.comms = make(map[int]string, len(u.results))
+			for _, res := range u.results {
+				u.comms[res.PID] = wss.Comm(res.PID)
+			}
+			select {
+			case updates <- u:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	keys := t.keys()
+	for {
+		v.draw(t)
+		select {
+		case <-ctx.Done():
+			return nil
+		case u := <-updates:
+			if u.err != nil && len(u.results) == 0 {
+				v.err = u.err
+				if exitStatus(u.err, 0) != EXIT_ERROR {
+					// the host can't measure
+					return u.err
+				}
+				continue
+			}
+			// the processes which could not be measured are not shown
+			v.results, v.comms, v.err = u.results, u.comms, nil
+			if len(u.results) > 0 {
+				v.est = u.results[0].Est
+			}
+			v.updated = time.Now()
+		case k, ok := <-keys:
+			if !ok || v.key(k) {
+				return nil
+			}
+		}
+	}
+}
+
+// key handles the key k, and reports whether to quit.
+func (v *topView) key(k byte) bool {
+	if v.editing {
+		switch k {
+		case '\r', '\n':
+			v.filter = string(v.input)
+			v.editing = false
+		case 0x1b: // escape
+			v.editing = false
+		case 0x7f, '\b':
+			if len(v.input) > 0 {
+				v.input = v.input[:len(v.input)-1]
+			}
+		default:
+			if k >= ' ' && k < 0x7f {
+				v.input = append(v.input, k)
+			}
+		}
+		return false
+	}
+	switch k {
+	case 'q':
+		return true
+	case 'w':
+		v.sort = TOP_SORT_REF
+	case 'r':
+		v.sort = TOP_SORT_RSS
+	case 'h':
+		v.sort = TOP_SORT_HOT
+	case 'p':
+		v.sort = TOP_SORT_PID
+	case 'c':
+		v.sort = TOP_SORT_COMM
+	case 'i':
+		v.reverse = !v.reverse
+	case '/':
+		v.editing = true
+		v.input = []byte(v.filter)
+	case 0x1b:
+		v.filter = ""
+	}
+	return false
+}
+
+// draw redraws the table on the terminal t.
+func (v *topView) draw(t *terminal) {
+	rows, cols := t.size()
+	var b strings.Builder
+	line := func(format string, a ...any) {
+		l := fmt.Sprintf(format, a...)
+		if len(l) > cols {
+			l = l[:cols]
+		}
+		b.WriteString(l + "\r\n")
+	}
+	b.WriteString(CLEAR_SCREEN)
+	if v.updated.IsZero() {
+		line("wss top - measuring all processes during %.2f seconds...", v.duration)
+	} else {
+		line("wss top - %d processes measured during %.2f seconds, Est(s) %.3f, at %s",
+			len(v.results), v.duration, v.est.Seconds(), v.updated.Format("15:04:05"))
+	}
+	line("Keys: w Ref, r RSS, h Hot, p PID, c COMM to sort, i invert, / filter, Esc clear, q quit")
+	switch {
+	case v.editing:
+		line("Filter COMM: %s_", v.input)
+	case v.err != nil:
+		line("%s", v.err)
+	case v.filter != "":
+		line("Filter COMM: %s", v.filter)
+	default:
+		line("")
+	}
+	header := fmt.Sprintf("%-7s %-16s %10s %10s %7s", "PID", "COMM", "RSS(MB)", "Ref(MB)", "Hot(%)")
+	b.WriteString(REVERSE + fmt.Sprintf("%-*s", cols, header)[:cols] + RESET + "\r\n")
+	shown := topRows(v.results, v.comms, v.sort, v.reverse, v.filter, v.minWSS)
+	for i, res := range shown {
+		if i >= rows-5 {
+			break
+		}
+		line("%-7d %-16s %10.2f %10.2f %7.1f", res.PID, v.comms[res.PID], mb(res.RssPages, res.PageSize), res.ReferencedMB(), res.HotPercent())
+	}
+	fmt.Fprint(t.out, b.String())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ANSI escape sequences of the interactive screen.
+const (
+	ALT_SCREEN_ON  = "\x1b[?1049h"
+	ALT_SCREEN_OFF = "\x1b[?1049l"
+	CURSOR_HIDE    = "\x1b[?25l"
+	CURSOR_SHOW    = "\x1b[?25h"
+	CLEAR_SCREEN   = "\x1b[H\x1b[2J"
+	REVERSE        = "\x1b[7m"
+	RESET          = "\x1b[0m"
+)
+
+// terminal is the controlling terminal of an interactive screen, in
+// non-canonical mode without echo, so keys are read as they are pressed.
+// Ctrl-C still sends SIGINT.
+type terminal struct {
+	in, out *os.File
+	saved   syscall.Termios
+}
+
+// ioctl calls the ioctl req of the file f with arg.
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	return ioctl(f, syscall.TCGETS, unsafe.Pointer(&t)) == nil
+}
+
+// openTerminal switches the terminal of stdin and stdout to the interactive
+// screen, restored by close.
+func openTerminal() (*terminal, error) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return nil, fmt.Errorf("Interactive mode needs a terminal")
+	}
+	t := &terminal{in: os.Stdin, out: os.Stdout}
+	if err := ioctl(t.in, syscall.TCGETS, unsafe.Pointer(&t.saved)); err != nil {
+		return nil, fmt.Errorf("Can't read the terminal settings %s", err)
+	}
+	raw := t.saved
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(t.in, syscall.TCSETS, unsafe.Pointer(&raw)); err != nil {
+		return nil, fmt.Errorf("Can't set the terminal settings %s", err)
+	}
+	fmt.Fprint(t.out, ALT_SCREEN_ON+CURSOR_HIDE)
+	return t, nil
+}
+
+// size returns the rows and columns of the terminal, 24x80 if unknown.
+func (t *terminal) size() (rows, cols int) {
+	var ws struct{ rows, cols, xpixel, ypixel uint16 }
+	if err := ioctl(t.out, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil || ws.rows == 0 {
+		return 24, 80
+	}
+	return int(ws.rows), int(ws.cols)
+}
+
+// keys sends the keys read from the terminal on a channel, until it is
+// closed.
+func (t *terminal) keys() <-chan byte {
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if n, err := t.in.Read(buf); err != nil || n == 0 {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+	return keys
+}
+
+// close restores the screen and the settings of the terminal.
+func (t *terminal) close() {
+	fmt.Fprint(t.out, CURSOR_SHOW+ALT_SCREEN_OFF)
+	ioctl(t.in, syscall.TCSETS, unsafe.Pointer(&t.saved))
+}
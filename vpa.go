@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// The VerticalPodAutoscaler recommendations of --recommend-vpa, in the
+// format of the status of a VPA object, see
+// https://github.com/kubernetes/autoscaler/tree/master/vertical-pod-autoscaler
+type vpaList struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Items      []*vpa `json:"items"`
+}
+
+type vpa struct {
+	APIVersion string      `json:"apiVersion"`
+	Kind       string      `json:"kind"`
+	Metadata   vpaMetadata `json:"metadata"`
+	Status     vpaStatus   `json:"status"`
+}
+
+type vpaMetadata struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type vpaStatus struct {
+	Recommendation vpaRecommendation `json:"recommendation"`
+}
+
+type vpaRecommendation struct {
+	ContainerRecommendations []vpaContainer `json:"containerRecommendations"`
+}
+
+type vpaContainer struct {
+	ContainerName  string            `json:"containerName"`
+	Target         map[string]string `json:"target"`
+	LowerBound     map[string]string `json:"lowerBound"`
+	UpperBound     map[string]string `json:"upperBound"`
+	UncappedTarget map[string]string `json:"uncappedTarget"`
+}
+
+// quantity formats mbytes as a Kubernetes memory quantity, rounded up to the
+// Mi.
+func quantity(mbytes float64) map[string]string {
+	return map[string]string{"memory": fmt.Sprintf("%dMi", int64(math.Ceil(mbytes)))}
+}
+
+// recommendVPA returns the VPA recommendations of the containers, or
+// cgroups, summarized in sums, with headroom the fraction added to the WSS:
+// the target, the memory request, is the p95 WSS plus headroom, the lower
+// bound the p95 WSS, and the upper bound, eg, for the limit, the max WSS
+// plus headroom. There is a VPA object per pod, or per cgroup or container
+// outside of a pod.
+func recommendVPA(sums []summary, headroom float64) *vpaList {
+	list := &vpaList{APIVersion: "v1", Kind: "List", Items: []*vpa{}}
+	objects := make(map[vpaMetadata]*vpa)
+	for _, s := range sums {
+		if s.pid != "total" {
+			continue
+		}
+		meta := vpaMetadata{Name: s.labels["pod"], Namespace: s.labels["namespace"]}
+		container := s.labels["container"]
+		switch {
+		case meta.Name != "" && container == "":
+			// the total of the pod, of its containers
+			continue
+		case meta.Name == "" && container != "":
+			meta.Name = container
+		case meta.Name == "":
+			meta.Name = s.labels["cgroup"]
+			container = s.labels["cgroup"]
+		}
+		obj, ok := objects[meta]
+		if !ok {
+			obj = &vpa{APIVersion: "autoscaling.k8s.io/v1", Kind: "VerticalPodAutoscaler", Metadata: meta}
+			objects[meta] = obj
+			list.Items = append(list.Items, obj)
+		}
+		target := quantity(s.p95 * (1 + headroom))
+		obj.Status.Recommendation.ContainerRecommendations = append(obj.Status.Recommendation.ContainerRecommendations, vpaContainer{
+			ContainerName:  container,
+			Target:         target,
+			LowerBound:     quantity(s.p95),
+			UpperBound:     quantity(s.max * (1 + headroom)),
+			UncappedTarget: target,
+		})
+	}
+	return list
+}
+
+// writeVPA writes the VPA recommendations as JSON to the file path, or to
+// stdout for "-".
+func writeVPA(path string, list *vpaList) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("Can't write VPA recommendations %s", err)
+	}
+	return nil
+}
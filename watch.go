@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// WATCH_HISTORY is the number of past measurements --watch shows.
+const WATCH_HISTORY = 10
+
+// watchPrinter is the --watch output of the text format on a terminal: the
+// current estimate and the last WATCH_HISTORY rows are redrawn in place,
+// rather than scrolling.
+type watchPrinter struct {
+	w io.Writer
+	// text renders the rows into buf
+	text *textPrinter
+	buf  bytes.Buffer
+
+	title   string
+	head    string
+	history []string
+	runs    int
+	// lines is the number of lines drawn last, to move back up over
+	lines int
+}
+
+func newWatchPrinter(w io.Writer, opts printOptions) *watchPrinter {
+	p := &watchPrinter{w: w}
+	p.text = &textPrinter{w: &p.buf, printOptions: opts}
+	return p
+}
+
+func (p *watchPrinter) banner(format string, a ...any) {
+	p.title = fmt.Sprintf(format, a...)
+}
+
+func (p *watchPrinter) header() {
+	p.buf.Reset()
+	p.text.header()
+	p.head = p.buf.String()
+}
+
+func (p *watchPrinter) row(res wss.Result) {
+	p.buf.Reset()
+	p.text.row(res)
+	p.record(res)
+}
+
+func (p *watchPrinter) total(res wss.Result) {
+	p.buf.Reset()
+	p.text.total(res)
+	p.record(res)
+}
+
+// record adds the rendered row of res to the history, and redraws.
+func (p *watchPrinter) record(res wss.Result) {
+	p.runs++
+	p.history = append(p.history, p.buf.String())
+	if len(p.history) > WATCH_HISTORY {
+		p.history = p.history[1:]
+	}
+	var b strings.Builder
+	fmt.Fprintln(&b, p.title)
+	fmt.Fprintf(&b, "Ref(MB) %.2f at %s, run %d\n\n", res.ReferencedMB(), res.Time.Format(time.TimeOnly), p.runs)
+	b.WriteString(p.head)
+	for _, row := range p.history {
+		b.WriteString(row)
+	}
+	// move up to the first line drawn, and clear down to the end
+	if p.lines > 0 {
+		fmt.Fprintf(p.w, "\x1b[%dA\r\x1b[J", p.lines)
+	}
+	fmt.Fprint(p.w, b.String())
+	p.lines = strings.Count(b.String(), "\n")
+}
+
+// summary is printed below the last drawing, which is left on the screen.
+func (p *watchPrinter) summary(runs int, sums []summary) {
+	p.text.w = p.w
+	p.text.summary(runs, sums)
+	p.lines = 0
+}
+
+func (p *watchPrinter) flush() {}
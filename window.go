@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/roopakparikh/wss/pkg/wss"
+)
+
+// WINDOW is the default seconds of measurements summarized per target on
+// /metrics
+const WINDOW = 3600
+
+// WINDOW_QUANTILES are the quantiles of the working set size of a target
+// over the window
+var WINDOW_QUANTILES = []float64{0.5, 0.9, 0.95, 0.99}
+
+// windowSeries is the working set size of a target, by its labels, over the
+// window: its measurements within it, and the sum and count of all of them,
+// as those of a Prometheus summary.
+type windowSeries struct {
+	labels  map[string]string
+	samples []windowSample
+	sum     float64
+	count   uint64
+}
+
+type windowSample struct {
+	time  time.Time
+	bytes float64
+}
+
+// observe adds the working set sizes of results to their series, and drops
+// the measurements older than the window, and the series of the targets
+// measured outside of it only, eg, gone.
+func (e *exporter) observe(results []wss.Result) {
+	if e.window <= 0 {
+		return
+	}
+	if e.history == nil {
+		e.history = make(map[string]*windowSeries)
+	}
+	for _, res := range results {
+		key := promLabels(res.Labels)
+		s, ok := e.history[key]
+		if !ok {
+			s = &windowSeries{labels: res.Labels}
+			e.history[key] = s
+		}
+		bytes := float64(res.ReferencedBytes())
+		s.samples = append(s.samples, windowSample{res.Time, bytes})
+		s.sum += bytes
+		s.count++
+	}
+	start := time.Now().Add(-e.window)
+	for key, s := range e.history {
+		s.samples = slices.DeleteFunc(s.samples, func(sample windowSample) bool {
+			return sample.time.Before(start)
+		})
+		if len(s.samples) == 0 {
+			delete(e.history, key)
+		}
+	}
+}
+
+// quantile returns the q quantile of sorted, by nearest rank.
+func quantile(sorted []float64, q float64) float64 {
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// writeWindow writes the summaries of the working set size of the targets
+// over the window in the Prometheus text exposition format.
+func (e *exporter) writeWindow(w io.Writer) {
+	if e.window <= 0 {
+		return
+	}
+	name := "wss_referenced_bytes_window"
+	fmt.Fprintf(w, "# HELP %s Bytes referenced by the measurements of the last %s, by quantile, the working set size over time.\n# TYPE %s summary\n", name, e.window, name)
+	for _, key := range slices.Sorted(maps.Keys(e.history)) {
+		s := e.history[key]
+		sorted := make([]float64, len(s.samples))
+		for i, sample := range s.samples {
+			sorted[i] = sample.bytes
+		}
+		slices.Sort(sorted)
+		for _, q := range WINDOW_QUANTILES {
+			labels := maps.Clone(s.labels)
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels["quantile"] = strconv.FormatFloat(q, 'g', -1, 64)
+			fmt.Fprintf(w, "%s%s %g\n", name, promLabels(labels), quantile(sorted, q))
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, key, s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, key, s.count)
+	}
+}